@@ -22,6 +22,7 @@ import (
 type Authenticator struct {
 	bucket          base.Bucket
 	channelComputer ChannelComputer
+	staticGrants    *StaticGrants // Grants from the server config (nil = none)
 }
 
 // Interface for deriving the set of channels and roles a User/Role has access to.
@@ -77,6 +78,7 @@ func (auth *Authenticator) GetUser(name string) (User, error) {
 		}
 	}
 	princ.(*userImpl).auth = auth
+	auth.applyStaticGrants(princ)
 	return princ.(User), err
 }
 
@@ -84,6 +86,9 @@ func (auth *Authenticator) GetUser(name string) (User, error) {
 func (auth *Authenticator) GetRole(name string) (Role, error) {
 	princ, err := auth.getPrincipal(docIDForRole(name), func() Principal { return &roleImpl{} })
 	role, _ := princ.(Role)
+	if role != nil {
+		auth.applyStaticGrants(role)
+	}
 	return role, err
 }
 
@@ -143,6 +148,11 @@ func (auth *Authenticator) rebuildChannels(princ Principal) error {
 		}
 		channels.Add(set)
 	}
+	for channel, _ := range channels {
+		if channel != "*" && princ.excludesChannel(channel) {
+			delete(channels, channel)
+		}
+	}
 	base.LogTo("Access", "Computed channels for %q: %s", princ.Name(), channels)
 	princ.setChannels(channels)
 	return nil
@@ -373,3 +373,72 @@ func TestRoleInheritance(t *testing.T) {
 	assert.True(t, user2.CanSeeChannel("hoopy"))
 	assert.Equals(t, user2.AuthorizeAllChannels(ch.SetOf("britain", "dull", "hoopiest")), nil)
 }
+
+func TestChannelExclusions(t *testing.T) {
+	auth := NewAuthenticator(gTestBucket, nil)
+	role, _ := auth.NewRole("staff", ch.SetOf("org-lobby", "org-secret"))
+	role.SetExcludedChannels(ch.SetOf("org-secret"))
+	assert.Equals(t, auth.Save(role), nil)
+
+	user, _ := auth.NewUser("ford", "password", ch.SetOf("*"))
+	user.SetExcludedChannels(base.SetOf("org-*", "hidden"))
+	user.SetExplicitRoleNames([]string{"staff"})
+	assert.Equals(t, auth.Save(user), nil)
+
+	user, err := auth.GetUser("ford")
+	assert.Equals(t, err, nil)
+	assert.True(t, user.HasChannelExclusions())
+	assert.True(t, user.CanSeeChannel("anything"))
+	assert.False(t, user.CanSeeChannel("hidden"))
+	assert.True(t, user.CanSeeChannel("org-lobby")) // granted by the role
+	assert.False(t, user.CanSeeChannel("org-secret"))
+	assert.False(t, user.CanSeeChannel("org-other"))
+	assert.Equals(t, user.CanSeeChannelSince("org-other"), uint64(0))
+	assert.True(t, user.AuthorizeAnyChannel(ch.SetOf("org-secret", "public")) == nil)
+	assert.False(t, user.AuthorizeAnyChannel(ch.SetOf("org-secret", "org-other")) == nil)
+	assert.DeepEquals(t, user.InheritedChannels().AsSet(), ch.SetOf("*", "org-lobby"))
+
+	// Exclusions must be channel names or prefix patterns:
+	user.SetExcludedChannels(base.SetOf("*"))
+	assert.False(t, auth.Save(user) == nil)
+	user.SetExcludedChannels(base.SetOf("bad:name"))
+	assert.False(t, auth.Save(user) == nil)
+}
+
+func TestStaticGrants(t *testing.T) {
+	auth := NewAuthenticator(gTestBucket, nil)
+	role, _ := auth.NewRole("editors", ch.SetOf("reviews"))
+	assert.Equals(t, auth.Save(role), nil)
+	user, _ := auth.NewUser("ford", "letmein", ch.SetOf("public"))
+	user.SetExplicitChannels(ch.TimedSet{"public": 5})
+	assert.Equals(t, auth.Save(user), nil)
+
+	grants := &StaticGrants{
+		Users: map[string]*StaticGrant{"ford": {Channels: ch.SetOf("news", "public"), RoleNames: []string{"editors"}}},
+		Roles: map[string]*StaticGrant{"editors": {Channels: ch.SetOf("drafts")}},
+	}
+	assert.Equals(t, grants.Validate(), nil)
+	auth.SetStaticGrants(grants)
+
+	user, err := auth.GetUser("ford")
+	assert.Equals(t, err, nil)
+	assert.DeepEquals(t, user.Channels(), ch.TimedSet{"public": StaticGrantSequence, "news": StaticGrantSequence})
+	assert.DeepEquals(t, user.RoleNames(), []string{"editors"})
+	assert.Equals(t, user.CanSeeChannelSince("news"), uint64(StaticGrantSequence))
+	assert.Equals(t, user.CanSeeChannelSince("drafts"), uint64(StaticGrantSequence))
+	assert.Equals(t, user.CanSeeChannelSince("reviews"), uint64(1))
+	assert.True(t, user.CanSeeChannel("drafts"))
+
+	// Static grants aren't saved, so they go away when the config no longer has them:
+	assert.Equals(t, auth.Save(user), nil)
+	auth.SetStaticGrants(nil)
+	user, _ = auth.GetUser("ford")
+	assert.DeepEquals(t, user.Channels(), ch.TimedSet{"public": 5})
+	assert.DeepEquals(t, user.RoleNames(), []string{})
+	assert.False(t, user.CanSeeChannel("news"))
+
+	bad := &StaticGrants{Roles: map[string]*StaticGrant{"editors": {RoleNames: []string{"x"}}}}
+	assert.True(t, bad.Validate() != nil)
+	bad = &StaticGrants{Users: map[string]*StaticGrant{"ford": {Channels: ch.SetOf("bad name")}}}
+	assert.True(t, bad.Validate() != nil)
+}
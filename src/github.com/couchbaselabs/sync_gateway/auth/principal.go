@@ -28,6 +28,17 @@ type Principal interface {
 	// Sets the explicit channels the Principal has access to.
 	SetExplicitChannels(ch.TimedSet)
 
+	// The channels the server config grants the Principal (see StaticGrants). These are
+	// included in Channels() but aren't saved.
+	StaticChannels() ch.TimedSet
+
+	// Channels the Principal is denied access to even if they're granted, e.g. through "*".
+	// A name ending in "*" excludes every channel that starts with the preceding prefix.
+	ExcludedChannels() base.Set
+
+	// Sets the channels the Principal is denied access to.
+	SetExcludedChannels(base.Set)
+
 	// Returns true if the Principal has access to the given channel.
 	CanSeeChannel(channel string) bool
 
@@ -47,6 +58,7 @@ type Principal interface {
 
 	docID() string
 	accessViewKey() string
+	excludesChannel(channel string) bool
 	validate() error
 	setChannels(ch.TimedSet)
 }
@@ -87,6 +99,12 @@ type User interface {
 	// Sets the explicit roles the user belongs to.
 	SetExplicitRoleNames([]string)
 
+	// The roles the server config gives the user (see StaticGrants); included in RoleNames().
+	StaticRoleNames() []string
+
+	// Loads the Roles the user belongs to.
+	GetRoles() []Role
+
 	// Every channel the user has access to, including those inherited from Roles.
 	InheritedChannels() ch.TimedSet
 
@@ -98,5 +116,9 @@ type User interface {
 	// to, annotated with the sequence number at which access was granted.
 	FilterToAvailableChannels(channels base.Set) ch.TimedSet
 
+	// Returns true if the user or any of its Roles has excluded channels, in which case access
+	// to everything via "*" doesn't mean access to every document.
+	HasChannelExclusions() bool
+
 	setRoleNames([]string)
 }
@@ -14,6 +14,7 @@ import (
 	"fmt"
 	"net/http"
 	"regexp"
+	"strings"
 
 	"github.com/couchbaselabs/sync_gateway/base"
 	ch "github.com/couchbaselabs/sync_gateway/channels"
@@ -23,7 +24,9 @@ import (
 type roleImpl struct {
 	Name_             string      `json:"name,omitempty"`
 	ExplicitChannels_ ch.TimedSet `json:"admin_channels,omitempty"`
+	ExcludedChannels_ base.Set    `json:"admin_excluded_channels,omitempty"`
 	Channels_         ch.TimedSet `json:"all_channels"`
+	staticChannels    ch.TimedSet // Granted by the server config; not saved (see StaticGrants)
 }
 
 var kValidNameRegexp *regexp.Regexp
@@ -57,6 +60,7 @@ func (auth *Authenticator) NewRole(name string, channels base.Set) (Role, error)
 	if err := auth.rebuildChannels(role); err != nil {
 		return nil, err
 	}
+	auth.applyStaticGrants(role)
 	return role, nil
 }
 
@@ -102,7 +106,16 @@ func (role *roleImpl) Name() string {
 }
 
 func (role *roleImpl) Channels() ch.TimedSet {
-	return role.Channels_
+	if role.Channels_ == nil || len(role.staticChannels) == 0 {
+		return role.Channels_
+	}
+	channels := role.Channels_.Copy()
+	for channel, seq := range role.staticChannels {
+		if channel == "*" || !role.excludesChannel(channel) {
+			channels.AddChannel(channel, seq)
+		}
+	}
+	return channels
 }
 
 func (role *roleImpl) setChannels(channels ch.TimedSet) {
@@ -113,16 +126,34 @@ func (role *roleImpl) ExplicitChannels() ch.TimedSet {
 	return role.ExplicitChannels_
 }
 
+func (role *roleImpl) StaticChannels() ch.TimedSet {
+	return role.staticChannels
+}
+
 func (role *roleImpl) SetExplicitChannels(channels ch.TimedSet) {
 	role.ExplicitChannels_ = channels
 	role.setChannels(nil)
 }
 
+func (role *roleImpl) ExcludedChannels() base.Set {
+	return role.ExcludedChannels_
+}
+
+func (role *roleImpl) SetExcludedChannels(channels base.Set) {
+	role.ExcludedChannels_ = channels
+	role.setChannels(nil)
+}
+
 // Checks whether this role object contains valid data; if not, returns an error.
 func (role *roleImpl) validate() error {
 	if !IsValidPrincipalName(role.Name_) {
 		return base.HTTPErrorf(http.StatusBadRequest, "Invalid name %q", role.Name_)
 	}
+	for pattern, _ := range role.ExcludedChannels_ {
+		if name := strings.TrimSuffix(pattern, "*"); name == "" || !ch.IsValidChannel(name) {
+			return base.HTTPErrorf(http.StatusBadRequest, "Invalid excluded channel %q", pattern)
+		}
+	}
 	return role.ExplicitChannels_.Validate()
 }
 
@@ -135,17 +166,51 @@ func (role *roleImpl) UnauthError(message string) error {
 	return base.HTTPErrorf(http.StatusForbidden, message)
 }
 
+// Returns true if the channel matches one of the Role's exclusions. An exclusion is either a
+// channel name, or a prefix followed by "*" that matches every channel starting with it.
+func (role *roleImpl) excludesChannel(channel string) bool {
+	for pattern, _ := range role.ExcludedChannels_ {
+		if strings.HasSuffix(pattern, "*") {
+			if strings.HasPrefix(channel, pattern[0:len(pattern)-1]) {
+				return true
+			}
+		} else if channel == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// Looks up the sequence at which the Role was granted the channel, either by its persistent
+// grants or statically.
+func (role *roleImpl) grantedAt(channel string) (seq uint64, found bool) {
+	seq, found = role.Channels_[channel]
+	if static, isStatic := role.staticChannels[channel]; isStatic && (!found || static < seq) {
+		seq, found = static, true
+	}
+	return
+}
+
+func (role *roleImpl) hasChannel(channel string) bool {
+	_, found := role.grantedAt(channel)
+	return found
+}
+
 // Returns true if the Role is allowed to access the channel.
 // A nil Role means access control is disabled, so the function will return true.
 func (role *roleImpl) CanSeeChannel(channel string) bool {
-	return role == nil || role.Channels_.Contains(channel) || role.Channels_.Contains("*")
+	return role == nil || ((role.hasChannel(channel) || role.hasChannel("*")) &&
+		!role.excludesChannel(channel))
 }
 
 // Returns the sequence number since which the Role has been able to access the channel, else zero.
 func (role *roleImpl) CanSeeChannelSince(channel string) uint64 {
-	seq := role.Channels_[channel]
+	if role.excludesChannel(channel) {
+		return 0
+	}
+	seq, _ := role.grantedAt(channel)
 	if seq == 0 {
-		seq = role.Channels_["*"]
+		seq, _ = role.grantedAt("*")
 	}
 	return seq
 }
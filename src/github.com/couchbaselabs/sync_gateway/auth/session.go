@@ -87,6 +87,9 @@ func (auth Authenticator) DeleteSessionForCookie(rq *http.Request) *http.Cookie
 	return &newCookie
 }
 
+// Prefix of the keys of login session docs
+const SessionKeyPrefix = "session:"
+
 func docIDForSession(sessionID string) string {
-	return "session:" + sessionID
+	return SessionKeyPrefix + sessionID
 }
@@ -0,0 +1,85 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package auth
+
+import (
+	"net/http"
+
+	"github.com/couchbaselabs/sync_gateway/base"
+	ch "github.com/couchbaselabs/sync_gateway/channels"
+)
+
+// Static grants are treated as having been in effect since the database's first sequence, so
+// the changes feed never backfills their channels to a client as new grants.
+const StaticGrantSequence = 1
+
+// Channels (and, for users, roles) that the server configuration grants to a named user or
+// role. These are merged with the principal's admin-API and sync-function grants when it's
+// loaded, but never saved with it, so removing them from the config revokes them.
+type StaticGrant struct {
+	Channels  base.Set `json:"admin_channels,omitempty"`
+	RoleNames []string `json:"admin_roles,omitempty"` // Users only
+}
+
+// The static grants of a database, keyed by user/role name. The guest user's name is "".
+type StaticGrants struct {
+	Users map[string]*StaticGrant `json:"users,omitempty"`
+	Roles map[string]*StaticGrant `json:"roles,omitempty"`
+}
+
+// Checks that the grants name valid users, roles and channels.
+func (grants *StaticGrants) Validate() error {
+	for _, spec := range []struct {
+		grants map[string]*StaticGrant
+		isUser bool
+	}{{grants.Users, true}, {grants.Roles, false}} {
+		for name, grant := range spec.grants {
+			if !IsValidPrincipalName(name) || (name == "" && !spec.isUser) {
+				return base.HTTPErrorf(http.StatusBadRequest, "Invalid name %q in static grants", name)
+			}
+			if err := ch.AtSequence(grant.Channels, StaticGrantSequence).Validate(); err != nil {
+				return err
+			}
+			if len(grant.RoleNames) > 0 && !spec.isUser {
+				return base.HTTPErrorf(http.StatusBadRequest, "Static grants can't give role %q roles", name)
+			}
+			for _, roleName := range grant.RoleNames {
+				if !IsValidPrincipalName(roleName) {
+					return base.HTTPErrorf(http.StatusBadRequest, "Invalid role name %q", roleName)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Sets the static grants applied to the users and roles this Authenticator loads or creates.
+func (auth *Authenticator) SetStaticGrants(grants *StaticGrants) {
+	auth.staticGrants = grants
+}
+
+// Attaches the static grants for a loaded or new principal to it.
+func (auth *Authenticator) applyStaticGrants(princ Principal) {
+	if auth.staticGrants == nil || princ == nil {
+		return
+	}
+	switch princ := princ.(type) {
+	case *userImpl:
+		if grant := auth.staticGrants.Users[princ.Name_]; grant != nil {
+			princ.staticChannels = ch.AtSequence(ch.ExpandingStar(grant.Channels), StaticGrantSequence)
+			princ.staticRoleNames = grant.RoleNames
+			princ.roles = nil
+		}
+	case *roleImpl:
+		if grant := auth.staticGrants.Roles[princ.Name_]; grant != nil {
+			princ.staticChannels = ch.AtSequence(ch.ExpandingStar(grant.Channels), StaticGrantSequence)
+		}
+	}
+}
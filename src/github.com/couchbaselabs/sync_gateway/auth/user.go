@@ -28,8 +28,9 @@ const kBcryptCostFactor = bcrypt.DefaultCost
 type userImpl struct {
 	roleImpl // userImpl "inherits from" Role
 	userImplBody
-	auth  *Authenticator
-	roles []Role
+	auth            *Authenticator
+	roles           []Role
+	staticRoleNames []string // Given by the server config; not saved (see StaticGrants)
 }
 
 // Marshalable data is stored in separate struct from userImpl,
@@ -83,6 +84,7 @@ func (auth *Authenticator) NewUser(username string, password string, channels ba
 	if err := auth.rebuildChannels(user); err != nil {
 		return nil, err
 	}
+	auth.applyStaticGrants(user)
 	user.SetPassword(password)
 	return user, nil
 }
@@ -163,7 +165,10 @@ func (user *userImpl) SetEmail(email string) error {
 }
 
 func (user *userImpl) RoleNames() []string {
-	return user.RoleNames_
+	if user.RoleNames_ == nil || len(user.staticRoleNames) == 0 {
+		return user.RoleNames_
+	}
+	return base.MergeStringArrays(user.RoleNames_, user.staticRoleNames)
 }
 
 func (user *userImpl) setRoleNames(names []string) {
@@ -175,6 +180,10 @@ func (user *userImpl) ExplicitRoleNames() []string {
 	return user.ExplicitRoleNames_
 }
 
+func (user *userImpl) StaticRoleNames() []string {
+	return user.staticRoleNames
+}
+
 func (user *userImpl) SetExplicitRoleNames(names []string) {
 	user.ExplicitRoleNames_ = names
 	user.setRoleNames(nil) // invalidate persistent cache of role names
@@ -214,8 +223,9 @@ func (user *userImpl) SetPassword(password string) {
 
 func (user *userImpl) GetRoles() []Role {
 	if user.roles == nil {
-		roles := make([]Role, 0, len(user.RoleNames_))
-		for _, name := range user.RoleNames_ {
+		roleNames := user.RoleNames()
+		roles := make([]Role, 0, len(roleNames))
+		for _, name := range roleNames {
 			role, err := user.auth.GetRole(name)
 			//base.LogTo("Access", "User %s role %q = %v", user.Name_, name, role)
 			if err != nil {
@@ -267,6 +277,18 @@ func (user *userImpl) InheritedChannels() ch.TimedSet {
 	return channels
 }
 
+func (user *userImpl) HasChannelExclusions() bool {
+	if len(user.ExcludedChannels_) > 0 {
+		return true
+	}
+	for _, role := range user.GetRoles() {
+		if len(role.ExcludedChannels()) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
 // If a channel list contains a wildcard ("*"), replace it with all the user's accessible channels.
 func (user *userImpl) ExpandWildCardChannel(channels base.Set) base.Set {
 	if channels.Contains("*") {
@@ -37,6 +37,8 @@ type AuthHandler couchbase.AuthHandler
 type BucketSpec struct {
 	Server, PoolName, BucketName string
 	Auth                         AuthHandler
+	FailoverGraceWindow          time.Duration // How long writes/queries wait out an outage (0 = don't)
+	FailoverMaxQueued            int           // Max calls waiting at once (0 = default)
 }
 
 // Implementation of walrus.Bucket that talks to a Couchbase server
@@ -136,7 +138,7 @@ func GetCouchbaseBucket(spec BucketSpec) (bucket Bucket, err error) {
 func GetBucket(spec BucketSpec) (bucket Bucket, err error) {
 	if isWalrus, _ := regexp.MatchString(`^(walrus:|file:|/|\.)`, spec.Server); isWalrus {
 		Log("Opening Walrus database %s on <%s>", spec.BucketName, spec.Server)
-		walrus.Logging = LogKeys["Walrus"]
+		walrus.Logging = LogEnabled("Walrus")
 		bucket, err = walrus.GetBucket(spec.Server, spec.PoolName, spec.BucketName)
 	} else {
 		suffix := ""
@@ -148,7 +150,14 @@ func GetBucket(spec BucketSpec) (bucket Bucket, err error) {
 		bucket, err = GetCouchbaseBucket(spec)
 	}
 
-	if LogKeys["Bucket"] {
+	if err != nil {
+		return
+	}
+	bucket = wrapChaosBucket(bucket)
+	if spec.FailoverGraceWindow > 0 {
+		bucket = newFailoverBucket(bucket, spec.FailoverGraceWindow, spec.FailoverMaxQueued)
+	}
+	if LogEnabled("Bucket") {
 		bucket = &LoggingBucket{bucket: bucket}
 	}
 	return
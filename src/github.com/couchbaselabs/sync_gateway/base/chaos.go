@@ -0,0 +1,49 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package base
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Settings of the fault-injection ("chaos") hooks used by soak tests. The hooks only exist in
+// binaries built with the "chaos" build tag; in normal builds they compile to no-ops.
+type ChaosConfig struct {
+	BucketErrorRate float64  `json:"bucket_error_rate,omitempty"` // Probability a bucket call fails
+	BucketErrorOps  []string `json:"bucket_error_ops,omitempty"`  // Calls that can fail, e.g. "Get" (default all)
+	FeedDropRate    float64  `json:"feed_drop_rate,omitempty"`    // Probability a tap feed event is dropped
+	SyncFnDelayMS   int      `json:"sync_fn_delay_ms,omitempty"`  // Added to the time of every sync fn call
+	CASStormRate    float64  `json:"cas_storm_rate,omitempty"`    // Probability an update hits CAS conflicts
+	CASStormRetries int      `json:"cas_storm_retries,omitempty"` // Number of conflicts per storm (default 5)
+}
+
+// The error returned by bucket calls that the chaos hooks make fail.
+var ErrChaos = errors.New("chaos: injected bucket failure")
+
+const kDefaultCASStormRetries = 5
+
+func (config *ChaosConfig) validate() error {
+	for _, rate := range []float64{config.BucketErrorRate, config.FeedDropRate, config.CASStormRate} {
+		if rate < 0 || rate > 1 {
+			return HTTPErrorf(400, "Chaos rates must be between 0 and 1")
+		}
+	}
+	if config.SyncFnDelayMS < 0 || config.CASStormRetries < 0 {
+		return HTTPErrorf(400, "Chaos delays and retry counts can't be negative")
+	}
+	return nil
+}
+
+func (config ChaosConfig) String() string {
+	return fmt.Sprintf("{bucket errors %g %v, feed drops %g, sync delay %dms, CAS storms %g x%d}",
+		config.BucketErrorRate, config.BucketErrorOps, config.FeedDropRate,
+		config.SyncFnDelayMS, config.CASStormRate, config.CASStormRetries)
+}
@@ -0,0 +1,36 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+//go:build !chaos
+// +build !chaos
+
+package base
+
+// Normal builds have no fault injection; these stubs let the compiler remove the hooks.
+
+const ChaosEnabled = false
+
+func SetChaos(config ChaosConfig) error {
+	return HTTPErrorf(404, "Server wasn't built with chaos hooks")
+}
+
+func GetChaos() ChaosConfig {
+	return ChaosConfig{}
+}
+
+func ChaosDropFeedEvent() bool {
+	return false
+}
+
+func ChaosSyncFnDelay() {
+}
+
+func wrapChaosBucket(bucket Bucket) Bucket {
+	return bucket
+}
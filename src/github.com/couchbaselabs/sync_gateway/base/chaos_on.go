@@ -0,0 +1,191 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+//go:build chaos
+// +build chaos
+
+package base
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/couchbaselabs/walrus"
+)
+
+const ChaosEnabled = true
+
+var chaos ChaosConfig
+var chaosLock sync.RWMutex
+
+// Changes the fault-injection settings. A zero ChaosConfig turns all faults off.
+func SetChaos(config ChaosConfig) error {
+	if err := config.validate(); err != nil {
+		return err
+	}
+	if config.CASStormRetries == 0 {
+		config.CASStormRetries = kDefaultCASStormRetries
+	}
+	chaosLock.Lock()
+	chaos = config
+	chaosLock.Unlock()
+	Warn("Chaos settings changed to %s", config)
+	return nil
+}
+
+func GetChaos() ChaosConfig {
+	chaosLock.RLock()
+	defer chaosLock.RUnlock()
+	return chaos
+}
+
+func chaosHappens(rate float64) bool {
+	return rate > 0 && rand.Float64() < rate
+}
+
+// Returns true if the tap feed should drop the current event.
+func ChaosDropFeedEvent() bool {
+	if chaosHappens(GetChaos().FeedDropRate) {
+		LogTo("Chaos", "Dropping tap feed event")
+		return true
+	}
+	return false
+}
+
+// Called before running the sync function; sleeps for the configured delay.
+func ChaosSyncFnDelay() {
+	if delay := GetChaos().SyncFnDelayMS; delay > 0 {
+		time.Sleep(time.Duration(delay) * time.Millisecond)
+	}
+}
+
+// Returns ErrChaos if the bucket call 'op' should fail.
+func chaosBucketError(op string) error {
+	config := GetChaos()
+	if !chaosHappens(config.BucketErrorRate) {
+		return nil
+	}
+	if len(config.BucketErrorOps) > 0 {
+		found := false
+		for _, failOp := range config.BucketErrorOps {
+			found = found || failOp == op
+		}
+		if !found {
+			return nil
+		}
+	}
+	LogTo("Chaos", "Failing bucket call %s", op)
+	return ErrChaos
+}
+
+// Returns the number of simulated CAS conflicts an update should go through.
+func chaosCASConflicts() int {
+	config := GetChaos()
+	if chaosHappens(config.CASStormRate) {
+		return config.CASStormRetries
+	}
+	return 0
+}
+
+func wrapChaosBucket(bucket Bucket) Bucket {
+	return &chaosBucket{bucket}
+}
+
+// A wrapper around a Bucket that injects failures according to the chaos settings.
+// A "CAS storm" makes Update/WriteUpdate call their callback several extra times and
+// discard the results, just as they would if other writers kept changing the doc.
+type chaosBucket struct {
+	Bucket
+}
+
+func (b *chaosBucket) Get(k string, rv interface{}) error {
+	if err := chaosBucketError("Get"); err != nil {
+		return err
+	}
+	return b.Bucket.Get(k, rv)
+}
+func (b *chaosBucket) GetRaw(k string) ([]byte, error) {
+	if err := chaosBucketError("GetRaw"); err != nil {
+		return nil, err
+	}
+	return b.Bucket.GetRaw(k)
+}
+func (b *chaosBucket) Add(k string, exp int, v interface{}) (added bool, err error) {
+	if err := chaosBucketError("Add"); err != nil {
+		return false, err
+	}
+	return b.Bucket.Add(k, exp, v)
+}
+func (b *chaosBucket) AddRaw(k string, exp int, v []byte) (added bool, err error) {
+	if err := chaosBucketError("AddRaw"); err != nil {
+		return false, err
+	}
+	return b.Bucket.AddRaw(k, exp, v)
+}
+func (b *chaosBucket) Set(k string, exp int, v interface{}) error {
+	if err := chaosBucketError("Set"); err != nil {
+		return err
+	}
+	return b.Bucket.Set(k, exp, v)
+}
+func (b *chaosBucket) SetRaw(k string, exp int, v []byte) error {
+	if err := chaosBucketError("SetRaw"); err != nil {
+		return err
+	}
+	return b.Bucket.SetRaw(k, exp, v)
+}
+func (b *chaosBucket) Delete(k string) error {
+	if err := chaosBucketError("Delete"); err != nil {
+		return err
+	}
+	return b.Bucket.Delete(k)
+}
+func (b *chaosBucket) Write(k string, flags int, exp int, v interface{}, opt walrus.WriteOptions) error {
+	if err := chaosBucketError("Write"); err != nil {
+		return err
+	}
+	return b.Bucket.Write(k, flags, exp, v, opt)
+}
+func (b *chaosBucket) Update(k string, exp int, callback walrus.UpdateFunc) error {
+	if err := chaosBucketError("Update"); err != nil {
+		return err
+	}
+	for i := chaosCASConflicts(); i > 0; i-- {
+		current, _ := b.Bucket.GetRaw(k)
+		if _, err := callback(current); err != nil {
+			return err
+		}
+	}
+	return b.Bucket.Update(k, exp, callback)
+}
+func (b *chaosBucket) WriteUpdate(k string, exp int, callback walrus.WriteUpdateFunc) error {
+	if err := chaosBucketError("WriteUpdate"); err != nil {
+		return err
+	}
+	for i := chaosCASConflicts(); i > 0; i-- {
+		current, _ := b.Bucket.GetRaw(k)
+		if _, _, err := callback(current); err != nil {
+			return err
+		}
+	}
+	return b.Bucket.WriteUpdate(k, exp, callback)
+}
+func (b *chaosBucket) Incr(k string, amt, def uint64, exp int) (uint64, error) {
+	if err := chaosBucketError("Incr"); err != nil {
+		return 0, err
+	}
+	return b.Bucket.Incr(k, amt, def, exp)
+}
+func (b *chaosBucket) View(ddoc, name string, params map[string]interface{}) (walrus.ViewResult, error) {
+	if err := chaosBucketError("View"); err != nil {
+		return walrus.ViewResult{}, err
+	}
+	return b.Bucket.View(ddoc, name, params)
+}
@@ -0,0 +1,44 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+//go:build chaos
+// +build chaos
+
+package base
+
+import (
+	"testing"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func TestChaosBucket(t *testing.T) {
+	bucket, err := GetBucket(BucketSpec{Server: "walrus:", PoolName: "default", BucketName: "chaos_test"})
+	assert.Equals(t, err, nil)
+	defer SetChaos(ChaosConfig{})
+	assert.Equals(t, bucket.Set("doc", 0, "value"), nil)
+
+	assert.Equals(t, SetChaos(ChaosConfig{BucketErrorRate: 1, BucketErrorOps: []string{"Get"}}), nil)
+	var value string
+	assert.Equals(t, bucket.Get("doc", &value), ErrChaos)
+	_, err = bucket.GetRaw("doc")
+	assert.Equals(t, err, nil)
+
+	// A CAS storm makes the update callback run extra times:
+	assert.Equals(t, SetChaos(ChaosConfig{CASStormRate: 1, CASStormRetries: 3}), nil)
+	calls := 0
+	err = bucket.Update("doc", 0, func(current []byte) ([]byte, error) {
+		calls++
+		return current, nil
+	})
+	assert.Equals(t, err, nil)
+	assert.Equals(t, calls, 4)
+
+	assert.True(t, SetChaos(ChaosConfig{FeedDropRate: 2}) != nil)
+}
@@ -31,6 +31,66 @@ func HTTPErrorf(status int, format string, args ...interface{}) *HTTPError {
 	return &HTTPError{status, fmt.Sprintf(format, args...)}
 }
 
+// A 409 Conflict error that also identifies the deepest revision that the rejected update and
+// the document's current revision have in common, so that the client can do a three-way merge
+// without having to fetch the revision tree itself.
+type ConflictError struct {
+	Message      string
+	CurrentRev   string                 // The document's current (winning) revision
+	AncestorRev  string                 // Deepest common ancestor, or "" if none is known
+	AncestorBody map[string]interface{} // Body of AncestorRev, if it's still stored
+}
+
+func (err *ConflictError) Error() string {
+	return fmt.Sprintf("%d %s", http.StatusConflict, err.Message)
+}
+
+// Returns the extra properties that describe the conflict in a CouchDB-style error response.
+func (err *ConflictError) Details() map[string]interface{} {
+	details := map[string]interface{}{}
+	if err.CurrentRev != "" {
+		details["current_rev"] = err.CurrentRev
+	}
+	if err.AncestorRev != "" {
+		details["ancestor_rev"] = err.AncestorRev
+		if err.AncestorBody != nil {
+			details["ancestor"] = err.AncestorBody
+		}
+	}
+	return details
+}
+
+// A rejection of a document update by one of the sync function's requireUser, requireRole or
+// requireAccess helpers, or by the database's document validation. Check names the helper, so
+// a client can tell why it was turned away without parsing the message. (The users, roles or
+// channels the helper wanted aren't given, since they may come from a revision the client
+// can't read.)
+type RejectionError struct {
+	Status  int
+	Message string
+	Check   string  // "requireUser", "requireRole", "requireAccess" or "validation"
+	Path    *string // For "validation", JSON Pointer to the invalid value ("" is the whole doc)
+}
+
+func (err *RejectionError) Error() string {
+	return fmt.Sprintf("%d %s", err.Status, err.Message)
+}
+
+// Returns the extra properties that describe the rejection in an error response.
+func (err *RejectionError) Details() map[string]interface{} {
+	details := map[string]interface{}{"rejected_by": err.Check}
+	if err.Path != nil {
+		details["path"] = *err.Path
+	}
+	return details
+}
+
+// An error with extra properties to add to its JSON error response.
+type DetailedError interface {
+	error
+	Details() map[string]interface{}
+}
+
 // Attempts to map an error to an HTTP status code and message.
 // Defaults to 500 if it doesn't recognize the error. Returns 200 for a nil error.
 func ErrorAsHTTPStatus(err error) (int, string) {
@@ -40,6 +100,10 @@ func ErrorAsHTTPStatus(err error) (int, string) {
 	switch err := err.(type) {
 	case *HTTPError:
 		return err.Status, err.Message
+	case *ConflictError:
+		return http.StatusConflict, err.Message
+	case *RejectionError:
+		return err.Status, err.Message
 	case *gomemcached.MCResponse:
 		switch err.Status {
 		case gomemcached.KEY_ENOENT:
@@ -0,0 +1,213 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package base
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/couchbaselabs/walrus"
+	"github.com/dustin/gomemcached"
+)
+
+// Default max number of bucket calls that can be waiting out a failover at once
+const DefaultFailoverMaxQueued = 100
+
+// Delays between retries of a bucket call during a failover
+const kFailoverMinRetryDelay = 50 * time.Millisecond
+const kFailoverMaxRetryDelay = 2 * time.Second
+
+// Returns true if an error means the bucket is temporarily unreachable, as happens while a
+// Couchbase node fails over or the cluster rebalances, so the call is worth retrying.
+func IsBucketUnavailableError(err error) bool {
+	switch err := err.(type) {
+	case *gomemcached.MCResponse:
+		return err.Status == gomemcached.NOT_MY_VBUCKET || err.Status == gomemcached.TMPFAIL
+	case net.Error:
+		return true
+	}
+	return err == io.EOF || err == io.ErrUnexpectedEOF
+}
+
+// Returns true if an error means the server refused a call without applying it. Unlike a
+// dropped connection or a timeout, after which a write may or may not have happened, this
+// makes it safe to retry a write that isn't idempotent.
+func IsBucketWriteNotAppliedError(err error) bool {
+	if err, ok := err.(*gomemcached.MCResponse); ok {
+		return err.Status == gomemcached.NOT_MY_VBUCKET || err.Status == gomemcached.TMPFAIL
+	}
+	return false
+}
+
+// A wrapper around a Bucket that rides out short outages: a write or view query that fails
+// because the bucket is unavailable is retried until it succeeds or the grace window runs out,
+// instead of failing right away. At most maxQueued calls wait at once; past that, calls fail
+// immediately. As soon as one waiting call succeeds, the others retry right away.
+// Reads aren't retried, since failing those quickly is better than stalling clients on them.
+// Calls that aren't idempotent (Add, Append, Incr) are only retried when the server says it
+// didn't apply them; otherwise a retry could apply them twice.
+type failoverBucket struct {
+	Bucket
+	grace     time.Duration
+	maxQueued int
+	lock      sync.Mutex
+	queued    int           // Number of calls waiting to retry
+	recovered chan struct{} // Closed (and replaced) when a call succeeds while others wait
+}
+
+func newFailoverBucket(bucket Bucket, grace time.Duration, maxQueued int) *failoverBucket {
+	if maxQueued <= 0 {
+		maxQueued = DefaultFailoverMaxQueued
+	}
+	return &failoverBucket{
+		Bucket:    bucket,
+		grace:     grace,
+		maxQueued: maxQueued,
+		recovered: make(chan struct{}),
+	}
+}
+
+// Calls fn, retrying it while it fails with a bucket-unavailable error, for up to the grace window.
+// If the call isn't idempotent, only errors that mean it wasn't applied are retried.
+func (b *failoverBucket) retry(op string, idempotent bool, fn func() error) error {
+	retryable := IsBucketUnavailableError
+	if !idempotent {
+		retryable = IsBucketWriteNotAppliedError
+	}
+	err := fn()
+	if !retryable(err) {
+		if err == nil {
+			b.succeeded()
+		}
+		return err
+	}
+
+	wake, ok := b.enqueue()
+	if !ok {
+		Warn("Bucket %s unavailable and %d calls already queued; failing %s: %v",
+			b.GetName(), b.maxQueued, op, err)
+		return err
+	}
+	defer b.dequeue()
+	LogTo("Bucket", "%s failed with %v; retrying for up to %v", op, err, b.grace)
+
+	deadline := time.Now().Add(b.grace)
+	delay := kFailoverMinRetryDelay
+	for {
+		remaining := deadline.Sub(time.Now())
+		if remaining <= 0 {
+			Warn("Bucket %s still unavailable after %v; failing %s: %v", b.GetName(), b.grace, op, err)
+			return err
+		} else if delay > remaining {
+			delay = remaining
+		}
+		select {
+		case <-time.After(delay):
+		case <-wake:
+		}
+		if err = fn(); !retryable(err) {
+			LogTo("Bucket", "%s succeeded after bucket recovered", op)
+			b.succeeded()
+			return err
+		}
+		wake = b.recoveredChannel()
+		if delay *= 2; delay > kFailoverMaxRetryDelay {
+			delay = kFailoverMaxRetryDelay
+		}
+	}
+}
+
+func (b *failoverBucket) enqueue() (<-chan struct{}, bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.queued >= b.maxQueued {
+		return nil, false
+	}
+	b.queued++
+	return b.recovered, true
+}
+
+func (b *failoverBucket) dequeue() {
+	b.lock.Lock()
+	b.queued--
+	b.lock.Unlock()
+}
+
+func (b *failoverBucket) recoveredChannel() <-chan struct{} {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.recovered
+}
+
+// Wakes up any calls waiting to retry, since the bucket is evidently back.
+func (b *failoverBucket) succeeded() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.queued > 0 {
+		close(b.recovered)
+		b.recovered = make(chan struct{})
+	}
+}
+
+func (b *failoverBucket) Add(k string, exp int, v interface{}) (added bool, err error) {
+	err = b.retry("Add", false, func() (err error) {
+		added, err = b.Bucket.Add(k, exp, v)
+		return
+	})
+	return
+}
+func (b *failoverBucket) AddRaw(k string, exp int, v []byte) (added bool, err error) {
+	err = b.retry("AddRaw", false, func() (err error) {
+		added, err = b.Bucket.AddRaw(k, exp, v)
+		return
+	})
+	return
+}
+func (b *failoverBucket) Append(k string, data []byte) error {
+	return b.retry("Append", false, func() error { return b.Bucket.Append(k, data) })
+}
+func (b *failoverBucket) Set(k string, exp int, v interface{}) error {
+	return b.retry("Set", true, func() error { return b.Bucket.Set(k, exp, v) })
+}
+func (b *failoverBucket) SetRaw(k string, exp int, v []byte) error {
+	return b.retry("SetRaw", true, func() error { return b.Bucket.SetRaw(k, exp, v) })
+}
+func (b *failoverBucket) Delete(k string) error {
+	return b.retry("Delete", true, func() error { return b.Bucket.Delete(k) })
+}
+func (b *failoverBucket) Write(k string, flags int, exp int, v interface{}, opt walrus.WriteOptions) error {
+	idempotent := opt&(walrus.AddOnly|walrus.Append) == 0
+	return b.retry("Write", idempotent, func() error { return b.Bucket.Write(k, flags, exp, v, opt) })
+}
+func (b *failoverBucket) Update(k string, exp int, callback walrus.UpdateFunc) error {
+	return b.retry("Update", true, func() error { return b.Bucket.Update(k, exp, callback) })
+}
+func (b *failoverBucket) WriteUpdate(k string, exp int, callback walrus.WriteUpdateFunc) error {
+	return b.retry("WriteUpdate", true, func() error { return b.Bucket.WriteUpdate(k, exp, callback) })
+}
+func (b *failoverBucket) Incr(k string, amt, def uint64, exp int) (result uint64, err error) {
+	err = b.retry("Incr", false, func() (err error) {
+		result, err = b.Bucket.Incr(k, amt, def, exp)
+		return
+	})
+	return
+}
+func (b *failoverBucket) View(ddoc, name string, params map[string]interface{}) (result walrus.ViewResult, err error) {
+	err = b.retry("View", true, func() (err error) {
+		result, err = b.Bucket.View(ddoc, name, params)
+		return
+	})
+	return
+}
+func (b *failoverBucket) ViewCustom(ddoc, name string, params map[string]interface{}, vres interface{}) error {
+	return b.retry("ViewCustom", true, func() error { return b.Bucket.ViewCustom(ddoc, name, params, vres) })
+}
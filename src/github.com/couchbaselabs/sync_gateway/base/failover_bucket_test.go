@@ -0,0 +1,83 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package base
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/go.assert"
+	"github.com/couchbaselabs/walrus"
+	"github.com/dustin/gomemcached"
+)
+
+// A bucket whose Set calls fail with 'err' the first 'failures' times.
+type flakyBucket struct {
+	Bucket
+	failures int
+	err      error
+}
+
+func (b *flakyBucket) Set(k string, exp int, v interface{}) error {
+	if b.failures > 0 {
+		b.failures--
+		return b.err
+	}
+	return b.Bucket.Set(k, exp, v)
+}
+
+func (b *flakyBucket) Append(k string, data []byte) error {
+	if b.failures > 0 {
+		b.failures--
+		return b.err
+	}
+	return b.Bucket.Append(k, data)
+}
+
+func TestFailoverBucket(t *testing.T) {
+	flaky := &flakyBucket{Bucket: walrus.NewBucket("failover_test"), err: io.EOF}
+	bucket := newFailoverBucket(flaky, time.Second, 0)
+
+	// A short outage is waited out:
+	flaky.failures = 3
+	assert.Equals(t, bucket.Set("doc", 0, "value"), nil)
+	assert.Equals(t, flaky.failures, 0)
+
+	// A long one fails once the grace window is over:
+	bucket.grace = 100 * time.Millisecond
+	flaky.failures = 1000
+	start := time.Now()
+	assert.Equals(t, bucket.Set("doc", 0, "value"), io.EOF)
+	assert.True(t, time.Since(start) >= bucket.grace)
+	assert.Equals(t, bucket.queued, 0)
+
+	// Other errors aren't retried:
+	otherErr := errors.New("bad")
+	flaky.failures, flaky.err = 2, otherErr
+	assert.Equals(t, bucket.Set("doc", 0, "value"), otherErr)
+	assert.Equals(t, flaky.failures, 1)
+
+	// A non-idempotent call isn't retried after an error that leaves it unknown whether it was
+	// applied, only after the server refuses it:
+	bucket.grace = time.Second
+	flaky.failures, flaky.err = 1, io.EOF
+	assert.Equals(t, bucket.Append("doc", []byte("x")), io.EOF)
+	assert.Equals(t, flaky.failures, 0)
+	flaky.failures, flaky.err = 2, &gomemcached.MCResponse{Status: gomemcached.TMPFAIL}
+	assert.Equals(t, bucket.Append("doc", []byte("x")), nil)
+	assert.Equals(t, flaky.failures, 0)
+
+	// If the queue is full, calls fail immediately:
+	bucket.maxQueued = 0
+	flaky.failures, flaky.err = 1, io.EOF
+	assert.Equals(t, bucket.Set("doc", 0, "value"), io.EOF)
+}
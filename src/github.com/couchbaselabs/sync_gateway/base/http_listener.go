@@ -5,11 +5,25 @@ import (
 	"net"
 	"net/http"
 	"sync"
+	"time"
 )
 
 // This is like a combination of http.ListenAndServe and http.ListenAndServeTLS, which also
-// uses ThrottledListen to limit the number of open HTTP connections.
-func ListenAndServeHTTP(addr string, connLimit int, certFile *string, keyFile *string, handler http.Handler) error {
+// uses ThrottledListen to limit the number of open HTTP connections, and disconnects clients
+// that leave a write blocked for longer than writeTimeout (if it's nonzero.)
+func ListenAndServeHTTP(addr string, connLimit int, writeTimeout time.Duration, certFile *string, keyFile *string, handler http.Handler) error {
+	listener, err := ListenHTTP(addr, connLimit, writeTimeout, certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	server := &http.Server{Addr: addr, Handler: handler}
+	return server.Serve(listener)
+}
+
+// Opens the listener that ListenAndServeHTTP serves on. Closing it stops the server
+// accepting connections.
+func ListenHTTP(addr string, connLimit int, writeTimeout time.Duration, certFile *string, keyFile *string) (net.Listener, error) {
 	var config *tls.Config
 	if certFile != nil {
 		config = &tls.Config{}
@@ -18,19 +32,20 @@ func ListenAndServeHTTP(addr string, connLimit int, certFile *string, keyFile *s
 		var err error
 		config.Certificates[0], err = tls.LoadX509KeyPair(*certFile, *keyFile)
 		if err != nil {
-			return err
+			return nil, err
 		}
 	}
 	listener, err := ThrottledListen("tcp", addr, connLimit)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if writeTimeout > 0 {
+		listener = &writeTimeoutListener{listener, writeTimeout}
 	}
 	if config != nil {
 		listener = tls.NewListener(listener, config)
 	}
-	defer listener.Close()
-	server := &http.Server{Addr: addr, Handler: handler}
-	return server.Serve(listener)
+	return listener, nil
 }
 
 type throttledListener struct {
@@ -90,3 +105,30 @@ func (conn *throttleConn) Close() error {
 	conn.listener.connFinished()
 	return err
 }
+
+// A net.Listener whose connections time out any single write that blocks too long. Unlike
+// http.Server's WriteTimeout this doesn't limit how long a whole response can take, so
+// continuous _changes feeds still work, but a client that stops reading gets disconnected
+// instead of tying up its connection and handler forever.
+type writeTimeoutListener struct {
+	net.Listener
+	timeout time.Duration
+}
+
+func (wl *writeTimeoutListener) Accept() (net.Conn, error) {
+	conn, err := wl.Listener.Accept()
+	if err != nil {
+		return conn, err
+	}
+	return &writeTimeoutConn{conn, wl.timeout}, nil
+}
+
+type writeTimeoutConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (conn *writeTimeoutConn) Write(data []byte) (int, error) {
+	conn.Conn.SetWriteDeadline(time.Now().Add(conn.timeout))
+	return conn.Conn.Write(data)
+}
@@ -0,0 +1,427 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package base
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Severity of a log message. Each sink logs only the messages at or above its level.
+type LogSinkLevel int
+
+const (
+	LogLevelDebug = LogSinkLevel(iota) // LogTo messages (whose keys are enabled)
+	LogLevelInfo                       // Log messages
+	LogLevelWarn                       // Warn messages
+	LogLevelError                      // LogError, LogPanic and LogFatal messages
+)
+
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+
+func (level LogSinkLevel) String() string {
+	return logLevelNames[level]
+}
+
+func ParseLogSinkLevel(name string) (LogSinkLevel, error) {
+	if name == "" {
+		return LogLevelDebug, nil
+	}
+	for i, levelName := range logLevelNames {
+		if name == levelName {
+			return LogSinkLevel(i), nil
+		}
+	}
+	return 0, HTTPErrorf(http.StatusBadRequest, "Unknown log level %q", name)
+}
+
+// Configuration of a log output. Sinks are named in the server config, and any number of them
+// can be active at once.
+type LogSinkConfig struct {
+	Type       string `json:"type"`                  // "console", "file" or "syslog"
+	Level      string `json:"level,omitempty"`       // Lowest level to log: "debug" (default), "info", "warn" or "error"
+	Path       string `json:"path,omitempty"`        // File to write to (file)
+	MaxSize    int    `json:"max_size,omitempty"`    // MB the file can grow to before it's rotated (file; 0 = no limit)
+	MaxAge     int    `json:"max_age,omitempty"`     // Hours the file is written to before it's rotated (file; 0 = no limit)
+	MaxBackups int    `json:"max_backups,omitempty"` // Number of rotated files to keep (file; 0 = all)
+	Network    string `json:"network,omitempty"`     // "udp", "tcp" or "unix" to use a remote syslog (syslog)
+	Address    string `json:"address,omitempty"`     // Address of the remote syslog (syslog)
+	Tag        string `json:"tag,omitempty"`         // Tag of syslog messages, default "sync_gateway" (syslog)
+}
+
+// Destination of syslog messages; implemented by *syslog.Writer.
+type syslogWriter interface {
+	Debug(m string) error
+	Info(m string) error
+	Warning(m string) error
+	Err(m string) error
+	Close() error
+}
+
+// One message being logged, which each sink formats for itself.
+type logMessage struct {
+	level  LogSinkLevel
+	color  string // ANSI color, used only on the console
+	prefix string // LogTo key, or "WARNING", etc.
+	text   string
+	caller string // Name of the calling function, for warnings & errors
+}
+
+func (m *logMessage) format(color bool) string {
+	c, r, d := m.color, reset, dim
+	if !color {
+		c, r, d = "", "", ""
+	}
+	if m.caller != "" {
+		return c + m.prefix + ": " + m.text + r + d + " -- " + m.caller + r
+	} else if m.prefix != "" {
+		return c + m.prefix + ": " + r + m.text
+	}
+	return m.text
+}
+
+type logSink struct {
+	config LogSinkConfig
+	level  LogSinkLevel
+	color  bool
+	logger *log.Logger   // Console & file sinks
+	file   *rotatingFile // File sinks
+	syslog syslogWriter  // Syslog sinks
+}
+
+func newLogSink(config LogSinkConfig) (*logSink, error) {
+	level, err := ParseLogSinkLevel(config.Level)
+	if err != nil {
+		return nil, err
+	}
+	config.Level = level.String()
+	sink := &logSink{config: config, level: level}
+	switch config.Type {
+	case "console":
+		sink.logger = log.New(os.Stderr, "", logFlags)
+		sink.color = true
+	case "file":
+		if config.Path == "" {
+			return nil, HTTPErrorf(http.StatusBadRequest, "Log file sink needs a path")
+		}
+		sink.file, err = openRotatingFile(config.Path, int64(config.MaxSize)<<20,
+			time.Duration(config.MaxAge)*time.Hour, config.MaxBackups)
+		if err != nil {
+			return nil, err
+		}
+		sink.logger = log.New(sink.file, "", logFlags|log.Ldate)
+	case "syslog":
+		tag := config.Tag
+		if tag == "" {
+			tag = "sync_gateway"
+		}
+		if sink.syslog, err = openSyslog(config.Network, config.Address, tag); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, HTTPErrorf(http.StatusBadRequest, "Unknown log sink type %q", config.Type)
+	}
+	return sink, nil
+}
+
+func (sink *logSink) write(m *logMessage) {
+	if m.level < sink.level {
+		return
+	}
+	if sink.syslog != nil {
+		text := m.format(false)
+		switch m.level {
+		case LogLevelDebug:
+			sink.syslog.Debug(text)
+		case LogLevelInfo:
+			sink.syslog.Info(text)
+		case LogLevelWarn:
+			sink.syslog.Warning(text)
+		default:
+			sink.syslog.Err(text)
+		}
+	} else {
+		sink.logger.Print(m.format(sink.color))
+	}
+}
+
+func (sink *logSink) close() {
+	if sink.file != nil {
+		sink.file.Close()
+	}
+	if sink.syslog != nil {
+		sink.syslog.Close()
+	}
+}
+
+var logSinks map[string]*logSink
+var logSinksLock sync.RWMutex
+
+// Flags of the console & file sinks' loggers (see LogNoTime)
+var logFlags = log.Lmicroseconds
+
+var defaultLogSinks = map[string]*LogSinkConfig{"console": {Type: "console"}}
+
+// Sends a message to all the sinks.
+func emitLog(m *logMessage) {
+	logSinksLock.RLock()
+	defer logSinksLock.RUnlock()
+	for _, sink := range logSinks {
+		sink.write(m)
+	}
+}
+
+// Replaces the active log sinks, opening the new ones before closing the old. If any of them
+// fails to open, the old sinks stay active. An empty map restores the default console sink.
+func SetLogSinks(configs map[string]*LogSinkConfig) error {
+	if len(configs) == 0 {
+		configs = defaultLogSinks
+	}
+	sinks := make(map[string]*logSink, len(configs))
+	for name, config := range configs {
+		var err error
+		if config == nil {
+			err = HTTPErrorf(http.StatusBadRequest, "Log sink %q has no config", name)
+		} else if sinks[name], err = newLogSink(*config); err != nil {
+			message := err.Error()
+			if httpErr, ok := err.(*HTTPError); ok {
+				message = httpErr.Message
+			}
+			err = HTTPErrorf(http.StatusBadRequest, "Log sink %q: %s", name, message)
+		}
+		if err != nil {
+			for _, sink := range sinks {
+				if sink != nil {
+					sink.close()
+				}
+			}
+			return err
+		}
+	}
+
+	logSinksLock.Lock()
+	oldSinks := logSinks
+	logSinks = sinks
+	logSinksLock.Unlock()
+	for _, sink := range oldSinks {
+		sink.close()
+	}
+	names := make([]string, 0, len(sinks))
+	for name := range sinks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	Log("Logging to %v", names)
+	return nil
+}
+
+// Returns the configs of the active log sinks.
+func GetLogSinks() map[string]*LogSinkConfig {
+	logSinksLock.RLock()
+	defer logSinksLock.RUnlock()
+	configs := make(map[string]*LogSinkConfig, len(logSinks))
+	for name, sink := range logSinks {
+		config := sink.config
+		configs[name] = &config
+	}
+	return configs
+}
+
+// Closes and reopens all log files, so that an external log rotator can move them aside.
+func ReopenLogFiles() error {
+	logSinksLock.RLock()
+	defer logSinksLock.RUnlock()
+	for _, sink := range logSinks {
+		if sink.file != nil {
+			if err := sink.file.reopen(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+//////// ROTATING FILES:
+
+// A log file that, once it reaches a maximum size or age, is renamed with a timestamp suffix and
+// replaced with a new empty file. Only the newest maxBackups of the renamed files are kept.
+type rotatingFile struct {
+	lock       sync.Mutex
+	path       string
+	maxSize    int64         // 0 = no limit
+	maxAge     time.Duration // 0 = no limit
+	maxBackups int           // 0 = keep all
+	file       *os.File
+	size       int64     // Current size of file
+	opened     time.Time // When file was opened
+}
+
+func openRotatingFile(path string, maxSize int64, maxAge time.Duration, maxBackups int) (*rotatingFile, error) {
+	f := &rotatingFile{path: path, maxSize: maxSize, maxAge: maxAge, maxBackups: maxBackups}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size, f.opened = file, info.Size(), time.Now()
+	return nil
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.file != nil && f.size > 0 &&
+		((f.maxSize > 0 && f.size+int64(len(p)) > f.maxSize) ||
+			(f.maxAge > 0 && time.Since(f.opened) >= f.maxAge)) {
+		if err := f.rotate(); err != nil {
+			// Can't use Warn, since that would come right back here:
+			fmt.Fprintf(os.Stderr, "WARNING: Couldn't rotate log file %s: %v\n", f.path, err)
+		}
+	}
+	if f.file == nil {
+		return 0, fmt.Errorf("Log file %s isn't open", f.path)
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// Format of the timestamp suffix of a rotated file's name, which may be followed by "-N" if
+// there'd otherwise be two with the same name.
+const kRotatedFileTimeFormat = "20060102-150405.000"
+
+// Renames the file aside and starts a new one. Called with the lock held.
+func (f *rotatingFile) rotate() error {
+	f.file.Close()
+	f.file = nil
+	stamp := time.Now().Format(kRotatedFileTimeFormat)
+	backup := f.path + "." + stamp
+	for i := 1; ; i++ {
+		if _, err := os.Stat(backup); os.IsNotExist(err) {
+			break
+		}
+		backup = fmt.Sprintf("%s.%s-%d", f.path, stamp, i)
+	}
+	renameErr := os.Rename(f.path, backup)
+	if err := f.open(); err != nil {
+		return err
+	} else if renameErr != nil {
+		f.size = 0 // Try again after another maxSize bytes, not on every write
+		return renameErr
+	}
+	if f.maxBackups > 0 {
+		backups, err := f.backups()
+		if err != nil {
+			return err
+		}
+		for len(backups) > f.maxBackups {
+			if err := os.Remove(backups[0]); err != nil {
+				return err
+			}
+			backups = backups[1:]
+		}
+	}
+	return nil
+}
+
+// A rotated file, found by rotatingFile.backups
+type rotatedFile struct {
+	path  string
+	time  time.Time
+	index int // Distinguishes files rotated within the same second
+}
+
+// Sorts rotated files oldest first.
+type rotatedFilesByAge []rotatedFile
+
+func (l rotatedFilesByAge) Len() int      { return len(l) }
+func (l rotatedFilesByAge) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+func (l rotatedFilesByAge) Less(i, j int) bool {
+	if !l[i].time.Equal(l[j].time) {
+		return l[i].time.Before(l[j].time)
+	}
+	return l[i].index < l[j].index
+}
+
+// Returns the paths of the rotated files, oldest first. Other files that merely start with the
+// same name are left out, so they're never deleted.
+func (f *rotatingFile) backups() ([]string, error) {
+	dir, prefix := filepath.Dir(f.path), filepath.Base(f.path)+"."
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var found []rotatedFile
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, prefix) || !entry.Mode().IsRegular() {
+			continue
+		}
+		suffix, index := name[len(prefix):], 0
+		if dash := len(kRotatedFileTimeFormat); len(suffix) > dash+1 && suffix[dash] == '-' {
+			if index, err = strconv.Atoi(suffix[dash+1:]); err != nil || index < 1 {
+				continue
+			}
+			suffix = suffix[:dash]
+		}
+		t, err := time.Parse(kRotatedFileTimeFormat, suffix)
+		if err != nil || t.Format(kRotatedFileTimeFormat) != suffix {
+			continue
+		}
+		found = append(found, rotatedFile{filepath.Join(dir, name), t, index})
+	}
+	sort.Sort(rotatedFilesByAge(found))
+	paths := make([]string, len(found))
+	for i, b := range found {
+		paths[i] = b.path
+	}
+	return paths, nil
+}
+
+func (f *rotatingFile) reopen() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.file != nil {
+		f.file.Close()
+		f.file = nil
+	}
+	return f.open()
+}
+
+func (f *rotatingFile) Close() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
@@ -0,0 +1,84 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package base
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rotating_file")
+	assert.Equals(t, err, nil)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sg.log")
+
+	// Files that only look like backups are never pruned:
+	for _, name := range []string{"sg.log.old", "sg.log.20140101-000000.000.gz", "sg.log.20140101-000000.000-x"} {
+		assert.Equals(t, ioutil.WriteFile(filepath.Join(dir, name), []byte("keep"), 0644), nil)
+	}
+
+	f, err := openRotatingFile(path, 10, 0, 1)
+	assert.Equals(t, err, nil)
+	for _, line := range []string{"one\n", "two\n", "three\n", "four\n", "five\n"} {
+		_, err = f.Write([]byte(line))
+		assert.Equals(t, err, nil)
+	}
+	assert.Equals(t, f.Close(), nil)
+
+	contents, _ := ioutil.ReadFile(path)
+	assert.Equals(t, string(contents), "four\nfive\n")
+	backups, _ := f.backups()
+	assert.Equals(t, len(backups), 1) // It rotated twice, but only one backup is kept
+	contents, _ = ioutil.ReadFile(backups[0])
+	assert.Equals(t, string(contents), "three\n")
+	others, _ := filepath.Glob(path + ".*")
+	assert.Equals(t, len(others), 4)
+}
+
+func TestLogSinkLevels(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log_sinks")
+	assert.Equals(t, err, nil)
+	defer os.RemoveAll(dir)
+	defer SetLogSinks(nil)
+	infoPath, warnPath := filepath.Join(dir, "info.log"), filepath.Join(dir, "warn.log")
+
+	assert.Equals(t, SetLogSinks(map[string]*LogSinkConfig{
+		"info": {Type: "file", Path: infoPath, Level: "info"},
+		"warn": {Type: "file", Path: warnPath, Level: "warn"},
+	}), nil)
+	sinks := GetLogSinks()
+	assert.Equals(t, len(sinks), 2)
+	assert.Equals(t, sinks["warn"].Level, "warn")
+
+	SetLogKeys(map[string]bool{"LogSinkTest": true})
+	defer SetLogKeys(map[string]bool{"LogSinkTest": false})
+	LogTo("LogSinkTest", "a debug message")
+	Log("an info message")
+	Warn("a warning")
+
+	info, _ := ioutil.ReadFile(infoPath)
+	warn, _ := ioutil.ReadFile(warnPath)
+	assert.False(t, strings.Contains(string(info), "a debug message"))
+	assert.True(t, strings.Contains(string(info), "an info message"))
+	assert.True(t, strings.Contains(string(info), "WARNING: a warning -- "))
+	assert.False(t, strings.Contains(string(warn), "an info message"))
+	assert.True(t, strings.Contains(string(warn), "WARNING: a warning -- "))
+	assert.False(t, strings.Contains(string(info), "\x1b[")) // No ANSI color in files
+
+	// A bad sink leaves the current ones in place:
+	assert.True(t, SetLogSinks(map[string]*LogSinkConfig{"bad": {Type: "carrier-pigeon"}}) != nil)
+	assert.Equals(t, len(GetLogSinks()), 2)
+}
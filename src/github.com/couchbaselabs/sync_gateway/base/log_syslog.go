@@ -0,0 +1,20 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package base
+
+import "log/syslog"
+
+// Connects to the local syslog daemon, or to a remote one if network and address are given.
+func openSyslog(network, address, tag string) (syslogWriter, error) {
+	return syslog.Dial(network, address, syslog.LOG_INFO|syslog.LOG_USER, tag)
+}
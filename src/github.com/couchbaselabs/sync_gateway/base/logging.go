@@ -15,20 +15,22 @@ import (
 	"os"
 	"runtime"
 	"strings"
+	"sync"
 )
 
 // 1 enables regular logs, 2 enables warnings, 3+ is nothing but panics.
 // Default value is 1.
 var LogLevel int = 1
 
-// Set of LogTo() key strings that are enabled.
+// Set of LogTo() key strings that are enabled. Once the server is running, use LogEnabled and
+// SetLogKeys instead of accessing it directly, since it can change at any time.
 var LogKeys map[string]bool
-
-var logger *log.Logger
+var logKeysLock sync.RWMutex
 
 func init() {
-	logger = log.New(os.Stderr, "", log.Lmicroseconds)
 	LogKeys = make(map[string]bool)
+	console, _ := newLogSink(*defaultLogSinks["console"])
+	logSinks = map[string]*logSink{"console": console}
 }
 
 // Disables ANSI color in log output.
@@ -36,8 +38,45 @@ func LogNoColor() {
 	reset, dim, fgRed, fgYellow = "", "", "", ""
 }
 
+// Removes timestamps from console and file log output.
 func LogNoTime() {
-	logger.SetFlags(logger.Flags() &^ (log.Ldate | log.Ltime | log.Lmicroseconds))
+	logSinksLock.Lock()
+	defer logSinksLock.Unlock()
+	logFlags &^= log.Ldate | log.Ltime | log.Lmicroseconds
+	for _, sink := range logSinks {
+		if sink.logger != nil {
+			sink.logger.SetFlags(logFlags)
+		}
+	}
+}
+
+// Returns true if LogTo messages with this key are enabled.
+func LogEnabled(key string) bool {
+	logKeysLock.RLock()
+	defer logKeysLock.RUnlock()
+	return LogKeys[key]
+}
+
+// Returns the keys whose LogTo messages are enabled.
+func GetLogKeys() map[string]bool {
+	logKeysLock.RLock()
+	defer logKeysLock.RUnlock()
+	keys := make(map[string]bool, len(LogKeys))
+	for key, enabled := range LogKeys {
+		if enabled {
+			keys[key] = true
+		}
+	}
+	return keys
+}
+
+// Enables or disables LogTo keys; keys not in the map are unchanged.
+func SetLogKeys(changes map[string]bool) {
+	logKeysLock.Lock()
+	defer logKeysLock.Unlock()
+	for key, enabled := range changes {
+		LogKeys[key] = enabled
+	}
 }
 
 // Parses a comma-separated list of log keys, probably coming from an argv flag.
@@ -58,11 +97,12 @@ func ParseLogFlags(flags []string) {
 		case "notime":
 			LogNoTime()
 		default:
-			LogKeys[key] = true
+			keys := map[string]bool{key: true}
 			for strings.HasSuffix(key, "+") {
 				key = key[0 : len(key)-1]
-				LogKeys[key] = true // "foo+" also enables "foo"
+				keys[key] = true // "foo+" also enables "foo"
 			}
+			SetLogKeys(keys)
 		}
 	}
 	Log("Enabling logging: %s", flags)
@@ -84,17 +124,18 @@ func GetCallersName(depth int) string {
 	return fmt.Sprintf("%s() at %s:%d", lastComponent(fnname), lastComponent(file), line)
 }
 
-// Logs a message to the console, but only if the corresponding key is true in LogKeys.
+// Logs a message, but only if the corresponding key is true in LogKeys.
 func LogTo(key string, format string, args ...interface{}) {
-	if LogLevel <= 1 && LogKeys[key] {
-		logger.Printf(fgYellow+key+": "+reset+format, args...)
+	if LogLevel <= 1 && LogEnabled(key) {
+		emitLog(&logMessage{level: LogLevelDebug, color: fgYellow, prefix: key,
+			text: fmt.Sprintf(format, args...)})
 	}
 }
 
-// Logs a message to the console.
+// Logs a message.
 func Log(format string, args ...interface{}) {
 	if LogLevel <= 1 {
-		logger.Printf(format, args...)
+		emitLog(&logMessage{level: LogLevelInfo, text: fmt.Sprintf(format, args...)})
 	}
 }
 
@@ -102,15 +143,15 @@ func Log(format string, args ...interface{}) {
 // Returns the input error for easy chaining.
 func LogError(err error) error {
 	if LogLevel <= 2 && err != nil {
-		logWithCaller(fgRed, "ERROR", "%v", err)
+		logWithCaller(LogLevelError, fgRed, "ERROR", "%v", err)
 	}
 	return err
 }
 
-// Logs a warning to the console
+// Logs a warning
 func Warn(format string, args ...interface{}) {
 	if LogLevel <= 2 {
-		logWithCaller(fgRed, "WARNING", format, args...)
+		logWithCaller(LogLevelWarn, fgRed, "WARNING", format, args...)
 	}
 }
 
@@ -118,25 +159,24 @@ func Warn(format string, args ...interface{}) {
 // temporary logging calls added during development and not to be checked in, hence its
 // distinctive name (which is visible and easy to search for before committing.)
 func TEMP(format string, args ...interface{}) {
-	logWithCaller(fgYellow, "TEMP", format, args...)
+	logWithCaller(LogLevelInfo, fgYellow, "TEMP", format, args...)
 }
 
 // Logs a warning to the console, then panics.
 func LogPanic(format string, args ...interface{}) {
-	logWithCaller(fgRed, "PANIC", format, args...)
+	logWithCaller(LogLevelError, fgRed, "PANIC", format, args...)
 	panic(fmt.Sprintf(format, args...))
 }
 
 // Logs a warning to the console, then exits the process.
 func LogFatal(format string, args ...interface{}) {
-	logWithCaller(fgRed, "FATAL", format, args...)
+	logWithCaller(LogLevelError, fgRed, "FATAL", format, args...)
 	os.Exit(1)
 }
 
-func logWithCaller(color string, prefix string, format string, args ...interface{}) {
-	message := fmt.Sprintf(format, args...)
-	logger.Print(color, prefix, ": ", message, reset,
-		dim, " -- ", GetCallersName(2), reset)
+func logWithCaller(level LogSinkLevel, color string, prefix string, format string, args ...interface{}) {
+	emitLog(&logMessage{level: level, color: color, prefix: prefix,
+		text: fmt.Sprintf(format, args...), caller: GetCallersName(2)})
 }
 
 func lastComponent(path string) string {
@@ -20,6 +20,7 @@ const (
 	Removed              // Doc was removed from this channel
 	Hidden               // This rev is not the default (hidden by a conflict)
 	Conflict             // Document is in conflict at this time
+	Resolved             // A conflict was resolved by tombstoning the losing branches
 
 	kMaxFlag = (1 << iota) - 1
 )
@@ -10,6 +10,8 @@
 package channels
 
 import (
+	"time"
+
 	"github.com/couchbaselabs/walrus"
 	_ "github.com/robertkrimen/otto/underscore"
 
@@ -48,11 +50,15 @@ func NewDefaultChannelMapper() *ChannelMapper {
 }
 
 func (mapper *ChannelMapper) MapToChannelsAndAccess(body map[string]interface{}, oldBodyJSON string, userCtx map[string]interface{}) (*ChannelMapperOutput, error) {
+	start := time.Now()
+	base.ChaosSyncFnDelay()
 	result1, err := mapper.Call(body, walrus.JSONString(oldBodyJSON), userCtx)
 	if err != nil {
+		recordSyncFnCall(start, nil, err)
 		return nil, err
 	}
 	output := result1.(*ChannelMapperOutput)
+	recordSyncFnCall(start, output, nil)
 	return output, nil
 }
 
@@ -11,6 +11,7 @@ package channels
 
 import (
 	"encoding/json"
+	"expvar"
 	"github.com/couchbaselabs/go.assert"
 	"testing"
 
@@ -220,6 +221,27 @@ func TestChannelMapperException(t *testing.T) {
 	assert.True(t, err != nil)
 }
 
+// Sync function stats
+func TestChannelMapperStats(t *testing.T) {
+	getCount := func(m *expvar.Map, key string) int64 {
+		if v, ok := m.Get(key).(*expvar.Int); ok {
+			return v.Value()
+		}
+		return 0
+	}
+	calls := getCount(syncFnExpvars, "calls")
+	rejections := getCount(syncFnRejections, "403 stats test")
+	threeChannels := getCount(syncFnChannelCounts, "2-5")
+
+	mapper := NewChannelMapper(`function(doc) {channel(doc.channels); if (doc.bad) reject(403, "stats test");}`)
+	mapper.MapToChannelsAndAccess(parse(`{"channels": ["foo", "bar", "baz"]}`), `{}`, noUser)
+	mapper.MapToChannelsAndAccess(parse(`{"bad": true}`), `{}`, noUser)
+
+	assert.Equals(t, getCount(syncFnExpvars, "calls"), calls+2)
+	assert.Equals(t, getCount(syncFnRejections, "403 stats test"), rejections+1)
+	assert.Equals(t, getCount(syncFnChannelCounts, "2-5"), threeChannels+1)
+}
+
 // Test the public API
 func TestPublicChannelMapper(t *testing.T) {
 	mapper := NewChannelMapper(`function(doc) {channel(doc.channels);}`)
@@ -241,7 +263,7 @@ func TestCheckUser(t *testing.T) {
 	var linus = map[string]interface{}{"name": "linus", "channels": []string{}}
 	res, err = mapper.MapToChannelsAndAccess(parse(`{"owner": "sally"}`), `{}`, linus)
 	assertNoError(t, err, "MapToChannelsAndAccess failed")
-	assert.DeepEquals(t, res.Rejection, base.HTTPErrorf(403, "wrong user"))
+	assert.DeepEquals(t, res.Rejection, &base.RejectionError{Status: 403, Message: "wrong user", Check: "requireUser"})
 
 	res, err = mapper.MapToChannelsAndAccess(parse(`{"owner": "sally"}`), `{}`, nil)
 	assertNoError(t, err, "MapToChannelsAndAccess failed")
@@ -261,7 +283,7 @@ func TestCheckUserArray(t *testing.T) {
 	var linus = map[string]interface{}{"name": "linus", "channels": []string{}}
 	res, err = mapper.MapToChannelsAndAccess(parse(`{"owners": ["sally", "joe"]}`), `{}`, linus)
 	assertNoError(t, err, "MapToChannelsAndAccess failed")
-	assert.DeepEquals(t, res.Rejection, base.HTTPErrorf(403, "wrong user"))
+	assert.DeepEquals(t, res.Rejection, &base.RejectionError{Status: 403, Message: "wrong user", Check: "requireUser"})
 
 	res, err = mapper.MapToChannelsAndAccess(parse(`{"owners": ["sally"]}`), `{}`, nil)
 	assertNoError(t, err, "MapToChannelsAndAccess failed")
@@ -281,7 +303,7 @@ func TestCheckRole(t *testing.T) {
 	var linus = map[string]interface{}{"name": "linus", "roles": []string{"boy", "musician"}}
 	res, err = mapper.MapToChannelsAndAccess(parse(`{"role": "girl"}`), `{}`, linus)
 	assertNoError(t, err, "MapToChannelsAndAccess failed")
-	assert.DeepEquals(t, res.Rejection, base.HTTPErrorf(403, "missing role"))
+	assert.DeepEquals(t, res.Rejection, &base.RejectionError{Status: 403, Message: "missing role", Check: "requireRole"})
 
 	res, err = mapper.MapToChannelsAndAccess(parse(`{"role": "girl"}`), `{}`, nil)
 	assertNoError(t, err, "MapToChannelsAndAccess failed")
@@ -301,7 +323,7 @@ func TestCheckRoleArray(t *testing.T) {
 	var linus = map[string]interface{}{"name": "linus", "roles": []string{"boy", "musician"}}
 	res, err = mapper.MapToChannelsAndAccess(parse(`{"roles": ["girl"]}`), `{}`, linus)
 	assertNoError(t, err, "MapToChannelsAndAccess failed")
-	assert.DeepEquals(t, res.Rejection, base.HTTPErrorf(403, "missing role"))
+	assert.DeepEquals(t, res.Rejection, &base.RejectionError{Status: 403, Message: "missing role", Check: "requireRole"})
 
 	res, err = mapper.MapToChannelsAndAccess(parse(`{"roles": ["girl"]}`), `{}`, nil)
 	assertNoError(t, err, "MapToChannelsAndAccess failed")
@@ -321,7 +343,7 @@ func TestCheckAccess(t *testing.T) {
 	var linus = map[string]interface{}{"name": "linus", "roles": []string{"boy", "musician"}, "channels": []string{"party", "school"}}
 	res, err = mapper.MapToChannelsAndAccess(parse(`{"channel": "work"}`), `{}`, linus)
 	assertNoError(t, err, "MapToChannelsAndAccess failed")
-	assert.DeepEquals(t, res.Rejection, base.HTTPErrorf(403, "missing channel access"))
+	assert.DeepEquals(t, res.Rejection, &base.RejectionError{Status: 403, Message: "missing channel access", Check: "requireAccess"})
 
 	res, err = mapper.MapToChannelsAndAccess(parse(`{"channel": "magic"}`), `{}`, nil)
 	assertNoError(t, err, "MapToChannelsAndAccess failed")
@@ -341,7 +363,7 @@ func TestCheckAccessArray(t *testing.T) {
 	var linus = map[string]interface{}{"name": "linus", "roles": []string{"boy", "musician"}, "channels": []string{"party", "school"}}
 	res, err = mapper.MapToChannelsAndAccess(parse(`{"channels": ["work"]}`), `{}`, linus)
 	assertNoError(t, err, "MapToChannelsAndAccess failed")
-	assert.DeepEquals(t, res.Rejection, base.HTTPErrorf(403, "missing channel access"))
+	assert.DeepEquals(t, res.Rejection, &base.RejectionError{Status: 403, Message: "missing channel access", Check: "requireAccess"})
 
 	res, err = mapper.MapToChannelsAndAccess(parse(`{"channels": ["magic"]}`), `{}`, nil)
 	assertNoError(t, err, "MapToChannelsAndAccess failed")
@@ -67,24 +67,24 @@ const funcWrapper = `
 
 		function requireUser(names) {
 			if (!haveUser(names))
-				throw({forbidden: "wrong user"});
+				throw({forbidden: "wrong user", check: "requireUser"});
 		}
 
 		function requireRole(roles) {
 			if (!haveRole(roles))
-				throw({forbidden: "missing role"});
+				throw({forbidden: "missing role", check: "requireRole"});
 		}
 
 		function requireAccess(channels) {
 			if (!haveAccess(channels))
-				throw({forbidden: "missing channel access"});
+				throw({forbidden: "missing channel access", check: "requireAccess"});
 		}
 
 		try {
 			v(newDoc, oldDoc);
 		} catch(x) {
 			if (x.forbidden)
-				reject(403, x.forbidden);
+				reject(403, x.forbidden, x.check);
 			else if (x.unauthorized)
 				reject(401, x.unauthorized);
 			else
@@ -137,7 +137,12 @@ func NewSyncRunner(funcSource string) (*SyncRunner, error) {
 				if len(call.ArgumentList) > 1 {
 					message = call.Argument(1).String()
 				}
-				runner.output.Rejection = base.HTTPErrorf(int(status), message)
+				if check := call.Argument(2); check.IsString() {
+					runner.output.Rejection = &base.RejectionError{Status: int(status), Message: message,
+						Check: check.String()}
+				} else {
+					runner.output.Rejection = base.HTTPErrorf(int(status), message)
+				}
 			}
 		}
 		return otto.UndefinedValue()
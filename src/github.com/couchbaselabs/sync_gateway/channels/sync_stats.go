@@ -0,0 +1,88 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package channels
+
+import (
+	"expvar"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/couchbaselabs/sync_gateway/base"
+)
+
+// Maximum number of distinct rejection reasons to track; any others are lumped together.
+const kMaxRejectionReasons = 100
+
+// Aggregate statistics about sync function calls, published at /_expvar as "syncGateway_syncFn".
+var (
+	syncFnExpvars       = expvar.NewMap("syncGateway_syncFn")
+	syncFnDurations     = new(expvar.Map).Init() // Histogram of call durations
+	syncFnChannelCounts = new(expvar.Map).Init() // Histogram of # of channels assigned per call
+	syncFnRejections    = new(expvar.Map).Init() // Count of each distinct rejection status+reason
+	numRejectionReasons int32
+)
+
+func init() {
+	syncFnExpvars.Set("durations", syncFnDurations)
+	syncFnExpvars.Set("channel_counts", syncFnChannelCounts)
+	syncFnExpvars.Set("rejections", syncFnRejections)
+}
+
+// Records the results of a single call of a sync function that began at 'start'.
+func recordSyncFnCall(start time.Time, output *ChannelMapperOutput, err error) {
+	duration := time.Since(start)
+	syncFnExpvars.Add("calls", 1)
+	syncFnExpvars.Add("total_time_ns", int64(duration))
+	syncFnDurations.Add(durationBucket(duration), 1)
+	if err != nil {
+		syncFnExpvars.Add("errors", 1)
+		return
+	}
+	syncFnChannelCounts.Add(countBucket(len(output.Channels)), 1)
+	if output.Rejection != nil {
+		status, message := base.ErrorAsHTTPStatus(output.Rejection)
+		reason := fmt.Sprintf("%d %s", status, message)
+		if syncFnRejections.Get(reason) == nil {
+			if atomic.AddInt32(&numRejectionReasons, 1) > kMaxRejectionReasons {
+				reason = "(other)"
+			}
+		}
+		syncFnRejections.Add(reason, 1)
+	}
+}
+
+func durationBucket(duration time.Duration) string {
+	switch {
+	case duration < time.Millisecond:
+		return "<1ms"
+	case duration < 10*time.Millisecond:
+		return "<10ms"
+	case duration < 100*time.Millisecond:
+		return "<100ms"
+	case duration < time.Second:
+		return "<1s"
+	default:
+		return ">=1s"
+	}
+}
+
+func countBucket(count int) string {
+	switch {
+	case count <= 1:
+		return fmt.Sprintf("%d", count)
+	case count <= 5:
+		return "2-5"
+	case count <= 20:
+		return "6-20"
+	default:
+		return ">20"
+	}
+}
@@ -0,0 +1,264 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/couchbaselabs/sync_gateway/base"
+)
+
+// Max number of documents that can be written in one atomic update
+const MaxAtomicWriteDocs = 25
+
+// An atomic update whose intent log is older than this is assumed to have been interrupted
+// (by a crash) and will be rolled back by RecoverAtomicWrites.
+var AtomicWriteTimeout = time.Minute
+
+// Key prefix of atomic-update intent logs
+const kAtomicWriteKeyPrefix = kSyncKeyPrefix + "atomic:"
+
+// Key of the doc that lists the IDs of the atomic updates in progress
+const kAtomicWriteRegistryKey = kSyncKeyPrefix + "atomic_writes"
+
+// The intent log of an atomic update, saved before any of its documents are written and
+// updated after each one, so that an interrupted update can be undone. While it exists, changes
+// feeds stop short of HoldSeq, which is lower than any of the update's sequences, so that none
+// of its revisions show up before all of them are in (or have been rolled back.)
+type atomicWriteLog struct {
+	Started time.Time        `json:"started"`
+	HoldSeq uint64           `json:"hold_seq,omitempty"`
+	Docs    []atomicWriteDoc `json:"docs"`
+}
+
+// Caches the intent logs of the atomic updates in progress, keyed by log key, so that finding
+// the hold sequence only means reading the registry. Only each log's Started and HoldSeq are
+// kept, and those never change once the log is saved.
+type atomicWriteLogCache struct {
+	lock sync.Mutex
+	logs map[string]atomicWriteLog
+}
+
+type atomicWriteDoc struct {
+	ID       string `json:"id"`
+	PrevRev  string `json:"prev_rev,omitempty"`  // Current revision before the update
+	PrevBody Body   `json:"prev_body,omitempty"` // Its body (nil if the doc was missing or deleted)
+	NewRev   string `json:"new_rev,omitempty"`   // Revision written by the update
+}
+
+// Writes a set of documents all-or-nothing. Each body must have an "_id", and a "_rev" matching
+// the doc's current revision if it exists. If any write fails, the ones already made are undone
+// by adding revisions that restore the previous bodies, and the error is returned.
+func (db *Database) AtomicUpdate(docs []Body) ([]string, error) {
+	if len(docs) > MaxAtomicWriteDocs {
+		return nil, base.HTTPErrorf(http.StatusBadRequest,
+			"Too many docs for an atomic update (max %d)", MaxAtomicWriteDocs)
+	}
+
+	// First check all the docs' current revisions, and save what's needed to roll back:
+	log := atomicWriteLog{Started: time.Now(), Docs: make([]atomicWriteDoc, len(docs))}
+	seen := map[string]bool{}
+	for i, body := range docs {
+		docid, _ := body["_id"].(string)
+		if docid == "" || realDocID(docid) == "" {
+			return nil, base.HTTPErrorf(http.StatusBadRequest, "Atomic update needs a valid _id in every doc")
+		} else if seen[docid] {
+			return nil, base.HTTPErrorf(http.StatusBadRequest, "Doc %q appears twice in atomic update", docid)
+		}
+		seen[docid] = true
+		entry := atomicWriteDoc{ID: docid}
+		doc, err := db.GetDoc(docid)
+		if err != nil && !base.IsDocNotFoundError(err) {
+			return nil, err
+		}
+		matchRev, _ := body["_rev"].(string)
+		if doc != nil {
+			entry.PrevRev = doc.CurrentRev
+			if !doc.Deleted {
+				if matchRev != doc.CurrentRev {
+					return nil, db.conflictError(doc, matchRev, "Document revision conflict")
+				}
+				// Include attachment bodies, in case the new revision doesn't keep them:
+				if entry.PrevBody, err = db.GetRev(docid, doc.CurrentRev, false, []string{}); err != nil {
+					return nil, err
+				}
+			}
+		} else if matchRev != "" {
+			return nil, base.HTTPErrorf(http.StatusNotFound, "No previous revision to replace")
+		}
+		log.Docs[i] = entry
+	}
+
+	// Record the intent log, then make the writes, updating the log after each one:
+	var err error
+	if log.HoldSeq, err = db.sequences.nextSequence(); err != nil {
+		return nil, err
+	}
+	logKey := kAtomicWriteKeyPrefix + base.CreateUUID()
+	if err := db.Bucket.Set(logKey, 0, log); err != nil {
+		return nil, err
+	}
+	if err := db.updateAtomicWriteRegistry(logKey, true); err != nil {
+		db.Bucket.Delete(logKey)
+		return nil, err
+	}
+	revids := make([]string, len(docs))
+	for i, body := range docs {
+		if revids[i], err = db.Put(log.Docs[i].ID, body); err != nil {
+			base.LogTo("CRUD", "Atomic update failed writing %q (%v); rolling back", log.Docs[i].ID, err)
+			break
+		}
+		log.Docs[i].NewRev = revids[i]
+		if err = db.Bucket.Set(logKey, 0, log); err != nil {
+			break
+		}
+	}
+	if err != nil {
+		if rollbackErr := db.rollBackAtomicWrite(&log); rollbackErr != nil {
+			// Keep the intent log, so RecoverAtomicWrites can finish the job later:
+			db.Bucket.Set(logKey, 0, log)
+			return nil, base.HTTPErrorf(http.StatusInternalServerError,
+				"Atomic update failed (%v) and couldn't be rolled back: %v", err, rollbackErr)
+		}
+	}
+	db.Bucket.Delete(logKey)
+	db.updateAtomicWriteRegistry(logKey, false)
+	if err != nil {
+		return nil, err
+	}
+	return revids, nil
+}
+
+// Undoes the writes recorded in an intent log, by adding a revision restoring each doc's
+// previous body (or deleting it, if it didn't exist.) Each doc rolled back has its NewRev
+// cleared in the log. Returns the first error, after trying all the docs.
+func (db *Database) rollBackAtomicWrite(log *atomicWriteLog) error {
+	var firstErr error
+	for i, entry := range log.Docs {
+		if entry.NewRev == "" {
+			continue
+		}
+		var err error
+		if entry.PrevBody != nil {
+			body := entry.PrevBody.ShallowCopy()
+			body["_rev"] = entry.NewRev
+			delete(body, "_revisions")
+			_, err = db.Put(entry.ID, body)
+		} else {
+			_, err = db.DeleteDoc(entry.ID, entry.NewRev)
+		}
+		if err != nil {
+			base.Warn("Couldn't roll back atomic update of %q to %q: %v", entry.ID, entry.PrevRev, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		} else {
+			log.Docs[i].NewRev = ""
+		}
+	}
+	return firstErr
+}
+
+// Returns the lowest HoldSeq of the atomic updates in progress, or 0 if there are none. Logs
+// older than AtomicWriteTimeout are ignored, so an interrupted update can't hold feeds forever.
+func (context *DatabaseContext) atomicWriteHoldSeq() uint64 {
+	var keys []string
+	if err := context.Bucket.Get(kAtomicWriteRegistryKey, &keys); err != nil {
+		return 0
+	}
+	cache := &context.atomicWriteLogs
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	logs := make(map[string]atomicWriteLog, len(keys))
+	var holdSeq uint64
+	for _, logKey := range keys {
+		log, found := cache.logs[logKey]
+		if !found {
+			if context.Bucket.Get(logKey, &log) != nil {
+				continue
+			}
+			log.Docs = nil
+		}
+		logs[logKey] = log
+		if time.Since(log.Started) >= AtomicWriteTimeout {
+			continue
+		}
+		if log.HoldSeq > 0 && (holdSeq == 0 || log.HoldSeq < holdSeq) {
+			holdSeq = log.HoldSeq
+		}
+	}
+	cache.logs = logs
+	return holdSeq
+}
+
+// Adds or removes an intent log's key in the registry of atomic updates in progress.
+func (db *Database) updateAtomicWriteRegistry(logKey string, add bool) error {
+	return db.Bucket.Update(kAtomicWriteRegistryKey, 0, func(current []byte) ([]byte, error) {
+		var keys []string
+		if current != nil {
+			if err := json.Unmarshal(current, &keys); err != nil {
+				return nil, err
+			}
+		}
+		updated := make([]string, 0, len(keys)+1)
+		for _, key := range keys {
+			if key != logKey {
+				updated = append(updated, key)
+			}
+		}
+		if add {
+			updated = append(updated, logKey)
+		}
+		return json.Marshal(updated)
+	})
+}
+
+// Rolls back any atomic updates that were interrupted, i.e. whose intent logs have been around
+// longer than AtomicWriteTimeout. This runs at startup, and periodically from the sweeper. A write that happened just before the crash, too late to be
+// recorded in the log, is recognized by the doc's current revision being a child of PrevRev.
+func (context *DatabaseContext) RecoverAtomicWrites() {
+	var keys []string
+	if err := context.Bucket.Get(kAtomicWriteRegistryKey, &keys); err != nil {
+		if !base.IsDocNotFoundError(err) {
+			base.Warn("Couldn't read atomic update registry: %v", err)
+		}
+		return
+	}
+	db := &Database{DatabaseContext: context}
+	for _, logKey := range keys {
+		var log atomicWriteLog
+		if err := context.Bucket.Get(logKey, &log); err != nil {
+			if base.IsDocNotFoundError(err) {
+				db.updateAtomicWriteRegistry(logKey, false)
+			}
+			continue
+		} else if time.Since(log.Started) < AtomicWriteTimeout {
+			continue // may still be in progress on another node
+		}
+		base.Log("Rolling back interrupted atomic update %s", logKey)
+		for i, entry := range log.Docs {
+			if entry.NewRev == "" {
+				if doc, _ := db.GetDoc(entry.ID); doc != nil && doc.CurrentRev != entry.PrevRev &&
+					doc.History[doc.CurrentRev].Parent == entry.PrevRev {
+					log.Docs[i].NewRev = doc.CurrentRev
+				}
+			}
+		}
+		if err := db.rollBackAtomicWrite(&log); err != nil {
+			context.Bucket.Set(logKey, 0, log) // Try the rest again next time
+			continue
+		}
+		context.Bucket.Delete(logKey)
+		db.updateAtomicWriteRegistry(logKey, false)
+	}
+}
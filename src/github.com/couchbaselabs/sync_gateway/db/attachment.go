@@ -23,6 +23,7 @@ import (
 	"net/http"
 	"net/textproto"
 	"strings"
+	"time"
 
 	"github.com/couchbaselabs/sync_gateway/base"
 )
@@ -125,6 +126,8 @@ func (db *Database) GetAttachment(key AttachmentKey) ([]byte, error) {
 // Stores a base64-encoded attachment and returns the key to get it by.
 func (db *Database) setAttachment(attachment []byte) (AttachmentKey, error) {
 	key := AttachmentKey(sha1DigestKey(attachment))
+	// Before adding, so that vacuuming can't delete an existing copy after this returns:
+	db.attachmentOrphans.forget(attachmentKeyToString(key))
 	_, err := db.Bucket.AddRaw(attachmentKeyToString(key), 0, attachment)
 	if err == nil {
 		base.LogTo("Attach", "\tAdded attachment %q", key)
@@ -385,8 +388,25 @@ func hasInlineAttachments(body Body) bool {
 	return false
 }
 
+// Adds the keys of the attachments in a revision body to a set.
+func addAttachmentKeys(body Body, keys map[AttachmentKey]bool) {
+	for _, value := range BodyAttachments(body) {
+		if meta, ok := value.(map[string]interface{}); ok {
+			if digest, ok := meta["digest"].(string); ok {
+				keys[AttachmentKey(digest)] = true
+			}
+		}
+	}
+}
+
+// Prefix of the keys of attachment bodies in the bucket
+const kAttachmentKeyPrefix = "_sync:att:"
+
+// How long an attachment must have been unreferenced before vacuuming deletes it
+var AttachmentOrphanGracePeriod = 10 * time.Minute
+
 func attachmentKeyToString(key AttachmentKey) string {
-	return "_sync:att:" + string(key)
+	return kAttachmentKeyPrefix + string(key)
 }
 
 func decodeAttachment(att interface{}) ([]byte, error) {
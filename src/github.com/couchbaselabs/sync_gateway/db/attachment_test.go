@@ -14,6 +14,7 @@ import (
 	"fmt"
 	"log"
 	"testing"
+	"time"
 
 	"github.com/couchbaselabs/go.assert"
 )
@@ -90,3 +91,57 @@ func TestAttachments(t *testing.T) {
 	assertNoError(t, err, "Couldn't get document")
 	assert.Equals(t, tojson(gotbody), rev3output)
 }
+
+func TestVacuumAttachments(t *testing.T) {
+	context, err := NewDatabaseContext("db", testBucket(), false)
+	assertNoError(t, err, "Couldn't create context for database 'db'")
+	defer context.Close()
+	db, err := CreateDatabase(context)
+	assertNoError(t, err, "Couldn't create database 'db'")
+
+	rev1input := `{"_attachments": {"hello.txt": {"data":"aGVsbG8gd29ybGQ="},
+                                    "bye.txt": {"data":"Z29vZGJ5ZSBjcnVlbCB3b3JsZA=="}}}`
+	rev1, err := db.Put("doc1", unjson(rev1input))
+	assertNoError(t, err, "Couldn't create document")
+	_, err = db.Put("doc1", unjson(`{"_rev": "`+rev1+`", "_attachments": {"bye.txt": {}}}`))
+	assertNoError(t, err, "Couldn't update document")
+	_, err = db.setAttachment([]byte("orphan"))
+	assertNoError(t, err, "Couldn't add attachment")
+
+	// An orphan isn't deleted until it's been unreferenced for the grace period:
+	count, _, err := db.VacuumAttachments()
+	assertNoError(t, err, "Vacuum failed")
+	assert.Equals(t, count, 0)
+	defer func(grace time.Duration) { AttachmentOrphanGracePeriod = grace }(AttachmentOrphanGracePeriod)
+	AttachmentOrphanGracePeriod = time.Nanosecond
+
+	// ...and the grace period starts over when the attachment is stored again:
+	_, err = db.setAttachment([]byte("orphan"))
+	assertNoError(t, err, "Couldn't add attachment")
+	count, _, err = db.VacuumAttachments()
+	assertNoError(t, err, "Vacuum failed")
+	assert.Equals(t, count, 0)
+
+	// Only the orphan goes; hello.txt is still used by the old revision:
+	time.Sleep(time.Millisecond)
+	count, size, err := db.VacuumAttachments()
+	assertNoError(t, err, "Vacuum failed")
+	assert.Equals(t, count, 1)
+	assert.Equals(t, size, 6)
+
+	// Once old revisions are compacted away, hello.txt is orphaned too:
+	_, err = db.Compact()
+	assertNoError(t, err, "Compact failed")
+	db.VacuumAttachments()
+	time.Sleep(time.Millisecond)
+	count, size, err = db.VacuumAttachments()
+	assertNoError(t, err, "Vacuum failed")
+	assert.Equals(t, count, 1)
+	assert.Equals(t, size, 11)
+
+	gotbody, err := db.GetRev("doc1", "", false, []string{})
+	assertNoError(t, err, "Couldn't get document")
+	atts := BodyAttachments(gotbody)
+	assert.Equals(t, len(atts), 1)
+	assert.Equals(t, atts["bye.txt"].(map[string]interface{})["digest"], "sha1-l+N7VpXGnoxMm8xfvtWPbz2YvDc=")
+}
@@ -0,0 +1,200 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"bytes"
+	"net/http"
+
+	"github.com/couchbaselabs/walrus"
+	"github.com/robertkrimen/otto"
+
+	"github.com/couchbaselabs/sync_gateway/base"
+)
+
+// An edit to apply to many documents at once (see Database.BulkUpdate). Exactly one of
+// Transform and Merge must be given.
+type BulkUpdate struct {
+	Transform string   `json:"transform,omitempty"` // JS fn(doc) returning the new body, or null to skip
+	Merge     Body     `json:"merge,omitempty"`     // JSON merge patch (RFC 7386) to apply
+	DocIDs    []string `json:"doc_ids,omitempty"`   // Only update these docs
+	Channels  []string `json:"channels,omitempty"`  // Only update docs in any of these channels
+	DryRun    bool     `json:"dry_run,omitempty"`   // Just count the docs that would change
+}
+
+// The outcome of a BulkUpdate.
+type BulkUpdateResult struct {
+	Matched int               `json:"matched"`          // Docs selected by the doc_ids/channels
+	Changed int               `json:"changed"`          // Docs given a new revision (or that would be)
+	DryRun  bool              `json:"dry_run"`          // If true, nothing was actually saved
+	Errors  map[string]string `json:"errors,omitempty"` // Docs that couldn't be updated, by ID
+}
+
+// Number of JS runners (and Otto contexts) for a bulk-update transform to cache
+const kBulkUpdateTaskCacheSize = 4
+
+// A JavaScript function that's called with a document's body and returns its new body,
+// or null/undefined to leave the document alone.
+type bulkUpdateFunction struct {
+	*walrus.JSServer // "Superclass"
+}
+
+func newBulkUpdateFunction(fnSource string) (*bulkUpdateFunction, error) {
+	if _, err := walrus.NewJSRunner(fnSource); err != nil { // Check that it compiles
+		return nil, base.HTTPErrorf(http.StatusBadRequest, "Invalid transform function: %v", err)
+	}
+	return &bulkUpdateFunction{
+		JSServer: walrus.NewJSServer(fnSource, kBulkUpdateTaskCacheSize,
+			func(fnSource string) (walrus.JSServerTask, error) {
+				runner, err := walrus.NewJSRunner(fnSource)
+				if err != nil {
+					return nil, err
+				}
+				runner.After = func(result otto.Value, err error) (interface{}, error) {
+					if err != nil || result.IsNull() || result.IsUndefined() {
+						return nil, err
+					} else if !result.IsObject() {
+						return nil, base.HTTPErrorf(http.StatusBadRequest,
+							"Transform function must return an object or null")
+					}
+					return result.Export()
+				}
+				return runner, nil
+			}),
+	}, nil
+}
+
+func (fn *bulkUpdateFunction) transform(body Body) (Body, error) {
+	result, err := fn.Call(map[string]interface{}(body))
+	if err != nil {
+		return nil, err
+	}
+	newBody, _ := result.(map[string]interface{})
+	return newBody, nil
+}
+
+// Edits every selected (non-deleted) document by a JS transform function or a JSON merge
+// patch, saving each changed one as a new revision. This goes through the regular Put path,
+// so the sync function is run on every new revision just as if a client had saved it.
+// Admin-only.
+func (db *Database) BulkUpdate(update BulkUpdate) (*BulkUpdateResult, error) {
+	if db.user != nil {
+		return nil, base.HTTPErrorf(http.StatusForbidden, "Only the admin can do bulk updates")
+	} else if (update.Transform == "") == (update.Merge == nil) {
+		return nil, base.HTTPErrorf(http.StatusBadRequest, "Need either a transform or a merge")
+	}
+	var fn *bulkUpdateFunction
+	if update.Transform != "" {
+		var err error
+		if fn, err = newBulkUpdateFunction(update.Transform); err != nil {
+			return nil, err
+		}
+	}
+
+	docIDs := update.DocIDs
+	if docIDs == nil {
+		vres, err := db.queryAllDocs(false)
+		if err != nil {
+			return nil, err
+		}
+		docIDs = make([]string, 0, len(vres.Rows))
+		for _, row := range vres.Rows {
+			docIDs = append(docIDs, row.ID)
+		}
+	}
+
+	result := &BulkUpdateResult{DryRun: update.DryRun, Errors: map[string]string{}}
+	for _, docid := range docIDs {
+		doc, err := db.GetDoc(docid)
+		if err != nil || doc.History[doc.CurrentRev].Deleted || !doc.inAnyChannel(update.Channels) {
+			continue
+		}
+		body, err := db.Get(docid)
+		if err != nil {
+			continue
+		}
+		result.Matched++
+
+		oldBody := stripSpecialProperties(body)
+		var newBody Body
+		if fn != nil {
+			input := stripSpecialProperties(body)
+			input["_id"] = docid
+			newBody, err = fn.transform(input)
+		} else {
+			newBody = mergePatch(oldBody, update.Merge)
+		}
+		if err != nil {
+			result.Errors[docid] = err.Error()
+			continue
+		} else if newBody == nil {
+			continue
+		}
+		newBody = stripSpecialProperties(newBody)
+		if bytes.Equal(canonicalEncoding(newBody), canonicalEncoding(oldBody)) {
+			continue
+		}
+
+		if !update.DryRun {
+			newBody["_rev"] = body["_rev"]
+			if _, err := db.Put(docid, newBody); err != nil {
+				result.Errors[docid] = err.Error()
+				continue
+			}
+		}
+		result.Changed++
+	}
+	base.Log("Bulk update of %q: %d docs matched, %d changed (dry_run=%v), %d errors",
+		db.Name, result.Matched, result.Changed, update.DryRun, len(result.Errors))
+	if len(result.Errors) == 0 {
+		result.Errors = nil
+	}
+	return result, nil
+}
+
+// Is the doc currently in any of the channels? An empty list matches every doc.
+func (doc *document) inAnyChannel(channelNames []string) bool {
+	if len(channelNames) == 0 {
+		return true
+	}
+	for _, name := range channelNames {
+		if removal, found := doc.Channels[name]; found && removal == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Applies a JSON merge patch (RFC 7386) to a body, returning a new body: null values remove
+// properties, nested objects are merged recursively, and anything else replaces the existing
+// value. The target isn't modified, since it may share nested objects with cached revisions.
+func mergePatch(target map[string]interface{}, patch map[string]interface{}) map[string]interface{} {
+	result := make(map[string]interface{}, len(target)+len(patch))
+	for key, value := range target {
+		result[key] = value
+	}
+	for key, value := range patch {
+		if value == nil {
+			delete(result, key)
+		} else if subPatch, ok := value.(map[string]interface{}); ok {
+			var subTarget map[string]interface{}
+			switch sub := result[key].(type) {
+			case map[string]interface{}:
+				subTarget = sub
+			case Body:
+				subTarget = sub
+			}
+			result[key] = mergePatch(subTarget, subPatch)
+		} else {
+			result[key] = value
+		}
+	}
+	return result
+}
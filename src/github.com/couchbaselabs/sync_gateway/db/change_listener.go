@@ -18,8 +18,10 @@ type changeListener struct {
 	tapNotifier      *sync.Cond           // Posts notifications when documents are updated
 	counter          uint64               // Event counter; increments on every doc update
 	keyCounts        map[string]uint64    // Latest count at which each doc key was updated
+	watchedDocs      map[string]int       // Doc IDs being watched, with number of watchers
 	DocChannel       chan walrus.TapEvent // Passthru channel for doc mutations
 	OnChannelChanged func(channelName string, channelLog []byte)
+	pause            pauseSwitch // Stops consumption of the tap feed while paused
 }
 
 // Starts a changeListener on a given Bucket.
@@ -33,6 +35,7 @@ func (listener *changeListener) Start(bucket base.Bucket, trackDocs bool) error
 	listener.tapFeed = tapFeed
 	listener.counter = 1
 	listener.keyCounts = map[string]uint64{}
+	listener.watchedDocs = map[string]int{}
 	listener.tapNotifier = sync.NewCond(&sync.Mutex{})
 	if trackDocs {
 		listener.DocChannel = make(chan walrus.TapEvent, 100)
@@ -47,6 +50,10 @@ func (listener *changeListener) Start(bucket base.Bucket, trackDocs bool) error
 			}
 		}()
 		for event := range tapFeed.Events() {
+			listener.pause.waitWhilePaused()
+			if base.ChaosDropFeedEvent() {
+				continue
+			}
 			if event.Opcode == walrus.TapMutation || event.Opcode == walrus.TapDeletion {
 				key := string(event.Key)
 				if strings.HasPrefix(key, kChannelLogKeyPrefix) {
@@ -59,10 +66,13 @@ func (listener *changeListener) Start(bucket base.Bucket, trackDocs bool) error
 					}
 					listener.notify(key)
 				} else if strings.HasPrefix(key, auth.UserKeyPrefix) ||
-					strings.HasPrefix(key, auth.RoleKeyPrefix) {
+					strings.HasPrefix(key, auth.RoleKeyPrefix) || key == kAtomicWriteRegistryKey {
 					listener.notify(key)
-				} else if trackDocs && !strings.HasPrefix(key, kSyncKeyPrefix) {
-					listener.DocChannel <- event
+				} else if !strings.HasPrefix(key, kSyncKeyPrefix) {
+					listener.notifyIfWatched(key)
+					if trackDocs {
+						listener.DocChannel <- event
+					}
 				}
 			}
 		}
@@ -75,6 +85,7 @@ func (listener *changeListener) Stop() {
 	if listener.tapFeed != nil {
 		listener.tapFeed.Close()
 	}
+	listener.pause.setPaused(false) // lets the goroutine see the feed has closed
 }
 
 // Changes the counter, notifying waiting clients.
@@ -93,6 +104,17 @@ func (listener *changeListener) notify(key string) {
 	listener.tapNotifier.L.Unlock()
 }
 
+// Notifies waiting clients that a document changed, but only if someone's watching it.
+// (Doc keys aren't tracked otherwise, since keyCounts would grow without bound.)
+func (listener *changeListener) notifyIfWatched(docid string) {
+	listener.tapNotifier.L.Lock()
+	watched := listener.watchedDocs[docid] > 0
+	listener.tapNotifier.L.Unlock()
+	if watched {
+		listener.notify(docid)
+	}
+}
+
 // Waits until the counter exceeds the given value. Returns the new counter.
 func (listener *changeListener) Wait(keys []string, counter uint64) uint64 {
 	listener.tapNotifier.L.Lock()
@@ -146,6 +168,7 @@ func (listener *changeListener) NewWaiter(keys []string) *changeWaiter {
 
 func (listener *changeListener) NewWaiterWithChannels(chans base.Set, user auth.User) *changeWaiter {
 	waitKeys := make([]string, 0, 5)
+	waitKeys = append(waitKeys, kAtomicWriteRegistryKey) // Held changes are released
 	for channel, _ := range chans {
 		waitKeys = append(waitKeys, channelLogDocID(channel))
 	}
@@ -158,6 +181,25 @@ func (listener *changeListener) NewWaiterWithChannels(chans base.Set, user auth.
 	return listener.NewWaiter(waitKeys)
 }
 
+// Creates a new changeWaiter that will wait for changes to a single document.
+// When done with it, the caller must call unwatchDoc.
+func (listener *changeListener) NewDocWaiter(docid string) *changeWaiter {
+	listener.tapNotifier.L.Lock()
+	listener.watchedDocs[docid]++
+	listener.tapNotifier.L.Unlock()
+	return listener.NewWaiter([]string{docid})
+}
+
+// Balances a call to NewDocWaiter.
+func (listener *changeListener) unwatchDoc(docid string) {
+	listener.tapNotifier.L.Lock()
+	if listener.watchedDocs[docid]--; listener.watchedDocs[docid] <= 0 {
+		delete(listener.watchedDocs, docid)
+		delete(listener.keyCounts, docid)
+	}
+	listener.tapNotifier.L.Unlock()
+}
+
 // Waits for the changeListener's counter to change from the last time Wait() was called.
 func (waiter *changeWaiter) Wait() bool {
 	waiter.lastCounter = waiter.listener.Wait(waiter.keys, waiter.lastCounter)
@@ -12,6 +12,7 @@ package db
 import (
 	"encoding/json"
 	"math"
+	"sync"
 
 	"github.com/couchbaselabs/go-couchbase"
 
@@ -21,12 +22,13 @@ import (
 
 // Options for Database.getChanges
 type ChangesOptions struct {
-	Since       channels.TimedSet // maps channel -> last sequence # seen on it
+	Since       SequenceID // Where the client is in the feed
 	Limit       int
 	Conflicts   bool
 	IncludeDocs bool
 	Wait        bool
 	Continuous  bool
+	Collapse    bool      // Only return the latest change of each document
 	Terminator  chan bool // Caller can close this channel to terminate the feed
 }
 
@@ -66,32 +68,96 @@ type ViewResult struct {
 // Number of rows to query from the changes view at one time
 const kChangesViewPageSize = 1000
 
+// Number of channel-log entries whose docs are fetched together, for all_docs or include_docs
+const kChangesDocBatchSize = 100
+
+// Max number of docs getDocs fetches from the bucket at once
+const kDocFetchConcurrency = 8
+
+// Fills in a change's other leaf revisions (style=all_docs) and/or the body of the doc's
+// winning revision, with attachment stubs (include_docs). The leaves include the tombstones
+// conflict resolution added to losing branches, so a client that has one gets its deletion.
 func (db *Database) addDocToChangeEntry(doc *document, entry *ChangeEntry, includeDocs, includeConflicts bool) {
 	if doc != nil {
 		revID := entry.Changes[0]["rev"]
 		if includeConflicts {
+			losers := map[string]bool{}
+			for _, resolution := range doc.Resolutions {
+				for _, loser := range resolution.Losers {
+					losers[loser] = true
+				}
+			}
 			doc.History.forEachLeaf(func(leaf *RevInfo) {
-				if leaf.ID != revID && !leaf.Deleted {
+				if leaf.ID == revID {
+					return
+				} else if !leaf.Deleted {
 					entry.Changes = append(entry.Changes, ChangeRev{"rev": leaf.ID})
 					entry.Deleted = false
+				} else if losers[leaf.Parent] {
+					entry.Changes = append(entry.Changes, ChangeRev{"rev": leaf.ID})
 				}
 			})
 		}
 		if includeDocs {
 			var err error
-			entry.Doc, err = db.getRevFromDoc(doc, revID, false)
+			entry.Doc, err = db.getRevFromDoc(doc, doc.CurrentRev, false)
 			if err != nil {
-				base.Warn("Changes feed: error getting doc %q/%q: %v", doc.ID, revID, err)
+				base.Warn("Changes feed: error getting doc %q/%q: %v", doc.ID, doc.CurrentRev, err)
 			}
 		}
 	}
 }
 
-// Returns a list of all the changes made on a channel.
+// Is a channel-log entry for a doc that's in conflict, or whose conflict it resolved? Only
+// these entries can have other leaf revisions to list, so only their docs are fetched for
+// a style=all_docs feed.
+func hasConflictFlags(entry *channels.LogEntry) bool {
+	return entry.Flags&(channels.Conflict|channels.Resolved) != 0
+}
+
+// Loads the docs with the given IDs, several at a time; docs that can't be loaded are left out.
+// Used to fill in a batch of changes (or view rows) without waiting on a round trip to the
+// bucket for each one in turn.
+func (db *Database) getDocs(docIDs []string) map[string]*document {
+	docs := make(map[string]*document, len(docIDs))
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	ids := make(chan string, len(docIDs))
+	for _, docID := range docIDs {
+		ids <- docID
+	}
+	close(ids)
+	workers := kDocFetchConcurrency
+	if len(docIDs) < workers {
+		workers = len(docIDs)
+	}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for docID := range ids {
+				doc, err := db.GetDoc(docID)
+				if err != nil {
+					if !base.IsDocNotFoundError(err) {
+						base.Warn("Error getting doc %q: %v", docID, err)
+					}
+					continue
+				}
+				lock.Lock()
+				docs[docID] = doc
+				lock.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return docs
+}
+
+// Returns a list of all the changes made on a channel after the log entry with sequence 'since',
+// skipping any with sequences up to 'minSeq'.
 // Does NOT handle the Wait option. Does NOT check authorization.
-func (db *Database) changesFeed(channel string, options ChangesOptions) (<-chan *ChangeEntry, error) {
+func (db *Database) changesFeed(channel string, since, minSeq uint64, options ChangesOptions) (<-chan *ChangeEntry, error) {
 	dbExpvars.Add("channelChangesFeeds", 1)
-	since := options.Since[channel]
 	channelLog, err := db.changesWriter.getChangeLog(channel, since)
 	if err != nil {
 		base.Warn("Error reading channel-log %q (using view instead): %v", channel, err)
@@ -110,7 +176,7 @@ func (db *Database) changesFeed(channel string, options ChangesOptions) (<-chan
 			upToSeq = channelLog.Since
 		}
 		// Channel log may not go back far enough, so also fetch view-based change feed:
-		viewFeed, err = db.changesFeedFromView(channel, options, upToSeq)
+		viewFeed, err = db.changesFeedFromView(channel, since, options, upToSeq)
 		if err != nil {
 			return nil, err
 		}
@@ -163,41 +229,75 @@ func (db *Database) changesFeed(channel string, options ChangesOptions) (<-chan
 			}
 		}
 
-		// Now write each log entry to the 'feed' channel in turn:
-		for _, logEntry := range log {
-			if !options.Conflicts && (logEntry.Flags&channels.Hidden) != 0 {
-				//continue  // FIX: had to comment this out.
-				// This entry is shadowed by a conflicting one. We would like to skip it.
-				// The problem is that if this is the newest revision of this doc, then the
-				// doc will appear under this sequence # in the changes view, which means
-				// we won't emit the doc at all because we already stopped emitting entries
-				// from the view before this point.
-			}
-			change := ChangeEntry{
-				seqNo:   logEntry.Sequence,
-				ID:      logEntry.DocID,
-				Deleted: (logEntry.Flags & channels.Deleted) != 0,
-				Changes: []ChangeRev{{"rev": logEntry.RevID}},
+		// In collapse mode, find the last entry of each doc so the earlier ones can be skipped:
+		var lastIndex map[string]int
+		if options.Collapse {
+			lastIndex = make(map[string]int, len(log))
+			for i, logEntry := range log {
+				lastIndex[logEntry.DocID] = i
 			}
-			conflict := options.Conflicts && (logEntry.Flags&channels.Conflict) != 0
-			if logEntry.Flags&channels.Removed != 0 {
-				change.Removed = channels.SetOf(channel)
-			} else if options.IncludeDocs || conflict {
-				doc, _ := db.GetDoc(logEntry.DocID)
-				db.addDocToChangeEntry(doc, &change, options.IncludeDocs, conflict)
+		}
+
+		// Now write the log entries to the 'feed' channel, a batch at a time. If they need
+		// docs, all the docs of a batch are fetched together before any of it is written.
+		// Without include_docs, only entries flagged as in or resolving a conflict need one.
+		batch := make([]*ChangeEntry, 0, kChangesDocBatchSize)
+		remaining := options.Limit
+		for i := 0; i < len(log) && (options.Limit == 0 || remaining > 0); {
+			batch = batch[0:0]
+			var docIDs []string
+			listLeaves := map[*ChangeEntry]bool{} // changes with docs to fetch -> all_docs?
+			for ; i < len(log) && len(batch) < kChangesDocBatchSize; i++ {
+				logEntry := log[i]
+				if lastIndex != nil && lastIndex[logEntry.DocID] != i {
+					continue // superseded by a later entry
+				} else if logEntry.Sequence <= minSeq {
+					continue // client has already seen everything up to minSeq
+				}
+				if !options.Conflicts && (logEntry.Flags&channels.Hidden) != 0 {
+					//continue  // FIX: had to comment this out.
+					// This entry is shadowed by a conflicting one. We would like to skip it.
+					// The problem is that if this is the newest revision of this doc, then the
+					// doc will appear under this sequence # in the changes view, which means
+					// we won't emit the doc at all because we already stopped emitting entries
+					// from the view before this point.
+				}
+				change := &ChangeEntry{
+					seqNo:   logEntry.Sequence,
+					ID:      logEntry.DocID,
+					Deleted: (logEntry.Flags & channels.Deleted) != 0,
+					Changes: []ChangeRev{{"rev": logEntry.RevID}},
+				}
+				if logEntry.Flags&channels.Removed != 0 {
+					change.Removed = channels.SetOf(channel)
+				} else if conflict := options.Conflicts && hasConflictFlags(logEntry); conflict || options.IncludeDocs {
+					docIDs = append(docIDs, logEntry.DocID)
+					listLeaves[change] = conflict
+				}
+				batch = append(batch, change)
+				if options.Limit > 0 {
+					if remaining--; remaining == 0 {
+						break
+					}
+				}
 			}
 
-			select {
-			case <-options.Terminator:
-				base.LogTo("Changes+", "Aborting changesFeed")
-				return
-			case feed <- &change:
+			if len(docIDs) > 0 {
+				docs := db.getDocs(base.MergeStringArrays(docIDs))
+				dbExpvars.Add("changesDocBatches", 1)
+				for _, change := range batch {
+					if conflict, ok := listLeaves[change]; ok {
+						db.addDocToChangeEntry(docs[change.ID], change, options.IncludeDocs, conflict)
+					}
+				}
 			}
 
-			if options.Limit > 0 {
-				options.Limit--
-				if options.Limit == 0 {
-					break
+			for _, change := range batch {
+				select {
+				case <-options.Terminator:
+					base.LogTo("Changes+", "Aborting changesFeed")
+					return
+				case feed <- change:
 				}
 			}
 		}
@@ -207,15 +307,17 @@ func (db *Database) changesFeed(channel string, options ChangesOptions) (<-chan
 
 // Returns a list of all the changes made on a channel, reading from a view instead of the
 // channel log. This will include all historical changes, but may omit very recent ones.
-func (db *Database) changesFeedFromView(channel string, options ChangesOptions, upToSeq uint64) (<-chan *ChangeEntry, error) {
+func (db *Database) changesFeedFromView(channel string, since uint64, options ChangesOptions, upToSeq uint64) (<-chan *ChangeEntry, error) {
 	dbExpvars.Add("channelChangesViewQueries", 1)
 	base.LogTo("Changes", "Getting 'changes' view for channel %q %#v", channel, options)
-	since := options.Since[channel]
 	endkey := []interface{}{channel, upToSeq}
 	if upToSeq == 0 {
 		endkey[1] = map[string]interface{}{} // infinity
 	}
 	totalLimit := options.Limit
+	if options.Collapse {
+		totalLimit = 0 // The limit applies after collapsing, so superseded rows can't count
+	}
 	usingDocs := options.Conflicts || options.IncludeDocs
 	opts := Body{"stale": false, "update_seq": true,
 		"endkey":       endkey,
@@ -303,6 +405,27 @@ func (db *Database) changesFeedFromView(channel string, options ChangesOptions,
 	return feed, nil
 }
 
+// Filters the "*" channel's feed for a user with excluded channels, since being able to see
+// "*" doesn't then imply being able to see every document.
+func (db *Database) filterExcludedChanges(feed <-chan *ChangeEntry, terminator chan bool) <-chan *ChangeEntry {
+	output := make(chan *ChangeEntry, 5)
+	go func() {
+		defer close(output)
+		for entry := range feed {
+			doc, _ := db.GetDoc(entry.ID)
+			if db.authorizeDoc(doc, entry.Changes[0]["rev"]) != nil {
+				continue
+			}
+			select {
+			case <-terminator:
+				return
+			case output <- entry:
+			}
+		}
+	}()
+	return output
+}
+
 // Returns the (ordered) union of all of the changes made to multiple channels.
 func (db *Database) MultiChangesFeed(chans base.Set, options ChangesOptions) (<-chan *ChangeEntry, error) {
 	if len(chans) == 0 {
@@ -315,15 +438,27 @@ func (db *Database) MultiChangesFeed(chans base.Set, options ChangesOptions) (<-
 		options.Wait = false
 		changeWaiter = db.tapListener.NewWaiterWithChannels(chans, db.user)
 	}
-	if options.Since == nil {
-		options.Since = channels.TimedSet{}
+	if options.Since.Channels == nil {
+		options.Since.Channels = channels.TimedSet{}
+	}
+
+	var collapsed *collapsedChanges
+	if options.Collapse {
+		collapsed = &collapsedChanges{}
 	}
 
+	options.Since = db.checkSinceForRollback(options.Since)
+
+	// On a first sync, the priority channels get a pass of their own before the rest:
+	firstSync := options.Since.LowSeq == 0 && len(options.Since.Channels) == 0
+
 	output := make(chan *ChangeEntry, kChangesViewPageSize)
 	go func() {
 		defer close(output)
 
 		// This loop is used to re-run the fetch after every database change, in Wait mode
+		var sentSomething bool
+		var prioritySent map[string]uint64 // Docs sent in the priority pass -> sequence
 	outer:
 		for {
 			// Restrict to available channels, expand wild-card, and find since when these channels
@@ -334,25 +469,39 @@ func (db *Database) MultiChangesFeed(chans base.Set, options ChangesOptions) (<-
 			} else {
 				channelsSince = channels.AtSequence(chans, 1)
 			}
+			priorityPass := false
+			if firstSync {
+				firstSync = false
+				if prioritySince := db.priorityChannelsSince(chans, channelsSince); prioritySince != nil {
+					channelsSince = prioritySince
+					priorityPass = true
+					prioritySent = map[string]uint64{}
+				}
+			}
 			base.LogTo("Changes", "MultiChangesFeed: channels expand to %s ...", channelsSince)
 
 			// Populate the parallel arrays of channels and names:
 			feeds := make([]<-chan *ChangeEntry, 0, len(channelsSince))
 			names := make([]string, 0, len(channelsSince))
-			for name, _ := range channelsSince {
-				feed, err := db.changesFeed(name, options)
+			for name, grantedAt := range channelsSince {
+				since, minSeq := options.Since.channelStart(name, grantedAt)
+				feed, err := db.changesFeed(name, since, minSeq, options)
 				if err != nil {
 					base.Warn("MultiChangesFeed got error reading changes feed %q: %v", name, err)
 					return
 				}
+				if name == "*" && db.user != nil && db.user.HasChannelExclusions() {
+					feed = db.filterExcludedChanges(feed, options.Terminator)
+				}
 				feeds = append(feeds, feed)
 				names = append(names, name)
 			}
 			current := make([]*ChangeEntry, len(feeds))
+			clientSeq := options.Since.maxSeq() // changes before this that get sent are backfills
+			holdSeq := db.atomicWriteHoldSeq()
 
 			// This loop reads the available entries from all the feeds in parallel, merges them,
 			// and writes them to the output channel:
-			var sentSomething bool
 			for {
 				//FIX: This assumes Reverse or Limit aren't set in the options
 				// Read more entries to fill up the current[] array:
@@ -377,15 +526,27 @@ func (db *Database) MultiChangesFeed(chans base.Set, options ChangesOptions) (<-
 				}
 				if minEntry == nil {
 					break // Exit the loop when there are no more entries
+				} else if holdSeq > 0 && minSeq >= holdSeq {
+					// Part of (or after) an atomic update in progress; leave it for a later pass:
+					for i, cur := range current {
+						if cur != nil && cur.seqNo == minSeq {
+							current[i] = nil
+						}
+					}
+					continue
 				}
 
 				// Clear the current entries for the sequence just sent:
+				seqID := SequenceID{LowSeq: options.Since.LowSeq, Channels: options.Since.Channels}
 				for i, cur := range current {
 					if cur != nil && cur.seqNo == minSeq {
 						current[i] = nil
-						// Update the public sequence ID and encode it into the entry:
-						options.Since[names[i]] = minSeq
-						cur.Seq = options.Since.String()
+						// Update the public sequence ID:
+						options.Since.Channels[names[i]] = minSeq
+						if grantedAt := channelsSince[names[i]]; minSeq < clientSeq && (grantedAt > clientSeq ||
+							grantedAt == options.Since.TriggeredBy) {
+							seqID.TriggeredBy = grantedAt // backfilling a newly granted channel
+						}
 						cur.seqNo = 0
 						// Also concatenate the matching entries' Removed arrays:
 						if cur != minEntry && cur.Removed != nil {
@@ -398,6 +559,22 @@ func (db *Database) MultiChangesFeed(chans base.Set, options ChangesOptions) (<-
 					}
 				}
 
+				minEntry.Seq = seqID.String()
+
+				// Don't send a change twice if it's also in a non-priority channel:
+				if priorityPass {
+					prioritySent[minEntry.ID] = minSeq
+				} else if prioritySent != nil && prioritySent[minEntry.ID] == minSeq {
+					continue
+				}
+
+				sentSomething = true
+				if collapsed != nil {
+					// Hold onto the entry until all of this pass's changes have been read:
+					collapsed.add(minEntry)
+					continue
+				}
+
 				// Send the entry, and repeat the loop:
 				base.LogTo("Changes+", "MultiChangesFeed sending %+v", minEntry)
 				select {
@@ -405,8 +582,8 @@ func (db *Database) MultiChangesFeed(chans base.Set, options ChangesOptions) (<-
 					base.LogTo("Changes+", "Aborting MultiChangesFeed")
 					return
 				case output <- minEntry:
+					db.recordDocSent()
 				}
-				sentSomething = true
 
 				// Stop when we hit the limit (if any):
 				if options.Limit > 0 {
@@ -417,6 +594,30 @@ func (db *Database) MultiChangesFeed(chans base.Set, options ChangesOptions) (<-
 				}
 			}
 
+			if collapsed != nil {
+				// Now send the latest change of each doc, in sequence order:
+				for _, entry := range collapsed.flush() {
+					base.LogTo("Changes+", "MultiChangesFeed sending %+v", entry)
+					select {
+					case <-options.Terminator:
+						base.LogTo("Changes+", "Aborting MultiChangesFeed")
+						return
+					case output <- entry:
+						db.recordDocSent()
+					}
+					if options.Limit > 0 {
+						options.Limit--
+						if options.Limit == 0 {
+							break outer
+						}
+					}
+				}
+			}
+
+			if priorityPass {
+				continue // Now go on to the rest of the channels
+			}
+			prioritySent = nil
 			if !options.Continuous && (sentSomething || changeWaiter == nil) {
 				break
 			}
@@ -442,6 +643,67 @@ func (db *Database) MultiChangesFeed(chans base.Set, options ChangesOptions) (<-
 	return output, nil
 }
 
+// Returns the subset of a changes feed's channels that are among the database's
+// PriorityChannels, annotated with when the user got access to them. Returns nil if the feed
+// has no priority channels, or has nothing but.
+func (db *Database) priorityChannelsSince(chans base.Set, channelsSince channels.TimedSet) channels.TimedSet {
+	var names []string
+	for name := range db.PriorityChannels {
+		if chans.Contains(name) || chans.Contains("*") {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	requested := base.SetFromArray(names)
+	var prioritySince channels.TimedSet
+	if db.user != nil {
+		prioritySince = db.user.FilterToAvailableChannels(requested)
+	} else {
+		prioritySince = channels.AtSequence(requested, 1)
+	}
+	if len(prioritySince) == 0 {
+		return nil
+	}
+	for name := range channelsSince {
+		if _, found := prioritySince[name]; !found {
+			return prioritySince
+		}
+	}
+	return nil
+}
+
+// Accumulates change entries, keeping only the latest one of each document.
+type collapsedChanges struct {
+	entries []*ChangeEntry
+	index   map[string]int // maps doc ID -> index in entries
+}
+
+func (c *collapsedChanges) add(entry *ChangeEntry) {
+	if c.index == nil {
+		c.index = map[string]int{}
+	}
+	if i, found := c.index[entry.ID]; found {
+		c.entries[i] = nil
+	}
+	c.index[entry.ID] = len(c.entries)
+	c.entries = append(c.entries, entry)
+}
+
+// Returns the surviving entries in the order they were added, and empties the receiver.
+func (c *collapsedChanges) flush() []*ChangeEntry {
+	result := make([]*ChangeEntry, 0, len(c.index))
+	for _, entry := range c.entries {
+		if entry != nil {
+			result = append(result, entry)
+		}
+	}
+	c.entries = nil
+	c.index = nil
+	return result
+}
+
 // Synchronous convenience function that returns all changes as a simple array.
 func (db *Database) GetChanges(channels base.Set, options ChangesOptions) ([]*ChangeEntry, error) {
 	options.Terminator = make(chan bool)
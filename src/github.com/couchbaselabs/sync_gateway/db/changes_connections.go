@@ -0,0 +1,140 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/couchbaselabs/sync_gateway/base"
+)
+
+// An open _changes feed request, as listed by the admin API.
+type ChangesConnection struct {
+	ID        uint64    `json:"id"`
+	User      string    `json:"user,omitempty"` // Empty for the admin API
+	Feed      string    `json:"feed"`
+	Channels  []string  `json:"channels"`
+	Since     string    `json:"since"`
+	StartTime time.Time `json:"start_time"`
+	Duration  float64   `json:"duration_secs"` // Filled in by ChangesConnections()
+
+	// Closed when the feed ends or is terminated; use it as the ChangesOptions.Terminator.
+	Terminator chan bool `json:"-"`
+
+	waiting   bool // Is this a longpoll/continuous feed, which counts against the limit?
+	closeOnce sync.Once
+}
+
+// The set of a database's open _changes feeds
+type changesConnections struct {
+	lock    sync.Mutex
+	active  map[uint64]*ChangesConnection
+	lastID  uint64
+	waiting int // Number of active connections that are waiting feeds
+}
+
+func (conn *ChangesConnection) terminate() {
+	conn.closeOnce.Do(func() { close(conn.Terminator) })
+}
+
+// Registers a new _changes feed. Feeds that wait for changes (longpoll, continuous or
+// websocket) are limited to MaxContinuousChanges at a time; past that a 503 error is returned.
+func (context *DatabaseContext) OpenChangesConnection(conn *ChangesConnection, waiting bool) error {
+	conns := &context.changesConnections
+	conns.lock.Lock()
+	defer conns.lock.Unlock()
+	if waiting && context.MaxContinuousChanges > 0 && conns.waiting >= context.MaxContinuousChanges {
+		base.Warn("Database %q reached its limit of %d waiting _changes feeds",
+			context.Name, context.MaxContinuousChanges)
+		return base.HTTPErrorf(http.StatusServiceUnavailable, "Too many _changes feeds")
+	}
+	if conns.active == nil {
+		conns.active = map[uint64]*ChangesConnection{}
+	}
+	conns.lastID++
+	conn.ID = conns.lastID
+	conn.StartTime = time.Now()
+	conn.Terminator = make(chan bool)
+	conn.waiting = waiting
+	conns.active[conn.ID] = conn
+	if waiting {
+		conns.waiting++
+	}
+	return nil
+}
+
+// Unregisters a _changes feed when its request finishes, closing its Terminator.
+func (context *DatabaseContext) CloseChangesConnection(conn *ChangesConnection) {
+	conns := &context.changesConnections
+	conns.lock.Lock()
+	defer conns.lock.Unlock()
+	if conns.active[conn.ID] == conn {
+		delete(conns.active, conn.ID)
+		if conn.waiting {
+			conns.waiting--
+		}
+	}
+	conn.terminate()
+}
+
+// Returns a snapshot of the open _changes feeds, in the order they were opened.
+func (context *DatabaseContext) ChangesConnections() []*ChangesConnection {
+	conns := &context.changesConnections
+	conns.lock.Lock()
+	defer conns.lock.Unlock()
+	result := make([]*ChangesConnection, 0, len(conns.active))
+	for _, conn := range conns.active {
+		result = append(result, &ChangesConnection{
+			ID:        conn.ID,
+			User:      conn.User,
+			Feed:      conn.Feed,
+			Channels:  conn.Channels,
+			Since:     conn.Since,
+			StartTime: conn.StartTime,
+			Duration:  time.Since(conn.StartTime).Seconds(),
+		})
+	}
+	sort.Sort(changesConnectionsByID(result))
+	return result
+}
+
+// Ends an open _changes feed. Returns false if there's no feed with that ID.
+func (context *DatabaseContext) TerminateChangesConnection(id uint64) bool {
+	conns := &context.changesConnections
+	conns.lock.Lock()
+	conn := conns.active[id]
+	conns.lock.Unlock()
+	if conn == nil {
+		return false
+	}
+	base.Log("Terminating _changes feed #%d of user %q", id, conn.User)
+	conn.terminate()
+	return true
+}
+
+// Ends every open _changes feed, as when the server is shutting down. Returns the number ended.
+func (context *DatabaseContext) TerminateAllChangesConnections() int {
+	conns := &context.changesConnections
+	conns.lock.Lock()
+	defer conns.lock.Unlock()
+	for _, conn := range conns.active {
+		conn.terminate()
+	}
+	return len(conns.active)
+}
+
+type changesConnectionsByID []*ChangesConnection
+
+func (c changesConnectionsByID) Len() int           { return len(c) }
+func (c changesConnectionsByID) Less(i, j int) bool { return c[i].ID < c[j].ID }
+func (c changesConnectionsByID) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
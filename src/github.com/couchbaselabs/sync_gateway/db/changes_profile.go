@@ -0,0 +1,84 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"net/http"
+
+	"github.com/couchbaselabs/sync_gateway/base"
+	"github.com/couchbaselabs/sync_gateway/channels"
+)
+
+// A named set of changes-feed options defined in the database config, which clients can ask
+// for by name ("_changes?profile=inbox") instead of specifying the options themselves.
+// The profile's settings take precedence over any the client also specifies.
+type ChangesProfile struct {
+	Channels    []string `json:"channels,omitempty"`     // Channels to filter by (default: all the user can access)
+	Style       string   `json:"style,omitempty"`        // "main_only" (default) or "all_docs"
+	IncludeDocs bool     `json:"include_docs,omitempty"` // Put doc bodies in the entries?
+	Collapse    bool     `json:"collapse,omitempty"`     // Only return the latest change of each doc?
+	Limit       int      `json:"limit,omitempty"`        // Max number of entries; caps the client's limit
+}
+
+func (profile *ChangesProfile) validate() error {
+	if profile.Channels != nil {
+		if set, err := channels.SetFromArray(profile.Channels, channels.ExpandStar); err != nil {
+			return err
+		} else if len(set) == 0 {
+			return base.HTTPErrorf(http.StatusBadRequest, "Empty channel list")
+		}
+	}
+	if profile.Style != "" && profile.Style != "main_only" && profile.Style != "all_docs" {
+		return base.HTTPErrorf(http.StatusBadRequest, "Invalid style %q", profile.Style)
+	}
+	if profile.Limit < 0 {
+		return base.HTTPErrorf(http.StatusBadRequest, "Invalid limit %d", profile.Limit)
+	}
+	return nil
+}
+
+// Applies the profile to options a client requested. Returns the channels to filter by,
+// which are the profile's if it has any, otherwise the given ones.
+func (profile *ChangesProfile) Apply(options *ChangesOptions, channelNames []string) []string {
+	if profile.Style != "" {
+		options.Conflicts = (profile.Style == "all_docs")
+	}
+	options.IncludeDocs = options.IncludeDocs || profile.IncludeDocs
+	options.Collapse = options.Collapse || profile.Collapse
+	if profile.Limit > 0 && (options.Limit <= 0 || options.Limit > profile.Limit) {
+		options.Limit = profile.Limit
+	}
+	if profile.Channels != nil {
+		channelNames = profile.Channels
+	}
+	return channelNames
+}
+
+// Sets the database's named changes profiles, after checking that they're valid.
+func (context *DatabaseContext) SetChangesProfiles(profiles map[string]*ChangesProfile) error {
+	for name, profile := range profiles {
+		if profile == nil {
+			return base.HTTPErrorf(http.StatusBadRequest, "Changes profile %q is empty", name)
+		} else if err := profile.validate(); err != nil {
+			return base.HTTPErrorf(http.StatusBadRequest, "Invalid changes profile %q: %v", name, err)
+		}
+	}
+	context.changesProfiles = profiles
+	return nil
+}
+
+// Returns the changes profile with the given name, or a 404 error if there isn't one.
+func (context *DatabaseContext) GetChangesProfile(name string) (*ChangesProfile, error) {
+	profile := context.changesProfiles[name]
+	if profile == nil {
+		return nil, base.HTTPErrorf(http.StatusNotFound, "No such changes profile %q", name)
+	}
+	return profile, nil
+}
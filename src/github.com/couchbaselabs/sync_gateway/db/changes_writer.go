@@ -236,7 +236,7 @@ func (c *channelLogWriter) addChangeLog_(log *channels.ChangeLog) (added bool, e
 			c.channelName, log.Len())
 	} else {
 		base.LogTo("ChannelLog", "Didn't add channel-log %q with %d entries (err=%v)",
-			c.channelName, log.Len())
+			c.channelName, log.Len(), err)
 	}
 	return
 }
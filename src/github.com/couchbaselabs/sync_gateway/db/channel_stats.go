@@ -0,0 +1,156 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"sort"
+
+	"github.com/couchbaselabs/sync_gateway/auth"
+	"github.com/couchbaselabs/sync_gateway/base"
+)
+
+// Diagnostic information about a channel, as returned by the admin _channels API.
+type ChannelStats struct {
+	Name         string   `json:"name"`
+	DocCount     int      `json:"doc_count"`       // Docs currently in the channel
+	DeletedCount int      `json:"deleted_count"`   // Deleted docs (tombstones) in the channel
+	RemovedCount int      `json:"removed_count"`   // Docs that have been removed from the channel
+	LastSeq      uint64   `json:"last_seq"`        // Latest sequence that affected the channel
+	Users        []string `json:"users,omitempty"` // Users who can see the channel
+	Roles        []string `json:"roles,omitempty"` // Roles that grant access to the channel
+}
+
+// A user or role, as loaded to find out who has access to channels
+type channelPrincipal struct {
+	principal auth.Principal
+	isUser    bool
+}
+
+// Returns the stats of one channel. A channel that has no docs isn't an error; its counts
+// are just zero.
+func (db *Database) ChannelStats(channel string) (*ChannelStats, error) {
+	stats, err := db.queryChannelStats([]interface{}{channel, 0}, []interface{}{channel, Body{}})
+	if err != nil {
+		return nil, err
+	}
+	principals, err := db.loadChannelPrincipals()
+	if err != nil {
+		return nil, err
+	}
+	result := stats[channel]
+	if result == nil {
+		result = &ChannelStats{Name: channel}
+	}
+	result.addAccess(principals)
+	return result, nil
+}
+
+// Returns the stats of every channel that has docs or that a user or role has access to,
+// sorted by name.
+func (db *Database) AllChannelStats() ([]*ChannelStats, error) {
+	stats, err := db.queryChannelStats(nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	delete(stats, "*") // The view's pseudo-channel of all docs
+	principals, err := db.loadChannelPrincipals()
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range principals {
+		for channel, _ := range p.principal.Channels() {
+			if channel != "*" && stats[channel] == nil {
+				stats[channel] = &ChannelStats{Name: channel}
+			}
+		}
+	}
+
+	names := make([]string, 0, len(stats))
+	for name, _ := range stats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	result := make([]*ChannelStats, 0, len(names))
+	for _, name := range names {
+		stats[name].addAccess(principals)
+		result = append(result, stats[name])
+	}
+	return result, nil
+}
+
+// Tallies the rows of the 'channels' view (optionally within a key range) by channel.
+// Every doc has exactly one row per channel it's in or has been removed from.
+func (db *Database) queryChannelStats(startkey, endkey interface{}) (map[string]*ChannelStats, error) {
+	opts := Body{"stale": false}
+	if startkey != nil {
+		opts["startkey"] = startkey
+		opts["endkey"] = endkey
+	}
+	var vres ViewResult
+	if err := db.Bucket.ViewCustom("sync_gateway", "channels", opts, &vres); err != nil {
+		base.Warn("Error from 'channels' view: %v", err)
+		return nil, err
+	}
+	stats := map[string]*ChannelStats{}
+	for _, row := range vres.Rows {
+		key := row.Key.([]interface{})
+		channel := key[0].(string)
+		sequence := uint64(key[1].(float64))
+		value := row.Value.([]interface{})
+		entry := stats[channel]
+		if entry == nil {
+			entry = &ChannelStats{Name: channel}
+			stats[channel] = entry
+		}
+		if len(value) >= 4 && value[3].(bool) {
+			entry.RemovedCount++
+		} else if len(value) >= 3 && value[2].(bool) {
+			entry.DeletedCount++
+		} else {
+			entry.DocCount++
+		}
+		if sequence > entry.LastSeq {
+			entry.LastSeq = sequence
+		}
+	}
+	return stats, nil
+}
+
+func (db *Database) loadChannelPrincipals() ([]channelPrincipal, error) {
+	userNames, roleNames, err := db.AllPrincipalIDs()
+	if err != nil {
+		return nil, err
+	}
+	authenticator := db.Authenticator()
+	principals := make([]channelPrincipal, 0, len(userNames)+len(roleNames))
+	for _, name := range userNames {
+		if user, err := authenticator.GetUser(name); err == nil && user != nil {
+			principals = append(principals, channelPrincipal{user, true})
+		}
+	}
+	for _, name := range roleNames {
+		if role, err := authenticator.GetRole(name); err == nil && role != nil {
+			principals = append(principals, channelPrincipal{role, false})
+		}
+	}
+	return principals, nil
+}
+
+func (stats *ChannelStats) addAccess(principals []channelPrincipal) {
+	for _, p := range principals {
+		if !p.principal.CanSeeChannel(stats.Name) {
+			continue
+		} else if p.isUser {
+			stats.Users = append(stats.Users, p.principal.Name())
+		} else {
+			stats.Roles = append(stats.Roles, p.principal.Name())
+		}
+	}
+}
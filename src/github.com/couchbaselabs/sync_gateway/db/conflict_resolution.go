@@ -0,0 +1,289 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/couchbaselabs/walrus"
+	"github.com/robertkrimen/otto"
+
+	"github.com/couchbaselabs/sync_gateway/base"
+)
+
+// How a database resolves a conflict when a write creates one.
+type ConflictPolicy string
+
+const (
+	ConflictPolicyLWW        = ConflictPolicy("lww")        // Latest timestamp property wins
+	ConflictPolicyRemoteWins = ConflictPolicy("remoteWins") // The incoming branch wins
+	ConflictPolicyLocalWins  = ConflictPolicy("localWins")  // The existing winner stays
+	ConflictPolicyCustom     = ConflictPolicy("custom")     // A JS function picks the winner
+)
+
+// Number of JS runners (and Otto contexts) for the resolver function to cache
+const kConflictResolverTaskCacheSize = 4
+
+// Number of resolutions kept in a document's syncData
+const kMaxConflictResolutions = 10
+
+// Decides which branch wins when a write puts a document in conflict. The losing branches are
+// tombstoned in the same write, so the document never appears in conflict.
+type ConflictResolver struct {
+	Policy            ConflictPolicy
+	TimestampProperty string                    // Body property compared by the lww policy
+	Function          *ConflictResolverFunction // Used by the custom policy
+}
+
+// A record, kept in the document's syncData, of a conflict that was resolved automatically.
+type ConflictResolution struct {
+	Policy ConflictPolicy `json:"policy"`
+	Winner string         `json:"winner"`
+	Losers []string       `json:"losers"` // Leaf revs that were tombstoned
+	Time   time.Time      `json:"time"`
+}
+
+// A JavaScript function that resolves a conflict. It's called with an array of the bodies of the
+// conflicting revisions, each with its "_rev" property, and returns the winner's revision ID (or
+// its body.) Returning null or nothing leaves the document in conflict. The array starts with
+// the revision that was current before the conflicting write, if it's still a leaf; the rest are
+// in descending order of generation, then digest.
+type ConflictResolverFunction struct {
+	*walrus.JSServer // "Superclass"
+}
+
+func NewConflictResolverFunction(fnSource string) *ConflictResolverFunction {
+	return &ConflictResolverFunction{
+		JSServer: walrus.NewJSServer(fnSource, kConflictResolverTaskCacheSize,
+			func(fnSource string) (walrus.JSServerTask, error) {
+				runner, err := walrus.NewJSRunner(fnSource)
+				if err != nil {
+					return nil, err
+				}
+				runner.After = func(result otto.Value, err error) (interface{}, error) {
+					if err != nil {
+						return nil, err
+					} else if result.IsString() {
+						return result.ToString()
+					} else if result.IsObject() {
+						exported, _ := result.Export()
+						if obj, ok := exported.(map[string]interface{}); ok {
+							revid, _ := obj["_rev"].(string)
+							return revid, nil
+						}
+					}
+					return "", nil
+				}
+				return runner, nil
+			}),
+	}
+}
+
+// Calls the function with the conflicting bodies; returns the winning revision ID, or "".
+func (fn *ConflictResolverFunction) ChooseWinner(conflicts []Body) (string, error) {
+	jsConflicts := make([]interface{}, len(conflicts))
+	for i, body := range conflicts {
+		jsConflicts[i] = map[string]interface{}(body)
+	}
+	result, err := fn.Call(jsConflicts)
+	if err != nil {
+		return "", err
+	}
+	return result.(string), nil
+}
+
+// Sets the database's conflict resolution policy. An empty policy, with no function, turns
+// automatic resolution off; a function with no policy implies "custom".
+func (context *DatabaseContext) ApplyConflictResolution(policy ConflictPolicy, timestampProperty, fnSource string) error {
+	if policy == "" && fnSource != "" {
+		policy = ConflictPolicyCustom
+	}
+	resolver := &ConflictResolver{Policy: policy, TimestampProperty: timestampProperty}
+	switch policy {
+	case "":
+		resolver = nil
+	case ConflictPolicyRemoteWins, ConflictPolicyLocalWins:
+	case ConflictPolicyLWW:
+		if timestampProperty == "" {
+			return base.HTTPErrorf(http.StatusBadRequest, "lww conflict resolution needs a timestamp_property")
+		}
+	case ConflictPolicyCustom:
+		if fnSource == "" {
+			return base.HTTPErrorf(http.StatusBadRequest, "custom conflict resolution needs a function")
+		}
+		if _, err := walrus.NewJSRunner(fnSource); err != nil { // Check that it compiles
+			base.Warn("Error setting conflict resolver function: %s", err)
+			return err
+		}
+		resolver.Function = NewConflictResolverFunction(fnSource)
+	default:
+		return base.HTTPErrorf(http.StatusBadRequest, "Unknown conflict resolution policy %q", policy)
+	}
+	context.ConflictResolver = resolver
+	return nil
+}
+
+// Returns the IDs of the tree's non-deleted leaf revisions, highest first (by compareRevIDs.)
+func (tree RevTree) liveLeaves() []string {
+	var leaves []string
+	tree.forEachLeaf(func(info *RevInfo) {
+		if !info.Deleted {
+			leaves = append(leaves, info.ID)
+		}
+	})
+	sort.Sort(sort.Reverse(revIDList(leaves)))
+	return leaves
+}
+
+// Called by updateDoc after newRevID has been added to the doc's history, but before the doc's
+// current revision is updated. If the new revision created a conflict (there are more live
+// leaves than priorLeaves), applies the database's policy: every live leaf but the winner is
+// given a deletion as a child, and the resolution is recorded in the doc. Returns the
+// tombstones' revision IDs.
+func (db *Database) resolveConflict(doc *document, newRevID string, newBody Body, priorLeaves []string) ([]string, error) {
+	resolver := db.ConflictResolver
+	if resolver == nil {
+		return nil, nil
+	}
+	leaves := doc.History.liveLeaves()
+	if len(leaves) < 2 || len(leaves) <= len(priorLeaves) {
+		return nil, nil
+	}
+
+	priorWinner := func() string {
+		winner := ""
+		for _, revid := range priorLeaves {
+			if revid == doc.CurrentRev {
+				return revid
+			} else if doc.History.isLeaf(revid) && compareRevIDs(revid, winner) > 0 {
+				winner = revid
+			}
+		}
+		return winner
+	}
+
+	var winner string
+	switch resolver.Policy {
+	case ConflictPolicyRemoteWins:
+		winner = newRevID
+	case ConflictPolicyLocalWins:
+		winner = priorWinner()
+	case ConflictPolicyLWW:
+		var latest float64
+		found := false
+		for _, revid := range leaves {
+			body := db.getLeafBody(doc, revid, newRevID, newBody)
+			stamp, ok := conflictTimestamp(body[resolver.TimestampProperty])
+			if ok && (!found || stamp > latest || (stamp == latest && compareRevIDs(revid, winner) > 0)) {
+				winner, latest, found = revid, stamp, true
+			}
+		}
+		if !found {
+			base.LogTo("CRUD+", "resolveConflict(%q): No leaf has a timestamp in %q",
+				doc.ID, resolver.TimestampProperty)
+			return nil, nil
+		}
+	case ConflictPolicyCustom:
+		ordered := make([]string, 0, len(leaves))
+		if doc.History.isLeaf(doc.CurrentRev) && !doc.History[doc.CurrentRev].Deleted {
+			ordered = append(ordered, doc.CurrentRev)
+		}
+		for _, revid := range leaves {
+			if revid != doc.CurrentRev {
+				ordered = append(ordered, revid)
+			}
+		}
+		conflicts := make([]Body, 0, len(ordered))
+		for _, revid := range ordered {
+			body := stripSpecialProperties(db.getLeafBody(doc, revid, newRevID, newBody))
+			delete(body, "_deleted")
+			body["_id"] = doc.ID
+			body["_rev"] = revid
+			conflicts = append(conflicts, body)
+		}
+		var err error
+		if winner, err = resolver.Function.ChooseWinner(conflicts); err != nil {
+			base.Warn("Conflict resolver fn exception: %+v; doc = %q", err, doc.ID)
+			return nil, base.HTTPErrorf(http.StatusInternalServerError, "Exception in JS conflict resolver function")
+		}
+	}
+	if winner == "" {
+		return nil, nil
+	} else if !doc.History.isLeaf(winner) || doc.History[winner].Deleted {
+		base.Warn("Conflict resolver fn returned %q, which isn't a conflicting rev of %q", winner, doc.ID)
+		return nil, nil
+	}
+
+	resolution := &ConflictResolution{Policy: resolver.Policy, Winner: winner, Time: time.Now().UTC()}
+	var tombstones []string
+	for _, revid := range leaves {
+		if revid == winner {
+			continue
+		}
+		generation, _ := parseRevID(revid)
+		deletion := Body{"_deleted": true}
+		tombstone := createRevID(generation+1, revid, deletion)
+		doc.History.addRevision(RevInfo{ID: tombstone, Parent: revid, Deleted: true})
+		bodyJSON, _ := json.Marshal(deletion)
+		doc.History.setRevisionBody(tombstone, bodyJSON)
+		resolution.Losers = append(resolution.Losers, revid)
+		tombstones = append(tombstones, tombstone)
+	}
+	doc.Resolutions = append(doc.Resolutions, resolution)
+	if n := len(doc.Resolutions); n > kMaxConflictResolutions {
+		doc.Resolutions = doc.Resolutions[n-kMaxConflictResolutions:]
+	}
+	base.LogTo("CRUD", "Resolved conflict in %q by %s policy: %q wins over %v",
+		doc.ID, resolver.Policy, winner, resolution.Losers)
+	dbExpvars.Add("conflicts_resolved", 1)
+	return tombstones, nil
+}
+
+// Returns the body of a leaf revision while updateDoc is adding newRevID, whose body isn't in the
+// doc yet.
+func (db *Database) getLeafBody(doc *document, revid, newRevID string, newBody Body) Body {
+	if revid == newRevID {
+		return newBody
+	} else if revid == doc.CurrentRev && doc.body != nil {
+		return doc.body
+	}
+	body := doc.History.getParsedRevisionBody(revid, db.loadRevBody)
+	if body == nil {
+		body = Body{}
+	}
+	return body
+}
+
+// Interprets the property compared by the lww policy: either a number, or an RFC 3339 date
+// string that's converted to milliseconds since the Unix epoch (the same as JavaScript's
+// Date.getTime.)
+func conflictTimestamp(value interface{}) (float64, bool) {
+	switch value := value.(type) {
+	case float64:
+		return value, true
+	case int:
+		return float64(value), true
+	case int64:
+		return float64(value), true
+	case uint64:
+		return float64(value), true
+	case json.Number:
+		f, err := value.Float64()
+		return f, err == nil
+	case string:
+		if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+			return float64(t.UnixNano()) / float64(time.Millisecond), true
+		}
+	}
+	return 0, false
+}
@@ -14,6 +14,7 @@ import (
 	"github.com/couchbaselabs/walrus"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/couchbaselabs/go-couchbase"
 
@@ -70,6 +71,111 @@ func (context *DatabaseContext) revCacheLoader(id IDAndRev) (body Body, history
 	return
 }
 
+// Returns the ID of the revision that was current as of a sequence number, so that a client can
+// read a mutually consistent set of documents. Returns a 404 error if the document didn't exist
+// yet, or a 409 error if that can't be determined. (The revision may have been deleted, or its
+// body may no longer be available.)
+func (db *Database) RevIDAtSequence(docid string, seq uint64) (string, error) {
+	doc, err := db.GetDoc(docid)
+	if doc == nil {
+		return "", err
+	} else if doc.Sequence <= seq {
+		return doc.CurrentRev, nil
+	} else if revid, err := doc.History.winningRevisionAsOf(seq); err != nil || revid != "" {
+		return revid, err
+	}
+	return "", base.HTTPErrorf(404, "missing")
+}
+
+// Returns the ID of the current revision of a document. This only looks at the doc's "_sync"
+// metadata, without unmarshaling its body, so it's much cheaper than Get.
+// Returns a 404 error if the document doesn't exist or is deleted.
+func (db *Database) GetCurrentRevID(docid string) (string, error) {
+	doc, err := db.getDocMetadata(docid)
+	if err != nil {
+		return "", err
+	} else if doc.Deleted {
+		return "", base.HTTPErrorf(404, "deleted")
+	}
+	return doc.CurrentRev, nil
+}
+
+// Loads a document's sync metadata, but not its body, and checks that the user can access it.
+func (db *Database) getDocMetadata(docid string) (*document, error) {
+	key := realDocID(docid)
+	if key == "" {
+		return nil, base.HTTPErrorf(400, "Invalid doc ID")
+	}
+	data, err := db.Bucket.GetRaw(key)
+	if err != nil {
+		return nil, err
+	}
+	root := documentRoot{SyncData: &syncData{History: make(RevTree)}}
+	if err := json.Unmarshal(data, &root); err != nil {
+		return nil, err
+	}
+	doc := &document{ID: docid}
+	if root.SyncData != nil {
+		doc.syncData = *root.SyncData
+	}
+	if !doc.hasValidSyncData() {
+		return nil, base.HTTPErrorf(404, "Not imported")
+	} else if err := db.authorizeDoc(doc, ""); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// Waits until the current revision of a document is something other than sinceRev, then
+// returns it. (The new revision may be a deletion; if the doc doesn't exist, which is the case
+// with sinceRev "", the result is "".) If the timeout expires first, returns sinceRev.
+func (db *Database) WaitForDocChange(docid, sinceRev string, timeout time.Duration) (string, error) {
+	type result struct {
+		revid string
+		err   error
+	}
+	results := make(chan result, 1)
+	done := make(chan bool)
+	waiter := db.tapListener.NewDocWaiter(docid)
+	go func() {
+		defer db.tapListener.unwatchDoc(docid)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			var revid string
+			doc, err := db.getDocMetadata(docid)
+			if err == nil {
+				revid = doc.CurrentRev
+			} else if base.IsDocNotFoundError(err) {
+				err = nil
+			}
+			if err != nil || revid != sinceRev {
+				results <- result{revid, err}
+				return
+			}
+			if !waiter.Wait() {
+				results <- result{sinceRev, nil} // listener stopped
+				return
+			}
+		}
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case r := <-results:
+		return r.revid, r.err
+	case <-timer.C:
+		// Wake up the goroutine so it can exit:
+		close(done)
+		db.tapListener.notifyIfWatched(docid)
+		return sinceRev, nil
+	}
+}
+
 // Returns the body of the current revision of a document
 func (db *Database) Get(docid string) (Body, error) {
 	return db.GetRev(docid, "", false, nil)
@@ -215,7 +321,7 @@ func (db *Database) authorizeDoc(doc *document, revid string) error {
 // This method adds the magic _id and _rev properties.
 func (db *DatabaseContext) getRevision(doc *document, revid string) (Body, error) {
 	var body Body
-	if body = doc.getRevision(revid); body == nil {
+	if body = doc.getRevision(revid, db.loadRevBody); body == nil {
 		// No inline body, so look for separate doc:
 		if !doc.History.contains(revid) {
 			return nil, base.HTTPErrorf(404, "missing")
@@ -235,7 +341,7 @@ func (db *DatabaseContext) getRevision(doc *document, revid string) (Body, error
 // If it's obsolete it will be loaded from the database if possible.
 // Does not add _id or _rev properties.
 func (db *Database) getRevisionJSON(doc *document, revid string) ([]byte, error) {
-	if body := doc.getRevisionJSON(revid); body != nil {
+	if body := doc.getRevisionJSON(revid, db.loadRevBody); body != nil {
 		return body, nil
 	} else if !doc.History.contains(revid) {
 		return nil, base.HTTPErrorf(404, "missing")
@@ -301,13 +407,13 @@ func (db *Database) backupAncestorRevs(doc *document, revid string) error {
 	for {
 		if revid = doc.History.getParent(revid); revid == "" {
 			return nil // No ancestors with JSON found
-		} else if json = doc.getRevisionJSON(revid); json != nil {
+		} else if json = doc.getRevisionJSON(revid, db.loadRevBody); json != nil {
 			break
 		}
 	}
 
 	// Store the JSON as a separate doc in the bucket:
-	if err := db.setOldRevisionJSON(doc.ID, revid, json); err != nil {
+	if err := db.setOldRevisionJSON(doc.ID, revid, doc.History.getParent(revid), json); err != nil {
 		// This isn't fatal since we haven't lost any information; just warn about it.
 		base.Warn("backupAncestorRevs failed: doc=%q rev=%q err=%v", doc.ID, revid, err)
 		return err
@@ -335,6 +441,7 @@ func (db *Database) initializeSyncData(doc *document) (err error) {
 	doc.History = make(RevTree)
 	doc.History.addRevision(RevInfo{ID: doc.CurrentRev, Parent: "", Deleted: false})
 	doc.Sequence, err = db.sequences.nextSequence()
+	doc.History[doc.CurrentRev].Sequence = doc.Sequence
 	return
 }
 
@@ -359,13 +466,13 @@ func (db *Database) Put(docid string, body Body) (string, error) {
 				// PUT with no parent rev given, but there is an existing current revision.
 				// This is OK as long as the current one is deleted.
 				if !doc.History[matchRev].Deleted {
-					return nil, base.HTTPErrorf(http.StatusConflict, "Document exists")
+					return nil, db.conflictError(doc, "", "Document exists")
 				}
 				generation, _ = parseRevID(matchRev)
 				generation++
 			}
 		} else if !doc.History.isLeaf(matchRev) {
-			return nil, base.HTTPErrorf(http.StatusConflict, "Document revision conflict")
+			return nil, db.conflictError(doc, matchRev, "Document revision conflict")
 		}
 
 		// Process the attachments, replacing bodies with digests. This alters 'body' so it has to
@@ -382,6 +489,22 @@ func (db *Database) Put(docid string, body Body) (string, error) {
 	})
 }
 
+// Creates the error returned when an update based on revid conflicts with the document. The error
+// identifies the deepest common ancestor of revid and the current revision, and includes its body
+// if that's still available, to help the client merge the two.
+func (db *Database) conflictError(doc *document, revid string, message string) error {
+	err := &base.ConflictError{Message: message, CurrentRev: doc.CurrentRev}
+	if revid != "" {
+		err.AncestorRev = doc.History.findCommonAncestor(revid, doc.CurrentRev)
+		if err.AncestorRev != "" {
+			if body, _ := db.getRevision(doc, err.AncestorRev); body != nil {
+				err.AncestorBody = body
+			}
+		}
+	}
+	return err
+}
+
 // Adds an existing revision to a document along with its history (list of rev IDs.)
 // This is equivalent to the "new_edits":false mode of CouchDB.
 func (db *Database) PutExistingRev(docid string, body Body, docHistory []string) error {
@@ -448,6 +571,7 @@ func (db *Database) updateDoc(docid string, allowImport bool, callback func(*doc
 	var changedPrincipals, changedRoleUsers []string
 	var docSequence uint64
 	var inConflict = false
+	var tombstones []string // Deletions added to losing branches by conflict resolution
 
 	err := db.Bucket.WriteUpdate(key, 0, func(currentValue []byte) (raw []byte, writeOpts walrus.WriteOptions, err error) {
 		// Be careful: this block can be invoked multiple times if there are races!
@@ -457,16 +581,29 @@ func (db *Database) updateDoc(docid string, allowImport bool, callback func(*doc
 			err = base.HTTPErrorf(409, "Not imported")
 			return
 		}
+		if err = db.checkDocLock(doc); err != nil {
+			return
+		}
 
 		// Invoke the callback to update the document and return a new revision body:
+		priorRevs := make(map[string]bool, len(doc.History))
+		for revid := range doc.History {
+			priorRevs[revid] = true
+		}
+		priorLeaves := doc.History.liveLeaves()
 		body, err = callback(doc)
 		if err != nil {
 			return
 		}
-
-		// Determine which is the current "winning" revision (it's not necessarily the new one):
 		newRevID = body["_rev"].(string)
 		parentRevID = doc.History[newRevID].Parent
+
+		// If the new revision created a conflict, the database's policy may resolve it:
+		if tombstones, err = db.resolveConflict(doc, newRevID, body, priorLeaves); err != nil {
+			return
+		}
+
+		// Determine which is the current "winning" revision (it's not necessarily the new one):
 		prevCurrentRev := doc.CurrentRev
 		doc.CurrentRev, inConflict = doc.History.winningRevision()
 		doc.Deleted = doc.History[doc.CurrentRev].Deleted
@@ -487,12 +624,16 @@ func (db *Database) updateDoc(docid string, allowImport bool, callback func(*doc
 			if doc.CurrentRev != prevCurrentRev {
 				// If the new revision is not current, transfer the current revision's
 				// body to the top level doc.body:
-				doc.body = doc.History.getParsedRevisionBody(doc.CurrentRev)
+				doc.body = doc.History.getParsedRevisionBody(doc.CurrentRev, db.loadRevBody)
 				doc.History.setRevisionBody(doc.CurrentRev, nil)
 			}
 		}
 
-		// Run the sync function, to validate the update and compute its channels/access:
+		// Check the new revision's shape, then run the sync function, to validate the update and
+		// compute its channels/access:
+		if err = db.validateDoc(doc.ID, body); err != nil {
+			return
+		}
 		body["_id"] = doc.ID
 		channels, access, roles, err := db.getChannelsAndAccess(doc, body, parentRevID)
 		if err != nil {
@@ -513,6 +654,12 @@ func (db *Database) updateDoc(docid string, allowImport bool, callback func(*doc
 			}
 		}
 		doc.Sequence = docSequence
+		for revid := newRevID; revid != "" && !priorRevs[revid]; revid = doc.History[revid].Parent {
+			doc.History[revid].Sequence = docSequence // (PutExistingRev may add ancestors too)
+		}
+		for _, revid := range tombstones {
+			doc.History[revid].Sequence = docSequence
+		}
 
 		if doc.CurrentRev != prevCurrentRev {
 			// Most of the time this update will change the doc's current rev. (The exception is
@@ -562,6 +709,12 @@ func (db *Database) updateDoc(docid string, allowImport bool, callback func(*doc
 			base.LogTo("CRUD+", "updateDoc(%q): Pruned %d old revisions", docid, pruned)
 		}
 
+		if db.ExternalRevBodies {
+			if err = db.externalizeRevBodies(doc); err != nil {
+				return
+			}
+		}
+
 		// Return the new raw document value for the bucket to store.
 		raw, err = json.Marshal(doc)
 		return
@@ -578,6 +731,7 @@ func (db *Database) updateDoc(docid string, allowImport bool, callback func(*doc
 	}
 
 	dbExpvars.Add("revs_added", 1)
+	db.recordDocWritten()
 
 	// Store the new revision in the cache
 	history := doc.History.getHistory(newRevID)
@@ -591,11 +745,10 @@ func (db *Database) updateDoc(docid string, allowImport bool, callback func(*doc
 	base.LogTo("CRUD", "Stored doc %q / %q", docid, newRevID)
 
 	// Mark affected users/roles as needing to recompute their channel access:
-	for _, name := range changedPrincipals {
-		db.invalUserOrRoleChannels(name)
-	}
-	for _, name := range changedRoleUsers {
-		db.invalUserRoles(name)
+	db.invalidatePrincipals(changedPrincipals, changedRoleUsers)
+
+	if strings.HasPrefix(docid, "_design/") && newRevID == doc.CurrentRev {
+		db.installDesignDoc(docid[len("_design/"):], body)
 	}
 
 	// Add the new revision to the change logs of all affected channels:
@@ -607,7 +760,16 @@ func (db *Database) updateDoc(docid string, allowImport bool, callback func(*doc
 	if doc.History[newRevID].Deleted {
 		newEntry.Flags |= channels.Deleted
 	}
-	if newRevID != doc.CurrentRev {
+	if len(tombstones) > 0 {
+		// A conflict was resolved, so log the winner, flagged so that style=all_docs feeds
+		// list the tombstones too, and clients that have the losing branches get them:
+		newEntry.RevID = doc.CurrentRev
+		newEntry.Flags = channels.Resolved
+		if doc.Deleted {
+			newEntry.Flags |= channels.Deleted
+		}
+		parentRevID = doc.History[doc.CurrentRev].Parent
+	} else if newRevID != doc.CurrentRev {
 		newEntry.Flags |= channels.Hidden
 	}
 	if inConflict {
@@ -619,18 +781,39 @@ func (db *Database) updateDoc(docid string, allowImport bool, callback func(*doc
 }
 
 // Creates a new document, assigning it a random doc ID.
+// If the body contains an "_id", that document is created or updated. Otherwise a new ID is
+// generated (from the DocIDTemplate if there is one), retrying if that ID is already taken.
 func (db *Database) Post(body Body) (string, string, error) {
+	if docid, ok := body["_id"].(string); ok && docid != "" {
+		rev, err := db.Put(docid, body)
+		if err != nil {
+			docid = ""
+		}
+		return docid, rev, err
+	}
 	if body["_rev"] != nil {
 		return "", "", base.HTTPErrorf(http.StatusNotFound, "No previous revision to replace")
 	}
-	docid := base.CreateUUID()
-	rev, err := db.Put(docid, body)
-	if err != nil {
-		docid = ""
+	for attempt := 1; ; attempt++ {
+		docid, canRetry, err := db.newDocID(body)
+		if err != nil {
+			return "", "", err
+		}
+		rev, err := db.Put(docid, body)
+		if err == nil {
+			return docid, rev, nil
+		}
+		if status, _ := base.ErrorAsHTTPStatus(err); status != http.StatusConflict ||
+			!canRetry || attempt >= kMaxPostDocIDAttempts {
+			return "", "", err
+		}
+		base.LogTo("CRUD", "Generated doc ID %q is already taken; trying another", docid)
 	}
-	return docid, rev, err
 }
 
+// Number of generated IDs Post will try before giving up
+const kMaxPostDocIDAttempts = 5
+
 // Deletes a document, by adding a new revision whose "_deleted" property is true.
 func (db *Database) DeleteDoc(docid string, revid string) (string, error) {
 	body := Body{"_deleted": true, "_rev": revid}
@@ -15,7 +15,9 @@ import (
 	"fmt"
 	"net/http"
 	"regexp"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/couchbaselabs/go-couchbase"
@@ -29,18 +31,42 @@ import (
 // Basic description of a database. Shared between all Database objects on the same database.
 // This object is thread-safe so it can be shared between HTTP handlers.
 type DatabaseContext struct {
-	Name               string                  // Database name
-	Bucket             base.Bucket             // Storage
-	tapListener        changeListener          // Listens on server Tap feed
-	sequences          *sequenceAllocator      // Source of new sequence numbers
-	ChannelMapper      *channels.ChannelMapper // Runs JS 'sync' function
-	changesWriter      *changesWriter          // Writes changes to the channel-log docs
-	StartTime          time.Time               // Timestamp when context was instantiated
-	ChangesClientStats Statistics              // Tracks stats of # of changes connections
-	RevsLimit          uint32                  // Max depth a document's revision tree can grow to
-	autoImport         bool                    // Add sync data to new untracked docs?
-	Shadower           *Shadower               // Tracks an external Couchbase bucket
-	revisionCache      *RevisionCache          // Cache of recently-accessed doc revisions
+	Name                 string                     // Database name
+	Bucket               base.Bucket                // Storage
+	tapListener          changeListener             // Listens on server Tap feed
+	sequences            *sequenceAllocator         // Source of new sequence numbers
+	ChannelMapper        *channels.ChannelMapper    // Runs JS 'sync' function
+	changesWriter        *changesWriter             // Writes changes to the channel-log docs
+	StartTime            time.Time                  // Timestamp when context was instantiated
+	instanceStartTime    int64                      // When the bucket's sync data was created (see instance.go)
+	instanceLock         sync.Mutex                 // Protects instanceStartTime
+	ChangesClientStats   Statistics                 // Tracks stats of # of changes connections
+	RevsLimit            uint32                     // Max depth a document's revision tree can grow to
+	autoImport           bool                       // Add sync data to new untracked docs?
+	Shadower             *Shadower                  // Tracks an external Couchbase bucket
+	revisionCache        *RevisionCache             // Cache of recently-accessed doc revisions
+	DocIDTemplate        *DocIDTemplate             // Generates IDs of POSTed docs (UUIDs if nil)
+	AtomicBulkDocs       bool                       // Allow atomic _bulk_docs on the public port?
+	resync               resyncState                // Tracks a resync, during which the db is offline
+	features             map[string]bool            // Optional features turned on/off by config
+	ImportFilter         *ImportFilterFunction      // Decides which untracked docs to import (nil = all)
+	changesProfiles      map[string]*ChangesProfile // Named sets of _changes options
+	changesConnections   changesConnections         // Open _changes feeds
+	MaxContinuousChanges int                        // Max concurrent waiting _changes feeds (0 = no limit)
+	ExternalRevBodies    bool                       // Store non-current rev bodies outside the RevTree?
+	revBodyOrphans       orphanedDocs               // Unreferenced rev-body docs compaction has seen
+	attachmentOrphans    orphanedDocs               // Unreferenced attachments vacuuming has seen
+	archiveLock          sync.RWMutex               // Held (shared) while archiving a revision
+	compacting           int                        // Number of Compact calls running (archiveLock)
+	atomicWriteLogs      atomicWriteLogCache        // Intent logs of atomic updates in progress
+	PriorityChannels     base.Set                   // Channels sent before all others on a first sync
+	sweeperStop          chan bool                  // Closing this stops the sweeper goroutine
+	meter                usageMeter                 // Usage in the current metering period
+	invalidations        invalidationBatcher        // Pools users/roles whose access changed
+	ValidationSchema     *DocSchema                 // Schema new revisions must match (nil = none)
+	ValidationFunction   *ValidationFunction        // JS fn new revisions must pass (nil = none)
+	ConflictResolver     *ConflictResolver          // Resolves conflicts as they're created (nil = don't)
+	StaticGrants         *auth.StaticGrants         // Channels & roles the config grants (nil = none)
 }
 
 const DefaultRevsLimit = 1000
@@ -100,6 +126,9 @@ func NewDatabaseContext(dbName string, bucket base.Bucket, autoImport bool) (*Da
 	if err != nil {
 		return nil, err
 	}
+	if context.instanceStartTime, err = loadInstanceStartTime(bucket); err != nil {
+		return nil, err
+	}
 
 	context.tapListener.OnChannelChanged = context.changesWriter.channelLogUpdated
 
@@ -111,6 +140,8 @@ func NewDatabaseContext(dbName string, bucket base.Bucket, autoImport bool) (*Da
 }
 
 func (context *DatabaseContext) Close() {
+	context.stopSweeper()
+	context.stopMetering()
 	context.tapListener.Stop()
 	context.Shadower.Stop()
 	context.changesWriter.checkpoint()
@@ -120,7 +151,9 @@ func (context *DatabaseContext) Close() {
 
 func (context *DatabaseContext) Authenticator() *auth.Authenticator {
 	// Authenticators are lightweight & stateless, so it's OK to return a new one every time
-	return auth.NewAuthenticator(context.Bucket, context)
+	authenticator := auth.NewAuthenticator(context.Bucket, context)
+	authenticator.SetStaticGrants(context.StaticGrants)
+	return authenticator
 }
 
 // Makes a Database object given its name and bucket.
@@ -294,7 +327,23 @@ type IDAndRev struct {
 
 // Returns all document IDs as an array.
 func (db *Database) AllDocIDs() ([]IDAndRev, error) {
-	vres, err := db.queryAllDocs(false)
+	return db.AllDocIDsInRange("", "", 0)
+}
+
+// Returns the IDs of documents whose IDs are in the range [startKey...endKey], in order.
+// An empty startKey or endKey leaves that end of the range open; a zero limit means no limit.
+func (db *Database) AllDocIDsInRange(startKey, endKey string, limit int) ([]IDAndRev, error) {
+	opts := Body{"stale": false, "reduce": false}
+	if startKey != "" {
+		opts["startkey"] = startKey
+	}
+	if endKey != "" {
+		opts["endkey"] = endKey
+	}
+	if limit > 0 {
+		opts["limit"] = limit
+	}
+	vres, err := db.queryAllDocsWithOptions(opts)
 	if err != nil {
 		return nil, err
 	}
@@ -334,7 +383,10 @@ func (db *DatabaseContext) AllPrincipalIDs() (users, roles []string, err error)
 }
 
 func (db *Database) queryAllDocs(reduce bool) (walrus.ViewResult, error) {
-	opts := Body{"stale": false, "reduce": reduce}
+	return db.queryAllDocsWithOptions(Body{"stale": false, "reduce": reduce})
+}
+
+func (db *Database) queryAllDocsWithOptions(opts Body) (walrus.ViewResult, error) {
 	vres, err := db.Bucket.View("sync_housekeeping", "all_docs", opts)
 	if err != nil {
 		base.Warn("all_docs got error: %v", err)
@@ -371,6 +423,10 @@ func (db *Database) DeleteAllDocs(docType string) error {
 
 // Deletes old revisions that have been moved to individual docs
 func (db *Database) Compact() (int, error) {
+	// While this runs, revisions are archived whole, since their parents may be deleted:
+	db.setCompacting(true)
+	defer db.setCompacting(false)
+
 	opts := Body{"stale": false, "reduce": false}
 	vres, err := db.Bucket.View("sync_housekeeping", "old_revs", opts)
 	if err != nil {
@@ -378,23 +434,128 @@ func (db *Database) Compact() (int, error) {
 		return 0, err
 	}
 
-	//FIX: Is there a way to do this in one operation?
-	base.Log("Compacting away %d old revs of %q ...", len(vres.Rows), db.Name)
+	// Each doc's newest revisions go first, so that a delta's source is still there in case the
+	// delta has to be stored whole:
+	keys := make([]string, 0, len(vres.Rows))
+	compacted := make(map[string]bool, len(vres.Rows))
+	for _, row := range vres.Rows {
+		if oldRevisionDocID(row.ID) != "" {
+			keys = append(keys, row.ID)
+			compacted[row.ID] = true
+		}
+	}
+	sort.Sort(oldRevisionKeysNewestFirst(keys))
+
+	base.Log("Compacting away %d old revs of %q ...", len(keys), db.Name)
 	count := 0
+	for _, key := range keys {
+		base.LogTo("CRUD", "\tDeleting %q", key)
+		if deleted, err := db.deleteArchivedRevision(key, compacted); err != nil {
+			base.Warn("Error deleting %q: %v", key, err)
+		} else if deleted {
+			count++
+		}
+	}
+	revBodies, err := db.compactRevBodies()
+	return count + revBodies, err
+}
+
+// Deletes orphaned attachments not used by any revisions. Returns the number deleted and
+// their total size in bytes.
+// A revision's attachments are stored before the revision is saved, and an existing orphan may
+// be adopted by a new revision with the same attachment, so an attachment has to have been
+// found unreferenced for AttachmentOrphanGracePeriod before it's deleted.
+func (db *Database) VacuumAttachments() (count int, size int, err error) {
+	opts := Body{"stale": false, "startkey": kAttachmentKeyPrefix, "endkey": kAttachmentKeyPrefix + "~",
+		"inclusive_end": false}
+	vres, err := db.Bucket.View("sync_housekeeping", "all_bits", opts)
+	if err != nil {
+		base.Warn("all_bits view returned %v", err)
+		return
+	}
+
+	referenced, err := db.findReferencedAttachments()
+	if err != nil {
+		return
+	}
+
+	base.Log("Vacuum: %d of %d attachments of %q are in use", len(referenced), len(vres.Rows), db.Name)
+	orphans := &db.attachmentOrphans
+	orphans.lock.Lock()
+	defer orphans.lock.Unlock()
+	found := make(map[string]time.Time)
+	now := time.Now()
 	for _, row := range vres.Rows {
-		base.LogTo("CRUD", "\tDeleting %q", row.ID)
-		if err := db.Bucket.Delete(row.ID); err != nil {
-			base.Warn("Error deleting %q: %v", row.ID, err)
+		key := row.ID
+		if referenced[AttachmentKey(key[len(kAttachmentKeyPrefix):])] {
+			continue
+		}
+		first, ok := orphans.found[key]
+		if !ok {
+			first = now
+		}
+		if now.Sub(first) < AttachmentOrphanGracePeriod {
+			found[key] = first // A revision using it may be about to be saved
+			continue
+		}
+		data, _ := db.Bucket.GetRaw(key)
+		base.LogTo("CRUD", "\tDeleting orphaned attachment %q", key)
+		if err := db.Bucket.Delete(key); err != nil {
+			base.Warn("Error deleting %q: %v", key, err)
 		} else {
 			count++
+			size += len(data)
 		}
 	}
-	return count, nil
+	orphans.found = found
+	return count, size, nil
 }
 
-// Deletes all orphaned CouchDB attachments not used by any revisions.
-func VacuumAttachments(bucket base.Bucket) (int, error) {
-	return 0, base.HTTPErrorf(http.StatusNotImplemented, "Vacuum is temporarily out of order")
+// Scans every document, including old revisions' bodies stored in the tree or as separate
+// docs, and returns the keys of all the attachments they refer to.
+func (db *Database) findReferencedAttachments() (map[AttachmentKey]bool, error) {
+	vres, err := db.Bucket.View("sync_housekeeping", "all_bits", Body{"stale": false})
+	if err != nil {
+		base.Warn("all_bits view returned %v", err)
+		return nil, err
+	}
+	referenced := map[AttachmentKey]bool{}
+	for _, row := range vres.Rows {
+		isOldRev := strings.HasPrefix(row.ID, kOldRevisionKeyPrefix) ||
+			strings.HasPrefix(row.ID, kRevBodyKeyPrefix)
+		if strings.HasPrefix(row.ID, kSyncKeyPrefix) && !isOldRev {
+			continue
+		}
+		data, err := db.Bucket.GetRaw(row.ID)
+		if err != nil {
+			if base.IsDocNotFoundError(err) {
+				continue // deleted since the view was queried
+			}
+			return nil, err
+		}
+		if isOldRev && isArchivedDelta(data) {
+			addDeltaAttachmentKeys(data, referenced)
+			continue
+		} else if isOldRev {
+			var body Body
+			if json.Unmarshal(data, &body) == nil {
+				addAttachmentKeys(body, referenced)
+			}
+			continue
+		}
+		doc, err := unmarshalDocument(row.ID, data)
+		if err != nil {
+			base.Warn("Vacuum: can't parse doc %q: %v", row.ID, err)
+			continue
+		}
+		addAttachmentKeys(doc.body, referenced)
+		for revid, info := range doc.History {
+			if info.Body != nil {
+				addAttachmentKeys(doc.History.getParsedRevisionBody(revid, nil), referenced)
+			}
+		}
+	}
+	return referenced, nil
 }
 
 //////// SYNC FUNCTION:
@@ -454,6 +615,13 @@ func (context *DatabaseContext) ApplySyncFun(syncFun string, importExistingDocs
 // and/or imports docs in the bucket not known to the gateway (if doImportDocs==true).
 // To be used when the JavaScript channelmap function changes.
 func (db *Database) UpdateAllDocChannels(doCurrentDocs bool, doImportDocs bool) error {
+	return db.updateAllDocChannels(doCurrentDocs, doImportDocs, nil)
+}
+
+// Implementation of UpdateAllDocChannels. If 'progress' is non-nil it's called after each doc
+// with the total number of docs, the number processed so far, and the number changed.
+func (db *Database) updateAllDocChannels(doCurrentDocs bool, doImportDocs bool,
+	progress func(total, processed, changed int)) error {
 	if doCurrentDocs {
 		base.Log("Recomputing document channels...")
 	}
@@ -476,7 +644,7 @@ func (db *Database) UpdateAllDocChannels(doCurrentDocs bool, doImportDocs bool)
 
 	//base.Log("Re-running sync() function on all %d documents...", len(vres.Rows))
 	changeCount := 0
-	for _, row := range vres.Rows {
+	for i, row := range vres.Rows {
 		rowKey := row.Key.([]interface{})
 		docid := rowKey[1].(string)
 		key := realDocID(docid)
@@ -494,7 +662,7 @@ func (db *Database) UpdateAllDocChannels(doCurrentDocs bool, doImportDocs bool)
 			imported := false
 			if !doc.hasValidSyncData() {
 				// This is a document not known to the sync gateway. Ignore or import it:
-				if !doImportDocs {
+				if !doImportDocs || !db.shouldImport(doc) {
 					return nil, couchbase.UpdateCancel
 				}
 				imported = true
@@ -541,6 +709,9 @@ func (db *Database) UpdateAllDocChannels(doCurrentDocs bool, doImportDocs bool)
 		} else if err != couchbase.UpdateCancel {
 			base.Warn("Error updating doc %q: %v", docid, err)
 		}
+		if progress != nil {
+			progress(len(vres.Rows), i+1, changeCount)
+		}
 	}
 
 	if changeCount > 0 {
@@ -10,9 +10,13 @@
 package db
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
+	"sort"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/couchbaselabs/go.assert"
 
@@ -54,6 +58,9 @@ func tearDownTestDB(t *testing.T, db *Database) {
 }
 
 func assertHTTPError(t *testing.T, err error, status int) {
+	if conflict, ok := err.(*base.ConflictError); ok {
+		err = base.HTTPErrorf(409, "%s", conflict.Message)
+	}
 	httpErr, ok := err.(*base.HTTPError)
 	if !ok {
 		assert.Errorf(t, "assertHTTPError: Expected an HTTP %d; got error %T %v", status, err, err)
@@ -308,6 +315,53 @@ func TestAllDocs(t *testing.T) {
 	assert.Equals(t, int(log.Entries[0].Sequence), 52)
 }
 
+func TestBulkUpdate(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+
+	_, err := db.Put("a", Body{"channels": []string{"red"}, "color": "red", "size": Body{"w": "1", "h": "2"}})
+	assertNoError(t, err, "Put")
+	_, err = db.Put("b", Body{"channels": []string{"blue"}, "color": "blue"})
+	assertNoError(t, err, "Put")
+
+	_, err = db.BulkUpdate(BulkUpdate{})
+	assertHTTPError(t, err, 400)
+
+	// Dry run of a merge patch on one channel:
+	update := BulkUpdate{
+		Merge:    Body{"color": nil, "size": map[string]interface{}{"h": "3"}},
+		Channels: []string{"red"},
+		DryRun:   true,
+	}
+	result, err := db.BulkUpdate(update)
+	assertNoError(t, err, "BulkUpdate")
+	assert.DeepEquals(t, *result, BulkUpdateResult{Matched: 1, Changed: 1, DryRun: true})
+	body, _ := db.Get("a")
+	assert.Equals(t, body["color"], "red")
+
+	update.DryRun = false
+	result, err = db.BulkUpdate(update)
+	assertNoError(t, err, "BulkUpdate")
+	assert.Equals(t, result.Changed, 1)
+	body, _ = db.Get("a")
+	generation, _ := parseRevID(body["_rev"].(string))
+	assert.Equals(t, generation, 2)
+	assert.Equals(t, body["color"], nil)
+	assert.Equals(t, string(canonicalEncoding(Body{"size": body["size"]})), `{"size":{"h":"3","w":"1"}}`)
+
+	// A transform that moves docs to another channel, which the sync function picks up:
+	update = BulkUpdate{Transform: `function(doc) {
+		if (doc.color != "blue") return null;
+		doc.channels = ["green"]; return doc;}`}
+	result, err = db.BulkUpdate(update)
+	assertNoError(t, err, "BulkUpdate")
+	assert.Equals(t, result.Matched, 2)
+	assert.Equals(t, result.Changed, 1)
+	doc, _ := db.GetDoc("b")
+	assert.True(t, doc.inAnyChannel([]string{"green"}))
+	assert.False(t, doc.inAnyChannel([]string{"blue"}))
+}
+
 func TestConflicts(t *testing.T) {
 	AlwaysCompactChangeLog = true // Makes examining the change log deterministic
 	defer func() { AlwaysCompactChangeLog = false }()
@@ -380,6 +434,18 @@ func TestConflicts(t *testing.T) {
 		ID:      "doc",
 		Changes: []ChangeRev{{"rev": "2-a"}, {"rev": "2-b"}}})
 
+	// With include_docs, every change carries the winning revision's body:
+	options.IncludeDocs = true
+	changes, err = db.GetChanges(channels.SetOf("all"), options)
+	assertNoError(t, err, "Couldn't GetChanges")
+	assert.Equals(t, len(changes), 2)
+	for _, change := range changes {
+		assert.Equals(t, change.Doc["_rev"], "2-b")
+		assert.Equals(t, change.Doc["n"], int64(2))
+	}
+	assert.Equals(t, len(changes[0].Changes), 1) // the doc wasn't in conflict yet
+	options.IncludeDocs = false
+
 	// Delete 2-b; verify this makes 2-a current:
 	_, err = db.DeleteDoc("doc", "2-b")
 	assertNoError(t, err, "delete 2-b")
@@ -395,6 +461,497 @@ func TestConflicts(t *testing.T) {
 	assert.True(t, doc.Channels["2b"] != nil) // has been removed from 2b
 }
 
+func TestConflictResolution(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+
+	// Creates a doc with revs 1-a and 2-b, then adds the conflicting rev 2-a:
+	makeConflict := func(docid string, bBody, aBody Body) *document {
+		assertNoError(t, db.PutExistingRev(docid, Body{"n": 1}, []string{"1-a"}), "add 1-a")
+		assertNoError(t, db.PutExistingRev(docid, bBody, []string{"2-b", "1-a"}), "add 2-b")
+		assertNoError(t, db.PutExistingRev(docid, aBody, []string{"2-a", "1-a"}), "add 2-a")
+		doc, err := db.GetDoc(docid)
+		assertNoError(t, err, "GetDoc")
+		return doc
+	}
+	// Checks that the doc isn't in conflict and that the loser got a tombstone:
+	checkResolved := func(doc *document, policy ConflictPolicy, winner, loser string) {
+		assert.Equals(t, doc.CurrentRev, winner)
+		assert.DeepEquals(t, doc.History.liveLeaves(), []string{winner})
+		_, inConflict := doc.History.winningRevision()
+		assert.False(t, inConflict)
+		assert.Equals(t, len(doc.Resolutions), 1)
+		assert.Equals(t, doc.Resolutions[0].Policy, policy)
+		assert.Equals(t, doc.Resolutions[0].Winner, winner)
+		assert.DeepEquals(t, doc.Resolutions[0].Losers, []string{loser})
+		tombstone := doc.History[createRevID(3, loser, Body{"_deleted": true})]
+		assert.True(t, tombstone != nil && tombstone.Deleted && tombstone.Parent == loser)
+		assert.Equals(t, tombstone.Sequence, doc.Sequence)
+	}
+
+	assertNoError(t, db.ApplyConflictResolution(ConflictPolicyRemoteWins, "", ""), "remoteWins")
+	doc := makeConflict("remote", Body{"n": 2}, Body{"n": 3})
+	checkResolved(doc, ConflictPolicyRemoteWins, "2-a", "2-b")
+	gotBody, err := db.Get("remote")
+	assertNoError(t, err, "Get")
+	assert.Equals(t, gotBody["n"], int64(3))
+
+	assertNoError(t, db.ApplyConflictResolution(ConflictPolicyLocalWins, "", ""), "localWins")
+	doc = makeConflict("local", Body{"n": 2}, Body{"n": 3})
+	checkResolved(doc, ConflictPolicyLocalWins, "2-b", "2-a")
+
+	assert.True(t, db.ApplyConflictResolution(ConflictPolicyLWW, "", "") != nil)
+	assertNoError(t, db.ApplyConflictResolution(ConflictPolicyLWW, "updated", ""), "lww")
+	doc = makeConflict("lww", Body{"updated": "2014-06-02T10:00:00Z"}, Body{"updated": "2014-06-01T10:00:00Z"})
+	checkResolved(doc, ConflictPolicyLWW, "2-b", "2-a")
+	doc = makeConflict("lww2", Body{"updated": 1401616800000}, Body{"updated": 1401703200000})
+	checkResolved(doc, ConflictPolicyLWW, "2-a", "2-b")
+
+	assertNoError(t, db.ApplyConflictResolution("", "",
+		`function(conflicts) {
+			for (var i = 0; i < conflicts.length; i++)
+				if (conflicts[i].primary) return conflicts[i]._rev;
+		}`), "custom")
+	doc = makeConflict("custom", Body{"n": 2}, Body{"n": 3, "primary": true})
+	checkResolved(doc, ConflictPolicyCustom, "2-a", "2-b")
+
+	// A null result leaves the doc in conflict:
+	doc = makeConflict("unresolved", Body{"n": 2}, Body{"n": 3})
+	assert.Equals(t, doc.CurrentRev, "2-b")
+	assert.Equals(t, len(doc.History.liveLeaves()), 2)
+	assert.Equals(t, len(doc.Resolutions), 0)
+
+	// The conflicts are passed current revision first, then by descending rev ID:
+	assertNoError(t, db.ApplyConflictResolution("", "",
+		`function(conflicts) {return conflicts[0]._rev;}`), "custom first")
+	doc = makeConflict("first", Body{"n": 2}, Body{"n": 3})
+	checkResolved(doc, ConflictPolicyCustom, "2-b", "2-a")
+	assertNoError(t, db.ApplyConflictResolution("", "",
+		`function(conflicts) {return conflicts[conflicts.length-1]._rev;}`), "custom last")
+	doc = makeConflict("last", Body{"n": 2}, Body{"n": 3})
+	checkResolved(doc, ConflictPolicyCustom, "2-a", "2-b")
+
+	assert.True(t, db.ApplyConflictResolution("coinToss", "", "") != nil)
+}
+
+func TestCollapsedChanges(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+	db.ChannelMapper = channels.NewDefaultChannelMapper()
+
+	body := Body{"channels": []string{"all"}}
+	rev1, err := db.Put("doc1", body)
+	assertNoError(t, err, "put doc1")
+	_, err = db.Put("doc2", body)
+	assertNoError(t, err, "put doc2")
+	body["_rev"] = rev1
+	rev2, err := db.Put("doc1", body)
+	assertNoError(t, err, "update doc1")
+
+	db.changesWriter.checkpoint()
+
+	options := ChangesOptions{Terminator: make(chan bool)}
+	defer close(options.Terminator)
+	changes, err := db.GetChanges(channels.SetOf("all"), options)
+	assertNoError(t, err, "Couldn't GetChanges")
+	assert.Equals(t, len(changes), 3)
+
+	// With collapse, the superseded change of doc1 is skipped:
+	options.Collapse = true
+	changes, err = db.GetChanges(channels.SetOf("all"), options)
+	assertNoError(t, err, "Couldn't GetChanges")
+	assert.Equals(t, len(changes), 2)
+	assert.Equals(t, changes[0].ID, "doc2")
+	assert.Equals(t, changes[0].Seq, "all:2")
+	assert.Equals(t, changes[1].ID, "doc1")
+	assert.Equals(t, changes[1].Seq, "all:3")
+	assert.DeepEquals(t, changes[1].Changes, []ChangeRev{{"rev": rev2}})
+
+	// The limit applies to the collapsed changes:
+	options.Limit = 1
+	changes, err = db.GetChanges(channels.SetOf("all"), options)
+	assertNoError(t, err, "Couldn't GetChanges")
+	assert.Equals(t, len(changes), 1)
+	assert.Equals(t, changes[0].ID, "doc2")
+
+	// Without collapse, both changes of doc1 get the body of its current revision:
+	options = ChangesOptions{IncludeDocs: true, Limit: 2, Terminator: options.Terminator}
+	changes, err = db.GetChanges(channels.SetOf("all"), options)
+	assertNoError(t, err, "Couldn't GetChanges")
+	assert.Equals(t, len(changes), 2)
+	assert.Equals(t, changes[0].ID, "doc1")
+	assert.Equals(t, changes[0].Changes[0]["rev"], rev1)
+	assert.Equals(t, changes[0].Doc["_rev"], rev2)
+	assert.Equals(t, changes[1].Doc["_id"], "doc2")
+}
+
+func TestCollapsedChangesFromView(t *testing.T) {
+	// Truncate the channel log so that all but the last change come from the view:
+	oldMaxLogLength := MaxChangeLogLength
+	oldAlwaysCompact := AlwaysCompactChangeLog
+	MaxChangeLogLength = 1
+	AlwaysCompactChangeLog = true
+	defer func() { MaxChangeLogLength = oldMaxLogLength; AlwaysCompactChangeLog = oldAlwaysCompact }()
+
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+	db.ChannelMapper = channels.NewDefaultChannelMapper()
+
+	body := Body{"channels": []string{"all"}}
+	rev1, err := db.Put("doc1", body)
+	assertNoError(t, err, "put doc1")
+	_, err = db.Put("doc2", body)
+	assertNoError(t, err, "put doc2")
+	body["_rev"] = rev1
+	rev2, err := db.Put("doc1", body)
+	assertNoError(t, err, "update doc1")
+	_, err = db.Put("doc3", Body{"channels": []string{"all"}})
+	assertNoError(t, err, "put doc3")
+
+	db.changesWriter.checkpoint()
+
+	// The superseded row of doc1 doesn't count toward the limit:
+	options := ChangesOptions{Collapse: true, Limit: 2, Terminator: make(chan bool)}
+	defer close(options.Terminator)
+	changes, err := db.GetChanges(channels.SetOf("all"), options)
+	assertNoError(t, err, "Couldn't GetChanges")
+	assert.Equals(t, len(changes), 2)
+	assert.Equals(t, changes[0].ID, "doc2")
+	assert.Equals(t, changes[1].ID, "doc1")
+	assert.DeepEquals(t, changes[1].Changes, []ChangeRev{{"rev": rev2}})
+}
+
+func TestPriorityChannels(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+	db.ChannelMapper = channels.NewDefaultChannelMapper()
+	db.PriorityChannels = channels.SetOf("profile")
+
+	for _, docid := range []string{"item1", "item2"} {
+		_, err := db.Put(docid, Body{"channels": []string{"items"}})
+		assertNoError(t, err, "put")
+	}
+	_, err := db.Put("me", Body{"channels": []string{"profile", "items"}})
+	assertNoError(t, err, "put")
+	db.changesWriter.checkpoint()
+
+	// On a first sync the priority channel's changes come first, and aren't repeated:
+	changes, err := db.GetChanges(channels.SetOf("*"), ChangesOptions{})
+	assertNoError(t, err, "Couldn't GetChanges")
+	assert.Equals(t, len(changes), 3)
+	assert.Equals(t, changes[0].ID, "me")
+	assert.Equals(t, changes[1].ID, "item1")
+	assert.Equals(t, changes[2].ID, "item2")
+
+	// Later syncs are in sequence order:
+	options := ChangesOptions{}
+	options.Since, _ = ParseSequenceID("*:1")
+	changes, err = db.GetChanges(channels.SetOf("*"), options)
+	assertNoError(t, err, "Couldn't GetChanges")
+	assert.Equals(t, len(changes), 2)
+	assert.Equals(t, changes[0].ID, "item2")
+	assert.Equals(t, changes[1].ID, "me")
+}
+
+func TestGetCurrentRevID(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+
+	rev1id, err := db.Put("doc1", Body{"key1": "value1"})
+	assertNoError(t, err, "Couldn't create document")
+	revid, err := db.GetCurrentRevID("doc1")
+	assertNoError(t, err, "GetCurrentRevID")
+	assert.Equals(t, revid, rev1id)
+
+	_, err = db.DeleteDoc("doc1", rev1id)
+	assertNoError(t, err, "DeleteDoc")
+	_, err = db.GetCurrentRevID("doc1")
+	assertHTTPError(t, err, 404)
+
+	_, err = db.GetCurrentRevID("nosuchdoc")
+	assert.True(t, base.IsDocNotFoundError(err))
+}
+
+func TestRevIDAtSequence(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+
+	rev1a, err := db.Put("doc1", Body{"n": 1})
+	assertNoError(t, err, "Put")
+	seq1, _ := db.LastSequence()
+	rev2a, err := db.Put("doc2", Body{"n": 1})
+	assertNoError(t, err, "Put")
+	seq2, _ := db.LastSequence()
+	rev1b, err := db.Put("doc1", Body{"_rev": rev1a, "n": 2})
+	assertNoError(t, err, "Put")
+	_, err = db.DeleteDoc("doc2", rev2a)
+	assertNoError(t, err, "DeleteDoc")
+	seq4, _ := db.LastSequence()
+
+	revid, err := db.RevIDAtSequence("doc1", seq2)
+	assertNoError(t, err, "RevIDAtSequence")
+	assert.Equals(t, revid, rev1a)
+	revid, _ = db.RevIDAtSequence("doc1", seq4)
+	assert.Equals(t, revid, rev1b)
+	_, err = db.RevIDAtSequence("doc2", seq1)
+	assertHTTPError(t, err, 404)
+	revid, _ = db.RevIDAtSequence("doc2", seq2)
+	assert.Equals(t, revid, rev2a)
+
+	// The old revision's body is still available:
+	body, err := db.GetRev("doc1", rev1a, false, nil)
+	assertNoError(t, err, "GetRev")
+	assert.Equals(t, body["n"], float64(1))
+
+	// Revisions added by PutExistingRev get the sequence they were added at:
+	err = db.PutExistingRev("doc3", Body{"n": 3}, []string{"3-c", "2-b", "1-a"})
+	assertNoError(t, err, "PutExistingRev")
+	_, err = db.RevIDAtSequence("doc3", seq4)
+	assertHTTPError(t, err, 404)
+
+	// A revision with no sequence only counts if a descendant is known to be old enough:
+	tree := RevTree{
+		"1-a": {ID: "1-a"},
+		"2-b": {ID: "2-b", Parent: "1-a", Sequence: 10},
+	}
+	revid, err = tree.winningRevisionAsOf(10)
+	assertNoError(t, err, "winningRevisionAsOf")
+	assert.Equals(t, revid, "2-b")
+	_, err = tree.winningRevisionAsOf(5)
+	assertHTTPError(t, err, 409)
+	tree["2-c"] = &RevInfo{ID: "2-c", Parent: "1-a"}
+	_, err = tree.winningRevisionAsOf(10)
+	assertHTTPError(t, err, 409)
+}
+
+func TestLocalDocs(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+
+	revid, err := db.PutLocal("checkpoint", Body{"seq": 5})
+	assertNoError(t, err, "PutLocal")
+	assert.Equals(t, revid, "0-1")
+	body, err := db.GetLocal("checkpoint")
+	assertNoError(t, err, "GetLocal")
+	assert.Equals(t, body["_rev"], "0-1")
+
+	// Local docs aren't real documents:
+	_, err = db.Get("checkpoint")
+	assert.True(t, base.IsDocNotFoundError(err))
+
+	_, err = db.PutLocal("checkpoint", Body{"seq": 6})
+	assertHTTPError(t, err, 409)
+	revid, err = db.PutLocal("checkpoint", Body{"seq": 6, "_rev": "0-1"})
+	assertNoError(t, err, "PutLocal")
+	assert.Equals(t, revid, "0-2")
+
+	assertHTTPError(t, db.DeleteLocal("checkpoint", "0-1"), 409)
+	assertNoError(t, db.DeleteLocal("checkpoint", "0-2"), "DeleteLocal")
+	_, err = db.GetLocal("checkpoint")
+	assert.True(t, base.IsDocNotFoundError(err))
+}
+
+func TestSweep(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+
+	authenticator := auth.NewAuthenticator(db.Bucket, db)
+	live, err := authenticator.CreateSession("naomi", time.Hour)
+	assertNoError(t, err, "CreateSession")
+	expired := auth.LoginSession{ID: "old", Username: "naomi", Expiration: time.Now().Add(-time.Minute)}
+	assertNoError(t, db.Bucket.Set(auth.SessionKeyPrefix+"old", 0, expired), "Set")
+	// Docs that only look like sessions aren't swept:
+	_, err = db.Put("session:doc", Body{"expiration": "2013-01-01T00:00:00Z"})
+	assertNoError(t, err, "Put")
+	assertNoError(t, db.Bucket.Set(auth.SessionKeyPrefix+"raw", 0, Body{"title": "raw doc"}), "Set")
+	mismatched := auth.LoginSession{ID: "other", Username: "naomi", Expiration: expired.Expiration}
+	assertNoError(t, db.Bucket.Set(auth.SessionKeyPrefix+"mismatched", 0, mismatched), "Set")
+
+	_, err = db.PutLocal("fresh", Body{"seq": 5})
+	assertNoError(t, err, "PutLocal")
+	aged := Body{"seq": 2, "_rev": "0-1", kSpecialDocTimeProperty: "2013-01-01T00:00:00Z"}
+	assertNoError(t, db.Bucket.Set(kLocalDocKeyPrefix+"aged", 0, aged), "Set")
+	assertNoError(t, db.Bucket.Set(kLocalDocKeyPrefix+"legacy", 0, Body{"_rev": "0-1"}), "Set")
+
+	sessions, localDocs := db.Sweep(time.Hour)
+	assert.Equals(t, sessions, 1)
+	assert.Equals(t, localDocs, 1)
+	_, err = db.Bucket.GetRaw(auth.SessionKeyPrefix + live.ID)
+	assertNoError(t, err, "Live session was swept")
+	_, err = db.Get("session:doc")
+	assertNoError(t, err, "User doc was swept")
+	for _, key := range []string{"raw", "mismatched"} {
+		_, err = db.Bucket.GetRaw(auth.SessionKeyPrefix + key)
+		assertNoError(t, err, "Non-session doc was swept")
+	}
+	_, err = db.GetLocal("aged")
+	assert.True(t, base.IsDocNotFoundError(err))
+
+	// The legacy doc got an update time, which GetLocal doesn't return:
+	body, err := db.GetLocal("legacy")
+	assertNoError(t, err, "GetLocal")
+	assert.DeepEquals(t, body, Body{"_rev": "0-1"})
+	raw := Body{}
+	assertNoError(t, db.Bucket.Get(kLocalDocKeyPrefix+"legacy", &raw), "Get")
+	assert.True(t, raw[kSpecialDocTimeProperty] != nil)
+
+	// A retention of 0 keeps local docs forever:
+	sessions, localDocs = db.Sweep(0)
+	assert.Equals(t, sessions, 0)
+	assert.Equals(t, localDocs, 0)
+}
+
+func TestWaitForDocChange(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+
+	rev1id, err := db.Put("doc1", Body{"key1": "value1"})
+	assertNoError(t, err, "Couldn't create document")
+
+	// Returns immediately if the doc's already changed:
+	revid, err := db.WaitForDocChange("doc1", "", time.Second)
+	assertNoError(t, err, "WaitForDocChange")
+	assert.Equals(t, revid, rev1id)
+
+	// Times out if it doesn't change:
+	revid, err = db.WaitForDocChange("doc1", rev1id, 100*time.Millisecond)
+	assertNoError(t, err, "WaitForDocChange")
+	assert.Equals(t, revid, rev1id)
+
+	// Wakes up when it's updated:
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		db.Put("doc1", Body{"_rev": rev1id, "key1": "value2"})
+	}()
+	revid, err = db.WaitForDocChange("doc1", rev1id, 5*time.Second)
+	assertNoError(t, err, "WaitForDocChange")
+	assert.True(t, revid != rev1id)
+	currentRev, _ := db.GetCurrentRevID("doc1")
+	assert.Equals(t, revid, currentRev)
+}
+
+func TestInstanceStartTime(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+
+	startTime, err := db.EnsureFullCommit()
+	assertNoError(t, err, "EnsureFullCommit")
+	assert.True(t, startTime > 0)
+
+	// Reopening the bucket (as after a gateway restart) keeps the same instance:
+	context2, err := NewDatabaseContext("db2", db.Bucket, false)
+	assertNoError(t, err, "NewDatabaseContext")
+	startTime2, _ := context2.CurrentInstanceStartTime()
+	assert.Equals(t, startTime2, startTime)
+
+	// ...but losing the bucket's data starts a new one:
+	assertNoError(t, db.Bucket.Delete(kInstanceKey), "Delete")
+	time.Sleep(time.Millisecond)
+	startTime2, err = db.EnsureFullCommit()
+	assertNoError(t, err, "EnsureFullCommit")
+	assert.True(t, startTime2 > startTime)
+
+	// A 'since' past the latest sequence can't be trusted, so the feed starts over:
+	_, err = db.Put("doc", Body{"channels": []string{"all"}})
+	assertNoError(t, err, "Put")
+	since := SequenceID{LowSeq: 1000}
+	assert.DeepEquals(t, db.checkSinceForRollback(since), SequenceID{Channels: channels.TimedSet{}})
+	since = SequenceID{LowSeq: 1}
+	assert.DeepEquals(t, db.checkSinceForRollback(since), since)
+}
+
+func TestConflictAncestor(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+
+	body := Body{"n": 1}
+	assertNoError(t, db.PutExistingRev("doc", body, []string{"1-a"}), "add 1-a")
+	body = Body{"n": 2}
+	assertNoError(t, db.PutExistingRev("doc", body, []string{"2-b", "1-a"}), "add 2-b")
+	body = Body{"n": 3}
+	assertNoError(t, db.PutExistingRev("doc", body, []string{"2-a", "1-a"}), "add 2-a")
+
+	// Updating the non-leaf 1-a conflicts; the ancestor it shares with 2-b is 1-a itself:
+	_, err := db.Put("doc", Body{"_rev": "1-a", "n": 4})
+	assertHTTPError(t, err, 409)
+	conflict, ok := err.(*base.ConflictError)
+	assert.True(t, ok)
+	assert.Equals(t, conflict.CurrentRev, "2-b")
+	assert.Equals(t, conflict.AncestorRev, "1-a")
+	assert.Equals(t, conflict.AncestorBody["n"], int64(1))
+
+	// An unknown rev has no common ancestor:
+	_, err = db.Put("doc", Body{"_rev": "2-zzz", "n": 5})
+	assertHTTPError(t, err, 409)
+	assert.Equals(t, err.(*base.ConflictError).AncestorRev, "")
+}
+
+func TestRepairRevTrees(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+
+	rev1, err := db.Put("doc", Body{"n": 1})
+	assertNoError(t, err, "Put")
+	rev2, err := db.Put("doc", Body{"n": 2, "_rev": rev1})
+	assertNoError(t, err, "Put")
+	_, err = db.Put("other", Body{"n": 3})
+	assertNoError(t, err, "Put")
+
+	// Corrupt the doc's rev tree by making it circular:
+	doc, err := db.GetDoc("doc")
+	assertNoError(t, err, "GetDoc")
+	doc.History[rev1].Parent = rev2
+	assertNoError(t, db.Bucket.Set("doc", 0, doc), "Set")
+
+	result, err := db.RepairRevTrees(nil, true)
+	assertNoError(t, err, "RepairRevTrees")
+	assert.Equals(t, result.Checked, 2)
+	assert.Equals(t, len(result.Docs), 1)
+	assert.DeepEquals(t, result.Docs["doc"].Problems, []RevTreeProblem{{RevTreeCycle, rev1, rev2}})
+	assert.DeepEquals(t, result.Docs["doc"].Fixes, []string(nil))
+
+	result, err = db.RepairRevTrees([]string{"doc"}, false)
+	assertNoError(t, err, "RepairRevTrees")
+	assert.Equals(t, len(result.Docs["doc"].Fixes), 1)
+	doc, err = db.GetDoc("doc")
+	assertNoError(t, err, "GetDoc")
+	assert.DeepEquals(t, doc.History.getHistory(rev2), []string{rev2, rev1})
+
+	result, err = db.RepairRevTrees(nil, false)
+	assertNoError(t, err, "RepairRevTrees")
+	assert.Equals(t, len(result.Docs), 0)
+
+	// A stored tree with out-of-range indexes can't be read or updated, and isn't overwritten:
+	corrupt := `{"n": 4, "_sync": {"rev": "2-b", "sequence": 9, "history": {
+		"revs": ["1-a", "2-b", "2-c"], "parents": [-1, 7], "deleted": [12],
+		"channels": [null, null, null]}}}`
+	assertNoError(t, db.Bucket.SetRaw("corrupt", 0, []byte(corrupt)), "SetRaw")
+	_, err = db.Get("corrupt")
+	assertHTTPError(t, err, 500)
+	_, err = db.Put("corrupt", Body{"n": 5, "_rev": "2-b"})
+	assertHTTPError(t, err, 500)
+	raw, _ := db.Bucket.GetRaw("corrupt")
+	assert.Equals(t, string(raw), corrupt)
+
+	// ...but it can still be loaded, checked and repaired by _repair:
+	result, err = db.RepairRevTrees([]string{"corrupt"}, false)
+	assertNoError(t, err, "RepairRevTrees")
+	assert.DeepEquals(t, result.Docs["corrupt"].Problems, []RevTreeProblem{
+		{RevTreeMissingParent, "2-b", fmt.Sprintf(kBadParentIndexFormat, 7)},
+		{RevTreeMissingParent, "2-c", kMissingParentIndex}})
+	assert.Equals(t, len(result.Docs["corrupt"].Fixes), 2)
+	doc, err = db.GetDoc("corrupt")
+	assertNoError(t, err, "GetDoc")
+	assert.DeepEquals(t, doc.History.getHistory("2-b"), []string{"2-b"})
+	assert.DeepEquals(t, doc.History.Validate(), []RevTreeProblem(nil))
+	_, err = db.Put("corrupt", Body{"n": 5, "_rev": "2-b"})
+	assertNoError(t, err, "Put after repair")
+
+	db.user, _ = db.Authenticator().NewUser("naomi", "letmein", nil)
+	_, err = db.RepairRevTrees(nil, false)
+	assertHTTPError(t, err, 403)
+}
+
 func TestInvalidChannel(t *testing.T) {
 	db := setupTestDB(t)
 	defer tearDownTestDB(t, db)
@@ -476,6 +1033,76 @@ func TestAccessFunction(t *testing.T) {
 	assert.DeepEquals(t, user.InheritedChannels(), expected)
 }
 
+func TestConcurrentInvalidations(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+
+	authenticator := auth.NewAuthenticator(db.Bucket, db)
+	const nUsers = 4
+	for i := 0; i < nUsers; i++ {
+		for _, prefix := range []string{"chan", "role"} {
+			user, _ := authenticator.NewUser(fmt.Sprintf("%s%d", prefix, i), "letmein", channels.SetOf("Netflix"))
+			assertNoError(t, authenticator.Save(user), "Save")
+		}
+	}
+
+	// Writers invalidating overlapping principals at once all return, once their own are done:
+	var wg sync.WaitGroup
+	for i := 0; i < 5*nUsers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			n := i % nUsers
+			db.invalidatePrincipals([]string{fmt.Sprintf("chan%d", n)}, []string{fmt.Sprintf("role%d", n)})
+		}(i)
+	}
+	wg.Wait()
+
+	for i := 0; i < nUsers; i++ {
+		var stored struct {
+			Channels map[string]interface{} `json:"all_channels"`
+			Roles    []string               `json:"roles"`
+		}
+		raw, err := db.Bucket.GetRaw(auth.UserKeyPrefix + fmt.Sprintf("chan%d", i))
+		assertNoError(t, err, "GetRaw")
+		assertNoError(t, json.Unmarshal(raw, &stored), "Unmarshal")
+		assert.True(t, stored.Channels == nil)
+		raw, err = db.Bucket.GetRaw(auth.UserKeyPrefix + fmt.Sprintf("role%d", i))
+		assertNoError(t, err, "GetRaw")
+		assertNoError(t, json.Unmarshal(raw, &stored), "Unmarshal")
+		assert.True(t, stored.Roles == nil)
+	}
+}
+
+func TestConcurrentSequences(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+
+	first, err := db.LastSequence()
+	assertNoError(t, err, "LastSequence")
+	const n = 50
+	seqs := make([]int, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			seq, err := db.sequences.nextSequence()
+			assertNoError(t, err, "nextSequence")
+			seqs[i] = int(seq)
+		}(i)
+	}
+	wg.Wait()
+
+	// Every sequence is assigned exactly once, with no gaps:
+	sort.Ints(seqs)
+	for i, seq := range seqs {
+		assert.Equals(t, seq, int(first)+i+1)
+	}
+	last, _ := db.LastSequence()
+	assert.Equals(t, last, first+n)
+}
+
 func TestDocIDs(t *testing.T) {
 	assert.Equals(t, realDocID(""), "")
 	assert.Equals(t, realDocID("_"), "")
@@ -484,6 +1111,53 @@ func TestDocIDs(t *testing.T) {
 	assert.Equals(t, realDocID("_design/foo"), "_design/foo")
 }
 
+func TestPostDocIDTemplate(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+
+	// Without a template, IDs are UUIDs:
+	docid, _, err := db.Post(Body{"type": "item"})
+	assertNoError(t, err, "Post")
+	assert.Equals(t, len(docid), 32)
+
+	db.DocIDTemplate, err = NewDocIDTemplate("{type}:{seq}")
+	assertNoError(t, err, "NewDocIDTemplate")
+	docid, _, err = db.Post(Body{"type": "item"})
+	assertNoError(t, err, "Post")
+	assert.Equals(t, docid, "item:1")
+
+	// A generated ID that's already taken is skipped:
+	_, err = db.Put("item:2", Body{})
+	assertNoError(t, err, "Put")
+	docid, _, err = db.Post(Body{"type": "item"})
+	assertNoError(t, err, "Post")
+	assert.Equals(t, docid, "item:3")
+
+	_, _, err = db.Post(Body{"kind": "item"})
+	assertHTTPError(t, err, 400)
+
+	// A body with an _id is an upsert of that doc:
+	docid, rev, err := db.Post(Body{"_id": "item:3", "_rev": "1-bogus"})
+	assertHTTPError(t, err, 409)
+	rev1, _ := db.GetCurrentRevID("item:3")
+	docid, rev, err = db.Post(Body{"_id": "item:3", "_rev": rev1, "type": "thing"})
+	assertNoError(t, err, "Post upsert")
+	assert.Equals(t, docid, "item:3")
+	assert.Equals(t, rev[0:2], "2-")
+
+	// With no unique placeholder, a colliding ID isn't retried:
+	db.DocIDTemplate, _ = NewDocIDTemplate("{type}")
+	_, _, err = db.Post(Body{"type": "single"})
+	assertNoError(t, err, "Post")
+	_, _, err = db.Post(Body{"type": "single"})
+	assertHTTPError(t, err, 409)
+
+	_, err = NewDocIDTemplate("{}")
+	assertTrue(t, err != nil, "empty placeholder")
+	_, err = NewDocIDTemplate("_{uuid}")
+	assertTrue(t, err != nil, "leading underscore")
+}
+
 func TestUpdateDesignDoc(t *testing.T) {
 	db := setupTestDB(t)
 	defer tearDownTestDB(t, db)
@@ -522,6 +1196,285 @@ func TestImport(t *testing.T) {
 	assertNoError(t, err, "can't get doc")
 }
 
+func TestImportFilter(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+
+	db.Bucket.Add("legacy1", 0, Body{"type": "order", "n": 1})
+	db.Bucket.Add("legacy2", 0, Body{"type": "cache", "n": 2})
+
+	assertTrue(t, db.ApplyImportFilter(`function(doc) {`) != nil, "bad filter accepted")
+	err := db.ApplyImportFilter(`function(doc) {return doc.type != "cache";}`)
+	assertNoError(t, err, "ApplyImportFilter")
+	err = db.ApplySyncFun(`function(doc) {channel(doc.type);}`, true)
+	assertNoError(t, err, "ApplySyncFun")
+
+	// Only the doc the filter accepted is imported, and the sync fn has run on it:
+	doc, err := db.GetDoc("legacy1")
+	assertNoError(t, err, "can't get doc")
+	assert.True(t, doc.CurrentRev != "")
+	assert.True(t, doc.Sequence > 0)
+	_, inChannel := doc.Channels["order"]
+	assert.True(t, inChannel)
+
+	_, err = db.GetDoc("legacy2")
+	assertHTTPError(t, err, 404)
+}
+
+func TestResync(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+	db.ChannelMapper = channels.NewChannelMapper(`function(doc){channel(doc.old);}`)
+
+	_, err := db.Put("doc1", Body{"old": "A", "new": "B"})
+	assertNoError(t, err, "Put")
+	_, err = db.Put("doc2", Body{"old": "A"})
+	assertNoError(t, err, "Put")
+
+	db.ChannelMapper.SetFunction(`function(doc){channel(doc.new);}`)
+	changed, err := db.Resync()
+	assertNoError(t, err, "Resync")
+	assert.Equals(t, changed, 2)
+	assert.True(t, db.IsOnline())
+
+	doc, err := db.GetDoc("doc1")
+	assertNoError(t, err, "GetDoc")
+	assert.True(t, doc.Channels["A"] != nil) // has been removed from A
+	_, found := doc.Channels["B"]
+	assert.True(t, found)
+	assert.Equals(t, doc.Channels["B"], (*ChannelRemoval)(nil))
+
+	status := db.ResyncStatus()
+	assert.Equals(t, status["docs_processed"], 2)
+	assert.Equals(t, status["docs_changed"], 2)
+	assert.Equals(t, status["running"], false)
+}
+
+func TestDocLock(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+
+	rev1id, err := db.Put("form", Body{"channels": []string{"forms"}})
+	assertNoError(t, err, "Put")
+	_, err = db.LockDoc("form", time.Minute)
+	assertHTTPError(t, err, 400) // the admin has no user to own the lock
+
+	authenticator := auth.NewAuthenticator(db.Bucket, db)
+	naomi, _ := authenticator.NewUser("naomi", "letmein", channels.SetOf("forms"))
+	zoe, _ := authenticator.NewUser("zoe", "letmein", channels.SetOf("forms"))
+	naomiDB := &Database{DatabaseContext: db.DatabaseContext, user: naomi}
+	zoeDB := &Database{DatabaseContext: db.DatabaseContext, user: zoe}
+
+	// Guests all share one identity, so they can't lock:
+	guest, _ := authenticator.GetUser("")
+	guestDB := &Database{DatabaseContext: db.DatabaseContext, user: guest}
+	_, err = guestDB.LockDoc("form", time.Minute)
+	assertHTTPError(t, err, 403)
+
+	lock, err := naomiDB.LockDoc("form", time.Minute)
+	assertNoError(t, err, "LockDoc")
+	assert.Equals(t, lock.Owner, "naomi")
+	_, err = zoeDB.LockDoc("form", time.Minute)
+	assertHTTPError(t, err, kLockedStatus)
+
+	// Others can see the lock, but only its owner (or the admin) can write:
+	body, err := zoeDB.Get("form")
+	assertNoError(t, err, "Get")
+	assert.Equals(t, body["_lock"], nil) // not part of the doc body
+	lock, err = zoeDB.GetDocLock("form")
+	assertNoError(t, err, "GetDocLock")
+	assert.Equals(t, lock.Owner, "naomi")
+	_, err = zoeDB.Put("form", Body{"_rev": rev1id, "channels": []string{"forms"}, "by": "zoe"})
+	assertHTTPError(t, err, kLockedStatus)
+	rev2id, err := naomiDB.Put("form", Body{"_rev": rev1id, "channels": []string{"forms"}, "by": "naomi"})
+	assertNoError(t, err, "Put by lock owner")
+	assertHTTPError(t, zoeDB.UnlockDoc("form"), kLockedStatus)
+
+	// After it's released, others can write:
+	assertNoError(t, naomiDB.UnlockDoc("form"), "UnlockDoc")
+	lock, err = zoeDB.GetDocLock("form")
+	assertNoError(t, err, "GetDocLock")
+	assert.True(t, lock == nil)
+	_, err = zoeDB.Put("form", Body{"_rev": rev2id, "channels": []string{"forms"}, "by": "zoe"})
+	assertNoError(t, err, "Put after unlock")
+
+	// Locking takes write access, not just read access:
+	db.ChannelMapper = channels.NewChannelMapper(`function(doc, oldDoc) {
+		channel(doc.channels);
+		if (oldDoc) requireUser(oldDoc.by);
+	}`)
+	_, err = naomiDB.LockDoc("form", time.Minute)
+	assertHTTPError(t, err, 403)
+	_, err = zoeDB.LockDoc("form", time.Minute)
+	assertNoError(t, err, "LockDoc by writer")
+}
+
+func TestAtomicUpdate(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+	db.ChannelMapper = channels.NewChannelMapper(`function(doc){
+		if (doc.balance < 0) throw({forbidden: "overdrawn"});
+	}`)
+
+	revids, err := db.AtomicUpdate([]Body{Body{"_id": "alice", "balance": 10}, Body{"_id": "bob", "balance": 0}})
+	assertNoError(t, err, "AtomicUpdate")
+	assert.Equals(t, len(revids), 2)
+
+	// A transfer between the two accounts:
+	revids, err = db.AtomicUpdate([]Body{
+		Body{"_id": "alice", "_rev": revids[0], "balance": 5},
+		Body{"_id": "bob", "_rev": revids[1], "balance": 5}})
+	assertNoError(t, err, "AtomicUpdate")
+	aliceRev, bobRev := revids[0], revids[1]
+
+	// A stale revision fails the whole update before anything's written:
+	_, err = db.AtomicUpdate([]Body{
+		Body{"_id": "alice", "_rev": aliceRev, "balance": 0},
+		Body{"_id": "bob", "_rev": "1-bogus", "balance": 10}})
+	assertHTTPError(t, err, 409)
+	rev, _ := db.GetCurrentRevID("alice")
+	assert.Equals(t, rev, aliceRev)
+
+	// If a write is rejected, the earlier ones are rolled back:
+	_, err = db.AtomicUpdate([]Body{
+		Body{"_id": "bob", "_rev": bobRev, "balance": 20},
+		Body{"_id": "carol", "balance": 1},
+		Body{"_id": "alice", "_rev": aliceRev, "balance": -10}})
+	assertHTTPError(t, err, 403)
+	body, err := db.Get("bob")
+	assertNoError(t, err, "Get bob")
+	assert.Equals(t, body["balance"], float64(5))
+	_, err = db.Get("carol")
+	assertHTTPError(t, err, 404)
+	body, err = db.Get("alice")
+	assertNoError(t, err, "Get alice")
+	assert.Equals(t, body["balance"], float64(5))
+
+	// No intent logs are left behind:
+	var pending []string
+	assertNoError(t, db.Bucket.Get(kAtomicWriteRegistryKey, &pending), "Get registry")
+	assert.Equals(t, len(pending), 0)
+
+	_, err = db.AtomicUpdate([]Body{Body{"_id": "x"}, Body{"_id": "x"}})
+	assertHTTPError(t, err, 400)
+
+	// If the rollback fails too, the intent log is kept so it can be recovered later:
+	db.ChannelMapper = channels.NewChannelMapper(`function(doc, oldDoc){
+		if (doc.balance < 0) throw({forbidden: "overdrawn"});
+		if (oldDoc && oldDoc.frozen) throw({forbidden: "frozen"});
+	}`)
+	bobRev, _ = db.GetCurrentRevID("bob")
+	_, err = db.AtomicUpdate([]Body{
+		Body{"_id": "bob", "_rev": bobRev, "balance": 5, "frozen": true},
+		Body{"_id": "alice", "_rev": aliceRev, "balance": -10}})
+	assertHTTPError(t, err, 500)
+	assertNoError(t, db.Bucket.Get(kAtomicWriteRegistryKey, &pending), "Get registry")
+	assert.Equals(t, len(pending), 1)
+
+	// ...which the sweeper does, once the update has timed out:
+	db.ChannelMapper = channels.NewChannelMapper(`function(doc){}`)
+	defer func(timeout time.Duration) { AtomicWriteTimeout = timeout }(AtomicWriteTimeout)
+	AtomicWriteTimeout = 0
+	db.Sweep(0)
+	assertNoError(t, db.Bucket.Get(kAtomicWriteRegistryKey, &pending), "Get registry")
+	assert.Equals(t, len(pending), 0)
+	body, err = db.Get("bob")
+	assertNoError(t, err, "Get bob")
+	assert.Equals(t, body["frozen"], nil)
+}
+
+func TestAtomicUpdateHoldsChanges(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+	db.ChannelMapper = channels.NewChannelMapper(`function(doc){channel(doc.channels);}`)
+	getChanges := func() []*ChangeEntry {
+		db.changesWriter.checkpoint()
+		options := ChangesOptions{Terminator: make(chan bool)}
+		defer close(options.Terminator)
+		changes, err := db.GetChanges(channels.SetOf("all"), options)
+		assertNoError(t, err, "GetChanges")
+		return changes
+	}
+
+	_, err := db.Put("before", Body{"channels": "all"})
+	assertNoError(t, err, "Put")
+
+	// Feeds stop short of an atomic update that's in progress:
+	holdSeq, err := db.sequences.nextSequence()
+	assertNoError(t, err, "nextSequence")
+	logKey := kAtomicWriteKeyPrefix + "test"
+	assertNoError(t, db.Bucket.Set(logKey, 0, atomicWriteLog{Started: time.Now(), HoldSeq: holdSeq}), "Set log")
+	assertNoError(t, db.updateAtomicWriteRegistry(logKey, true), "Update registry")
+	_, err = db.Put("during", Body{"channels": "all"})
+	assertNoError(t, err, "Put")
+	changes := getChanges()
+	assert.Equals(t, len(changes), 1)
+	assert.Equals(t, changes[0].ID, "before")
+
+	// ...and see its changes once it's done:
+	db.Bucket.Delete(logKey)
+	assertNoError(t, db.updateAtomicWriteRegistry(logKey, false), "Update registry")
+	changes = getChanges()
+	assert.Equals(t, len(changes), 2)
+	assert.Equals(t, changes[1].ID, "during")
+}
+
+func TestExternalRevBodies(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+
+	// Create a conflict while bodies are stored inline:
+	assertNoError(t, db.PutExistingRev("ext", Body{"n": 1}, []string{"1-a"}), "add 1-a")
+	assertNoError(t, db.PutExistingRev("ext", Body{"n": 2}, []string{"2-b", "1-a"}), "add 2-b")
+	assertNoError(t, db.PutExistingRev("ext", Body{"n": 3}, []string{"2-a", "1-a"}), "add 2-a")
+	doc, _ := db.GetDoc("ext")
+	assert.True(t, doc.History["2-a"].Body != nil)
+
+	_, err := db.MigrateRevBodies()
+	assert.True(t, err != nil) // External bodies aren't enabled
+
+	// Migrating moves the losing rev's body out of the tree, and it's loaded on demand:
+	db.ExternalRevBodies = true
+	count, err := db.MigrateRevBodies()
+	assertNoError(t, err, "MigrateRevBodies")
+	assert.Equals(t, count, 1)
+	doc, _ = db.GetDoc("ext")
+	assert.True(t, doc.History["2-a"].Body == nil)
+	assert.Equals(t, doc.History["2-a"].BodyKey, revBodyKey("ext", "2-a"))
+	body, err := db.getRevision(doc, "2-a")
+	assertNoError(t, err, "getRevision")
+	assert.Equals(t, body["n"], int64(3))
+
+	// New conflicts are stored externally when the doc is saved:
+	assertNoError(t, db.PutExistingRev("ext", Body{"n": 4}, []string{"3-a", "2-a"}), "add 3-a")
+	doc, _ = db.GetDoc("ext")
+	assert.Equals(t, doc.CurrentRev, "3-a")
+	assert.True(t, doc.History["2-b"].Body == nil)
+	assert.Equals(t, doc.History["2-b"].BodyKey, revBodyKey("ext", "2-b"))
+	assert.Equals(t, doc.History["2-a"].BodyKey, "")
+
+	// Compaction deletes only the body that's no longer referenced (2-a's), and only once it's
+	// been unreferenced for the grace period:
+	_, err = db.Compact()
+	assertNoError(t, err, "Compact")
+	_, err = db.Bucket.GetRaw(revBodyKey("ext", "2-a"))
+	assertNoError(t, err, "Body deleted within grace period")
+	defer func(grace time.Duration) { RevBodyOrphanGracePeriod = grace }(RevBodyOrphanGracePeriod)
+	RevBodyOrphanGracePeriod = 0
+	_, err = db.Compact()
+	assertNoError(t, err, "Compact")
+	_, err = db.Bucket.GetRaw(revBodyKey("ext", "2-a"))
+	assert.True(t, base.IsDocNotFoundError(err))
+	body, err = db.getRevision(doc, "2-b")
+	assertNoError(t, err, "getRevision after compact")
+	assert.Equals(t, body["n"], int64(2))
+
+	docid, revid, ok := parseRevBodyKey(revBodyKey("a:b:1", "2-b"))
+	assert.True(t, ok)
+	assert.Equals(t, docid, "a:b:1")
+	assert.Equals(t, revid, "2-b")
+}
+
 //////// BENCHMARKS
 
 func BenchmarkDatabase(b *testing.B) {
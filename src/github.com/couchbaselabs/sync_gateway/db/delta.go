@@ -0,0 +1,339 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+
+	"github.com/couchbaselabs/go-couchbase"
+
+	"github.com/couchbaselabs/sync_gateway/base"
+)
+
+// A delta is a JSON object describing how to turn one revision body into another. Each key
+// maps to a 1-element array [value] if the property is set to that value, an empty array [] if
+// the property is removed, or a nested delta object if both values are objects. (Encoding
+// values in arrays makes it unambiguous, unlike JSON merge-patch, where "null" means deletion.)
+type Delta map[string]interface{}
+
+// A delta is only used if its JSON is at most this fraction of the size of the full body
+const kMaxDeltaRatio = 0.5
+
+// Max number of deltas that have to be applied to reconstruct an archived revision
+const kMaxDeltaChain = 4
+
+// Computes the delta from one body to another.
+func diffBodies(source, target map[string]interface{}) Delta {
+	delta := Delta{}
+	for key, targetValue := range target {
+		sourceValue, exists := source[key]
+		if exists && reflect.DeepEqual(sourceValue, targetValue) {
+			continue
+		}
+		sourceMap, ok1 := sourceValue.(map[string]interface{})
+		targetMap, ok2 := targetValue.(map[string]interface{})
+		if ok1 && ok2 {
+			delta[key] = map[string]interface{}(diffBodies(sourceMap, targetMap))
+		} else {
+			delta[key] = []interface{}{targetValue}
+		}
+	}
+	for key := range source {
+		if _, exists := target[key]; !exists {
+			delta[key] = []interface{}{}
+		}
+	}
+	return delta
+}
+
+// Applies a delta to a body, returning a new body (the source isn't modified.)
+func applyDelta(source map[string]interface{}, delta Delta) (map[string]interface{}, error) {
+	result := make(map[string]interface{}, len(source)+len(delta))
+	for key, value := range source {
+		result[key] = value
+	}
+	for key, change := range delta {
+		switch change := change.(type) {
+		case []interface{}:
+			if len(change) == 0 {
+				delete(result, key)
+			} else if len(change) == 1 {
+				result[key] = change[0]
+			} else {
+				return nil, base.HTTPErrorf(400, "Invalid delta for property %q", key)
+			}
+		case map[string]interface{}:
+			sourceMap, _ := result[key].(map[string]interface{})
+			if sourceMap == nil {
+				return nil, base.HTTPErrorf(400, "Delta for property %q needs an object", key)
+			}
+			updated, err := applyDelta(sourceMap, Delta(change))
+			if err != nil {
+				return nil, err
+			}
+			result[key] = updated
+		default:
+			return nil, base.HTTPErrorf(400, "Invalid delta for property %q", key)
+		}
+	}
+	return result, nil
+}
+
+// Returns the JSON of the delta between two bodies, or nil if it isn't small enough to be
+// worth using in place of the target's full JSON.
+func encodeDeltaIfSmaller(source, target map[string]interface{}, targetSize int) []byte {
+	deltaJSON, err := json.Marshal(diffBodies(source, target))
+	if err != nil || float64(len(deltaJSON)) > kMaxDeltaRatio*float64(targetSize) {
+		return nil
+	}
+	return deltaJSON
+}
+
+//////// ARCHIVED REVISIONS:
+
+// An archived revision stored as a delta from its parent's archived body. (Old revisions are
+// archived, and compacted away, together, so the parent's body outlives the delta. Bodies
+// kept inside the document's RevTree aren't delta-encoded, since a leaf's parent usually has
+// no body available there.)
+type archivedDelta struct {
+	Source string          `json:"_deltaSrc"`
+	Depth  int             `json:"_deltaDepth"`
+	Delta  json.RawMessage `json:"_delta"`
+}
+
+func isArchivedDelta(data []byte) bool {
+	return len(data) > 12 && string(data[0:12]) == `{"_deltaSrc"`
+}
+
+// Encodes the JSON of a revision being archived as a delta from its parent's archived JSON,
+// if that's available and the delta is small enough. Otherwise returns the JSON unchanged.
+func (db *DatabaseContext) encodeArchivedRevision(docid, parentRevID string, data []byte) []byte {
+	if parentRevID == "" {
+		return data
+	}
+	parentRaw, err := db.Bucket.GetRaw(oldRevisionKey(docid, parentRevID))
+	if err != nil {
+		return data
+	}
+	depth := 1
+	if isArchivedDelta(parentRaw) {
+		var parentDelta archivedDelta
+		if json.Unmarshal(parentRaw, &parentDelta) != nil || parentDelta.Depth >= kMaxDeltaChain {
+			return data
+		}
+		depth = parentDelta.Depth + 1
+		if parentRaw, err = db.getOldRevisionJSON(docid, parentRevID); err != nil {
+			return data
+		}
+	}
+	var parentBody, body map[string]interface{}
+	if json.Unmarshal(parentRaw, &parentBody) != nil || json.Unmarshal(data, &body) != nil {
+		return data
+	}
+	deltaJSON := encodeDeltaIfSmaller(parentBody, body, len(data))
+	if deltaJSON == nil {
+		return data
+	}
+	encoded, err := json.Marshal(archivedDelta{Source: parentRevID, Depth: depth, Delta: deltaJSON})
+	if err != nil {
+		return data
+	}
+	base.LogTo("CRUD+", "Archiving rev of %q as %d-byte delta from %q (instead of %d bytes)",
+		docid, len(deltaJSON), parentRevID, len(data))
+	return encoded
+}
+
+// Notes that a compaction has started or finished. Starting one waits for revisions being
+// archived (maybe as deltas) to finish.
+func (db *DatabaseContext) setCompacting(compacting bool) {
+	db.archiveLock.Lock()
+	if compacting {
+		db.compacting++
+	} else {
+		db.compacting--
+	}
+	db.archiveLock.Unlock()
+}
+
+// Rewrites an archived revision stored as a delta with its full JSON, so it no longer depends
+// on its source revision's archive.
+func (db *DatabaseContext) materializeArchivedRevision(key string) error {
+	data, err := db.Bucket.GetRaw(key)
+	if err != nil || !isArchivedDelta(data) {
+		return err
+	}
+	docid := oldRevisionDocID(key)
+	if data, err = db.decodeArchivedRevision(docid, data); err != nil {
+		return err
+	}
+	base.LogTo("CRUD+", "Storing archived rev %q whole, since compaction will delete its source", key)
+	return db.Bucket.SetRaw(key, 0, data)
+}
+
+// Deletes an archived revision for compaction. If a delta that isn't being compacted was made
+// from it (by another gateway, after the compaction began) the delta is stored whole first.
+// The deletion is conditional on the revision's CAS, which archiving a delta from it changes
+// (see setOldRevisionJSON), so a delta that's written while this checks isn't missed.
+func (db *DatabaseContext) deleteArchivedRevision(key string, compacted map[string]bool) (bool, error) {
+	docid := oldRevisionDocID(key)
+	revid := key[strings.LastIndex(key, ":")+1:]
+	err := db.Bucket.Update(key, 0, func(current []byte) ([]byte, error) {
+		if current == nil {
+			return nil, couchbase.UpdateCancel // already deleted
+		}
+		if doc, _ := db.GetDoc(docid); doc != nil {
+			for childID, info := range doc.History {
+				childKey := oldRevisionKey(docid, childID)
+				if info.Parent == revid && !compacted[childKey] {
+					if err := db.materializeArchivedRevision(childKey); err != nil &&
+						!base.IsDocNotFoundError(err) {
+						return nil, err
+					}
+				}
+			}
+		}
+		return nil, nil // deletes it
+	})
+	if err == couchbase.UpdateCancel {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Sorts old revisions' keys by doc ID, and each doc's by descending generation.
+type oldRevisionKeysNewestFirst []string
+
+func (keys oldRevisionKeysNewestFirst) Len() int      { return len(keys) }
+func (keys oldRevisionKeysNewestFirst) Swap(i, j int) { keys[i], keys[j] = keys[j], keys[i] }
+func (keys oldRevisionKeysNewestFirst) Less(i, j int) bool {
+	docid1, docid2 := oldRevisionDocID(keys[i]), oldRevisionDocID(keys[j])
+	if docid1 != docid2 {
+		return docid1 < docid2
+	}
+	gen1, _ := parseRevID(keys[i][strings.LastIndex(keys[i], ":")+1:])
+	gen2, _ := parseRevID(keys[j][strings.LastIndex(keys[j], ":")+1:])
+	return gen1 > gen2
+}
+
+// Reconstructs the JSON of an archived revision that was stored as a delta.
+func (db *DatabaseContext) decodeArchivedRevision(docid string, data []byte) ([]byte, error) {
+	var stored archivedDelta
+	var delta Delta
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return nil, err
+	} else if err := json.Unmarshal(stored.Delta, &delta); err != nil {
+		return nil, err
+	}
+	sourceJSON, err := db.getOldRevisionJSON(docid, stored.Source)
+	if err != nil {
+		base.Warn("Archived rev of %q is a delta from missing rev %q", docid, stored.Source)
+		return nil, err
+	}
+	var source map[string]interface{}
+	if err := json.Unmarshal(sourceJSON, &source); err != nil {
+		return nil, err
+	}
+	body, err := applyDelta(source, delta)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(body)
+}
+
+// Adds the digests of the attachments that an archived delta sets or changes. (Attachments it
+// inherits unchanged are referenced by the source revision's archived body.)
+func addDeltaAttachmentKeys(data []byte, keys map[AttachmentKey]bool) {
+	var stored struct {
+		Delta struct {
+			Attachments interface{} `json:"_attachments"`
+		} `json:"_delta"`
+	}
+	if json.Unmarshal(data, &stored) != nil {
+		return
+	}
+	switch change := stored.Delta.Attachments.(type) {
+	case []interface{}: // All of _attachments was replaced
+		if len(change) == 1 {
+			addAttachmentKeys(Body{"_attachments": change[0]}, keys)
+		}
+	case map[string]interface{}: // Individual attachments were added or changed
+		for _, attChange := range change {
+			switch attChange := attChange.(type) {
+			case []interface{}:
+				if len(attChange) == 1 {
+					addAttachmentKeys(Body{"_attachments": map[string]interface{}{"": attChange[0]}}, keys)
+				}
+			case map[string]interface{}:
+				if digest, ok := attChange["digest"].([]interface{}); ok && len(digest) == 1 {
+					if str, ok := digest[0].(string); ok {
+						keys[AttachmentKey(str)] = true
+					}
+				}
+			}
+		}
+	}
+}
+
+//////// SERVING DELTAS:
+
+// Returns a revision as a delta from the most recent of its ancestors in 'knownRevs' (the
+// revisions the client already has), if there is one whose body is available and the delta is
+// small enough. The result has "_deltaSrc" and "_delta" properties in place of the document's
+// own properties; "_id", "_rev", "_revisions", "_deleted" and "_attachments" are left as-is.
+// Otherwise returns the full revision body like GetRev.
+func (db *Database) GetRevAsDelta(docid, revid string, listRevisions bool, attachmentsSince, knownRevs []string) (Body, error) {
+	body, err := db.GetRev(docid, revid, listRevisions, attachmentsSince)
+	if err != nil || len(knownRevs) == 0 || body["_removed"] != nil {
+		return body, err
+	}
+	doc, _ := db.GetDoc(docid)
+	if doc == nil {
+		return body, nil
+	}
+	revid = body["_rev"].(string)
+	parent := doc.History.getParent(revid)
+	if parent == "" {
+		return body, nil
+	}
+	sourceRev := doc.History.findAncestorFromSet(parent, knownRevs)
+	if sourceRev == "" {
+		return body, nil
+	}
+	sourceBody, err := db.getRevision(doc, sourceRev)
+	if err != nil {
+		return body, nil // Source body isn't available, so send the whole thing
+	}
+	source, target := userProperties(sourceBody), userProperties(body)
+	fullJSON, _ := json.Marshal(target)
+	deltaJSON := encodeDeltaIfSmaller(source, target, len(fullJSON))
+	if deltaJSON == nil {
+		return body, nil
+	}
+	result := Body{"_deltaSrc": sourceRev, "_delta": json.RawMessage(deltaJSON)}
+	for key, value := range body {
+		if strings.HasPrefix(key, "_") {
+			result[key] = value
+		}
+	}
+	return result, nil
+}
+
+// Returns just the non-special properties of a body (those not starting with "_").
+func userProperties(body Body) map[string]interface{} {
+	result := make(map[string]interface{}, len(body))
+	for key, value := range body {
+		if !strings.HasPrefix(key, "_") {
+			result[key] = value
+		}
+	}
+	return result
+}
@@ -0,0 +1,139 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func TestDiffBodies(t *testing.T) {
+	source := unjson(`{"a": 1, "b": "two", "c": {"x": true, "y": [1, 2]}, "gone": null}`)
+	target := unjson(`{"a": 1, "b": "TWO", "c": {"x": true, "y": [1, 2, 3]}, "new": {"k": 1}}`)
+	delta := diffBodies(source, target)
+	assert.Equals(t, tojson(delta), `{"b":["TWO"],"c":{"y":[[1,2,3]]},"gone":[],"new":[{"k":1}]}`)
+
+	result, err := applyDelta(source, delta)
+	assertNoError(t, err, "applyDelta failed")
+	assert.DeepEquals(t, Body(result), target)
+	assert.Equals(t, tojson(source["b"]), `"two"`) // source isn't modified
+
+	_, err = applyDelta(source, Delta{"a": map[string]interface{}{"x": []interface{}{1}}})
+	assertHTTPError(t, err, 400)
+}
+
+func TestArchivedDeltas(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+
+	big := strings.Repeat("lorem ipsum ", 100)
+	rev1, err := db.Put("doc", Body{"text": big, "n": 1})
+	assertNoError(t, err, "Put rev 1")
+	rev2, err := db.Put("doc", Body{"_rev": rev1, "text": big, "n": 2})
+	assertNoError(t, err, "Put rev 2")
+	_, err = db.Put("doc", Body{"_rev": rev2, "text": big, "n": 3})
+	assertNoError(t, err, "Put rev 3")
+
+	// rev 1 has no archived parent so it's stored whole; rev 2 is a delta from it:
+	raw1, _ := db.Bucket.GetRaw(oldRevisionKey("doc", rev1))
+	assertFalse(t, isArchivedDelta(raw1), "rev 1 shouldn't be a delta")
+	raw2, _ := db.Bucket.GetRaw(oldRevisionKey("doc", rev2))
+	assertTrue(t, isArchivedDelta(raw2), "rev 2 should be a delta")
+	assertTrue(t, len(raw2) < len(big)/2, "delta is too big")
+
+	body, err := db.GetRev("doc", rev2, false, nil)
+	assertNoError(t, err, "GetRev rev 2")
+	assert.Equals(t, body["text"], big)
+	assert.Equals(t, body["n"], int64(2))
+
+	// Serving rev 3 to a client that has rev 1:
+	body, err = db.GetRevAsDelta("doc", "", false, nil, []string{rev1})
+	assertNoError(t, err, "GetRevAsDelta")
+	assert.Equals(t, body["_deltaSrc"], rev1)
+	assert.Equals(t, tojson(body["_delta"]), `{"n":[3]}`)
+	assert.Equals(t, body["text"], nil)
+
+	// ...and to one that has nothing in common with it:
+	body, err = db.GetRevAsDelta("doc", "", false, nil, []string{"1-cafe"})
+	assertNoError(t, err, "GetRevAsDelta")
+	assert.Equals(t, body["_deltaSrc"], nil)
+	assert.Equals(t, body["text"], big)
+}
+
+func TestArchivedDeltasDuringCompaction(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+
+	big := strings.Repeat("lorem ipsum ", 100)
+	rev1, err := db.Put("doc", Body{"text": big, "n": 1})
+	assertNoError(t, err, "Put rev 1")
+	rev2, err := db.Put("doc", Body{"_rev": rev1, "text": big, "n": 2})
+	assertNoError(t, err, "Put rev 2")
+	rev3, err := db.Put("doc", Body{"_rev": rev2, "text": big, "n": 3})
+	assertNoError(t, err, "Put rev 3")
+
+	// Revisions archived while compacting are stored whole:
+	db.setCompacting(true)
+	_, err = db.Put("doc", Body{"_rev": rev3, "text": big, "n": 4})
+	db.setCompacting(false)
+	assertNoError(t, err, "Put rev 4")
+	raw3, _ := db.Bucket.GetRaw(oldRevisionKey("doc", rev3))
+	assertFalse(t, isArchivedDelta(raw3), "rev 3 shouldn't be a delta")
+
+	// A materialized delta survives the deletion of its source:
+	key2 := oldRevisionKey("doc", rev2)
+	assertNoError(t, db.materializeArchivedRevision(key2), "materializeArchivedRevision")
+	raw2, _ := db.Bucket.GetRaw(key2)
+	assertFalse(t, isArchivedDelta(raw2), "rev 2 should have been materialized")
+	assertNoError(t, db.Bucket.Delete(oldRevisionKey("doc", rev1)), "Delete rev 1")
+	body, err := db.GetRev("doc", rev2, false, nil)
+	assertNoError(t, err, "GetRev rev 2")
+	assert.Equals(t, body["text"], big)
+	assert.Equals(t, body["n"], int64(2))
+}
+
+func TestCompactionKeepsLateDeltas(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+
+	big := strings.Repeat("lorem ipsum ", 100)
+	rev1, err := db.Put("doc", Body{"text": big, "n": 1})
+	assertNoError(t, err, "Put rev 1")
+	rev2, err := db.Put("doc", Body{"_rev": rev1, "text": big, "n": 2})
+	assertNoError(t, err, "Put rev 2")
+	_, err = db.Put("doc", Body{"_rev": rev2, "text": big, "n": 3})
+	assertNoError(t, err, "Put rev 3")
+
+	// If only rev 1 is being compacted (rev 2 having been archived since the compaction began),
+	// rev 2 is stored whole before its source is deleted:
+	key1, key2 := oldRevisionKey("doc", rev1), oldRevisionKey("doc", rev2)
+	deleted, err := db.deleteArchivedRevision(key1, map[string]bool{key1: true})
+	assertNoError(t, err, "deleteArchivedRevision")
+	assertTrue(t, deleted, "rev 1 should have been deleted")
+	raw2, _ := db.Bucket.GetRaw(key2)
+	assertFalse(t, isArchivedDelta(raw2), "rev 2 should have been materialized")
+	body, err := db.GetRev("doc", rev2, false, nil)
+	assertNoError(t, err, "GetRev rev 2")
+	assert.Equals(t, body["n"], int64(2))
+
+	deleted, err = db.deleteArchivedRevision(key1, map[string]bool{key1: true})
+	assertNoError(t, err, "deleteArchivedRevision")
+	assertFalse(t, deleted, "rev 1 was already deleted")
+}
+
+func TestOldRevisionDocID(t *testing.T) {
+	assert.Equals(t, oldRevisionDocID(oldRevisionKey("doc", "2-abc")), "doc")
+	assert.Equals(t, oldRevisionDocID(oldRevisionKey("a:1:b", "10-abc")), "a:1:b")
+	assert.Equals(t, oldRevisionDocID(oldRevisionKey("", "1-a")), "")
+	assert.Equals(t, oldRevisionDocID("_sync:rev:doc:4:2-abc"), "")
+	assert.Equals(t, oldRevisionDocID("doc:5:2-abc"), "")
+}
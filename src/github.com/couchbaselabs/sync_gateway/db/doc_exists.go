@@ -0,0 +1,69 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"encoding/json"
+
+	"github.com/couchbaselabs/sync_gateway/base"
+)
+
+// What _exists reports about a document.
+type DocExistence struct {
+	Missing     bool     `json:"missing,omitempty"`      // No such doc (or the user can't see it)
+	Rev         string   `json:"rev,omitempty"`          // Current revision
+	Deleted     bool     `json:"deleted,omitempty"`      // Is the current revision a deletion?
+	MissingRevs []string `json:"missing_revs,omitempty"` // Requested revs that aren't in the doc
+}
+
+// Reads just the "_sync" metadata of a document, skipping the work of parsing its body.
+func (db *DatabaseContext) getSyncData(docid string) (*syncData, error) {
+	key := realDocID(docid)
+	if key == "" {
+		return nil, base.HTTPErrorf(400, "Invalid doc ID")
+	}
+	data, err := db.Bucket.GetRaw(key)
+	if err != nil {
+		return nil, err
+	}
+	var doc struct {
+		Sync *syncData `json:"_sync"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	if doc.Sync == nil || doc.Sync.CurrentRev == "" {
+		return nil, base.HTTPErrorf(404, "Not imported")
+	}
+	return doc.Sync, nil
+}
+
+// Reports whether a document exists and what its current revision is, and which of the given
+// revisions (if any) it doesn't have, using only its sync metadata. Docs the user has no access
+// to are reported as missing.
+func (db *Database) DocExists(docid string, revids []string) DocExistence {
+	sync, err := db.getSyncData(docid)
+	if err == nil {
+		err = db.authorizeDoc(&document{syncData: *sync, ID: docid}, "")
+	}
+	if err != nil {
+		if !base.IsDocNotFoundError(err) {
+			base.LogTo("CRUD+", "DocExists(%q) --> %v", docid, err)
+		}
+		return DocExistence{Missing: true, MissingRevs: revids}
+	}
+	result := DocExistence{Rev: sync.CurrentRev, Deleted: sync.Deleted}
+	for _, revid := range revids {
+		if !sync.History.contains(revid) {
+			result.MissingRevs = append(result.MissingRevs, revid)
+		}
+	}
+	return result
+}
@@ -0,0 +1,98 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/couchbaselabs/sync_gateway/base"
+)
+
+// Key of the counter document that supplies the {seq} placeholder of DocIDTemplates
+const kDocIDSequenceKey = kSyncKeyPrefix + "docidseq"
+
+var kDocIDPlaceholderRegexp = regexp.MustCompile(`\{([^{}]*)\}`)
+
+// A template for the IDs the server assigns to documents POSTed without one, like
+// "{type}:{uuid}". Placeholders are "{uuid}" (a random UUID), "{seq}" (a per-database counter),
+// or the name of a top-level string or number property of the document.
+type DocIDTemplate struct {
+	pattern string
+	unique  bool // Does the pattern contain {uuid} or {seq}?
+}
+
+func NewDocIDTemplate(pattern string) (*DocIDTemplate, error) {
+	template := &DocIDTemplate{pattern: pattern}
+	for _, match := range kDocIDPlaceholderRegexp.FindAllStringSubmatch(pattern, -1) {
+		switch match[1] {
+		case "":
+			return nil, fmt.Errorf("Empty placeholder in doc ID template %q", pattern)
+		case "uuid", "seq":
+			template.unique = true
+		}
+	}
+	if strings.HasPrefix(pattern, "_") {
+		return nil, fmt.Errorf("Doc ID template %q can't start with an underscore", pattern)
+	}
+	return template, nil
+}
+
+func (template *DocIDTemplate) String() string {
+	return template.pattern
+}
+
+// Generates a doc ID for a document body. The returned flag is true if calling this again
+// would produce a different ID, i.e. it's worth retrying if the ID turns out to be taken.
+func (template *DocIDTemplate) generate(body Body, nextSeq func() (uint64, error)) (string, bool, error) {
+	var err error
+	docid := kDocIDPlaceholderRegexp.ReplaceAllStringFunc(template.pattern, func(placeholder string) string {
+		if err != nil {
+			return ""
+		}
+		name := placeholder[1 : len(placeholder)-1]
+		switch name {
+		case "uuid":
+			return base.CreateUUID()
+		case "seq":
+			var seq uint64
+			seq, err = nextSeq()
+			return fmt.Sprintf("%d", seq)
+		}
+		switch value := body[name].(type) {
+		case string:
+			if value != "" {
+				return value
+			}
+		case float64, int, int64, uint64, json.Number:
+			return fmt.Sprintf("%v", value)
+		}
+		err = base.HTTPErrorf(http.StatusBadRequest,
+			"Document needs a string or number %q property to generate its ID", name)
+		return ""
+	})
+	if err == nil && strings.HasPrefix(docid, "_") {
+		err = base.HTTPErrorf(http.StatusBadRequest, "Generated doc ID %q is invalid", docid)
+	}
+	return docid, template.unique, err
+}
+
+// Returns the ID to give a new document that was POSTed without one.
+func (db *Database) newDocID(body Body) (string, bool, error) {
+	if db.DocIDTemplate == nil {
+		return base.CreateUUID(), true, nil
+	}
+	return db.DocIDTemplate.generate(body, func() (uint64, error) {
+		return db.Bucket.Incr(kDocIDSequenceKey, 1, 1, 0)
+	})
+}
@@ -0,0 +1,143 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/couchbaselabs/sync_gateway/base"
+)
+
+// Default and maximum lifetimes of a document lock
+const (
+	DefaultDocLockTTL = 5 * time.Minute
+	MaxDocLockTTL     = time.Hour
+)
+
+// HTTP status of a write rejected because another user holds the doc's lock (WebDAV "Locked")
+const kLockedStatus = 423
+
+// An advisory lock ("check-out") of a document by a user, stored in the doc's sync metadata.
+// While it's held, only its owner (or the admin API) can update the document. It expires on
+// its own so a client that goes away can't keep a document locked.
+type DocLock struct {
+	Owner   string    `json:"owner"`
+	Expires time.Time `json:"expires"`
+}
+
+func (lock *DocLock) isHeld() bool {
+	return lock != nil && time.Now().Before(lock.Expires)
+}
+
+// Returns an error if the doc is locked by someone other than the current user. Admins
+// (with no user) can always write.
+func (db *Database) checkDocLock(doc *document) error {
+	if !doc.Lock.isHeld() {
+		doc.Lock = nil // clear any expired lock
+		return nil
+	} else if db.user != nil && db.user.Name() != doc.Lock.Owner {
+		return base.HTTPErrorf(kLockedStatus, "Document is locked by another user")
+	}
+	return nil
+}
+
+// Locks a document for the current user, or renews the user's existing lock, for the given
+// duration. Fails if another user holds the lock, or if the user isn't allowed to update the
+// document, since a lock blocks everyone else's writes. The guest user can't lock documents:
+// every anonymous client is the guest, so its lock wouldn't keep anyone else out.
+func (db *Database) LockDoc(docid string, ttl time.Duration) (*DocLock, error) {
+	if db.user == nil {
+		return nil, base.HTTPErrorf(http.StatusBadRequest, "Only users can lock documents")
+	} else if db.user.Name() == "" {
+		return nil, base.HTTPErrorf(http.StatusForbidden, "The guest user can't lock documents")
+	} else if ttl <= 0 || ttl > MaxDocLockTTL {
+		return nil, base.HTTPErrorf(http.StatusBadRequest, "Invalid lock TTL")
+	}
+	lock := &DocLock{Owner: db.user.Name(), Expires: time.Now().Add(ttl).UTC()}
+	err := db.updateDocLock(docid, func(doc *document) error {
+		if err := db.checkDocLock(doc); err != nil {
+			return err
+		} else if err = db.authorizeDocWrite(doc); err != nil {
+			return err
+		}
+		doc.Lock = lock
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	base.LogTo("CRUD+", "User %q locked doc %q until %s", lock.Owner, docid, lock.Expires)
+	return lock, nil
+}
+
+// Returns an error unless the current user could update the document, by calling the sync
+// function as though the user were saving the current revision unchanged.
+func (db *Database) authorizeDocWrite(doc *document) error {
+	if db.user == nil {
+		return nil
+	}
+	body, err := db.getRevision(doc, doc.CurrentRev)
+	if err != nil {
+		return err
+	}
+	_, _, _, err = db.getChannelsAndAccess(doc, body, doc.CurrentRev)
+	return err
+}
+
+// Releases the lock on a document. Only the lock's owner or an admin can do this; it's not
+// an error if the doc isn't locked.
+func (db *Database) UnlockDoc(docid string) error {
+	return db.updateDocLock(docid, func(doc *document) error {
+		if err := db.checkDocLock(doc); err != nil {
+			return err
+		}
+		doc.Lock = nil
+		return nil
+	})
+}
+
+// Returns a document's lock, or nil if it isn't locked.
+func (db *Database) GetDocLock(docid string) (*DocLock, error) {
+	doc, err := db.GetDoc(docid)
+	if doc == nil {
+		return nil, err
+	} else if err = db.authorizeDoc(doc, doc.CurrentRev); err != nil {
+		return nil, err
+	} else if !doc.Lock.isHeld() {
+		return nil, nil
+	}
+	return doc.Lock, nil
+}
+
+// Changes a document's lock, without creating a new revision.
+func (db *Database) updateDocLock(docid string, callback func(*document) error) error {
+	key := realDocID(docid)
+	if key == "" {
+		return base.HTTPErrorf(http.StatusBadRequest, "Invalid doc ID")
+	}
+	return db.Bucket.Update(key, 0, func(currentValue []byte) ([]byte, error) {
+		if currentValue == nil {
+			return nil, base.HTTPErrorf(http.StatusNotFound, "missing")
+		}
+		doc, err := unmarshalDocument(docid, currentValue)
+		if err != nil {
+			return nil, err
+		} else if !doc.hasValidSyncData() {
+			return nil, base.HTTPErrorf(http.StatusNotFound, "Not imported")
+		} else if err = db.authorizeDoc(doc, doc.CurrentRev); err != nil {
+			return nil, err
+		} else if err = callback(doc); err != nil {
+			return nil, err
+		}
+		return json.Marshal(doc)
+	})
+}
@@ -0,0 +1,411 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A compiled JSON Schema (draft 4). The validation keywords supported are type, enum,
+// properties, required, additionalProperties, items, minItems, maxItems, minLength, maxLength,
+// pattern, minimum, maximum, exclusiveMinimum, exclusiveMaximum, allOf, anyOf, oneOf and not.
+// Other keywords (including $ref) are ignored, as the spec says unknown ones should be.
+type DocSchema struct {
+	types                []string
+	enum                 []interface{}
+	properties           map[string]*DocSchema
+	required             []string
+	additional           *DocSchema // Schema of properties not in 'properties' (nil = anything)
+	noAdditional         bool       // If true, no properties beyond 'properties' are allowed
+	items                *DocSchema
+	minItems, maxItems   int // -1 if not given
+	minLength, maxLength int // -1 if not given
+	pattern              *regexp.Regexp
+	minimum, maximum     *float64
+	exclusiveMin         bool
+	exclusiveMax         bool
+	allOf, anyOf, oneOf  []*DocSchema
+	not                  *DocSchema
+}
+
+// Where and why a value failed to match a schema.
+type SchemaViolation struct {
+	Path    string // JSON Pointer (RFC 6901) to the offending value; "" is the document itself
+	Message string
+}
+
+func (v *SchemaViolation) Error() string {
+	if v.Path == "" {
+		return "document " + v.Message
+	}
+	return v.Path + " " + v.Message
+}
+
+var kSchemaTypes = map[string]bool{"array": true, "boolean": true, "integer": true,
+	"null": true, "number": true, "object": true, "string": true}
+
+// Compiles a JSON Schema from its JSON source.
+func ParseDocSchema(source []byte) (*DocSchema, error) {
+	var schema interface{}
+	if err := json.Unmarshal(source, &schema); err != nil {
+		return nil, fmt.Errorf("schema isn't valid JSON: %v", err)
+	}
+	return compileDocSchema(schema, "")
+}
+
+func compileDocSchema(source interface{}, path string) (*DocSchema, error) {
+	props, ok := source.(map[string]interface{})
+	if !ok {
+		return nil, schemaSyntaxError(path, "must be an object")
+	}
+	schema := &DocSchema{minItems: -1, maxItems: -1, minLength: -1, maxLength: -1}
+	var err error
+
+	switch types := props["type"].(type) {
+	case nil:
+	case string:
+		schema.types = []string{types}
+	case []interface{}:
+		for _, t := range types {
+			if str, ok := t.(string); ok {
+				schema.types = append(schema.types, str)
+			} else {
+				return nil, schemaSyntaxError(path+"/type", "must contain only strings")
+			}
+		}
+	default:
+		return nil, schemaSyntaxError(path+"/type", "must be a string or array")
+	}
+	for _, t := range schema.types {
+		if !kSchemaTypes[t] {
+			return nil, schemaSyntaxError(path+"/type", fmt.Sprintf("has unknown type %q", t))
+		}
+	}
+
+	if enum, found := props["enum"]; found {
+		if schema.enum, ok = enum.([]interface{}); !ok || len(schema.enum) == 0 {
+			return nil, schemaSyntaxError(path+"/enum", "must be a non-empty array")
+		}
+	}
+
+	if properties, found := props["properties"]; found {
+		propMap, ok := properties.(map[string]interface{})
+		if !ok {
+			return nil, schemaSyntaxError(path+"/properties", "must be an object")
+		}
+		schema.properties = make(map[string]*DocSchema, len(propMap))
+		for name, sub := range propMap {
+			subPath := path + "/properties/" + escapeJSONPointer(name)
+			if schema.properties[name], err = compileDocSchema(sub, subPath); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if required, found := props["required"]; found {
+		names, ok := required.([]interface{})
+		if !ok {
+			return nil, schemaSyntaxError(path+"/required", "must be an array")
+		}
+		for _, name := range names {
+			if str, ok := name.(string); ok {
+				schema.required = append(schema.required, str)
+			} else {
+				return nil, schemaSyntaxError(path+"/required", "must contain only strings")
+			}
+		}
+	}
+
+	switch additional := props["additionalProperties"].(type) {
+	case nil:
+	case bool:
+		schema.noAdditional = !additional
+	default:
+		if schema.additional, err = compileDocSchema(additional, path+"/additionalProperties"); err != nil {
+			return nil, err
+		}
+	}
+
+	if items, found := props["items"]; found {
+		if schema.items, err = compileDocSchema(items, path+"/items"); err != nil {
+			return nil, err
+		}
+	}
+
+	for keyword, dst := range map[string]*int{"minItems": &schema.minItems,
+		"maxItems": &schema.maxItems, "minLength": &schema.minLength, "maxLength": &schema.maxLength} {
+		if value, found := props[keyword]; found {
+			n, ok := schemaNumber(value)
+			if !ok || n < 0 || n != math.Floor(n) {
+				return nil, schemaSyntaxError(path+"/"+keyword, "must be a non-negative integer")
+			}
+			*dst = int(n)
+		}
+	}
+	for keyword, dst := range map[string]**float64{"minimum": &schema.minimum,
+		"maximum": &schema.maximum} {
+		if value, found := props[keyword]; found {
+			n, ok := schemaNumber(value)
+			if !ok {
+				return nil, schemaSyntaxError(path+"/"+keyword, "must be a number")
+			}
+			*dst = &n
+		}
+	}
+	schema.exclusiveMin, _ = props["exclusiveMinimum"].(bool)
+	schema.exclusiveMax, _ = props["exclusiveMaximum"].(bool)
+
+	if pattern, found := props["pattern"]; found {
+		str, ok := pattern.(string)
+		if !ok {
+			return nil, schemaSyntaxError(path+"/pattern", "must be a string")
+		}
+		if schema.pattern, err = regexp.Compile(str); err != nil {
+			return nil, schemaSyntaxError(path+"/pattern", err.Error())
+		}
+	}
+
+	for keyword, dst := range map[string]*[]*DocSchema{"allOf": &schema.allOf,
+		"anyOf": &schema.anyOf, "oneOf": &schema.oneOf} {
+		if value, found := props[keyword]; found {
+			subs, ok := value.([]interface{})
+			if !ok || len(subs) == 0 {
+				return nil, schemaSyntaxError(path+"/"+keyword, "must be a non-empty array")
+			}
+			for i, sub := range subs {
+				compiled, err := compileDocSchema(sub, fmt.Sprintf("%s/%s/%d", path, keyword, i))
+				if err != nil {
+					return nil, err
+				}
+				*dst = append(*dst, compiled)
+			}
+		}
+	}
+
+	if not, found := props["not"]; found {
+		if schema.not, err = compileDocSchema(not, path+"/not"); err != nil {
+			return nil, err
+		}
+	}
+	return schema, nil
+}
+
+func schemaSyntaxError(path string, message string) error {
+	return fmt.Errorf("invalid schema: %s %s", "#"+path, message)
+}
+
+// Checks a value (as decoded from JSON) against the schema. Returns nil if it matches,
+// else the first violation found.
+func (schema *DocSchema) Validate(value interface{}) *SchemaViolation {
+	return schema.validate(value, "")
+}
+
+func (schema *DocSchema) validate(value interface{}, path string) *SchemaViolation {
+	fail := func(format string, args ...interface{}) *SchemaViolation {
+		return &SchemaViolation{Path: path, Message: fmt.Sprintf(format, args...)}
+	}
+
+	valueType := schemaTypeOf(value)
+	if schema.types != nil && !schema.allowsType(valueType, value) {
+		return fail("must be of type %s", strings.Join(schema.types, " or "))
+	}
+	if schema.enum != nil && !schemaEnumContains(schema.enum, value) {
+		return fail("must be one of the allowed values")
+	}
+
+	switch valueType {
+	case "object":
+		object := value.(map[string]interface{})
+		for _, name := range schema.required {
+			if _, found := object[name]; !found {
+				return &SchemaViolation{Path: path + "/" + escapeJSONPointer(name),
+					Message: "is required"}
+			}
+		}
+		// Check properties in a consistent order so the same violation is always reported:
+		names := make([]string, 0, len(object))
+		for name := range object {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			subPath := path + "/" + escapeJSONPointer(name)
+			sub := schema.properties[name]
+			if sub == nil {
+				if schema.noAdditional {
+					return &SchemaViolation{Path: subPath, Message: "is not an allowed property"}
+				}
+				sub = schema.additional
+			}
+			if sub != nil {
+				if v := sub.validate(object[name], subPath); v != nil {
+					return v
+				}
+			}
+		}
+	case "array":
+		array := value.([]interface{})
+		if schema.minItems >= 0 && len(array) < schema.minItems {
+			return fail("must have at least %d items", schema.minItems)
+		}
+		if schema.maxItems >= 0 && len(array) > schema.maxItems {
+			return fail("must have at most %d items", schema.maxItems)
+		}
+		if schema.items != nil {
+			for i, item := range array {
+				if v := schema.items.validate(item, path+"/"+strconv.Itoa(i)); v != nil {
+					return v
+				}
+			}
+		}
+	case "string":
+		str := value.(string)
+		length := len([]rune(str))
+		if schema.minLength >= 0 && length < schema.minLength {
+			return fail("must be at least %d characters long", schema.minLength)
+		}
+		if schema.maxLength >= 0 && length > schema.maxLength {
+			return fail("must be at most %d characters long", schema.maxLength)
+		}
+		if schema.pattern != nil && !schema.pattern.MatchString(str) {
+			return fail("must match the pattern %q", schema.pattern.String())
+		}
+	case "number":
+		n, _ := schemaNumber(value)
+		if min := schema.minimum; min != nil {
+			if n < *min || (schema.exclusiveMin && n == *min) {
+				return fail("must be greater than %s%v", orEqual(!schema.exclusiveMin), *min)
+			}
+		}
+		if max := schema.maximum; max != nil {
+			if n > *max || (schema.exclusiveMax && n == *max) {
+				return fail("must be less than %s%v", orEqual(!schema.exclusiveMax), *max)
+			}
+		}
+	}
+
+	for _, sub := range schema.allOf {
+		if v := sub.validate(value, path); v != nil {
+			return v
+		}
+	}
+	if schema.anyOf != nil {
+		matched := false
+		for _, sub := range schema.anyOf {
+			if sub.validate(value, path) == nil {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return fail("must match at least one of the anyOf schemas")
+		}
+	}
+	if schema.oneOf != nil {
+		matches := 0
+		for _, sub := range schema.oneOf {
+			if sub.validate(value, path) == nil {
+				matches++
+			}
+		}
+		if matches != 1 {
+			return fail("must match exactly one of the oneOf schemas (matches %d)", matches)
+		}
+	}
+	if schema.not != nil && schema.not.validate(value, path) == nil {
+		return fail("must not match the 'not' schema")
+	}
+	return nil
+}
+
+func (schema *DocSchema) allowsType(valueType string, value interface{}) bool {
+	for _, t := range schema.types {
+		if t == valueType {
+			return true
+		} else if t == "integer" && valueType == "number" {
+			if n, _ := schemaNumber(value); n == math.Floor(n) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func orEqual(inclusive bool) string {
+	if inclusive {
+		return "or equal to "
+	}
+	return ""
+}
+
+// Returns the JSON Schema type name of a decoded JSON value. (Integers are "number".)
+func schemaTypeOf(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	if _, ok := schemaNumber(value); ok {
+		return "number"
+	}
+	return "unknown"
+}
+
+// Converts any of the numeric types a decoded JSON number can have (see base.FixJSONNumbers)
+// to a float64.
+func schemaNumber(value interface{}) (float64, bool) {
+	switch n := value.(type) {
+	case float64:
+		return n, true
+	case int64:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
+
+func schemaEnumContains(enum []interface{}, value interface{}) bool {
+	n, isNumber := schemaNumber(value)
+	for _, item := range enum {
+		if isNumber {
+			if m, ok := schemaNumber(item); ok && m == n {
+				return true
+			}
+		} else if reflect.DeepEqual(item, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// Escapes a property name for use in a JSON Pointer.
+func escapeJSONPointer(name string) string {
+	return strings.Replace(strings.Replace(name, "~", "~0", -1), "/", "~1", -1)
+}
@@ -0,0 +1,75 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"testing"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+const kTestSchema = `{
+	"type": "object",
+	"required": ["type", "name"],
+	"properties": {
+		"type": {"enum": ["person", "company"]},
+		"name": {"type": "string", "minLength": 1, "maxLength": 20},
+		"age": {"type": "integer", "minimum": 0, "maximum": 150, "exclusiveMaximum": true},
+		"tags": {"type": "array", "maxItems": 2, "items": {"type": "string", "pattern": "^[a-z]+$"}},
+		"address": {
+			"type": "object",
+			"properties": {"zip/code": {"type": ["string", "null"]}},
+			"additionalProperties": false
+		},
+		"contact": {"oneOf": [{"required": ["email"]}, {"required": ["phone"]}]}
+	}
+}`
+
+func TestDocSchema(t *testing.T) {
+	schema, err := ParseDocSchema([]byte(kTestSchema))
+	assertNoError(t, err, "ParseDocSchema failed")
+
+	pathOf := func(docJSON string) string {
+		violation := schema.Validate(map[string]interface{}(unjson(docJSON)))
+		if violation == nil {
+			return "(valid)"
+		}
+		return violation.Path
+	}
+	assert.Equals(t, pathOf(`{"type": "person", "name": "Ann"}`), "(valid)")
+	assert.Equals(t, pathOf(`{"type": "person", "name": "Ann", "age": 35, "tags": ["x", "y"],
+		"address": {"zip/code": null}, "contact": {"email": "ann@example.com"}}`), "(valid)")
+
+	assert.Equals(t, pathOf(`{"name": "Ann"}`), "/type")
+	assert.Equals(t, pathOf(`{"type": "robot", "name": "Ann"}`), "/type")
+	assert.Equals(t, pathOf(`{"type": "person", "name": ""}`), "/name")
+	assert.Equals(t, pathOf(`{"type": "person", "name": 17}`), "/name")
+	assert.Equals(t, pathOf(`{"type": "person", "name": "Ann", "age": 35.5}`), "/age")
+	assert.Equals(t, pathOf(`{"type": "person", "name": "Ann", "age": 150}`), "/age")
+	assert.Equals(t, pathOf(`{"type": "person", "name": "Ann", "age": -1}`), "/age")
+	assert.Equals(t, pathOf(`{"type": "person", "name": "Ann", "tags": ["ok", "NOT"]}`), "/tags/1")
+	assert.Equals(t, pathOf(`{"type": "person", "name": "Ann", "tags": ["a", "b", "c"]}`), "/tags")
+	assert.Equals(t, pathOf(`{"type": "person", "name": "Ann", "address": {"zip/code": 5}}`), "/address/zip~1code")
+	assert.Equals(t, pathOf(`{"type": "person", "name": "Ann", "address": {"street": "x"}}`), "/address/street")
+	assert.Equals(t, pathOf(`{"type": "person", "name": "Ann", "contact": {}}`), "/contact")
+	assert.Equals(t, pathOf(`{"type": "person", "name": "Ann", "contact": {"email": "a", "phone": "b"}}`), "/contact")
+
+	violation := schema.Validate(map[string]interface{}(unjson(`{"type": "person"}`)))
+	assert.Equals(t, violation.Error(), "/name is required")
+	violation = schema.Validate([]interface{}{})
+	assert.Equals(t, violation.Error(), "document must be of type object")
+
+	// Bad schemas:
+	for _, bad := range []string{`[]`, `{"type": "thing"}`, `{"enum": []}`, `{"pattern": "("}`,
+		`{"properties": {"x": {"minLength": -1}}}`, `{"anyOf": {}}`, `{"required": [1]}`} {
+		_, err := ParseDocSchema([]byte(bad))
+		assertTrue(t, err != nil, "bad schema accepted: "+bad)
+	}
+}
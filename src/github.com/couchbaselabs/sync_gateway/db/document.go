@@ -36,6 +36,9 @@ type syncData struct {
 	Channels   ChannelMap    `json:"channels,omitempty"`
 	Access     UserAccessMap `json:"access,omitempty"`
 	RoleAccess UserAccessMap `json:"role_access,omitempty"`
+	Lock       *DocLock      `json:"lock,omitempty"` // Advisory lock held by a user
+
+	Resolutions []*ConflictResolution `json:"resolutions,omitempty"` // Recent automatic conflict resolutions
 
 	// Fields used by bucket-shadowing:
 	UpstreamCAS *uint64 `json:"upstream_cas,omitempty"` // CAS value of remote doc
@@ -78,13 +81,14 @@ func (doc *document) newestRevID() string {
 	return doc.CurrentRev
 }
 
-// Fetches the body of a revision as a map, or nil if it's not available.
-func (doc *document) getRevision(revid string) Body {
+// Fetches the body of a revision as a map, or nil if it's not available. The loader reads
+// bodies stored outside the doc (see DatabaseContext.loadRevBody) and may be nil.
+func (doc *document) getRevision(revid string, loader RevBodyLoaderFunc) Body {
 	var body Body
 	if revid == doc.CurrentRev {
 		body = doc.body
 	} else {
-		body = doc.History.getParsedRevisionBody(revid)
+		body = doc.History.getParsedRevisionBody(revid, loader)
 		if body == nil {
 			return nil
 		}
@@ -93,12 +97,12 @@ func (doc *document) getRevision(revid string) Body {
 }
 
 // Fetches the body of a revision as JSON, or nil if it's not available.
-func (doc *document) getRevisionJSON(revid string) []byte {
+func (doc *document) getRevisionJSON(revid string, loader RevBodyLoaderFunc) []byte {
 	var bodyJSON []byte
 	if revid == doc.CurrentRev {
 		bodyJSON, _ = json.Marshal(doc.body)
 	} else {
-		bodyJSON, _ = doc.History.getRevisionBody(revid)
+		bodyJSON, _ = doc.History.getRevisionBody(revid, loader)
 	}
 	return bodyJSON
 }
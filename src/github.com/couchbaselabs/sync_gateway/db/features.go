@@ -0,0 +1,75 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"net/http"
+
+	"github.com/couchbaselabs/sync_gateway/base"
+)
+
+// Names of the optional features a database can offer its clients.
+const (
+	FeatureDeltas              = "deltas"                // GET and _bulk_get with ?deltas=true
+	FeatureWebSockets          = "websockets"            // _changes?feed=websocket
+	FeatureAttachmentsByDigest = "attachments_by_digest" // Attachment bodies addressed by digest
+	FeaturePatch               = "patch"                 // Partial document updates
+	FeatureSnapshot            = "snapshot"              // _all_docs and _bulk_get with ?at_seq
+)
+
+// Maps each optional feature to whether this version of the gateway implements it. Features
+// that are implemented are enabled unless the database's config turns them off.
+var kImplementedFeatures = map[string]bool{
+	FeatureDeltas:              true,
+	FeatureWebSockets:          true,
+	FeatureAttachmentsByDigest: false,
+	FeaturePatch:               false,
+	FeatureSnapshot:            true,
+}
+
+// Enables or disables optional features, given a map from feature names to booleans.
+// Features not mentioned keep their default (enabled if implemented.)
+func (context *DatabaseContext) SetFeatures(features map[string]bool) error {
+	for name, enabled := range features {
+		implemented, known := kImplementedFeatures[name]
+		if !known {
+			return base.HTTPErrorf(http.StatusBadRequest, "Unknown feature %q", name)
+		} else if enabled && !implemented {
+			return base.HTTPErrorf(http.StatusBadRequest, "Feature %q is not implemented", name)
+		}
+	}
+	context.features = features
+	return nil
+}
+
+// Returns true if an optional feature is enabled for this database.
+func (context *DatabaseContext) FeatureEnabled(name string) bool {
+	if enabled, set := context.features[name]; set {
+		return enabled
+	}
+	return kImplementedFeatures[name]
+}
+
+// Returns a map from the name of every optional feature to whether it's enabled.
+func (context *DatabaseContext) Capabilities() map[string]bool {
+	capabilities := make(map[string]bool, len(kImplementedFeatures))
+	for name := range kImplementedFeatures {
+		capabilities[name] = context.FeatureEnabled(name)
+	}
+	return capabilities
+}
+
+// Returns a 400 error if an optional feature isn't enabled.
+func (context *DatabaseContext) RequireFeature(name string) error {
+	if !context.FeatureEnabled(name) {
+		return base.HTTPErrorf(http.StatusBadRequest, "Feature %q is not enabled for this database", name)
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"github.com/couchbaselabs/walrus"
+	"github.com/robertkrimen/otto"
+
+	"github.com/couchbaselabs/sync_gateway/base"
+)
+
+// Number of JS runners (and Otto contexts) for the import filter to cache
+const kImportFilterTaskCacheSize = 2
+
+// A JavaScript function that decides whether a document that was written directly to the
+// bucket (without sync metadata) should be imported. It's called with the document's body
+// and returns true to import it.
+type ImportFilterFunction struct {
+	*walrus.JSServer // "Superclass"
+}
+
+func NewImportFilterFunction(fnSource string) *ImportFilterFunction {
+	return &ImportFilterFunction{
+		JSServer: walrus.NewJSServer(fnSource, kImportFilterTaskCacheSize,
+			func(fnSource string) (walrus.JSServerTask, error) {
+				runner, err := walrus.NewJSRunner(fnSource)
+				if err != nil {
+					return nil, err
+				}
+				runner.After = func(result otto.Value, err error) (interface{}, error) {
+					if err != nil {
+						return nil, err
+					}
+					return result.ToBoolean()
+				}
+				return runner, nil
+			}),
+	}
+}
+
+// Returns true if the document with this body should be imported.
+func (filter *ImportFilterFunction) ShouldImport(body Body) (bool, error) {
+	result, err := filter.Call(map[string]interface{}(body))
+	if err != nil {
+		return false, err
+	}
+	return result.(bool), nil
+}
+
+// Sets the database's import filter from JS source code; an empty string removes it.
+func (context *DatabaseContext) ApplyImportFilter(fnSource string) error {
+	if fnSource == "" {
+		context.ImportFilter = nil
+		return nil
+	}
+	if _, err := walrus.NewJSRunner(fnSource); err != nil { // Check that it compiles
+		base.Warn("Error setting import filter: %s", err)
+		return err
+	}
+	context.ImportFilter = NewImportFilterFunction(fnSource)
+	return nil
+}
+
+// Decides whether a doc without sync metadata should be imported, by calling the import
+// filter if there is one. A filter that fails to run rejects the doc.
+func (context *DatabaseContext) shouldImport(doc *document) bool {
+	if context.ImportFilter == nil {
+		return true
+	}
+	shouldImport, err := context.ImportFilter.ShouldImport(doc.body)
+	if err != nil {
+		base.Warn("Error calling import filter on doc %q: %v", doc.ID, err)
+		shouldImport = false
+	}
+	if shouldImport {
+		dbExpvars.Add("importFilterAccepted", 1)
+	} else {
+		base.LogTo("CRUD+", "Import filter rejected doc %q", doc.ID)
+		dbExpvars.Add("importFilterRejected", 1)
+	}
+	return shouldImport
+}
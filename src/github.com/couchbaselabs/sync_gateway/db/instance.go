@@ -0,0 +1,97 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"time"
+
+	"github.com/couchbaselabs/sync_gateway/base"
+	"github.com/couchbaselabs/sync_gateway/channels"
+)
+
+// CouchDB-style replicators compare the database's "instance_start_time" when they save a
+// checkpoint with its value when they started; if it changed, the database may have lost
+// changes, so they don't trust the checkpoint. A gateway restart doesn't lose anything (the
+// data is in the bucket), but a flushed or recreated bucket does. So the instance start time
+// is stored in the bucket itself, created along with the bucket's first sync data, and it only
+// changes when that doc disappears.
+
+// Key of the doc recording when the bucket's sync data was created
+const kInstanceKey = "_sync:instance"
+
+type syncInstance struct {
+	StartTime int64 `json:"start_time"` // Microseconds since the Unix epoch
+}
+
+// Reads this bucket's instance start time, creating it first if it doesn't exist yet.
+func loadInstanceStartTime(bucket base.Bucket) (int64, error) {
+	for {
+		var instance syncInstance
+		err := bucket.Get(kInstanceKey, &instance)
+		if err == nil {
+			return instance.StartTime, nil
+		} else if !base.IsDocNotFoundError(err) {
+			return 0, err
+		}
+		instance.StartTime = time.Now().UnixNano() / 1000
+		if added, err := bucket.Add(kInstanceKey, 0, instance); err != nil {
+			return 0, err
+		} else if added {
+			base.Log("New sync instance started at %d in bucket %s", instance.StartTime, bucket.GetName())
+			return instance.StartTime, nil
+		}
+		// Someone else created it first; read theirs
+	}
+}
+
+// Returns the instance start time to report to replicators, in microseconds. If the bucket's
+// instance doc vanished since the database was opened, a new instance begins.
+func (context *DatabaseContext) CurrentInstanceStartTime() (int64, error) {
+	startTime, err := loadInstanceStartTime(context.Bucket)
+	if err != nil {
+		return 0, err
+	}
+	context.instanceLock.Lock()
+	defer context.instanceLock.Unlock()
+	if startTime != context.instanceStartTime {
+		base.Warn("Bucket of database %q was flushed or replaced; replicators will restart",
+			context.Name)
+		context.instanceStartTime = startTime
+	}
+	return startTime, nil
+}
+
+// The handler of _ensure_full_commit. Couchbase Server persists writes on its own schedule, so
+// there's nothing to flush, but the caller needs to know whether the instance has changed.
+func (context *DatabaseContext) EnsureFullCommit() (int64, error) {
+	return context.CurrentInstanceStartTime()
+}
+
+// A 'since' value past the latest sequence can only come from a checkpoint made before the
+// bucket was flushed or rolled back. Resuming from it would silently skip every change made
+// since, so the feed restarts from the beginning instead.
+func (db *Database) checkSinceForRollback(since SequenceID) SequenceID {
+	maxSeq := since.LowSeq
+	for _, seq := range since.Channels {
+		if seq > maxSeq {
+			maxSeq = seq
+		}
+	}
+	if maxSeq == 0 {
+		return since
+	}
+	lastSeq, err := db.LastSequence()
+	if err != nil || maxSeq <= lastSeq {
+		return since
+	}
+	base.Warn("Changes feed 'since' %s is past the latest sequence %d of %q; starting over",
+		since, lastSeq, db.Name)
+	return SequenceID{Channels: channels.TimedSet{}}
+}
@@ -0,0 +1,91 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"sync"
+)
+
+// When a doc grants access, every user/role whose access changed has to be loaded and saved
+// with its cached channels (or roles) cleared. Docs written at the same time often grant
+// access to the same principals (e.g. a _bulk_docs of docs that all name the same user), so
+// writers' invalidations are pooled, and each principal is invalidated once per batch.
+
+// One principal whose access needs recomputing
+type principalInvalidation struct {
+	name  string // User name, or "role:" + role name
+	roles bool   // If true, invalidate the user's roles, else its channels
+}
+
+type invalidationBatcher struct {
+	lock    sync.Mutex
+	pending map[principalInvalidation]bool // Invalidations not yet started
+	done    chan struct{}                  // Closed when the pending invalidations are finished
+	running bool                           // Is a batch being processed?
+}
+
+// Invalidates the channels of users/roles, and the roles of users, returning once that's done.
+// If other writers' invalidations are in progress, these are batched up with any others that
+// arrive meanwhile and done next.
+func (db *Database) invalidatePrincipals(channelNames []string, roleUserNames []string) {
+	if len(channelNames) == 0 && len(roleUserNames) == 0 {
+		return
+	}
+	b := &db.invalidations
+	b.lock.Lock()
+	if b.pending == nil {
+		b.pending = map[principalInvalidation]bool{}
+		b.done = make(chan struct{})
+	}
+	for _, name := range channelNames {
+		b.pending[principalInvalidation{name, false}] = true
+	}
+	for _, name := range roleUserNames {
+		b.pending[principalInvalidation{name, true}] = true
+	}
+	done := b.done
+	start := !b.running
+	b.running = true
+	b.lock.Unlock()
+
+	if start {
+		db.DatabaseContext.runInvalidations()
+	}
+	<-done
+}
+
+// Processes the pending batch of invalidations. If more arrived meanwhile, they're processed
+// next on another goroutine, so no writer is kept busy with batch after batch.
+func (context *DatabaseContext) runInvalidations() {
+	b := &context.invalidations
+	b.lock.Lock()
+	batch, done := b.pending, b.done
+	b.pending, b.done = nil, nil
+	b.lock.Unlock()
+
+	db := &Database{DatabaseContext: context}
+	for inval := range batch {
+		if inval.roles {
+			db.invalUserRoles(inval.name)
+		} else {
+			db.invalUserOrRoleChannels(inval.name)
+		}
+	}
+	dbExpvars.Add("invalidation_batches", 1)
+	close(done)
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.pending != nil {
+		go context.runInvalidations()
+	} else {
+		b.running = false
+	}
+}
@@ -0,0 +1,215 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/couchbaselabs/sync_gateway/auth"
+	"github.com/couchbaselabs/sync_gateway/base"
+)
+
+// Usage metering, for hosting providers that bill the tenants of a shared gateway. Each
+// database counts requests, bytes and synced docs per user; at the end of every metering
+// period the counts are saved to the bucket as a MeteringRecord and start over.
+
+// Default length of a metering period
+const DefaultMeteringInterval = time.Hour
+
+// Prefix of the keys of the docs holding MeteringRecords
+const kMeteringKeyPrefix = "_sync:meter:"
+
+// Names under which usage not by a regular user is recorded
+const (
+	MeteringAdminName = "(admin)"
+	MeteringGuestName = "GUEST"
+)
+
+// Usage by one user, or by everyone, in a metering period.
+type UsageCounts struct {
+	Requests    int64 `json:"requests"`
+	BytesIn     int64 `json:"bytes_in"`     // Request bodies
+	BytesOut    int64 `json:"bytes_out"`    // Response bodies
+	DocsWritten int64 `json:"docs_written"` // New revisions saved
+	DocsSent    int64 `json:"docs_sent"`    // Changes sent by _changes feeds
+}
+
+// A database's usage in one metering period.
+type MeteringRecord struct {
+	Database string                  `json:"db"`
+	Start    time.Time               `json:"start"`
+	End      time.Time               `json:"end"`
+	Total    UsageCounts             `json:"total"`
+	Users    map[string]*UsageCounts `json:"users"`
+	Partial  bool                    `json:"partial,omitempty"` // Current period, not over yet
+}
+
+type usageMeter struct {
+	lock    sync.Mutex
+	current *MeteringRecord
+	stop    chan bool // Closing this stops the goroutine that saves records
+}
+
+func (context *DatabaseContext) newMeteringRecord() *MeteringRecord {
+	return &MeteringRecord{
+		Database: context.Name,
+		Start:    time.Now().UTC(),
+		Users:    map[string]*UsageCounts{},
+	}
+}
+
+// Adds to the current period's usage of a user (nil for the admin.)
+func (context *DatabaseContext) recordUsage(user auth.User, update func(*UsageCounts)) {
+	name := MeteringAdminName
+	if user != nil {
+		if name = user.Name(); name == "" {
+			name = MeteringGuestName
+		}
+	}
+	meter := &context.meter
+	meter.lock.Lock()
+	defer meter.lock.Unlock()
+	if meter.stop == nil {
+		return // Metering is off
+	}
+	if meter.current == nil {
+		meter.current = context.newMeteringRecord()
+	}
+	counts := meter.current.Users[name]
+	if counts == nil {
+		counts = &UsageCounts{}
+		meter.current.Users[name] = counts
+	}
+	update(counts)
+	update(&meter.current.Total)
+}
+
+// Counts an HTTP request by a user (nil for the admin) and the bytes it transferred.
+func (context *DatabaseContext) RecordRequest(user auth.User, bytesIn, bytesOut int64) {
+	context.recordUsage(user, func(counts *UsageCounts) {
+		counts.Requests++
+		counts.BytesIn += bytesIn
+		counts.BytesOut += bytesOut
+	})
+}
+
+func (db *Database) recordDocWritten() {
+	db.recordUsage(db.user, func(counts *UsageCounts) { counts.DocsWritten++ })
+}
+
+func (db *Database) recordDocSent() {
+	db.recordUsage(db.user, func(counts *UsageCounts) { counts.DocsSent++ })
+}
+
+// Starts a goroutine that saves a MeteringRecord every interval until the database is closed.
+// Until this is called, usage isn't metered.
+func (context *DatabaseContext) StartMetering(interval time.Duration) {
+	meter := &context.meter
+	meter.lock.Lock()
+	defer meter.lock.Unlock()
+	if meter.stop != nil {
+		return
+	}
+	meter.stop = make(chan bool)
+	go func(stop <-chan bool) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				context.SaveMeteringRecord()
+			case <-stop:
+				return
+			}
+		}
+	}(meter.stop)
+}
+
+func (context *DatabaseContext) stopMetering() {
+	meter := &context.meter
+	meter.lock.Lock()
+	stop := meter.stop
+	meter.stop = nil
+	meter.lock.Unlock()
+	if stop != nil {
+		close(stop)
+		context.SaveMeteringRecord()
+	}
+}
+
+// Ends the current metering period, saving its record to the bucket if there was any usage.
+func (context *DatabaseContext) SaveMeteringRecord() error {
+	meter := &context.meter
+	meter.lock.Lock()
+	record := meter.current
+	meter.current = context.newMeteringRecord()
+	meter.lock.Unlock()
+
+	if record == nil || record.Total.Requests == 0 && record.Total.DocsSent == 0 &&
+		record.Total.DocsWritten == 0 {
+		return nil
+	}
+	record.End = time.Now().UTC()
+	key := kMeteringKeyPrefix + record.Start.Format(time.RFC3339Nano)
+	if err := context.Bucket.Set(key, 0, record); err != nil {
+		base.Warn("Couldn't save metering record %q: %v", key, err)
+		return err
+	}
+	base.LogTo("CRUD+", "Saved metering record %q", key)
+	return nil
+}
+
+// Returns the saved metering records of periods that started in the given time range
+// (either end can be zero to leave it open), followed by the current period's partial record.
+func (context *DatabaseContext) MeteringRecords(since, until time.Time) ([]*MeteringRecord, error) {
+	opts := Body{"stale": false, "startkey": kMeteringKeyPrefix, "endkey": kMeteringKeyPrefix + "~",
+		"inclusive_end": false}
+	vres, err := context.Bucket.View("sync_housekeeping", "all_bits", opts)
+	if err != nil {
+		base.Warn("all_bits view returned %v", err)
+		return nil, err
+	}
+	inRange := func(record *MeteringRecord) bool {
+		return (since.IsZero() || !record.Start.Before(since)) &&
+			(until.IsZero() || record.Start.Before(until))
+	}
+
+	records := make([]*MeteringRecord, 0, len(vres.Rows)+1)
+	for _, row := range vres.Rows {
+		data, err := context.Bucket.GetRaw(row.ID)
+		if err != nil {
+			continue
+		}
+		var record MeteringRecord
+		if err := json.Unmarshal(data, &record); err != nil {
+			base.Warn("Invalid metering record %q: %v", row.ID, err)
+		} else if inRange(&record) {
+			records = append(records, &record)
+		}
+	}
+
+	meter := &context.meter
+	meter.lock.Lock()
+	defer meter.lock.Unlock()
+	if current := meter.current; current != nil && inRange(current) {
+		partial := *current
+		partial.End = time.Now().UTC()
+		partial.Partial = true
+		partial.Users = make(map[string]*UsageCounts, len(current.Users))
+		for name, counts := range current.Users {
+			countsCopy := *counts
+			partial.Users[name] = &countsCopy
+		}
+		records = append(records, &partial)
+	}
+	return records, nil
+}
@@ -0,0 +1,98 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/couchbaselabs/sync_gateway/base"
+)
+
+// Names of the background subsystems of a database that can be paused.
+const (
+	FeedSubsystem   = "feed"   // Consumption of the bucket's mutation (tap) feed
+	ShadowSubsystem = "shadow" // Bucket shadowing (see Shadower)
+)
+
+// Lets a background goroutine be paused and resumed. The zero value is ready to use, and is
+// not paused. (Thread-safe.)
+type pauseSwitch struct {
+	lock   sync.Mutex
+	cond   *sync.Cond
+	paused bool
+}
+
+func (p *pauseSwitch) setPaused(paused bool) {
+	p.lock.Lock()
+	p.paused = paused
+	if p.cond != nil {
+		p.cond.Broadcast()
+	}
+	p.lock.Unlock()
+}
+
+func (p *pauseSwitch) isPaused() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.paused
+}
+
+// Blocks for as long as the switch is paused.
+func (p *pauseSwitch) waitWhilePaused() {
+	p.lock.Lock()
+	for p.paused {
+		if p.cond == nil {
+			p.cond = sync.NewCond(&p.lock)
+		}
+		p.cond.Wait()
+	}
+	p.lock.Unlock()
+}
+
+func (context *DatabaseContext) subsystemSwitch(name string) *pauseSwitch {
+	switch name {
+	case FeedSubsystem:
+		return &context.tapListener.pause
+	case ShadowSubsystem:
+		if context.Shadower != nil {
+			return &context.Shadower.pause
+		}
+	}
+	return nil
+}
+
+// Pauses or resumes one of the database's background subsystems, e.g. for a maintenance window.
+func (context *DatabaseContext) SetSubsystemPaused(name string, paused bool) error {
+	p := context.subsystemSwitch(name)
+	if p == nil {
+		return base.HTTPErrorf(http.StatusNotFound, "No such subsystem %q", name)
+	}
+	p.setPaused(paused)
+	if paused {
+		base.Log("Database %q: paused %s", context.Name, name)
+	} else {
+		base.Log("Database %q: resumed %s", context.Name, name)
+	}
+	return nil
+}
+
+// Returns the names of the database's pausable subsystems that are currently paused.
+func (context *DatabaseContext) PausedSubsystems() []string {
+	paused := []string{}
+	for _, name := range []string{FeedSubsystem, ShadowSubsystem} {
+		if p := context.subsystemSwitch(name); p != nil && p.isPaused() {
+			paused = append(paused, name)
+		}
+	}
+	sort.Strings(paused)
+	return paused
+}
@@ -0,0 +1,117 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/couchbaselabs/sync_gateway/base"
+)
+
+// Tracks the progress of re-running the sync function over all docs. While it's running the
+// database is offline: the REST API rejects requests to it, other than admin reads.
+type resyncState struct {
+	lock      sync.Mutex
+	running   bool
+	started   time.Time
+	finished  time.Time
+	total     int
+	processed int
+	changed   int
+	err       error
+}
+
+// Is the database available for normal use, i.e. not in the middle of a resync?
+func (context *DatabaseContext) IsOnline() bool {
+	context.resync.lock.Lock()
+	defer context.resync.lock.Unlock()
+	return !context.resync.running
+}
+
+// Takes the database offline and re-runs the sync function on the current revision of every
+// document, updating their channels and access grants. Returns the number of docs changed.
+// Use this after changing the sync function in a way that affects existing docs.
+func (context *DatabaseContext) Resync() (int, error) {
+	if err := context.beginResync(); err != nil {
+		return 0, err
+	}
+	return context.runResync()
+}
+
+// Like Resync, but runs in the background; the database is offline by the time this returns.
+func (context *DatabaseContext) StartResync() error {
+	if err := context.beginResync(); err != nil {
+		return err
+	}
+	go context.runResync()
+	return nil
+}
+
+func (context *DatabaseContext) beginResync() error {
+	state := &context.resync
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	if state.running {
+		return base.HTTPErrorf(http.StatusConflict, "Resync is already running")
+	}
+	state.running = true
+	state.started = time.Now()
+	state.total, state.processed, state.changed, state.err = 0, 0, 0, nil
+	base.Log("Database %q: taken offline for resync", context.Name)
+	return nil
+}
+
+func (context *DatabaseContext) runResync() (int, error) {
+	state := &context.resync
+	db := &Database{context, nil}
+	err := db.updateAllDocChannels(true, false, func(total, processed, changed int) {
+		state.lock.Lock()
+		state.total, state.processed, state.changed = total, processed, changed
+		state.lock.Unlock()
+	})
+
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	state.running = false
+	state.finished = time.Now()
+	state.err = err
+	if err != nil {
+		base.Warn("Database %q: resync failed: %v", context.Name, err)
+	} else {
+		base.Log("Database %q: resync changed %d of %d docs; back online",
+			context.Name, state.changed, state.processed)
+	}
+	return state.changed, err
+}
+
+// Returns a JSON-compatible description of the current or last resync.
+func (context *DatabaseContext) ResyncStatus() Body {
+	state := &context.resync
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	status := Body{
+		"running":        state.running,
+		"docs_total":     state.total,
+		"docs_processed": state.processed,
+		"docs_changed":   state.changed,
+	}
+	if !state.started.IsZero() {
+		status["start_time"] = state.started
+	}
+	if !state.running && !state.finished.IsZero() {
+		status["end_time"] = state.finished
+	}
+	if state.err != nil {
+		status["error"] = state.err.Error()
+	}
+	return status
+}
@@ -0,0 +1,190 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/couchbaselabs/go-couchbase"
+
+	"github.com/couchbaselabs/sync_gateway/base"
+)
+
+// If DatabaseContext.ExternalRevBodies is set, the bodies of non-current revisions (mostly
+// conflicting branches) are stored as separate docs instead of inline in the RevTree, so that
+// reading a document with a big tree doesn't mean reading all of them. The RevInfo keeps the
+// key of the doc, which is loaded only when the revision itself is needed.
+//
+// Unlike the docs holding archived old revisions, these can't be deleted by compaction since
+// they may be the only copy of a leaf revision; compaction deletes only the ones no longer
+// referenced by their document. Since updateDoc writes a body doc before the document that
+// refers to it is saved, an unreferenced body doc isn't deleted until compaction has found it
+// unreferenced for at least RevBodyOrphanGracePeriod.
+
+// Prefix of the keys of the docs that hold non-current revisions' bodies
+const kRevBodyKeyPrefix = "_sync:rb:"
+
+// How long a revision-body doc must have been unreferenced before compaction deletes it
+var RevBodyOrphanGracePeriod = 10 * time.Minute
+
+// Tracks when housekeeping first found each unreferenced revision-body or attachment doc.
+type orphanedDocs struct {
+	lock  sync.Mutex
+	found map[string]time.Time
+}
+
+// Forgets that a doc was found unreferenced, because something has just referred to it again;
+// its grace period starts over if it's found unreferenced later.
+func (orphans *orphanedDocs) forget(key string) {
+	orphans.lock.Lock()
+	defer orphans.lock.Unlock()
+	delete(orphans.found, key)
+}
+
+func revBodyKey(docid string, revid string) string {
+	return fmt.Sprintf("%s%s:%d:%s", kRevBodyKeyPrefix, docid, len(revid), revid)
+}
+
+// Reads a revision body stored outside its document. This is a RevBodyLoaderFunc.
+func (context *DatabaseContext) loadRevBody(key string) ([]byte, error) {
+	return context.Bucket.GetRaw(key)
+}
+
+// Moves all revision bodies stored inline in a document's RevTree into separate docs.
+func (context *DatabaseContext) externalizeRevBodies(doc *document) error {
+	for revid, info := range doc.History {
+		if info.Body == nil || revid == doc.CurrentRev {
+			continue
+		}
+		key := revBodyKey(doc.ID, revid)
+		if err := context.Bucket.SetRaw(key, 0, info.Body); err != nil {
+			return err
+		}
+		base.LogTo("CRUD+", "Moved body of %q / %q to %q", doc.ID, revid, key)
+		info.Body = nil
+		info.BodyKey = key
+	}
+	return nil
+}
+
+// Moves the inline revision bodies of every existing document into separate docs, without
+// creating new revisions. (Documents are otherwise migrated only when they're next updated.)
+// Returns the number of documents changed.
+func (db *Database) MigrateRevBodies() (int, error) {
+	if !db.ExternalRevBodies {
+		return 0, base.HTTPErrorf(http.StatusBadRequest, "external_rev_bodies isn't enabled for this database")
+	}
+	vres, err := db.queryAllDocs(false)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, row := range vres.Rows {
+		changed := false
+		err := db.Bucket.Update(row.ID, 0, func(currentValue []byte) ([]byte, error) {
+			if currentValue == nil {
+				return nil, couchbase.UpdateCancel // deleted since the view was queried
+			}
+			doc, err := unmarshalDocument(row.ID, currentValue)
+			if err != nil {
+				return nil, err
+			}
+			inline := false
+			for revid, info := range doc.History {
+				if info.Body != nil && revid != doc.CurrentRev {
+					inline = true
+				}
+			}
+			if !inline {
+				return nil, couchbase.UpdateCancel
+			} else if err = db.externalizeRevBodies(doc); err != nil {
+				return nil, err
+			}
+			changed = true
+			return json.Marshal(doc)
+		})
+		if err != nil && err != couchbase.UpdateCancel {
+			base.Warn("MigrateRevBodies: couldn't update doc %q: %v", row.ID, err)
+		} else if changed {
+			count++
+		}
+	}
+	base.Log("Moved revision bodies of %d docs of %q out of their rev trees", count, db.Name)
+	return count, nil
+}
+
+// Deletes revision-body docs that are no longer referenced by their document's RevTree,
+// because the revision was pruned, became current, or got an inline body again, and that were
+// already unreferenced at least RevBodyOrphanGracePeriod ago.
+func (db *Database) compactRevBodies() (int, error) {
+	opts := Body{"stale": false, "startkey": kRevBodyKeyPrefix, "endkey": kRevBodyKeyPrefix + "~",
+		"inclusive_end": false}
+	vres, err := db.Bucket.View("sync_housekeeping", "all_bits", opts)
+	if err != nil {
+		base.Warn("all_bits view returned %v", err)
+		return 0, err
+	}
+	orphans := &db.revBodyOrphans
+	orphans.lock.Lock()
+	defer orphans.lock.Unlock()
+	found := make(map[string]time.Time)
+	now := time.Now()
+	count := 0
+	for _, row := range vres.Rows {
+		docid, revid, ok := parseRevBodyKey(row.ID)
+		if !ok {
+			continue
+		}
+		if doc, _ := db.GetDoc(docid); doc != nil {
+			if info := doc.History[revid]; info != nil && info.BodyKey == row.ID {
+				continue
+			}
+		}
+		first, ok := orphans.found[row.ID]
+		if !ok {
+			first = now
+		}
+		if now.Sub(first) < RevBodyOrphanGracePeriod {
+			found[row.ID] = first // Its doc may be about to be saved; check again next time
+			continue
+		}
+		base.LogTo("CRUD", "\tDeleting %q", row.ID)
+		if err := db.Bucket.Delete(row.ID); err != nil {
+			base.Warn("Error deleting %q: %v", row.ID, err)
+		} else {
+			count++
+		}
+	}
+	orphans.found = found
+	return count, nil
+}
+
+// Parses a key generated by revBodyKey.
+func parseRevBodyKey(key string) (docid string, revid string, ok bool) {
+	if !strings.HasPrefix(key, kRevBodyKeyPrefix) {
+		return
+	}
+	key = key[len(kRevBodyKeyPrefix):]
+	colon := strings.LastIndex(key, ":")
+	if colon < 0 {
+		return
+	}
+	revid = key[colon+1:]
+	suffix := fmt.Sprintf(":%d", len(revid))
+	if !strings.HasSuffix(key[:colon], suffix) {
+		return
+	}
+	return key[:colon-len(suffix)], revid, true
+}
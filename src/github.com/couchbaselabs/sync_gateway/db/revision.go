@@ -13,6 +13,9 @@ import (
 	"crypto/md5"
 	"encoding/json"
 	"fmt"
+	"strings"
+
+	"github.com/couchbaselabs/go-couchbase"
 
 	"github.com/couchbaselabs/sync_gateway/base"
 )
@@ -38,19 +41,70 @@ func (db *DatabaseContext) getOldRevisionJSON(docid string, revid string) ([]byt
 	}
 	if data != nil {
 		base.LogTo("CRUD+", "Got old revision %q / %q --> %d bytes", docid, revid, len(data))
+		if isArchivedDelta(data) {
+			data, err = db.decodeArchivedRevision(docid, data)
+		}
 	}
 	return data, err
 }
 
-func (db *Database) setOldRevisionJSON(docid string, revid string, body []byte) error {
-	base.LogTo("CRUD+", "Saving old revision %q / %q (%d bytes)", docid, revid, len(body))
-	return db.Bucket.SetRaw(oldRevisionKey(docid, revid), 0, body)
+// Archives a revision's JSON to a separate doc. If possible it's stored as a delta from the
+// archived body of its parent revision (see delta.go), but not during compaction, which could
+// delete the parent out from under it.
+func (db *Database) setOldRevisionJSON(docid string, revid string, parentRevID string, body []byte) error {
+	db.archiveLock.RLock()
+	defer db.archiveLock.RUnlock()
+	stored := body
+	if db.compacting == 0 {
+		stored = db.encodeArchivedRevision(docid, parentRevID, body)
+	}
+	key := oldRevisionKey(docid, revid)
+	base.LogTo("CRUD+", "Saving old revision %q / %q (%d bytes)", docid, revid, len(stored))
+	if err := db.Bucket.SetRaw(key, 0, stored); err != nil || !isArchivedDelta(stored) {
+		return err
+	}
+
+	// Another gateway may be compacting. Rewriting the source bumps its CAS, so a compaction
+	// that's about to delete it has to look for deltas again; if it's already gone, the
+	// revision is stored whole after all.
+	err := db.Bucket.Update(oldRevisionKey(docid, parentRevID), 0, func(current []byte) ([]byte, error) {
+		if current == nil {
+			return nil, couchbase.UpdateCancel
+		}
+		return current, nil
+	})
+	if err == couchbase.UpdateCancel {
+		base.LogTo("CRUD+", "Source of old revision %q / %q was compacted; saving it whole", docid, revid)
+		return db.Bucket.SetRaw(key, 0, body)
+	}
+	return err
 }
 
 //////// UTILITY FUNCTIONS:
 
+// Prefix of the keys of the docs that hold old revisions' bodies
+const kOldRevisionKeyPrefix = "_sync:rev:"
+
 func oldRevisionKey(docid string, revid string) string {
-	return fmt.Sprintf("_sync:rev:%s:%d:%s", docid, len(revid), revid)
+	return fmt.Sprintf("%s%s:%d:%s", kOldRevisionKeyPrefix, docid, len(revid), revid)
+}
+
+// Returns the doc ID of an old revision's key, or "" if it isn't one.
+func oldRevisionDocID(key string) string {
+	if !strings.HasPrefix(key, kOldRevisionKeyPrefix) {
+		return ""
+	}
+	key = key[len(kOldRevisionKeyPrefix):]
+	colon := strings.LastIndex(key, ":")
+	if colon < 0 {
+		return ""
+	}
+	revLen := len(key) - colon - 1
+	suffix := fmt.Sprintf(":%d:", revLen)
+	if !strings.HasSuffix(key[:colon+1], suffix) {
+		return ""
+	}
+	return key[:colon+1-len(suffix)]
 }
 
 // Version of FixJSONNumbers (see base/util.go) that operates on a Body
@@ -10,9 +10,12 @@
 package db
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"math"
+	"sort"
+	"strings"
 
 	"github.com/couchbaselabs/sync_gateway/base"
 )
@@ -25,7 +28,9 @@ type RevInfo struct {
 	Parent   string
 	Deleted  bool
 	Body     []byte
+	BodyKey  string // Key of the separate doc holding the body, if it's not inline in Body
 	Channels base.Set
+	Sequence uint64 // Sequence # the revision was added at (0 if unknown)
 	depth    uint32
 }
 
@@ -41,6 +46,8 @@ type revTreeList struct {
 	Deleted  []int      `json:"deleted,omitempty"` // Indexes of revisions that are deletions
 	Bodies   []string   `json:"bodies,omitempty"`  // JSON of each revision
 	Channels []base.Set `json:"channels"`
+	Seqs     []uint64   `json:"seqs,omitempty"`      // Sequence # at which each revision was added
+	BodyKeys []string   `json:"body_keys,omitempty"` // Keys of docs holding bodies stored outside the tree
 }
 
 func (tree RevTree) MarshalJSON() ([]byte, error) {
@@ -59,6 +66,18 @@ func (tree RevTree) MarshalJSON() ([]byte, error) {
 		rep.Revs[i] = info.ID
 		rep.Bodies[i] = string(info.Body)
 		rep.Channels[i] = info.Channels
+		if info.BodyKey != "" {
+			if rep.BodyKeys == nil {
+				rep.BodyKeys = make([]string, n)
+			}
+			rep.BodyKeys[i] = info.BodyKey
+		}
+		if info.Sequence > 0 {
+			if rep.Seqs == nil {
+				rep.Seqs = make([]uint64, n)
+			}
+			rep.Seqs[i] = info.Sequence
+		}
 		if info.Deleted {
 			if rep.Deleted == nil {
 				rep.Deleted = make([]int, 0, 1)
@@ -85,31 +104,62 @@ func (tree RevTree) UnmarshalJSON(inputjson []byte) (err error) {
 	if err != nil {
 		return
 	}
+	return tree.load(&rep, false)
+}
 
+// Fills in the tree from its stored form. A corrupted tree's arrays may be too short or have bad
+// indexes; that's an error, unless lenient is set (for _repair), in which case a bad parent index
+// becomes a parent ID that isn't in the tree, for Validate to report.
+func (tree RevTree) load(rep *revTreeList, lenient bool) error {
+	if !lenient {
+		if len(rep.Parents) != len(rep.Revs) {
+			return base.HTTPErrorf(500, "Corrupt revision tree: %d parents for %d revs; use _repair",
+				len(rep.Parents), len(rep.Revs))
+		}
+		for _, parentIndex := range rep.Parents {
+			if parentIndex >= len(rep.Revs) || parentIndex < -1 {
+				return base.HTTPErrorf(500, "Corrupt revision tree: invalid parent index %d; use _repair",
+					parentIndex)
+			}
+		}
+	}
 	for i, revid := range rep.Revs {
 		info := RevInfo{ID: revid}
-		if rep.Bodies != nil && len(rep.Bodies[i]) > 0 {
+		if i < len(rep.Bodies) && len(rep.Bodies[i]) > 0 {
 			info.Body = []byte(rep.Bodies[i])
 		}
-		if rep.Channels != nil {
+		if i < len(rep.BodyKeys) {
+			info.BodyKey = rep.BodyKeys[i]
+		}
+		if i < len(rep.Channels) {
 			info.Channels = rep.Channels[i]
 		}
-		parentIndex := rep.Parents[i]
-		if parentIndex >= 0 {
+		if i < len(rep.Seqs) {
+			info.Sequence = rep.Seqs[i]
+		}
+		if i >= len(rep.Parents) {
+			info.Parent = kMissingParentIndex
+		} else if parentIndex := rep.Parents[i]; parentIndex >= len(rep.Revs) || parentIndex < -1 {
+			info.Parent = fmt.Sprintf(kBadParentIndexFormat, parentIndex)
+		} else if parentIndex >= 0 {
 			info.Parent = rep.Revs[parentIndex]
 		}
 		tree[revid] = &info
 	}
-	if rep.Deleted != nil {
-		for _, i := range rep.Deleted {
-			info := tree[rep.Revs[i]]
-			info.Deleted = true //because tree[rep.Revs[i]].Deleted=true is a compile error
-			tree[rep.Revs[i]] = info
+	for _, i := range rep.Deleted {
+		if i < 0 || i >= len(rep.Revs) {
+			base.Warn("RevTree has invalid deleted index %d", i)
+			continue
 		}
+		tree[rep.Revs[i]].Deleted = true
 	}
-	return
+	return nil
 }
 
+// Parent IDs UnmarshalJSON gives revisions whose stored parent index is missing or invalid
+const kMissingParentIndex = "(missing parent index)"
+const kBadParentIndexFormat = "(invalid parent index %d)"
+
 // Returns true if the RevTree has an entry for this revid.
 func (tree RevTree) contains(revid string) bool {
 	_, exists := tree[revid]
@@ -200,6 +250,47 @@ func (tree RevTree) winningRevision() (winner string, inConflict bool) {
 	return
 }
 
+// Finds the revision that was the winner as of a sequence number, i.e. taking into account only
+// the revisions added at or before that sequence. Returns "" if none of the revisions existed
+// yet. A revision whose sequence isn't known (because it was added by an older version of the
+// gateway) is only known to have existed if a descendant did; if there's one whose existence
+// can't be determined, returns a 409 error since the snapshot can't be reconstructed.
+func (tree RevTree) winningRevisionAsOf(seq uint64) (winner string, err error) {
+	present := map[string]bool{}
+	for revid, info := range tree {
+		if info.Sequence != 0 && info.Sequence <= seq {
+			for ; revid != "" && !present[revid]; revid = tree[revid].Parent {
+				present[revid] = true
+				if !tree.contains(tree[revid].Parent) {
+					break
+				}
+			}
+		}
+	}
+	isParent := map[string]bool{}
+	for revid, info := range tree {
+		if present[revid] {
+			isParent[info.Parent] = true
+		} else if info.Sequence == 0 {
+			return "", base.HTTPErrorf(409,
+				"Snapshot unavailable: the sequence of revision %q isn't known", revid)
+		}
+	}
+	winnerExists := false
+	for revid, info := range tree {
+		if !present[revid] || isParent[revid] {
+			continue
+		}
+		exists := !info.Deleted
+		if winner == "" || (exists && !winnerExists) ||
+			((exists == winnerExists) && compareRevIDs(revid, winner) > 0) {
+			winner = revid
+			winnerExists = exists
+		}
+	}
+	return
+}
+
 // Given a revision and a set of possible ancestors, finds the one that is the most recent
 // ancestor of the revision; if none are ancestors, returns "".
 func (tree RevTree) findAncestorFromSet(revid string, ancestors []string) string {
@@ -215,6 +306,27 @@ func (tree RevTree) findAncestorFromSet(revid string, ancestors []string) string
 	return ""
 }
 
+// Finds the deepest revision that is an ancestor of (or equal to) both revisions; if they have
+// no common ancestor in the tree (e.g. one of them is unknown or was pruned), returns "".
+func (tree RevTree) findCommonAncestor(revid1, revid2 string) string {
+	ancestors := map[string]bool{}
+	for revid := revid1; revid != ""; revid = tree[revid].Parent {
+		if !tree.contains(revid) {
+			break
+		}
+		ancestors[revid] = true
+	}
+	for revid := revid2; revid != ""; revid = tree[revid].Parent {
+		if !tree.contains(revid) {
+			break
+		}
+		if ancestors[revid] {
+			return revid
+		}
+	}
+	return ""
+}
+
 // Records a revision in a RevTree.
 func (tree RevTree) addRevision(info RevInfo) {
 	revid := info.ID
@@ -231,7 +343,12 @@ func (tree RevTree) addRevision(info RevInfo) {
 	tree[revid] = &info
 }
 
-func (tree RevTree) getRevisionBody(revid string) ([]byte, bool) {
+// Reads a body stored outside the RevTree, given its key.
+type RevBodyLoaderFunc func(key string) ([]byte, error)
+
+// Returns a revision's body JSON, and whether the revision exists. A body stored in a separate
+// doc is loaded by calling the loader function; if that's nil the body is treated as missing.
+func (tree RevTree) getRevisionBody(revid string, loader RevBodyLoaderFunc) ([]byte, bool) {
 	if revid == "" {
 		panic("Illegal empty revision ID")
 	}
@@ -239,6 +356,13 @@ func (tree RevTree) getRevisionBody(revid string) ([]byte, bool) {
 	if !found {
 		return nil, false
 	}
+	if info.Body == nil && info.BodyKey != "" && loader != nil {
+		body, err := loader(info.BodyKey)
+		if err != nil {
+			base.Warn("Couldn't load body of rev %q from %q: %v", revid, info.BodyKey, err)
+		}
+		return body, true
+	}
 	return info.Body, true
 }
 
@@ -251,10 +375,11 @@ func (tree RevTree) setRevisionBody(revid string, body []byte) {
 		panic(fmt.Sprintf("rev id %q not found", revid))
 	}
 	info.Body = body
+	info.BodyKey = ""
 }
 
-func (tree RevTree) getParsedRevisionBody(revid string) Body {
-	bodyJSON, found := tree.getRevisionBody(revid)
+func (tree RevTree) getParsedRevisionBody(revid string, loader RevBodyLoaderFunc) Body {
+	bodyJSON, found := tree.getRevisionBody(revid, loader)
 	if !found || len(bodyJSON) == 0 {
 		return nil
 	}
@@ -331,6 +456,105 @@ func (tree RevTree) pruneRevisions(maxDepth uint32) (pruned int) {
 
 //////// HELPERS:
 
+// Returns the tree's revision IDs sorted by generation (and then by digest.)
+func (tree RevTree) sortedRevIDs() []string {
+	revids := make([]string, 0, len(tree))
+	for revid, _ := range tree {
+		revids = append(revids, revid)
+	}
+	sort.Sort(revIDList(revids))
+	return revids
+}
+
+type revIDList []string
+
+func (l revIDList) Len() int           { return len(l) }
+func (l revIDList) Less(i, j int) bool { return compareRevIDs(l[i], l[j]) < 0 }
+func (l revIDList) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+
+// Describes the tree as an adjacency list, for debugging: each revision is listed with its
+// parent and children, and whether it's a leaf, a deletion, and has its body available.
+// (The winning revision's body is stored in the document, not the tree, so it counts as present.)
+func (tree RevTree) RenderJSON() Body {
+	winner, conflict := tree.winningRevision()
+	children := map[string][]string{}
+	revids := tree.sortedRevIDs()
+	for _, revid := range revids {
+		if parent := tree[revid].Parent; parent != "" {
+			children[parent] = append(children[parent], revid)
+		}
+	}
+	revs := make([]Body, 0, len(revids))
+	for _, revid := range revids {
+		info := tree[revid]
+		rev := Body{
+			"id":       revid,
+			"leaf":     len(children[revid]) == 0,
+			"has_body": info.Body != nil || info.BodyKey != "" || revid == winner,
+		}
+		if info.Parent != "" {
+			rev["parent"] = info.Parent
+		}
+		if children[revid] != nil {
+			rev["children"] = children[revid]
+		}
+		if info.Deleted {
+			rev["deleted"] = true
+		}
+		if info.Channels != nil {
+			rev["channels"] = info.Channels
+		}
+		revs = append(revs, rev)
+	}
+	return Body{"winner": winner, "conflict": conflict, "revs": revs}
+}
+
+// Describes the tree in Graphviz DOT format, for debugging. Leaves have a double border,
+// deletions (tombstones) are gray, revisions without a body are dashed, and the winner is bold.
+func (tree RevTree) RenderDOT() string {
+	winner, _ := tree.winningRevision()
+	isParent := map[string]bool{}
+	for _, info := range tree {
+		isParent[info.Parent] = true
+	}
+	var out bytes.Buffer
+	out.WriteString("digraph RevTree {\n\tnode [shape=box];\n")
+	revids := tree.sortedRevIDs()
+	for _, revid := range revids {
+		info := tree[revid]
+		var attrs []string
+		var styles []string
+		if !isParent[revid] {
+			attrs = append(attrs, "peripheries=2")
+		}
+		if info.Deleted {
+			attrs = append(attrs, "fillcolor=gray")
+			styles = append(styles, "filled")
+		}
+		if info.Body == nil && info.BodyKey == "" && revid != winner {
+			styles = append(styles, "dashed")
+		}
+		if revid == winner {
+			styles = append(styles, "bold")
+		}
+		if styles != nil {
+			attrs = append(attrs, fmt.Sprintf("style=%q", strings.Join(styles, ",")))
+		}
+		fmt.Fprintf(&out, "\t%q", revid)
+		if attrs != nil {
+			fmt.Fprintf(&out, " [%s]", strings.Join(attrs, ", "))
+		}
+		out.WriteString(";\n")
+	}
+	for _, revid := range revids {
+		if parent := tree[revid].Parent; parent != "" && tree.contains(parent) {
+			fmt.Fprintf(&out, "\t%q -> %q;\n", parent, revid)
+		}
+	}
+	out.WriteString("}\n")
+	return out.String()
+}
+
 // Parses a CouchDB _revisions property into a list of revision IDs
 func ParseRevisions(body Body) []string {
 	// http://wiki.apache.org/couchdb/HTTP_Document_API#GET
@@ -0,0 +1,261 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/couchbaselabs/go-couchbase"
+
+	"github.com/couchbaselabs/sync_gateway/base"
+)
+
+// Kinds of RevTreeProblem
+const (
+	RevTreeMissingParent = "missing_parent" // Rev's parent isn't in the tree
+	RevTreeCycle         = "cycle"          // Rev is its own ancestor
+	RevTreeSharedBody    = "shared_body"    // Two live leaves have the same body
+)
+
+// Something wrong with a RevTree, found by Validate.
+type RevTreeProblem struct {
+	Type  string `json:"type"`
+	RevID string `json:"rev"`
+	Other string `json:"other,omitempty"` // The missing parent, the parent link closing the cycle, or the other leaf
+}
+
+func (p RevTreeProblem) String() string {
+	switch p.Type {
+	case RevTreeMissingParent:
+		return fmt.Sprintf("parent %q of %q is missing", p.Other, p.RevID)
+	case RevTreeCycle:
+		return fmt.Sprintf("%q -> %q closes a cycle", p.RevID, p.Other)
+	case RevTreeSharedBody:
+		return fmt.Sprintf("leaves %q and %q have the same body", p.RevID, p.Other)
+	}
+	return p.Type
+}
+
+// Checks the tree's integrity. Returns the problems found, or nil if there are none.
+// Parent links to missing revisions and cycles make history traversals fail or loop forever;
+// live leaves sharing a body usually mean the same revision was saved twice under different IDs.
+func (tree RevTree) Validate() (problems []RevTreeProblem) {
+	revids := tree.sortedRevIDs()
+
+	const (
+		unvisited = iota
+		onPath
+		done
+	)
+	state := make(map[string]int, len(tree))
+	for _, revid := range revids {
+		var path []string
+		for r := revid; r != "" && state[r] == unvisited; {
+			info := tree[r]
+			if info == nil {
+				break
+			}
+			state[r] = onPath
+			path = append(path, r)
+			if parent := info.Parent; parent != "" && state[parent] == onPath {
+				problems = append(problems, tree.cycleProblem(parent, r))
+				break
+			}
+			r = info.Parent
+		}
+		for _, r := range path {
+			state[r] = done
+		}
+	}
+
+	isParent := map[string]bool{}
+	for _, revid := range revids {
+		info := tree[revid]
+		isParent[info.Parent] = true
+		if info.Parent != "" && !tree.contains(info.Parent) {
+			problems = append(problems, RevTreeProblem{RevTreeMissingParent, revid, info.Parent})
+		}
+	}
+
+	leafWithBody := map[string]string{}
+	for _, revid := range revids {
+		info := tree[revid]
+		if isParent[revid] || info.Deleted {
+			continue
+		}
+		var key string
+		if info.BodyKey != "" {
+			key = "key:" + info.BodyKey
+		} else if len(info.Body) > 0 {
+			key = "json:" + string(info.Body)
+		} else {
+			continue
+		}
+		if other, found := leafWithBody[key]; found {
+			problems = append(problems, RevTreeProblem{RevTreeSharedBody, revid, other})
+		} else {
+			leafWithBody[key] = revid
+		}
+	}
+	return
+}
+
+// Describes the cycle going from 'start' up to 'end' (whose parent is 'start'). The link
+// that's reported, and that Repair cuts, is the one from the lowest revision in the cycle,
+// since its parent can't legitimately be an older revision.
+func (tree RevTree) cycleProblem(start, end string) RevTreeProblem {
+	lowest := end
+	for r := start; r != end; r = tree[r].Parent {
+		if compareRevIDs(r, lowest) < 0 {
+			lowest = r
+		}
+	}
+	return RevTreeProblem{RevTreeCycle, lowest, tree[lowest].Parent}
+}
+
+// Fixes the problems Validate finds that can be fixed without losing revisions: orphans whose
+// parent is missing become roots, and cycles are broken by making their lowest revision a root.
+// Returns a description of each change made.
+func (tree RevTree) Repair() (fixes []string) {
+	for _, problem := range tree.Validate() {
+		switch problem.Type {
+		case RevTreeMissingParent, RevTreeCycle:
+			tree[problem.RevID].Parent = ""
+			fixes = append(fixes, fmt.Sprintf("made %q a root (%s)", problem.RevID, problem))
+		}
+	}
+	return
+}
+
+// What _repair found in, and did to, one document.
+type DocRepair struct {
+	Problems []RevTreeProblem `json:"problems"`
+	Fixes    []string         `json:"fixes,omitempty"`
+	Error    string           `json:"error,omitempty"`
+}
+
+// The outcome of RepairRevTrees.
+type RevTreeRepairResult struct {
+	Checked int                   `json:"checked"`        // Number of docs checked
+	DryRun  bool                  `json:"dry_run"`        // If true, nothing was changed
+	Docs    map[string]*DocRepair `json:"docs,omitempty"` // Docs with problems, by ID
+}
+
+// Parses a document like unmarshalDocument, but loads a corrupted rev tree as best it can
+// instead of failing, so it can be validated and repaired.
+func unmarshalDocumentForRepair(docid string, data []byte) (*document, error) {
+	var root map[string]json.RawMessage
+	if err := json.Unmarshal(data, &root); err != nil {
+		return nil, err
+	}
+	var sync map[string]json.RawMessage
+	if raw := root["_sync"]; raw != nil {
+		if err := json.Unmarshal(raw, &sync); err != nil {
+			return nil, err
+		}
+	}
+	history := sync["history"]
+	if history == nil {
+		return unmarshalDocument(docid, data)
+	}
+	delete(sync, "history")
+	var err error
+	if root["_sync"], err = json.Marshal(sync); err != nil {
+		return nil, err
+	}
+	if data, err = json.Marshal(root); err != nil {
+		return nil, err
+	}
+	doc, err := unmarshalDocument(docid, data)
+	if err != nil {
+		return nil, err
+	}
+	var rep revTreeList
+	if err := json.Unmarshal(history, &rep); err != nil {
+		return nil, err
+	}
+	doc.History = make(RevTree)
+	return doc, doc.History.load(&rep, true)
+}
+
+// Validates the rev trees of the given docs (or all docs, if none are given) and, unless
+// dryRun is set, repairs the ones with problems and saves them, logging every fix.
+// Admin-only.
+func (db *Database) RepairRevTrees(docIDs []string, dryRun bool) (*RevTreeRepairResult, error) {
+	if db.user != nil {
+		return nil, base.HTTPErrorf(http.StatusForbidden, "Only the admin can repair docs")
+	}
+	if docIDs == nil {
+		vres, err := db.queryAllDocs(false)
+		if err != nil {
+			return nil, err
+		}
+		docIDs = make([]string, 0, len(vres.Rows))
+		for _, row := range vres.Rows {
+			docIDs = append(docIDs, row.ID)
+		}
+	}
+
+	result := &RevTreeRepairResult{DryRun: dryRun, Docs: map[string]*DocRepair{}}
+	for _, docid := range docIDs {
+		key := realDocID(docid)
+		if key == "" {
+			continue
+		}
+		var repair *DocRepair
+		err := db.Bucket.Update(key, 0, func(current []byte) ([]byte, error) {
+			repair = nil
+			if current == nil {
+				return nil, couchbase.UpdateCancel
+			}
+			doc, err := unmarshalDocumentForRepair(docid, current)
+			if err != nil {
+				return nil, err
+			} else if !doc.hasValidSyncData() {
+				return nil, couchbase.UpdateCancel
+			}
+			problems := doc.History.Validate()
+			if problems == nil {
+				return nil, couchbase.UpdateCancel
+			}
+			repair = &DocRepair{Problems: problems}
+			if dryRun {
+				return nil, couchbase.UpdateCancel
+			}
+			if repair.Fixes = doc.History.Repair(); repair.Fixes == nil {
+				return nil, couchbase.UpdateCancel
+			}
+			return json.Marshal(doc)
+		})
+		if err != nil && err != couchbase.UpdateCancel {
+			if repair == nil {
+				repair = &DocRepair{}
+			}
+			repair.Fixes = nil
+			repair.Error = err.Error()
+		}
+		result.Checked++
+		if repair == nil {
+			continue
+		}
+		result.Docs[docid] = repair
+		for _, problem := range repair.Problems {
+			base.Warn("Rev tree of doc %q: %s", docid, problem)
+		}
+		for _, fix := range repair.Fixes {
+			base.Log("Repaired rev tree of doc %q: %s", docid, fix)
+		}
+	}
+	base.Log("Rev tree check of %q: %d docs checked, %d with problems (dry_run=%v)",
+		db.Name, result.Checked, len(result.Docs), dryRun)
+	return result, nil
+}
@@ -124,6 +124,40 @@ func TestRevTreeWinningRev(t *testing.T) {
 	assert.False(t, conflict)
 }
 
+func TestRevTreeFindCommonAncestor(t *testing.T) {
+	assert.Equals(t, branchymap.findCommonAncestor("3-three", "3-drei"), "2-two")
+	assert.Equals(t, branchymap.findCommonAncestor("3-three", "2-two"), "2-two")
+	assert.Equals(t, branchymap.findCommonAncestor("1-one", "3-drei"), "1-one")
+	assert.Equals(t, branchymap.findCommonAncestor("3-three", "3-three"), "3-three")
+	assert.Equals(t, branchymap.findCommonAncestor("bogus", "3-three"), "")
+}
+
+func TestRevTreeRender(t *testing.T) {
+	rendered := branchymap.RenderJSON()
+	assert.Equals(t, rendered["winner"], "3-three")
+	assert.Equals(t, rendered["conflict"], true)
+	revs := rendered["revs"].([]Body)
+	assert.Equals(t, len(revs), 4)
+	assert.DeepEquals(t, revs[0], Body{"id": "1-one", "leaf": false, "has_body": false,
+		"children": []string{"2-two"}})
+	assert.DeepEquals(t, revs[1], Body{"id": "2-two", "parent": "1-one", "leaf": false,
+		"has_body": false, "children": []string{"3-drei", "3-three"}})
+	assert.DeepEquals(t, revs[3], Body{"id": "3-three", "parent": "2-two", "leaf": true,
+		"has_body": true})
+
+	assert.Equals(t, branchymap.RenderDOT(), `digraph RevTree {
+	node [shape=box];
+	"1-one" [style="dashed"];
+	"2-two" [style="dashed"];
+	"3-drei" [peripheries=2, style="dashed"];
+	"3-three" [peripheries=2, style="bold"];
+	"1-one" -> "2-two";
+	"2-two" -> "3-drei";
+	"2-two" -> "3-three";
+}
+`)
+}
+
 func TestRevTreeDepths(t *testing.T) {
 	tempmap := testmap.copy()
 	tempmap.computeDepths()
@@ -189,6 +223,33 @@ func TestParseRevisions(t *testing.T) {
 	}
 }
 
+func TestRevTreeValidate(t *testing.T) {
+	assert.DeepEquals(t, testmap.Validate(), []RevTreeProblem(nil))
+	assert.DeepEquals(t, branchymap.Validate(), []RevTreeProblem(nil))
+
+	tree := RevTree{
+		"1-a": {ID: "1-a", Parent: "3-c"},
+		"2-b": {ID: "2-b", Parent: "1-a"},
+		"3-c": {ID: "3-c", Parent: "2-b"},
+		"5-e": {ID: "5-e", Parent: "4-gone", Body: []byte(`{"x":1}`)},
+		"5-f": {ID: "5-f", Parent: "3-c", Body: []byte(`{"x":1}`)},
+	}
+	assert.DeepEquals(t, tree.Validate(), []RevTreeProblem{
+		{RevTreeCycle, "1-a", "3-c"},
+		{RevTreeMissingParent, "5-e", "4-gone"},
+		{RevTreeSharedBody, "5-f", "5-e"},
+	})
+
+	fixes := tree.Repair()
+	assert.Equals(t, len(fixes), 2)
+	assert.Equals(t, tree["1-a"].Parent, "")
+	assert.Equals(t, tree["5-e"].Parent, "")
+	assert.DeepEquals(t, tree.getHistory("5-f"), []string{"5-f", "3-c", "2-b", "1-a"})
+	// Shared bodies are reported but left alone:
+	assert.DeepEquals(t, tree.Validate(), []RevTreeProblem{{RevTreeSharedBody, "5-f", "5-e"}})
+	assert.DeepEquals(t, tree.Repair(), []string(nil))
+}
+
 //////// HELPERS:
 
 func assertFailed(t *testing.T, message string) {
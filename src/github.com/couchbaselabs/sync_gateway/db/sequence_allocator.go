@@ -16,14 +16,18 @@ import (
 )
 
 type sequenceAllocator struct {
-	bucket base.Bucket // Bucket whose counter to use
-	mutex  sync.Mutex  // Makes this object thread-safe
-	last   uint64      // Last sequence # assigned
-	max    uint64      // Max sequence # reserved
+	bucket    base.Bucket // Bucket whose counter to use
+	mutex     sync.Mutex  // Makes this object thread-safe
+	last      uint64      // Last sequence # assigned
+	max       uint64      // Max sequence # reserved
+	reserving bool        // Is a nextSequence call reserving more sequences?
+	waiting   uint64      // Number of nextSequence calls waiting for that
+	reserved  *sync.Cond  // Signaled when a reservation finishes
 }
 
 func newSequenceAllocator(bucket base.Bucket) (*sequenceAllocator, error) {
 	s := &sequenceAllocator{bucket: bucket}
+	s.reserved = sync.NewCond(&s.mutex)
 	return s, s.reserveSequences(0) // just reads latest sequence from bucket
 }
 
@@ -36,13 +40,33 @@ func (s *sequenceAllocator) lastSequence() (uint64, error) {
 	return last, err
 }
 
+// Assigns a new sequence number. When none are left in the reserved block, one caller
+// reserves more, enough for itself plus every other caller that's waiting meanwhile; so
+// concurrent writers share a single Incr instead of each making its own round trip.
 func (s *sequenceAllocator) nextSequence() (uint64, error) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
-	if s.last >= s.max {
-		if err := s._reserveSequences(1); err != nil {
+	for s.last >= s.max {
+		if s.reserving {
+			s.waiting++
+			s.reserved.Wait()
+			s.waiting--
+			continue
+		}
+		numToReserve := s.waiting + 1
+		s.reserving = true
+		s.mutex.Unlock()
+		dbExpvars.Add("sequence_reserves", 1)
+		max, err := s.bucket.Incr("_sync:seq", numToReserve, numToReserve, 0)
+		s.mutex.Lock()
+		s.reserving = false
+		s.reserved.Broadcast()
+		if err != nil {
+			base.Warn("Error from Incr in nextSequence(): %v", err)
 			return 0, err
 		}
+		s.max = max
+		s.last = max - numToReserve
 	}
 	s.last++
 	return s.last, nil
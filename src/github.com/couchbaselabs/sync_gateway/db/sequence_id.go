@@ -0,0 +1,98 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/couchbaselabs/sync_gateway/base"
+	"github.com/couchbaselabs/sync_gateway/channels"
+)
+
+// A position in the changes feed: the public "seq" of a ChangeEntry, and the "since" value a
+// client passes back. Clients treat its string form as opaque.
+type SequenceID struct {
+	// The sequence of the last change sent from each channel. Resuming a channel's log from
+	// the exact entry last sent means late-arriving sequences (ones added to the log after
+	// higher ones) aren't skipped.
+	Channels channels.TimedSet
+	// Every change with a sequence up to and including this one has been sent, so earlier
+	// changes can be skipped even in channels not listed in Channels. (A plain integer
+	// 'since' is parsed as a LowSeq.)
+	LowSeq uint64
+	// If nonzero, the change was sent as part of a backfill of a channel the user was granted
+	// access to at this sequence, after the client had already got past it. Such changes are
+	// older than ones the client has seen; the user couldn't see them before. A feed resumed
+	// from here goes on marking that channel's older changes as backfill.
+	TriggeredBy uint64
+}
+
+// Separates the "low:triggeredBy" prefix of a compound SequenceID from the channel vector.
+// (Channel names can't contain colons, so this can't appear in the vector.)
+const kSequenceIDSeparator = "::"
+
+// Encodes a SequenceID as a string. If it has no LowSeq or TriggeredBy, this is the same
+// as the string form of its Channels (the format used by earlier versions.)
+func (s SequenceID) String() string {
+	vector := s.Channels.String()
+	if s.LowSeq == 0 && s.TriggeredBy == 0 {
+		return vector
+	}
+	return fmt.Sprintf("%d:%d%s%s", s.LowSeq, s.TriggeredBy, kSequenceIDSeparator, vector)
+}
+
+// Parses a string generated by SequenceID.String(), or a plain integer sequence.
+func ParseSequenceID(str string) (s SequenceID, err error) {
+	vector := str
+	if i := strings.Index(str, kSequenceIDSeparator); i >= 0 {
+		vector = str[i+len(kSequenceIDSeparator):]
+		if _, err = fmt.Sscanf(str[:i], "%d:%d", &s.LowSeq, &s.TriggeredBy); err != nil {
+			return SequenceID{}, base.HTTPErrorf(http.StatusBadRequest, "Invalid sequence ID")
+		}
+	} else if low, err := strconv.ParseUint(str, 10, 64); err == nil {
+		s.LowSeq = low
+		vector = ""
+	}
+	if s.Channels = channels.TimedSetFromString(vector); s.Channels == nil {
+		return SequenceID{}, base.HTTPErrorf(http.StatusBadRequest, "Invalid sequence ID")
+	}
+	return s, nil
+}
+
+// Determines where to start reading a channel, given the sequence at which the user was granted
+// access to it. Returns the sequence of the log entry to resume after, and the sequence up to
+// which entries can be skipped. A channel granted after LowSeq hasn't been fully seen by the
+// client, so it's backfilled from its start (or from where an earlier backfill got to.)
+func (s SequenceID) channelStart(channel string, grantedAt uint64) (since uint64, minSeq uint64) {
+	since = s.Channels[channel]
+	if grantedAt > s.LowSeq {
+		if since == 0 && s.LowSeq > 0 {
+			base.LogTo("Changes+", "Backfilling channel %q granted at #%d", channel, grantedAt)
+		}
+		return since, 0
+	} else if since == 0 {
+		since = s.LowSeq
+	}
+	return since, s.LowSeq
+}
+
+// Returns the highest sequence the client is known to have seen.
+func (s SequenceID) maxSeq() uint64 {
+	max := s.LowSeq
+	for _, seq := range s.Channels {
+		if seq > max {
+			max = seq
+		}
+	}
+	return max
+}
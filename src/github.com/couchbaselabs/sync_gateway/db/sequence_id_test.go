@@ -0,0 +1,93 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/couchbaselabs/go.assert"
+
+	"github.com/couchbaselabs/sync_gateway/auth"
+	"github.com/couchbaselabs/sync_gateway/channels"
+)
+
+func TestParseSequenceID(t *testing.T) {
+	for _, str := range []string{"", "a:5,b:7", "10:0::a:5", "10:12::", "0:12::a:5,b:7"} {
+		s, err := ParseSequenceID(str)
+		assertNoError(t, err, "ParseSequenceID failed")
+		assert.Equals(t, s.String(), str)
+	}
+
+	s, err := ParseSequenceID("42")
+	assertNoError(t, err, "ParseSequenceID failed")
+	assert.Equals(t, s.LowSeq, uint64(42))
+	assert.Equals(t, s.String(), "42:0::")
+
+	for _, str := range []string{"a", "a:0", "x:y::a:5", "10:0::a"} {
+		_, err := ParseSequenceID(str)
+		assertHTTPError(t, err, 400)
+	}
+}
+
+func TestChangesSinceLowSeq(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+	db.ChannelMapper = channels.NewDefaultChannelMapper()
+
+	for _, docid := range []string{"doc1", "doc2", "doc3"} {
+		_, err := db.Put(docid, Body{"channels": []string{"all"}})
+		assertNoError(t, err, "put")
+	}
+	db.changesWriter.checkpoint()
+
+	// Changes up to LowSeq are skipped even though the channel isn't in the vector:
+	options := ChangesOptions{Since: SequenceID{LowSeq: 2}}
+	changes, err := db.GetChanges(channels.SetOf("all"), options)
+	assertNoError(t, err, "Couldn't GetChanges")
+	assert.Equals(t, len(changes), 1)
+	assert.Equals(t, changes[0].ID, "doc3")
+	assert.Equals(t, changes[0].Seq, "2:0::all:3")
+
+	// Resuming from a vector position:
+	options.Since, _ = ParseSequenceID("all:1")
+	changes, err = db.GetChanges(channels.SetOf("all"), options)
+	assertNoError(t, err, "Couldn't GetChanges")
+	assert.Equals(t, len(changes), 2)
+	assert.Equals(t, changes[1].Seq, "all:3")
+}
+
+func TestChangesResumeBackfill(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+	db.ChannelMapper = channels.NewDefaultChannelMapper()
+
+	for i, channel := range []string{"a", "b", "b", "x", "x", "a"} {
+		_, err := db.Put(fmt.Sprintf("doc%d", i+1), Body{"channels": []string{channel}})
+		assertNoError(t, err, "put")
+	}
+	db.changesWriter.checkpoint()
+
+	authenticator := auth.NewAuthenticator(db.Bucket, db)
+	user, _ := authenticator.NewUser("naomi", "letmein", nil)
+	user.SetExplicitChannels(channels.TimedSet{"a": 1, "b": 5})
+	assertNoError(t, authenticator.Save(user), "Save")
+	db.user, _ = authenticator.GetUser("naomi")
+
+	// The client got part of channel b's backfill, triggered by its grant at #5, and has since
+	// seen channel a up to #6. The rest of the backfill is still marked as triggered by #5:
+	options := ChangesOptions{}
+	options.Since, _ = ParseSequenceID("0:5::a:6,b:2")
+	changes, err := db.GetChanges(channels.SetOf("a", "b"), options)
+	assertNoError(t, err, "Couldn't GetChanges")
+	assert.Equals(t, len(changes), 1)
+	assert.Equals(t, changes[0].ID, "doc3")
+	assert.Equals(t, changes[0].Seq, "0:5::a:6,b:3")
+}
@@ -20,6 +20,7 @@ type Shadower struct {
 	bucket       base.Bucket      // External bucket we sync with
 	tapFeed      base.TapFeed     // Observes changes to bucket
 	docIDPattern *regexp.Regexp    // Optional regex that key/doc IDs must match
+	pause        pauseSwitch       // Stops pulling changes while paused
 }
 
 // Creates a new Shadower.
@@ -37,6 +38,7 @@ func NewShadower(context *DatabaseContext, bucket base.Bucket, docIDPattern *reg
 func (s *Shadower) Stop() {
 	if s != nil && s.tapFeed != nil {
 		s.tapFeed.Close()
+		s.pause.setPaused(false)
 	}
 }
 
@@ -54,6 +56,7 @@ func (s *Shadower) docIDMatches(docID string) bool {
 func (s *Shadower) readTapFeed() {
 	vbucketsFilling := 0
 	for event := range s.tapFeed.Events() {
+		s.pause.waitWhilePaused()
 		switch event.Opcode {
 		case walrus.TapBeginBackfill:
 			if vbucketsFilling == 0 {
@@ -90,6 +93,8 @@ func (s *Shadower) pullDocument(key string, value []byte, isDeletion bool, cas u
 		if err := json.Unmarshal(value, &body); err != nil {
 			return err
 		}
+		// The external bucket has no notion of revisions, so ignore any "_rev" (etc.) in it:
+		body = stripSpecialProperties(body)
 	}
 
 	db, _ := CreateDatabase(s.context)
@@ -109,6 +114,7 @@ func (s *Shadower) pullDocument(key string, value []byte, isDeletion bool, cas u
 		if doc.History[newRev] == nil {
 			doc.History.addRevision(RevInfo{ID: newRev, Parent: parentRev, Deleted: isDeletion})
 			base.LogTo("Shadow", "Pulling %q, CAS=%x --> rev %q", key, cas, newRev)
+			dbExpvars.Add("shadow_pulls", 1)
 		} else {
 			// We already have this rev; but don't cancel, because we do need to update the
 			// doc's UpstreamRev/UpstreamCAS fields.
@@ -136,7 +142,7 @@ func (s *Shadower) PushRevision(doc *document) {
 		err = s.bucket.Delete(doc.ID)
 	} else {
 		base.LogTo("Shadow", "Pushing %q, rev %q", doc.ID, doc.CurrentRev)
-		body := doc.getRevision(doc.CurrentRev)
+		body := doc.getRevision(doc.CurrentRev, nil)
 		if body == nil {
 			base.Warn("Can't get rev %q.%q to push to external bucket", doc.ID, doc.CurrentRev)
 			return
@@ -145,5 +151,7 @@ func (s *Shadower) PushRevision(doc *document) {
 	}
 	if err != nil {
 		base.Warn("Error pushing rev of %q to external bucket: %v", doc.ID, err)
+	} else {
+		dbExpvars.Add("shadow_pushes", 1)
 	}
 }
@@ -13,6 +13,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/couchbaselabs/sync_gateway/base"
 )
@@ -28,6 +29,7 @@ func (db *Database) GetSpecial(doctype string, docid string) (Body, error) {
 	if err != nil {
 		return nil, err
 	}
+	delete(body, kSpecialDocTimeProperty)
 	return body, nil
 }
 
@@ -61,6 +63,7 @@ func (db *Database) putSpecial(doctype string, docid string, matchRev string, bo
 			}
 			revid = fmt.Sprintf("0-%d", generation+1)
 			body["_rev"] = revid
+			stampSpecialDoc(body)
 			return json.Marshal(body)
 		} else {
 			// Deleting:
@@ -82,6 +85,34 @@ func (db *Database) DeleteSpecial(doctype string, docid string, revid string) er
 	return err
 }
 
+// Gets a _local document. These are stored outside the regular document namespace and have no
+// revision tree, channels or sync function; they're not replicated. Replicators use them to
+// store checkpoints.
+func (db *Database) GetLocal(docid string) (Body, error) {
+	return db.GetSpecial("local", docid)
+}
+
+// Creates, or updates if the body's "_rev" matches, a _local document.
+func (db *Database) PutLocal(docid string, body Body) (string, error) {
+	return db.PutSpecial("local", docid, body)
+}
+
+// Deletes a _local document, whose current revision must match revid.
+func (db *Database) DeleteLocal(docid string, revid string) error {
+	return db.DeleteSpecial("local", docid, revid)
+}
+
+// Prefix of the keys of _local docs
+const kLocalDocKeyPrefix = "_sync:local:"
+
+// Property of a special doc holding the time it was last updated, which the sweeper uses to
+// find abandoned _local docs
+const kSpecialDocTimeProperty = "_time"
+
+func stampSpecialDoc(body Body) {
+	body[kSpecialDocTimeProperty] = time.Now().UTC().Format(time.RFC3339)
+}
+
 func (db *Database) realSpecialDocID(doctype string, docid string) string {
 	return "_sync:" + doctype + ":" + docid
 }
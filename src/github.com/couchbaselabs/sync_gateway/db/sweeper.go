@@ -0,0 +1,153 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/couchbaselabs/go-couchbase"
+
+	"github.com/couchbaselabs/sync_gateway/auth"
+	"github.com/couchbaselabs/sync_gateway/base"
+)
+
+// How often the sweeper runs
+const kSweepInterval = time.Hour
+
+// Default time after its last update that a _local doc is deleted by the sweeper
+const DefaultLocalDocRetention = 90 * 24 * time.Hour
+
+// Starts a goroutine that periodically deletes leftover housekeeping docs (see Sweep) until
+// the database is closed.
+func (context *DatabaseContext) StartSweeper(localDocRetention time.Duration) {
+	if context.sweeperStop != nil {
+		return
+	}
+	context.sweeperStop = make(chan bool)
+	go func(stop <-chan bool) {
+		ticker := time.NewTicker(kSweepInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				context.Sweep(localDocRetention)
+			case <-stop:
+				return
+			}
+		}
+	}(context.sweeperStop)
+}
+
+func (context *DatabaseContext) stopSweeper() {
+	if context.sweeperStop != nil {
+		close(context.sweeperStop)
+		context.sweeperStop = nil
+	}
+}
+
+// Deletes login sessions that have expired (Couchbase Server expires them itself, but other
+// buckets may not), and _local docs (usually replication checkpoints) that haven't been
+// updated within the retention period. A retention of 0 keeps _local docs forever.
+// Also rolls back atomic updates that were interrupted since the last sweep.
+// Returns the number of each kind of doc deleted.
+func (context *DatabaseContext) Sweep(localDocRetention time.Duration) (sessions int, localDocs int) {
+	context.RecoverAtomicWrites()
+	now := time.Now()
+	sessions = context.sweepDocs(auth.SessionKeyPrefix, func(key string, data []byte) ([]byte, error) {
+		if !isExpiredSession(key, data, now) {
+			return nil, couchbase.UpdateCancel
+		}
+		return nil, nil
+	})
+	if localDocRetention > 0 {
+		cutoff := now.Add(-localDocRetention)
+		localDocs = context.sweepDocs(kLocalDocKeyPrefix, func(key string, data []byte) ([]byte, error) {
+			return sweepLocalDoc(data, cutoff)
+		})
+	}
+	dbExpvars.Add("sweptSessions", int64(sessions))
+	dbExpvars.Add("sweptLocalDocs", int64(localDocs))
+	if sessions > 0 || localDocs > 0 {
+		base.Log("Sweeper deleted %d expired sessions and %d stale _local docs of %q",
+			sessions, localDocs, context.Name)
+	}
+	return
+}
+
+// Is this doc a login session that expired before now? Session keys share a namespace with
+// regular docs (a doc ID can start with "session:"), so anything that isn't unmistakably a
+// session -- a doc with sync metadata, or missing any of a session's properties -- is kept.
+func isExpiredSession(key string, data []byte, now time.Time) bool {
+	var raw map[string]json.RawMessage
+	if json.Unmarshal(data, &raw) != nil || raw["_sync"] != nil {
+		return false
+	}
+	var session auth.LoginSession
+	if json.Unmarshal(data, &session) != nil || session.ID == "" || session.Username == "" ||
+		session.Expiration.IsZero() || key != auth.SessionKeyPrefix+session.ID {
+		return false
+	}
+	return session.Expiration.Before(now)
+}
+
+// Sweeps the docs with a key prefix. The callback is called from within a Bucket.Update, so
+// the doc can't change between being checked and being deleted, and returns what Update's
+// callback would: nil to delete the doc, new contents for it, or couchbase.UpdateCancel.
+// Returns the number of docs deleted.
+func (context *DatabaseContext) sweepDocs(prefix string, sweep func(key string, data []byte) ([]byte, error)) int {
+	opts := Body{"stale": false, "startkey": prefix, "endkey": prefix + "~", "inclusive_end": false}
+	vres, err := context.Bucket.View("sync_housekeeping", "all_bits", opts)
+	if err != nil {
+		base.Warn("all_bits view returned %v", err)
+		return 0
+	}
+	count := 0
+	for _, row := range vres.Rows {
+		key := row.ID
+		deleted := false
+		err := context.Bucket.Update(key, 0, func(value []byte) ([]byte, error) {
+			if value == nil {
+				return nil, couchbase.UpdateCancel
+			}
+			updated, err := sweep(key, value)
+			deleted = (updated == nil && err == nil)
+			return updated, err
+		})
+		if err == couchbase.UpdateCancel {
+			continue
+		} else if err != nil {
+			base.Warn("Sweeper couldn't update %q: %v", key, err)
+		} else if deleted {
+			base.LogTo("CRUD", "\tSwept %q", key)
+			count++
+		}
+	}
+	return count
+}
+
+// Sweeps a _local doc: deletes it if its update time is before the cutoff. A doc saved by an
+// earlier version, with no update time, is given the current time so that it'll be swept a
+// retention period later.
+func sweepLocalDoc(data []byte, cutoff time.Time) ([]byte, error) {
+	var body Body
+	if json.Unmarshal(data, &body) != nil {
+		return nil, couchbase.UpdateCancel
+	}
+	updated, ok := body[kSpecialDocTimeProperty].(string)
+	if !ok {
+		stampSpecialDoc(body)
+		return json.Marshal(body)
+	}
+	if t, err := time.Parse(time.RFC3339, updated); err != nil || !t.Before(cutoff) {
+		return nil, couchbase.UpdateCancel
+	}
+	return nil, nil
+}
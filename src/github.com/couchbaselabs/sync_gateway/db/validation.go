@@ -0,0 +1,145 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/couchbaselabs/walrus"
+	"github.com/robertkrimen/otto"
+
+	"github.com/couchbaselabs/sync_gateway/base"
+)
+
+// Number of JS runners (and Otto contexts) for the validation function to cache
+const kValidationTaskCacheSize = 4
+
+// A JavaScript function that checks the shape of a new revision's body before the sync
+// function sees it. It's called with the body (minus its "_" properties) and returns true,
+// null or nothing if the body is valid. To reject it, it returns false, an error message, or
+// an object {"path": <JSON Pointer to the bad value>, "message": <error message>}.
+type ValidationFunction struct {
+	*walrus.JSServer // "Superclass"
+}
+
+func NewValidationFunction(fnSource string) *ValidationFunction {
+	return &ValidationFunction{
+		JSServer: walrus.NewJSServer(fnSource, kValidationTaskCacheSize,
+			func(fnSource string) (walrus.JSServerTask, error) {
+				runner, err := walrus.NewJSRunner(fnSource)
+				if err != nil {
+					return nil, err
+				}
+				runner.After = func(result otto.Value, err error) (interface{}, error) {
+					if err != nil {
+						return nil, err
+					}
+					return validationResult(result)
+				}
+				return runner, nil
+			}),
+	}
+}
+
+// Converts the validation function's return value to nil (valid) or a *SchemaViolation.
+func validationResult(result otto.Value) (interface{}, error) {
+	if result.IsUndefined() || result.IsNull() {
+		return (*SchemaViolation)(nil), nil
+	} else if result.IsString() {
+		message, _ := result.ToString()
+		return &SchemaViolation{Message: message}, nil
+	} else if result.IsObject() {
+		exported, _ := result.Export()
+		if obj, ok := exported.(map[string]interface{}); ok {
+			violation := &SchemaViolation{Message: "is invalid"}
+			violation.Path, _ = obj["path"].(string)
+			if message, ok := obj["message"].(string); ok {
+				violation.Message = message
+			}
+			return violation, nil
+		}
+	}
+	if valid, _ := result.ToBoolean(); valid {
+		return (*SchemaViolation)(nil), nil
+	}
+	return &SchemaViolation{Message: "is invalid"}, nil
+}
+
+// Checks a document body with the function.
+func (fn *ValidationFunction) Validate(body map[string]interface{}) (*SchemaViolation, error) {
+	result, err := fn.Call(body)
+	if err != nil {
+		return nil, err
+	}
+	return result.(*SchemaViolation), nil
+}
+
+// Sets the database's document validation: a JSON Schema and/or a JS validation function.
+// Either can be empty; if both are given, the schema is checked first.
+func (context *DatabaseContext) ApplyValidation(schemaJSON []byte, fnSource string) error {
+	var schema *DocSchema
+	if len(schemaJSON) > 0 {
+		var err error
+		if schema, err = ParseDocSchema(schemaJSON); err != nil {
+			base.Warn("Error setting validation schema: %s", err)
+			return err
+		}
+	}
+	var fn *ValidationFunction
+	if fnSource != "" {
+		if _, err := walrus.NewJSRunner(fnSource); err != nil { // Check that it compiles
+			base.Warn("Error setting validation function: %s", err)
+			return err
+		}
+		fn = NewValidationFunction(fnSource)
+	}
+	context.ValidationSchema = schema
+	context.ValidationFunction = fn
+	return nil
+}
+
+// Checks a new revision's body against the database's schema and validation function.
+// Deletions aren't checked. A body that doesn't pass is rejected with a 403 whose details
+// give the path of the bad value.
+func (context *DatabaseContext) validateDoc(docid string, body Body) error {
+	if (context.ValidationSchema == nil && context.ValidationFunction == nil) || body["_deleted"] == true {
+		return nil
+	}
+	userBody := make(map[string]interface{}, len(body))
+	for key, value := range body {
+		if key == "" || key[0] != '_' {
+			userBody[key] = value
+		}
+	}
+
+	var violation *SchemaViolation
+	if context.ValidationSchema != nil {
+		violation = context.ValidationSchema.Validate(userBody)
+	}
+	if violation == nil && context.ValidationFunction != nil {
+		var err error
+		if violation, err = context.ValidationFunction.Validate(userBody); err != nil {
+			base.Warn("Validation fn exception: %+v; doc = %q", err, docid)
+			return base.HTTPErrorf(http.StatusInternalServerError, "Exception in JS validation function")
+		}
+	}
+	if violation == nil {
+		return nil
+	}
+	base.LogTo("CRUD", "Doc %q failed validation: %s", docid, violation)
+	dbExpvars.Add("validation_rejections", 1)
+	return &base.RejectionError{
+		Status:  http.StatusForbidden,
+		Message: fmt.Sprintf("Document failed validation: %s", violation),
+		Check:   "validation",
+		Path:    &violation.Path,
+	}
+}
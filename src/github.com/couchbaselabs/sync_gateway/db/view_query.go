@@ -0,0 +1,107 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/couchbaselabs/walrus"
+
+	"github.com/couchbaselabs/sync_gateway/base"
+)
+
+// Queries a view of one of the bucket's design docs. The admin gets the bucket's result as-is.
+// Other users only get the rows emitted by (live) docs in their channels, with include_docs
+// bodies being the gateway's view of the doc; they can't query the gateway's own design docs,
+// or run reduce queries, since reduced rows can't be traced back to their docs. Their queries
+// always run with stale=false, since a stale index may have rows emitted by older revisions
+// the user can't see, whose keys and values would leak.
+// Note that 'limit' is applied before the rows are filtered, so fewer rows may be returned.
+func (db *Database) QueryDesignDoc(ddocName string, viewName string, options map[string]interface{}) (*walrus.ViewResult, error) {
+	if db.user == nil {
+		result, err := db.Bucket.View(ddocName, viewName, options)
+		if err != nil {
+			return nil, err
+		}
+		return &result, nil
+	}
+
+	if ddocName == "sync_gateway" || ddocName == "sync_housekeeping" {
+		return nil, base.HTTPErrorf(http.StatusForbidden, "forbidden")
+	}
+	if options["reduce"] == true || options["group"] == true || options["group_level"] != nil {
+		return nil, base.HTTPErrorf(http.StatusForbidden, "Only the admin can run reduce queries")
+	}
+	includeDocs := options["include_docs"] == true
+	delete(options, "include_docs")
+	options["reduce"] = false
+	options["stale"] = false
+
+	result, err := db.Bucket.View(ddocName, viewName, options)
+	if err != nil {
+		return nil, err
+	}
+
+	docIDs := make([]string, 0, len(result.Rows))
+	for _, row := range result.Rows {
+		if row.ID != "" && !strings.HasPrefix(row.ID, kSyncKeyPrefix) {
+			docIDs = append(docIDs, row.ID)
+		}
+	}
+	docs := db.getDocs(base.MergeStringArrays(docIDs))
+
+	rows := make(walrus.ViewRows, 0, len(result.Rows))
+	for _, row := range result.Rows {
+		doc := docs[row.ID]
+		if doc == nil || doc.Deleted || db.authorizeDoc(doc, "") != nil {
+			continue
+		}
+		row.Doc = nil
+		if includeDocs {
+			body, err := db.getRevFromDoc(doc, doc.CurrentRev, false)
+			if err != nil {
+				continue
+			}
+			var docValue interface{} = body
+			row.Doc = &docValue
+		}
+		rows = append(rows, row)
+	}
+	base.LogTo("HTTP+", "View %s/%s: user %q can see %d of %d rows",
+		ddocName, viewName, db.user.Name(), len(rows), len(result.Rows))
+	result.Rows = rows
+	result.TotalRows = len(rows)
+	return &result, nil
+}
+
+// Installs the views of a saved "_design/" doc as the bucket's design doc of that name, so they
+// can be queried. Deleting the doc leaves an empty design doc with no views. The gateway's own
+// design docs can't be replaced this way.
+func (db *Database) installDesignDoc(ddocName string, body Body) {
+	if ddocName == "sync_gateway" || ddocName == "sync_housekeeping" {
+		base.Warn("Not installing design doc %q over the gateway's own", ddocName)
+		return
+	}
+	var ddoc walrus.DesignDoc
+	if body["_deleted"] != true {
+		raw, _ := json.Marshal(body)
+		if err := json.Unmarshal(raw, &ddoc); err != nil {
+			base.Warn("Design doc %q has invalid views: %v", ddocName, err)
+			return
+		}
+	}
+	if err := db.Bucket.PutDDoc(ddocName, ddoc); err != nil {
+		base.Warn("Couldn't install design doc %q: %v", ddocName, err)
+		return
+	}
+	base.LogTo("CRUD", "Installed design doc %q with %d views", ddocName, len(ddoc.Views))
+}
@@ -0,0 +1,318 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+// Package loadgen simulates a population of mobile clients replicating with a Sync Gateway,
+// for capacity testing. Each client repeatedly pushes a batch of new docs (via _bulk_docs) and
+// pulls the changes in the channels it subscribes to (via _changes and _all_docs).
+package loadgen
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/couchbaselabs/sync_gateway/base"
+)
+
+// Parameters of a load test.
+type Config struct {
+	Target         string        // URL of the target database, e.g. "http://localhost:4984/db"
+	Username       string        // User to authenticate as (optional)
+	Password       string        // Password of the user
+	Clients        int           // Number of simulated clients
+	Duration       time.Duration // How long to run
+	DocSize        int           // Approximate size in bytes of each doc pushed
+	DocsPerPush    int           // Number of docs each push writes
+	Channels       int           // Number of distinct channels docs are assigned to
+	ChannelsPerDoc int           // Number of channels each doc is in
+	PullChannels   int           // Number of channels each client pulls (0 for all)
+	ChannelDist    string        // Distribution of channels: "uniform", or "zipf" (few hot channels)
+	Seed           int64         // Random seed, so runs are reproducible
+}
+
+// The default parameters, used for any the Config leaves zero.
+var DefaultConfig = Config{
+	Clients:        10,
+	Duration:       30 * time.Second,
+	DocSize:        1024,
+	DocsPerPush:    10,
+	Channels:       10,
+	ChannelsPerDoc: 1,
+	PullChannels:   1,
+	ChannelDist:    "uniform",
+	Seed:           1,
+}
+
+// Max number of changes a client pulls at once
+const kChangesLimit = 100
+
+func (config *Config) setup() error {
+	config.Target = strings.TrimRight(config.Target, "/")
+	if u, err := url.Parse(config.Target); err != nil || u.Host == "" {
+		return fmt.Errorf("Invalid target URL %q", config.Target)
+	}
+	defaults := DefaultConfig
+	for _, field := range []struct{ value, def *int }{
+		{&config.Clients, &defaults.Clients},
+		{&config.DocSize, &defaults.DocSize},
+		{&config.DocsPerPush, &defaults.DocsPerPush},
+		{&config.Channels, &defaults.Channels},
+		{&config.ChannelsPerDoc, &defaults.ChannelsPerDoc},
+	} {
+		if *field.value <= 0 {
+			*field.value = *field.def
+		}
+	}
+	if config.Duration <= 0 {
+		config.Duration = defaults.Duration
+	}
+	if config.ChannelsPerDoc > config.Channels {
+		config.ChannelsPerDoc = config.Channels
+	}
+	if config.PullChannels > config.Channels {
+		config.PullChannels = config.Channels
+	}
+	switch config.ChannelDist {
+	case "":
+		config.ChannelDist = defaults.ChannelDist
+	case "uniform", "zipf":
+	default:
+		return fmt.Errorf("Unknown channel distribution %q", config.ChannelDist)
+	}
+	return nil
+}
+
+// Runs a load test and returns the latencies of the requests made.
+func Run(config Config) (*Report, error) {
+	if err := config.setup(); err != nil {
+		return nil, err
+	}
+	base.Log("Load test: %d clients for %v against %s", config.Clients, config.Duration, config.Target)
+	stats := newLatencyStats()
+	start := time.Now()
+	deadline := start.Add(config.Duration)
+	runID := fmt.Sprintf("%x", start.UnixNano())
+	var wg sync.WaitGroup
+	for i := 0; i < config.Clients; i++ {
+		c := &client{
+			config: &config,
+			stats:  stats,
+			http:   &http.Client{},
+			rand:   rand.New(rand.NewSource(config.Seed + int64(i))),
+			prefix: fmt.Sprintf("loadgen-%s-%d-", runID, i),
+		}
+		c.chooseChannel = c.channelChooser()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.run(deadline)
+		}()
+	}
+	wg.Wait()
+	return stats.report(time.Since(start)), nil
+}
+
+// Entry point of the "sync_gateway loadgen" subcommand; 'args' are the arguments following it.
+func Main(args []string) {
+	config := DefaultConfig
+	flags := flag.NewFlagSet("loadgen", flag.ExitOnError)
+	flags.StringVar(&config.Username, "user", "", "Name of user to authenticate as")
+	flags.StringVar(&config.Password, "password", "", "Password of user")
+	flags.IntVar(&config.Clients, "clients", config.Clients, "Number of simulated clients")
+	flags.DurationVar(&config.Duration, "duration", config.Duration, "How long to run")
+	flags.IntVar(&config.DocSize, "docSize", config.DocSize, "Size in bytes of each doc")
+	flags.IntVar(&config.DocsPerPush, "docsPerPush", config.DocsPerPush, "Number of docs in each push")
+	flags.IntVar(&config.Channels, "channels", config.Channels, "Number of distinct channels")
+	flags.IntVar(&config.ChannelsPerDoc, "channelsPerDoc", config.ChannelsPerDoc, "Number of channels per doc")
+	flags.IntVar(&config.PullChannels, "pullChannels", config.PullChannels, "Number of channels each client pulls (0 for all)")
+	flags.StringVar(&config.ChannelDist, "channelDist", config.ChannelDist, "Channel distribution: uniform or zipf")
+	flags.Int64Var(&config.Seed, "seed", config.Seed, "Random seed")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s loadgen [options] <database URL>\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(1)
+	}
+	config.Target = flags.Arg(0)
+
+	report, err := Run(config)
+	if err != nil {
+		base.LogFatal("Load test failed: %v", err)
+	}
+	report.Write(os.Stdout)
+}
+
+//////// CLIENT:
+
+// A simulated client.
+type client struct {
+	config        *Config
+	stats         *latencyStats
+	http          *http.Client
+	rand          *rand.Rand
+	chooseChannel func() int
+	prefix        string   // Prefix of the IDs of the docs it creates
+	docCount      int      // Number of docs it's created
+	pullChannels  []string // Channels it pulls, or nil for all
+	since         string   // Checkpoint of its pull replication
+}
+
+func (c *client) run(deadline time.Time) {
+	if c.config.PullChannels > 0 {
+		c.pullChannels = make([]string, 0, c.config.PullChannels)
+		for _, ch := range c.rand.Perm(c.config.Channels)[0:c.config.PullChannels] {
+			c.pullChannels = append(c.pullChannels, channelName(ch))
+		}
+	}
+	for time.Now().Before(deadline) {
+		c.push()
+		c.pull()
+	}
+}
+
+// Returns a function that picks a random channel number according to the configured distribution.
+func (c *client) channelChooser() func() int {
+	n := c.config.Channels
+	if c.config.ChannelDist == "zipf" && n > 1 {
+		zipf := rand.NewZipf(c.rand, 1.1, 1, uint64(n-1))
+		return func() int { return int(zipf.Uint64()) }
+	}
+	return func() int { return c.rand.Intn(n) }
+}
+
+func channelName(n int) string {
+	return fmt.Sprintf("ch%d", n)
+}
+
+func (c *client) newDoc() map[string]interface{} {
+	channels := map[string]bool{}
+	for len(channels) < c.config.ChannelsPerDoc {
+		channels[channelName(c.chooseChannel())] = true
+	}
+	channelList := make([]string, 0, len(channels))
+	for ch := range channels {
+		channelList = append(channelList, ch)
+	}
+	data := make([]byte, c.config.DocSize)
+	for i := range data {
+		data[i] = byte('a' + c.rand.Intn(26))
+	}
+	c.docCount++
+	return map[string]interface{}{
+		"_id":      fmt.Sprintf("%s%d", c.prefix, c.docCount),
+		"channels": channelList,
+		"data":     string(data),
+	}
+}
+
+// Pushes a batch of new docs.
+func (c *client) push() {
+	docs := make([]interface{}, c.config.DocsPerPush)
+	for i := range docs {
+		docs[i] = c.newDoc()
+	}
+	var results []map[string]interface{}
+	err := c.timedRequest("push", "POST", "/_bulk_docs", map[string]interface{}{"docs": docs}, &results)
+	if err == nil {
+		for _, result := range results {
+			if result["error"] != nil {
+				base.Warn("Load test: couldn't push %v: %v", result["id"], result["reason"])
+			}
+		}
+	}
+}
+
+// Pulls the changes since the last pull, and the docs they refer to.
+func (c *client) pull() {
+	query := url.Values{}
+	query.Set("limit", fmt.Sprintf("%d", kChangesLimit))
+	if c.since != "" {
+		query.Set("since", c.since)
+	}
+	if c.pullChannels != nil {
+		query.Set("filter", "sync_gateway/bychannel")
+		query.Set("channels", strings.Join(c.pullChannels, ","))
+	}
+	var changes struct {
+		Results []struct {
+			ID      string `json:"id"`
+			Deleted bool   `json:"deleted"`
+		} `json:"results"`
+		LastSeq json.RawMessage `json:"last_seq"`
+	}
+	if c.timedRequest("changes", "GET", "/_changes?"+query.Encode(), nil, &changes) != nil {
+		return
+	}
+	if json.Unmarshal(changes.LastSeq, &c.since) != nil {
+		c.since = string(changes.LastSeq)
+	}
+
+	keys := make([]string, 0, len(changes.Results))
+	for _, change := range changes.Results {
+		if !change.Deleted {
+			keys = append(keys, change.ID)
+		}
+	}
+	if len(keys) > 0 {
+		var docs map[string]interface{}
+		c.timedRequest("get_docs", "POST", "/_all_docs?include_docs=true",
+			map[string]interface{}{"keys": keys}, &docs)
+	}
+}
+
+// Sends a request to the target database, recording its latency as operation 'op'.
+func (c *client) timedRequest(op, method, path string, body interface{}, result interface{}) error {
+	var input io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		input = bytes.NewReader(data)
+	}
+	rq, err := http.NewRequest(method, c.config.Target+path, input)
+	if err != nil {
+		return err
+	}
+	rq.Header.Set("Accept", "application/json")
+	if body != nil {
+		rq.Header.Set("Content-Type", "application/json")
+	}
+	if c.config.Username != "" {
+		rq.SetBasicAuth(c.config.Username, c.config.Password)
+	}
+
+	start := time.Now()
+	response, err := c.http.Do(rq)
+	if err == nil {
+		defer response.Body.Close()
+		if response.StatusCode >= 300 {
+			err = fmt.Errorf("%s %s returned %s", method, path, response.Status)
+		} else {
+			err = json.NewDecoder(response.Body).Decode(result)
+		}
+	}
+	c.stats.add(op, time.Since(start), err)
+	if err != nil {
+		base.Warn("Load test: %v", err)
+	}
+	return err
+}
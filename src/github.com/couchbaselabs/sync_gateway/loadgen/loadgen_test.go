@@ -0,0 +1,70 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package loadgen
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/go.assert"
+
+	"github.com/couchbaselabs/sync_gateway/rest"
+)
+
+func TestPercentile(t *testing.T) {
+	samples := make([]time.Duration, 100)
+	for i := range samples {
+		samples[i] = time.Duration(i+1) * time.Millisecond
+	}
+	assert.Equals(t, percentile(samples, 0.50), 50*time.Millisecond)
+	assert.Equals(t, percentile(samples, 0.99), 99*time.Millisecond)
+	assert.Equals(t, percentile(samples, 1.0), 100*time.Millisecond)
+	assert.Equals(t, percentile(samples[0:1], 0.9), 1*time.Millisecond)
+}
+
+func TestConfigSetup(t *testing.T) {
+	config := Config{Target: "http://localhost:4985/db/", Channels: 2, PullChannels: 5}
+	assert.Equals(t, config.setup(), nil)
+	assert.Equals(t, config.Target, "http://localhost:4985/db")
+	assert.Equals(t, config.Clients, DefaultConfig.Clients)
+	assert.Equals(t, config.PullChannels, 2)
+
+	config = Config{Target: "http://localhost:4985/db", ChannelDist: "normal"}
+	assert.True(t, config.setup() != nil)
+}
+
+func TestRun(t *testing.T) {
+	server := "walrus:"
+	bucketName := "loadgen_test"
+	sc := rest.NewServerContext(&rest.ServerConfig{})
+	defer sc.Close()
+	_, err := sc.AddDatabaseFromConfig(&rest.DbConfig{Server: &server, Bucket: &bucketName})
+	assert.Equals(t, err, nil)
+	httpServer := httptest.NewServer(rest.CreateAdminHandler(sc))
+	defer httpServer.Close()
+
+	report, err := Run(Config{
+		Target:      httpServer.URL + "/loadgen_test",
+		Clients:     2,
+		Duration:    200 * time.Millisecond,
+		DocSize:     100,
+		ChannelDist: "zipf",
+	})
+	assert.Equals(t, err, nil)
+	ops := map[string]OpReport{}
+	for _, op := range report.Ops {
+		ops[op.Op] = op
+	}
+	assert.True(t, ops["push"].Count > 0)
+	assert.Equals(t, ops["push"].Errors, 0)
+	assert.True(t, ops["changes"].Count > 0)
+	assert.Equals(t, ops["changes"].Errors, 0)
+}
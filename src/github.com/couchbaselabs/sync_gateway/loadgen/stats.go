@@ -0,0 +1,122 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package loadgen
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Collects the latencies of the requests made by the simulated clients, by operation.
+type latencyStats struct {
+	lock    sync.Mutex
+	samples map[string][]time.Duration
+	errors  map[string]int
+}
+
+func newLatencyStats() *latencyStats {
+	return &latencyStats{
+		samples: map[string][]time.Duration{},
+		errors:  map[string]int{},
+	}
+}
+
+func (stats *latencyStats) add(op string, latency time.Duration, err error) {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+	if err != nil {
+		stats.errors[op]++
+	} else {
+		stats.samples[op] = append(stats.samples[op], latency)
+	}
+}
+
+// Summary of the requests made for one operation.
+type OpReport struct {
+	Op       string
+	Count    int // Successful requests
+	Errors   int // Failed requests
+	P50, P90 time.Duration
+	P99, Max time.Duration
+}
+
+// The results of a load test.
+type Report struct {
+	Elapsed time.Duration
+	Ops     []OpReport
+}
+
+func (stats *latencyStats) report(elapsed time.Duration) *Report {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+	ops := map[string]bool{}
+	for op := range stats.samples {
+		ops[op] = true
+	}
+	for op := range stats.errors {
+		ops[op] = true
+	}
+	report := &Report{Elapsed: elapsed}
+	for op := range ops {
+		samples := stats.samples[op]
+		sort.Sort(durationList(samples))
+		opReport := OpReport{Op: op, Count: len(samples), Errors: stats.errors[op]}
+		if len(samples) > 0 {
+			opReport.P50 = percentile(samples, 0.50)
+			opReport.P90 = percentile(samples, 0.90)
+			opReport.P99 = percentile(samples, 0.99)
+			opReport.Max = samples[len(samples)-1]
+		}
+		report.Ops = append(report.Ops, opReport)
+	}
+	sort.Sort(opReportList(report.Ops))
+	return report
+}
+
+// Returns the p'th percentile (0 < p <= 1) of a sorted, non-empty list, by the nearest-rank method.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	rank := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	return sorted[rank]
+}
+
+// Writes the report as a table.
+func (report *Report) Write(w io.Writer) {
+	fmt.Fprintf(w, "Ran for %v\n", report.Elapsed)
+	fmt.Fprintf(w, "%-10s %8s %7s %8s %10s %10s %10s %10s\n",
+		"op", "count", "errors", "per sec", "p50", "p90", "p99", "max")
+	for _, op := range report.Ops {
+		rate := float64(op.Count) / report.Elapsed.Seconds()
+		fmt.Fprintf(w, "%-10s %8d %7d %8.1f %10v %10v %10v %10v\n", op.Op, op.Count, op.Errors, rate,
+			roundDuration(op.P50), roundDuration(op.P90), roundDuration(op.P99), roundDuration(op.Max))
+	}
+}
+
+func roundDuration(d time.Duration) time.Duration {
+	return (d + 5*time.Microsecond) / (10 * time.Microsecond) * (10 * time.Microsecond)
+}
+
+type durationList []time.Duration
+
+func (l durationList) Len() int           { return len(l) }
+func (l durationList) Less(i, j int) bool { return l[i] < l[j] }
+func (l durationList) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+
+type opReportList []OpReport
+
+func (l opReportList) Len() int           { return len(l) }
+func (l opReportList) Less(i, j int) bool { return l[i].Op < l[j].Op }
+func (l opReportList) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
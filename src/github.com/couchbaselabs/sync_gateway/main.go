@@ -9,9 +9,19 @@
 
 package main
 
-import "github.com/couchbaselabs/sync_gateway/rest"
+import (
+	"os"
+
+	"github.com/couchbaselabs/sync_gateway/loadgen"
+	"github.com/couchbaselabs/sync_gateway/rest"
+)
 
 // Simple Sync Gateway launcher tool.
+// "sync_gateway loadgen ..." runs a load test against a gateway instead of serving.
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "loadgen" {
+		loadgen.Main(os.Args[2:])
+		return
+	}
 	rest.ServerMain()
 }
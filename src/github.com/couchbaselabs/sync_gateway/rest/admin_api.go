@@ -12,6 +12,8 @@ package rest
 import (
 	"encoding/json"
 	"net/http"
+	"path/filepath"
+	"strconv"
 
 	"github.com/gorilla/mux"
 
@@ -55,6 +57,187 @@ func (h *handler) handleDeleteDB() error {
 	return nil
 }
 
+// Pauses one of a database's background subsystems (tap feed, shadowing...)
+func (h *handler) handlePauseSubsystem() error {
+	return h.setSubsystemPaused(true)
+}
+
+// Resumes a paused background subsystem
+func (h *handler) handleResumeSubsystem() error {
+	return h.setSubsystemPaused(false)
+}
+
+func (h *handler) setSubsystemPaused(paused bool) error {
+	h.assertAdminOnly()
+	if err := h.db.SetSubsystemPaused(h.PathVar("subsystem"), paused); err != nil {
+		return err
+	}
+	h.writeJSON(db.Body{"ok": true, "paused": h.db.PausedSubsystems()})
+	return nil
+}
+
+// Starts re-running the sync function over all docs, taking the database offline until done
+func (h *handler) handleResync() error {
+	h.assertAdminOnly()
+	if err := h.db.StartResync(); err != nil {
+		return err
+	}
+	h.writeJSONStatus(http.StatusAccepted, h.db.ResyncStatus())
+	return nil
+}
+
+// Reports the progress of the current (or last) resync
+func (h *handler) handleGetResync() error {
+	h.writeJSON(h.db.ResyncStatus())
+	return nil
+}
+
+// Checks docs' rev trees for corruption, repairing them unless ?dry_run is given. Checks the
+// docs given by ?docid= parameters, or all docs.
+func (h *handler) handleRepair() error {
+	docIDs := h.rq.URL.Query()["docid"]
+	result, err := h.db.RepairRevTrees(docIDs, h.getBoolQuery("dry_run"))
+	if err != nil {
+		return err
+	}
+	h.writeJSON(result)
+	return nil
+}
+
+// Reports doc counts, latest sequence and access of every channel
+func (h *handler) handleGetAllChannelStats() error {
+	stats, err := h.db.AllChannelStats()
+	if err != nil {
+		return err
+	}
+	h.writeJSON(stats)
+	return nil
+}
+
+// Reports doc counts, latest sequence and access of one channel
+func (h *handler) handleGetChannelStats() error {
+	stats, err := h.db.ChannelStats(h.PathVar("channel"))
+	if err != nil {
+		return err
+	}
+	h.writeJSON(stats)
+	return nil
+}
+
+// Lists the database's open _changes feeds
+func (h *handler) handleGetChangesConnections() error {
+	h.writeJSON(h.db.ChangesConnections())
+	return nil
+}
+
+// Ends an open _changes feed, given its ID from the listing
+func (h *handler) handleTerminateChangesConnection() error {
+	id, err := strconv.ParseUint(h.PathVar("id"), 10, 64)
+	if err != nil || !h.db.TerminateChangesConnection(id) {
+		return base.HTTPErrorf(http.StatusNotFound, "No such _changes feed")
+	}
+	h.writeJSON(db.Body{"ok": true})
+	return nil
+}
+
+//////// REPLICATION:
+
+// Starts or cancels a replication between two gateways (CouchDB-style POST /_replicate)
+func (h *handler) handleReplicate() error {
+	h.assertAdminOnly()
+	var config ReplicationConfig
+	if err := h.readJSONInto(&config); err != nil {
+		return err
+	}
+	if config.Cancel {
+		if err := config.setup(); err != nil {
+			return err
+		}
+		if !h.server.StopReplication(config.ReplicationID) {
+			return kNotFoundError
+		}
+		h.writeJSON(db.Body{"ok": true, "replication_id": config.ReplicationID})
+		return nil
+	}
+	status, err := h.server.StartReplication(config)
+	if err != nil {
+		return err
+	}
+	status["ok"] = true
+	h.writeJSON(status)
+	return nil
+}
+
+// Lists the running replications
+func (h *handler) handleActiveTasks() error {
+	h.assertAdminOnly()
+	h.writeJSON(h.server.ActiveReplications())
+	return nil
+}
+
+// Body of GET and PUT /_logging.
+type loggingSettings struct {
+	Keys  map[string]bool                `json:"keys,omitempty"`  // LogTo keys (PUT can disable them with false)
+	Sinks map[string]*base.LogSinkConfig `json:"sinks,omitempty"` // Log outputs by name (PUT replaces them all)
+}
+
+func currentLoggingSettings() loggingSettings {
+	return loggingSettings{Keys: base.GetLogKeys(), Sinks: base.GetLogSinks()}
+}
+
+// Returns the enabled log keys and the log sinks
+func (h *handler) handleGetLogging() error {
+	h.assertAdminOnly()
+	h.writeJSON(currentLoggingSettings())
+	return nil
+}
+
+// Changes the log keys and/or sinks while the server runs
+func (h *handler) handleSetLogging() error {
+	h.assertAdminOnly()
+	var settings loggingSettings
+	if err := h.readJSONInto(&settings); err != nil {
+		return err
+	}
+	if settings.Sinks != nil {
+		if err := h.checkLogFilePaths(settings.Sinks); err != nil {
+			return err
+		}
+		if err := base.SetLogSinks(settings.Sinks); err != nil {
+			return err
+		}
+	}
+	if settings.Keys != nil {
+		base.SetLogKeys(settings.Keys)
+		base.Log("Log keys changed through the admin API: %v", settings.Keys)
+	}
+	h.writeJSON(currentLoggingSettings())
+	return nil
+}
+
+// Only lets file sinks write into the configured LogDir, unless they're already logging to the
+// same path. A bare file name is taken to be in LogDir.
+func (h *handler) checkLogFilePaths(sinks map[string]*base.LogSinkConfig) error {
+	current := base.GetLogSinks()
+	for name, sink := range sinks {
+		if sink == nil || sink.Type != "file" || sink.Path == "" {
+			continue
+		} else if old := current[name]; old != nil && old.Type == "file" && old.Path == sink.Path {
+			continue
+		}
+		logDir := h.server.config.LogDir
+		if logDir == nil {
+			return base.HTTPErrorf(http.StatusForbidden, "Log files can't be added at runtime; set LogDir in the config")
+		}
+		if filepath.Base(sink.Path) == sink.Path && sink.Path != "." && sink.Path != ".." {
+			sink.Path = filepath.Join(*logDir, sink.Path)
+		} else if filepath.Dir(filepath.Clean(sink.Path)) != filepath.Clean(*logDir) {
+			return base.HTTPErrorf(http.StatusForbidden, "Log file %q isn't in the LogDir", sink.Path)
+		}
+	}
+	return nil
+}
+
 // raw document access for admin api
 
 func (h *handler) handleGetRawDoc() error {
@@ -67,6 +250,30 @@ func (h *handler) handleGetRawDoc() error {
 	return err
 }
 
+// Renders a document's revision tree, as JSON or (with ?format=dot) as a Graphviz graph
+func (h *handler) handleGetRevTree() error {
+	h.assertAdminOnly()
+	doc, err := h.db.GetDoc(h.PathVar("docid"))
+	if doc == nil {
+		if err == nil {
+			err = kNotFoundError
+		}
+		return err
+	}
+	switch h.getQuery("format") {
+	case "", "json":
+		tree := doc.History.RenderJSON()
+		tree["id"] = doc.ID
+		h.writeJSON(tree)
+	case "dot":
+		h.setHeader("Content-Type", "text/vnd.graphviz")
+		h.response.Write([]byte(doc.History.RenderDOT()))
+	default:
+		return base.HTTPErrorf(http.StatusBadRequest, "Unknown format; use json or dot")
+	}
+	return nil
+}
+
 //////// USERS & ROLES:
 
 func internalUserName(name string) string {
@@ -88,6 +295,7 @@ func marshalPrincipal(princ auth.Principal) ([]byte, error) {
 	info := PrincipalConfig{
 		Name:             &name,
 		ExplicitChannels: princ.ExplicitChannels().AsSet(),
+		ExcludedChannels: princ.ExcludedChannels(),
 	}
 	if user, ok := princ.(auth.User); ok {
 		info.Channels = user.InheritedChannels().AsSet()
@@ -95,12 +303,39 @@ func marshalPrincipal(princ auth.Principal) ([]byte, error) {
 		info.Disabled = user.Disabled()
 		info.ExplicitRoleNames = user.ExplicitRoleNames()
 		info.RoleNames = user.RoleNames()
+		info.ChannelSources = channelSources(user)
 	} else {
 		info.Channels = princ.Channels().AsSet()
 	}
 	return json.Marshal(info)
 }
 
+// Lists where each of a user's channels came from, so admins can see why a user has access.
+func channelSources(user auth.User) map[string][]string {
+	sources := map[string][]string{}
+	explicit := user.ExplicitChannels()
+	static := user.StaticChannels()
+	for channel := range user.Channels() {
+		_, isExplicit := explicit[channel]
+		_, isStatic := static[channel]
+		if isExplicit {
+			sources[channel] = append(sources[channel], "admin")
+		}
+		if isStatic {
+			sources[channel] = append(sources[channel], "config")
+		}
+		if !isExplicit && !isStatic {
+			sources[channel] = append(sources[channel], "sync")
+		}
+	}
+	for _, role := range user.GetRoles() {
+		for channel := range role.Channels() {
+			sources[channel] = append(sources[channel], "role:"+role.Name())
+		}
+	}
+	return sources
+}
+
 // Updates or creates a principal from a PrincipalConfig structure.
 func updatePrincipal(dbc *db.DatabaseContext, newInfo PrincipalConfig, isUser bool, allowReplace bool) (replaced bool, err error) {
 	// Get the existing principal, or if this is a POST make sure there isn't one:
@@ -145,6 +380,7 @@ func updatePrincipal(dbc *db.DatabaseContext, newInfo PrincipalConfig, isUser bo
 	}
 	updatedChannels.UpdateAtSequence(newInfo.ExplicitChannels, lastSeq+1)
 	princ.SetExplicitChannels(updatedChannels)
+	princ.SetExcludedChannels(newInfo.ExcludedChannels)
 
 	// Then the roles:
 	if isUser {
@@ -211,7 +447,11 @@ func (h *handler) putRole() error {
 
 func (h *handler) deleteUser() error {
 	h.assertAdminOnly()
-	user, err := h.db.Authenticator().GetUser(mux.Vars(h.rq)["name"])
+	name := internalUserName(mux.Vars(h.rq)["name"])
+	if name == "" {
+		return base.HTTPErrorf(http.StatusForbidden, "The GUEST user can't be deleted; disable it instead")
+	}
+	user, err := h.db.Authenticator().GetUser(name)
 	if user == nil {
 		if err == nil {
 			err = kNotFoundError
@@ -11,10 +11,18 @@ package rest
 
 import (
 	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/couchbaselabs/go.assert"
 
+	"github.com/couchbaselabs/sync_gateway/base"
 	"github.com/couchbaselabs/sync_gateway/channels"
 	"github.com/couchbaselabs/sync_gateway/db"
 )
@@ -152,4 +160,244 @@ func TestGuestUser(t *testing.T) {
 	assert.Equals(t, user.Name(), "")
 	assert.DeepEquals(t, user.ExplicitChannels(), channels.TimedSet(nil))
 	assert.Equals(t, user.Disabled(), true)
+
+	// The guest user can be disabled but not deleted:
+	assertStatus(t, rt.sendAdminRequest("DELETE", "/db/_user/GUEST", ""), 403)
+}
+
+func TestUserChannelSources(t *testing.T) {
+	rt := restTester{syncFn: `function(doc) {access(doc.users, doc.grant);}`}
+	assertStatus(t, rt.sendAdminRequest("PUT", "/db/_role/hipster", `{"admin_channels":["fixies", "foo"]}`), 201)
+	assertStatus(t, rt.sendAdminRequest("PUT", "/db/_user/snej",
+		`{"password":"letmein", "admin_channels":["foo"], "admin_roles":["hipster"]}`), 201)
+	assertStatus(t, rt.sendAdminRequest("PUT", "/db/grant", `{"users":["snej"], "grant":["bar"]}`), 201)
+
+	response := rt.sendAdminRequest("GET", "/db/_user/snej", "")
+	assertStatus(t, response, 200)
+	var body struct {
+		ChannelSources map[string][]string `json:"channel_sources"`
+	}
+	json.Unmarshal(response.Body.Bytes(), &body)
+	assert.DeepEquals(t, body.ChannelSources["foo"], []string{"admin", "role:hipster"})
+	assert.DeepEquals(t, body.ChannelSources["bar"], []string{"sync"})
+	assert.DeepEquals(t, body.ChannelSources["fixies"], []string{"role:hipster"})
+}
+
+func TestPauseSubsystem(t *testing.T) {
+	var rt restTester
+	response := rt.sendAdminRequest("POST", "/db/_pause/feed", "")
+	assertStatus(t, response, 200)
+	assert.Equals(t, string(response.Body.Bytes()), `{"ok":true,"paused":["feed"]}`)
+
+	// The health/info endpoint shows the paused subsystems:
+	response = rt.sendAdminRequest("GET", "/db/", "")
+	assertStatus(t, response, 200)
+	var body db.Body
+	json.Unmarshal(response.Body.Bytes(), &body)
+	assert.DeepEquals(t, body["paused"], []interface{}{"feed"})
+
+	response = rt.sendAdminRequest("POST", "/db/_resume/feed", "")
+	assertStatus(t, response, 200)
+	assert.Equals(t, string(response.Body.Bytes()), `{"ok":true,"paused":[]}`)
+
+	// There's no shadower configured, and no such thing as a "bogus" subsystem:
+	assertStatus(t, rt.sendAdminRequest("POST", "/db/_pause/shadow", ""), 404)
+	assertStatus(t, rt.sendAdminRequest("POST", "/db/_pause/bogus", ""), 404)
+}
+
+func TestChangesConnections(t *testing.T) {
+	var rt restTester
+	database := rt.ServerContext().Database("db")
+	database.MaxContinuousChanges = 1
+	conn := &db.ChangesConnection{User: "alice", Feed: "continuous", Channels: []string{"*"}}
+	assert.Equals(t, database.OpenChangesConnection(conn, true), nil)
+
+	// The limit only applies to feeds that wait for changes:
+	assertStatus(t, rt.sendRequest("GET", "/db/_changes?feed=longpoll", ""), 503)
+	assertStatus(t, rt.sendRequest("GET", "/db/_changes", ""), 200)
+
+	response := rt.sendAdminRequest("GET", "/db/_changes_connections", "")
+	assertStatus(t, response, 200)
+	var conns []db.ChangesConnection
+	json.Unmarshal(response.Body.Bytes(), &conns)
+	assert.Equals(t, len(conns), 1)
+	assert.Equals(t, conns[0].User, "alice")
+	assert.Equals(t, conns[0].Feed, "continuous")
+
+	assertStatus(t, rt.sendAdminRequest("DELETE", "/db/_changes_connections/99", ""), 404)
+	assertStatus(t, rt.sendAdminRequest("DELETE", fmt.Sprintf("/db/_changes_connections/%d", conn.ID), ""), 200)
+	_, open := <-conn.Terminator
+	assert.False(t, open)
+	database.CloseChangesConnection(conn)
+	assertStatus(t, rt.sendRequest("GET", "/db/_changes?feed=longpoll&timeout=1", ""), 200)
+}
+
+func TestChannelStats(t *testing.T) {
+	var rt restTester
+	assertStatus(t, rt.sendAdminRequest("PUT", "/db/_role/hipster", `{"admin_channels":["fedoras"]}`), 201)
+	assertStatus(t, rt.sendAdminRequest("PUT", "/db/_user/naomi",
+		`{"password":"letmein", "admin_channels":["hats"], "admin_roles":["hipster"]}`), 201)
+	assertStatus(t, rt.sendRequest("PUT", "/db/doc1", `{"channels":["fedoras"]}`), 201)
+	response := rt.sendRequest("PUT", "/db/doc2", `{"channels":["fedoras", "hats"]}`)
+	assertStatus(t, response, 201)
+	var body db.Body
+	json.Unmarshal(response.Body.Bytes(), &body)
+	assertStatus(t, rt.sendRequest("PUT", "/db/doc2", `{"channels":["hats"], "_rev":"`+body["rev"].(string)+`"}`), 201)
+
+	response = rt.sendAdminRequest("GET", "/db/_channels/fedoras", "")
+	assertStatus(t, response, 200)
+	var stats db.ChannelStats
+	json.Unmarshal(response.Body.Bytes(), &stats)
+	assert.Equals(t, stats.DocCount, 1)
+	assert.Equals(t, stats.RemovedCount, 1)
+	assert.True(t, stats.LastSeq > 0)
+	assert.DeepEquals(t, stats.Users, []string{"naomi"})
+	assert.DeepEquals(t, stats.Roles, []string{"hipster"})
+
+	response = rt.sendAdminRequest("GET", "/db/_channels", "")
+	assertStatus(t, response, 200)
+	var all []db.ChannelStats
+	json.Unmarshal(response.Body.Bytes(), &all)
+	assert.Equals(t, len(all), 2)
+	assert.Equals(t, all[0].Name, "fedoras")
+	assert.Equals(t, all[1].Name, "hats")
+	assert.Equals(t, all[1].DocCount, 1)
+	assert.DeepEquals(t, all[1].Roles, []string(nil))
+
+	// Unknown channels have no docs and no access, except through wildcards:
+	response = rt.sendAdminRequest("GET", "/db/_channels/nothing", "")
+	assertStatus(t, response, 200)
+	stats = db.ChannelStats{}
+	json.Unmarshal(response.Body.Bytes(), &stats)
+	assert.Equals(t, stats.DocCount, 0)
+	assert.DeepEquals(t, stats.Users, []string(nil))
+	assertStatus(t, rt.sendRequest("GET", "/db/_channels", ""), 404)
+}
+
+func TestMetering(t *testing.T) {
+	var rt restTester
+	docBody := `{"channels":["public"]}`
+	assertStatus(t, rt.sendRequest("PUT", "/db/doc1", docBody), 201)
+	assertStatus(t, rt.sendAdminRequest("PUT", "/db/doc2", docBody), 201)
+
+	response := rt.sendAdminRequest("GET", "/db/_metering", "")
+	assertStatus(t, response, 200)
+	var records []*db.MeteringRecord
+	json.Unmarshal(response.Body.Bytes(), &records)
+	assert.Equals(t, len(records), 1)
+	current := records[0]
+	assert.True(t, current.Partial)
+	guest := current.Users[db.MeteringGuestName]
+	assert.Equals(t, guest.Requests, int64(1))
+	assert.Equals(t, guest.BytesIn, int64(len(docBody)))
+	assert.True(t, guest.BytesOut > 0)
+	assert.Equals(t, guest.DocsWritten, int64(1))
+	assert.Equals(t, current.Users[db.MeteringAdminName].DocsWritten, int64(1))
+	assert.Equals(t, current.Total.Requests, int64(2))
+
+	// Saving ends the period; its record comes first, then the new period's:
+	context := rt.ServerContext().Database("db")
+	assert.Equals(t, context.SaveMeteringRecord(), nil)
+	response = rt.sendAdminRequest("GET", "/db/_metering", "")
+	records = nil
+	json.Unmarshal(response.Body.Bytes(), &records)
+	assert.Equals(t, len(records), 2)
+	assert.False(t, records[0].Partial)
+	assert.Equals(t, records[0].Total.Requests, int64(3))
+	assert.True(t, records[1].Partial)
+	assert.Equals(t, records[1].Total.Requests, int64(0))
+
+	since := url.QueryEscape(records[1].Start.Format(time.RFC3339Nano))
+	response = rt.sendAdminRequest("GET", "/db/_metering?since="+since, "")
+	records = nil
+	json.Unmarshal(response.Body.Bytes(), &records)
+	assert.Equals(t, len(records), 1)
+	assertStatus(t, rt.sendAdminRequest("GET", "/db/_metering?until=yesterday", ""), 400)
+}
+
+func TestDebugRuntimeSettings(t *testing.T) {
+	var rt restTester
+	response := rt.sendAdminRequest("GET", "/_debug/runtime", "")
+	assertStatus(t, response, 200)
+	var settings map[string]int
+	json.Unmarshal(response.Body.Bytes(), &settings)
+	maxProcs := settings["gomaxprocs"]
+	assert.True(t, maxProcs >= 1)
+	assert.True(t, settings["num_cpu"] >= 1)
+
+	response = rt.sendAdminRequest("PUT", "/_debug/runtime",
+		`{"block_profile_rate": 1, "mutex_profile_fraction": 5}`)
+	assertStatus(t, response, 200)
+	settings = nil
+	json.Unmarshal(response.Body.Bytes(), &settings)
+	assert.Equals(t, settings["block_profile_rate"], 1)
+	assert.Equals(t, settings["mutex_profile_fraction"], 5)
+	assert.Equals(t, settings["gomaxprocs"], maxProcs)
+
+	assertStatus(t, rt.sendAdminRequest("PUT", "/_debug/runtime", `{"gomaxprocs": 0}`), 400)
+	assertStatus(t, rt.sendAdminRequest("PUT", "/_debug/runtime",
+		`{"block_profile_rate": 0, "mutex_profile_fraction": 0}`), 200)
+
+	assertStatus(t, rt.sendAdminRequest("GET", "/_debug/pprof/", ""), 200)
+	response = rt.sendAdminRequest("GET", "/_debug/pprof/goroutine?debug=1", "")
+	assertStatus(t, response, 200)
+	assert.True(t, response.Body.Len() > 0)
+
+	// Heap dumps are only written into the configured directory:
+	assertStatus(t, rt.sendAdminRequest("POST", "/_debug/heapdump", ""), 403)
+	dir, err := ioutil.TempDir("", "sg_heapdump")
+	assert.Equals(t, err, nil)
+	defer os.RemoveAll(dir)
+	rt.ServerContext().config.HeapDumpDir = &dir
+	response = rt.sendAdminRequest("POST", "/_debug/heapdump", `{"file": "/etc/passwd"}`)
+	assertStatus(t, response, 200)
+	var result map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &result)
+	path, _ := result["file"].(string)
+	assert.Equals(t, filepath.Dir(path), dir)
+	info, err := os.Stat(path)
+	assert.Equals(t, err, nil)
+	assert.True(t, info.Size() > 0)
+}
+
+func TestLoggingSettings(t *testing.T) {
+	var rt restTester
+	dir, err := ioutil.TempDir("", "sg_logging")
+	assert.Equals(t, err, nil)
+	defer os.RemoveAll(dir)
+	defer base.SetLogSinks(nil)
+	logPath := filepath.Join(dir, "sg.log")
+
+	// Log files can only be added in the configured directory:
+	assertStatus(t, rt.sendAdminRequest("PUT", "/_logging", fmt.Sprintf(
+		`{"sinks": {"file": {"type": "file", "path": %q}}}`, logPath)), 403)
+	rt.ServerContext().config.LogDir = &dir
+	assertStatus(t, rt.sendAdminRequest("PUT", "/_logging",
+		`{"sinks": {"file": {"type": "file", "path": "/etc/sg.log"}}}`), 403)
+
+	response := rt.sendAdminRequest("PUT", "/_logging",
+		`{"keys": {"LoggingTest": true},
+		  "sinks": {"file": {"type": "file", "path": "sg.log", "max_size": 10}}}`)
+	assertStatus(t, response, 200)
+	defer base.SetLogKeys(map[string]bool{"LoggingTest": false})
+	var settings loggingSettings
+	json.Unmarshal(response.Body.Bytes(), &settings)
+	assert.True(t, settings.Keys["LoggingTest"])
+	assert.Equals(t, len(settings.Sinks), 1)
+	assert.Equals(t, settings.Sinks["file"].Level, "debug")
+	assert.Equals(t, settings.Sinks["file"].MaxSize, 10)
+	assert.Equals(t, settings.Sinks["file"].Path, logPath)
+
+	base.LogTo("LoggingTest", "hello from the test")
+	contents, _ := ioutil.ReadFile(logPath)
+	assert.True(t, strings.Contains(string(contents), "LoggingTest: hello from the test"))
+
+	assertStatus(t, rt.sendAdminRequest("PUT", "/_logging", `{"sinks": {"x": {"type": "file"}}}`), 400)
+	assertStatus(t, rt.sendAdminRequest("PUT", "/_logging", `{"sinks": {"x": {"type": "console", "level": "loud"}}}`), 400)
+
+	response = rt.sendAdminRequest("PUT", "/_logging", `{"sinks": {}}`)
+	assertStatus(t, response, 200)
+	settings = loggingSettings{}
+	json.Unmarshal(response.Body.Bytes(), &settings)
+	assert.Equals(t, settings.Sinks["console"].Type, "console")
 }
@@ -56,17 +56,42 @@ func (h *handler) handleCompact() error {
 	return nil
 }
 
+func (h *handler) handleMigrateRevBodies() error {
+	docsChanged, err := h.db.MigrateRevBodies()
+	if err != nil {
+		return err
+	}
+	h.writeJSON(db.Body{"docs": docsChanged})
+	return nil
+}
+
+// Edits many documents at once, by a JS transform or a JSON merge patch.
+func (h *handler) handleBulkUpdate() error {
+	var update db.BulkUpdate
+	if err := h.readJSONInto(&update); err != nil {
+		return err
+	}
+	update.DryRun = update.DryRun || h.getBoolQuery("dry_run")
+	result, err := h.db.BulkUpdate(update)
+	if err != nil {
+		return err
+	}
+	h.writeJSON(result)
+	return nil
+}
+
 func (h *handler) handleVacuum() error {
-	attsDeleted, err := db.VacuumAttachments(h.db.Bucket)
+	attsDeleted, bytesDeleted, err := h.db.VacuumAttachments()
 	if err != nil {
 		return err
 	}
-	h.writeJSON(db.Body{"atts": attsDeleted})
+	h.writeJSON(db.Body{"atts": attsDeleted, "bytes": bytesDeleted})
 	return nil
 }
 
-func (h *handler) instanceStartTime() json.Number {
-	return json.Number(strconv.FormatInt(h.db.StartTime.UnixNano()/1000, 10))
+func (h *handler) instanceStartTime() (json.Number, error) {
+	startTime, err := h.db.CurrentInstanceStartTime()
+	return json.Number(strconv.FormatInt(startTime, 10)), err
 }
 
 func (h *handler) handleGetDB() error {
@@ -77,25 +102,48 @@ func (h *handler) handleGetDB() error {
 	if err != nil {
 		return err
 	}
+	startTime, err := h.instanceStartTime()
+	if err != nil {
+		return err
+	}
 	response := db.Body{
 		"db_name":              h.db.Name,
 		"update_seq":           lastSeq,
 		"committed_update_seq": lastSeq,
-		"instance_start_time":  h.instanceStartTime(),
+		"instance_start_time":  startTime,
 		"compact_running":      false, // TODO: Implement this
 		"purge_seq":            0,     // TODO: Should track this value
 		"disk_format_version":  0,     // Probably meaningless, but add for compatibility
 		//"doc_count":          h.db.DocCount(), // Removed: too expensive to compute (#278)
 	}
+	if h.privs == adminPrivs {
+		response["paused"] = h.db.PausedSubsystems()
+		if h.db.IsOnline() {
+			response["state"] = "Online"
+		} else {
+			response["state"] = "Resyncing"
+		}
+	}
 	h.writeJSON(response)
 	return nil
 }
 
+// Describes which optional features this database offers, so clients can adapt to them.
+func (h *handler) handleGetCapabilities() error {
+	h.writeJSON(db.Body{"db_name": h.db.Name, "features": h.db.Capabilities()})
+	return nil
+}
+
 func (h *handler) handleEFC() error { // Handles _ensure_full_commit.
-	// no-op. CouchDB's replicator sends this, so don't barf. Status must be 201.
+	// CouchDB's replicator sends this, then compares the instance_start_time with the one it
+	// got when it started, to decide whether to trust its checkpoint. Status must be 201.
+	startTime, err := h.db.EnsureFullCommit()
+	if err != nil {
+		return err
+	}
 	h.writeJSONStatus(http.StatusCreated, db.Body{
-		"ok": true,
-		"instance_start_time": h.instanceStartTime(),
+		"ok":                  true,
+		"instance_start_time": json.Number(strconv.FormatInt(startTime, 10)),
 	})
 	return nil
 }
@@ -119,9 +167,10 @@ func (h *handler) handleDesign() error {
 	}
 }
 
+// Saving a design doc also installs its views in the bucket (see Database.QueryDesignDoc.)
 func (h *handler) handlePutDesign() error {
 	designDocID := h.PathVar("docid")
-	if designDocID == "sync_gateway" {
+	if designDocID == "sync_gateway" || designDocID == "sync_housekeeping" {
 		return base.HTTPErrorf(http.StatusForbidden, "forbidden")
 	} else {
 		h.SetPathVar("docid", "_design/"+designDocID)
@@ -133,6 +182,54 @@ func (h *handler) handlePutDesign() error {
 	}
 }
 
+// HTTP handler for GET _design/{ddoc}/_view/{view}: queries a view in the bucket. The usual
+// CouchDB query parameters are passed through. On the public port the rows are filtered to
+// the user's channels (see Database.QueryDesignDoc).
+func (h *handler) handleViewQuery() error {
+	ddocName := h.PathVar("ddoc")
+	viewName := h.PathVar("view")
+	opts := db.Body{}
+	for _, name := range []string{"key", "keys", "startkey", "endkey", "start_key", "end_key"} {
+		if q := h.getQuery(name); q != "" {
+			var value interface{}
+			if err := json.Unmarshal([]byte(q), &value); err != nil {
+				return base.HTTPErrorf(http.StatusBadRequest, "Invalid JSON in %s parameter", name)
+			}
+			opts[name] = value
+		}
+	}
+	for _, name := range []string{"startkey_docid", "endkey_docid"} {
+		if q := h.getQuery(name); q != "" {
+			opts[name] = q
+		}
+	}
+	for _, name := range []string{"descending", "inclusive_end", "reduce", "group", "include_docs"} {
+		if q := h.getQuery(name); q != "" {
+			opts[name] = (q == "true")
+		}
+	}
+	for _, name := range []string{"limit", "skip", "group_level"} {
+		if q := h.getQuery(name); q != "" {
+			opts[name] = int(h.getIntQuery(name, 0))
+		}
+	}
+	switch stale := h.getQuery("stale"); stale {
+	case "":
+	case "false", "true":
+		opts["stale"] = (stale == "true")
+	default:
+		opts["stale"] = stale // "ok" or "update_after"
+	}
+
+	base.LogTo("HTTP", "View query %s/%s opts %v", ddocName, viewName, opts)
+	result, err := h.db.QueryDesignDoc(ddocName, viewName, opts)
+	if err != nil {
+		return err
+	}
+	h.writeJSON(result)
+	return nil
+}
+
 // ADMIN API to turn Go CPU profiling on/off
 func (h *handler) handleProfiling() error {
 	profileName := h.PathVar("name")
@@ -14,12 +14,18 @@ import (
 	"compress/gzip"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"mime"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"runtime"
 	"sort"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/couchbaselabs/go.assert"
 	"github.com/robertkrimen/otto/underscore"
@@ -183,6 +189,98 @@ func TestRoot(t *testing.T) {
 	assert.Equals(t, response.Header().Get("Allow"), "GET, HEAD")
 }
 
+func TestCORS(t *testing.T) {
+	var rt restTester
+	rt.ServerContext().GetDatabaseConfig("db").CORS = &CORSConfig{
+		Origin:      []string{"http://example.com"},
+		MaxAge:      600,
+		Credentials: true,
+	}
+	preflight := map[string]string{"Origin": "http://example.com", "Access-Control-Request-Method": "PUT"}
+
+	response := rt.sendRequestWithHeaders("OPTIONS", "/db/doc", "", preflight)
+	assertStatus(t, response, 200)
+	assert.Equals(t, response.Header().Get("Access-Control-Allow-Origin"), "http://example.com")
+	assert.Equals(t, response.Header().Get("Access-Control-Allow-Methods"), "GET, HEAD, PUT, DELETE")
+	assert.Equals(t, response.Header().Get("Access-Control-Allow-Credentials"), "true")
+	assert.Equals(t, response.Header().Get("Access-Control-Max-Age"), "600")
+	response = rt.sendRequestWithHeaders("OPTIONS", "/db/_session", "", preflight)
+	assert.Equals(t, response.Header().Get("Access-Control-Allow-Methods"), "GET, HEAD, POST, DELETE")
+
+	response = rt.sendRequestWithHeaders("GET", "/db/_changes", "", map[string]string{"Origin": "http://example.com"})
+	assertStatus(t, response, 200)
+	assert.Equals(t, response.Header().Get("Access-Control-Allow-Origin"), "http://example.com")
+
+	// Other origins, and the admin port, get no CORS headers:
+	preflight["Origin"] = "http://evil.com"
+	response = rt.sendRequestWithHeaders("OPTIONS", "/db/doc", "", preflight)
+	assert.Equals(t, response.Header().Get("Access-Control-Allow-Origin"), "")
+	response = rt.sendAdminRequest("GET", "/db/_changes", "")
+	assert.Equals(t, response.Header().Get("Access-Control-Allow-Origin"), "")
+
+	// Credentials can't be combined with a wildcard origin:
+	cors := &CORSConfig{Origin: []string{"*"}, Credentials: true}
+	dbConfig := &DbConfig{CORS: cors}
+	assert.True(t, dbConfig.setup("db") != nil)
+	rt.ServerContext().GetDatabaseConfig("db").CORS = cors
+	response = rt.sendRequestWithHeaders("OPTIONS", "/db/doc", "", preflight)
+	assert.Equals(t, response.Header().Get("Access-Control-Allow-Origin"), "*")
+	assert.Equals(t, response.Header().Get("Access-Control-Allow-Credentials"), "")
+}
+
+func TestRateLimit(t *testing.T) {
+	var rt restTester
+	rt.ServerContext().rateLimiter = newRateLimiter(RateLimitConfig{RequestsPerSec: 0.1, Burst: 2})
+
+	assertStatus(t, rt.sendRequest("GET", "/db/", ""), 200)
+	assertStatus(t, rt.sendRequest("GET", "/db/", ""), 200)
+	response := rt.sendRequest("GET", "/db/", "")
+	assertStatus(t, response, 429)
+	assert.Equals(t, response.Header().Get("Retry-After"), "10")
+
+	// Other clients, and the admin API, aren't affected:
+	rq := request("GET", "/db/", "")
+	rq.RemoteAddr = "10.0.0.2:1234"
+	assertStatus(t, rt.send(rq), 200)
+	assertStatus(t, rt.sendAdminRequest("GET", "/db/", ""), 200)
+
+	// A client can't start more requests than the concurrency limit:
+	rt.ServerContext().rateLimiter = newRateLimiter(RateLimitConfig{MaxConcurrent: 1})
+	limiter := rt.ServerContext().rateLimiter
+	ok, _ := limiter.start("ip:")
+	assert.True(t, ok)
+	assertStatus(t, rt.sendRequest("GET", "/db/", ""), 429)
+	limiter.finish("ip:")
+	assertStatus(t, rt.sendRequest("GET", "/db/", ""), 200)
+}
+
+func TestRateLimitAuthenticated(t *testing.T) {
+	rt := restTester{noAdminParty: true}
+	assertStatus(t, rt.sendAdminRequest("PUT", "/db/_user/naomi", `{"password":"letmein", "admin_channels":["*"]}`), 201)
+	rt.ServerContext().rateLimiter = newRateLimiter(RateLimitConfig{RequestsPerSec: 0.1, Burst: 2, TrustProxy: true})
+
+	// Failed logins are throttled by IP address, before they're authenticated:
+	for i := 0; i < 2; i++ {
+		rq := request("GET", "/db/", "")
+		rq.SetBasicAuth("naomi", "wrong")
+		assertStatus(t, rt.send(rq), 401)
+	}
+	rq := request("GET", "/db/", "")
+	rq.SetBasicAuth("naomi", "wrong")
+	assertStatus(t, rt.send(rq), 429)
+
+	// A user is throttled wherever their requests come from:
+	for i := 0; i < 3; i++ {
+		rq = requestByUser("GET", "/db/", "", "naomi")
+		rq.Header.Set("X-Forwarded-For", fmt.Sprintf("192.168.1.1, 10.0.1.%d", i))
+		if i < 2 {
+			assertStatus(t, rt.send(rq), 200)
+		} else {
+			assertStatus(t, rt.send(rq), 429)
+		}
+	}
+}
+
 func (rt *restTester) createDoc(t *testing.T, docid string) string {
 	response := rt.sendRequest("PUT", "/db/"+docid, `{"prop":true}`)
 	assertStatus(t, response, 201)
@@ -229,6 +327,35 @@ func TestDesignDocs(t *testing.T) {
 	assertStatus(t, response, 404)
 }
 
+func TestDocEtag(t *testing.T) {
+	var rt restTester
+	revid := rt.createDoc(t, "doc")
+
+	response := rt.sendRequest("GET", "/db/doc", "")
+	assertStatus(t, response, 200)
+	assert.Equals(t, response.Header().Get("Etag"), revid)
+
+	// A matching If-None-Match gets a 304 with no body:
+	reqHeaders := map[string]string{"If-None-Match": `"` + revid + `"`}
+	response = rt.sendRequestWithHeaders("GET", "/db/doc", "", reqHeaders)
+	assertStatus(t, response, 304)
+	assert.Equals(t, response.Body.Len(), 0)
+
+	// After an update the old ETag no longer matches:
+	response = rt.sendRequestWithHeaders("PUT", "/db/doc", `{"prop":false}`,
+		map[string]string{"If-Match": revid})
+	assertStatus(t, response, 201)
+	newRevid := response.Header().Get("Etag")
+	assert.True(t, newRevid != revid)
+	response = rt.sendRequestWithHeaders("GET", "/db/doc", "", reqHeaders)
+	assertStatus(t, response, 200)
+	assert.Equals(t, response.Header().Get("Etag"), newRevid)
+
+	// A stale If-Match is a conflict:
+	response = rt.sendRequestWithHeaders("DELETE", "/db/doc", "", map[string]string{"If-Match": revid})
+	assertStatus(t, response, 409)
+}
+
 func TestManualAttachment(t *testing.T) {
 	var rt restTester
 
@@ -403,6 +530,40 @@ func TestBulkDocs(t *testing.T) {
 		map[string]interface{}{"rev": "1-035168c88bd4b80fb098a8da72f881ce", "id": "bulk2"})
 }
 
+func TestBulkDocsRepeatedIDs(t *testing.T) {
+	var rt restTester
+	// Interleave edits of one doc with lots of others, so they're spread over the savers:
+	var items []string
+	for i := 0; i < 40; i++ {
+		items = append(items, fmt.Sprintf(`{"_id": "other%d"}`, i))
+		if i%10 == 0 {
+			items = append(items, fmt.Sprintf(`{"_id": "same", "n": %d}`, i))
+		}
+	}
+	response := rt.sendRequest("POST", "/db/_bulk_docs", `{"docs": [`+strings.Join(items, ",")+`]}`)
+	assertStatus(t, response, 201)
+	var docs []map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &docs)
+	assert.Equals(t, len(docs), len(items))
+
+	// Edits of the same doc are made in request order, so only the first one succeeds:
+	var sameStatuses []interface{}
+	for i, doc := range docs {
+		if strings.Contains(items[i], `"same"`) {
+			assert.Equals(t, doc["id"], "same")
+			sameStatuses = append(sameStatuses, doc["status"])
+		} else {
+			assert.Equals(t, doc["status"], nil)
+		}
+	}
+	assert.DeepEquals(t, sameStatuses, []interface{}{nil, 409.0, 409.0, 409.0})
+	response = rt.sendRequest("GET", "/db/same", "")
+	assertStatus(t, response, 200)
+	var body db.Body
+	json.Unmarshal(response.Body.Bytes(), &body)
+	assert.Equals(t, body["n"], 0.0)
+}
+
 func TestBulkDocsNoEdits(t *testing.T) {
 	var rt restTester
 	input := `{"new_edits":false, "docs": [
@@ -525,6 +686,41 @@ func TestResponseEncoding(t *testing.T) {
 	assert.Equals(t, body["long"], str)
 }
 
+func TestBulkGetResponseEncoding(t *testing.T) {
+	var rt restTester
+	response := rt.sendRequest("PUT", "/db/doc1", `{"greeting": "howdy"}`)
+	assertStatus(t, response, 201)
+
+	// The multipart response is compressed as a whole, so its parts aren't:
+	response = rt.sendRequestWithHeaders("POST", "/db/_bulk_get", `{"docs": [{"id": "doc1"}]}`,
+		map[string]string{"Accept-Encoding": "gzip", "X-Accept-Part-Encoding": "gzip"})
+	assertStatus(t, response, 200)
+	assert.DeepEquals(t, response.HeaderMap["Content-Encoding"], []string{"gzip"})
+	unzip, err := gzip.NewReader(response.Body)
+	assert.Equals(t, err, nil)
+	raw, err := ioutil.ReadAll(unzip)
+	assert.Equals(t, err, nil)
+	assert.True(t, bytes.Contains(raw, []byte(`"greeting":"howdy"`)))
+}
+
+func TestGzipRequestBody(t *testing.T) {
+	var buf bytes.Buffer
+	zip := gzip.NewWriter(&buf)
+	zip.Write([]byte(`{"docs": [{"_id": "bulk1", "n": 1}, {"_id": "bulk2", "n": 2}]}`))
+	zip.Close()
+
+	var rt restTester
+	response := rt.sendRequestWithHeaders("POST", "/db/_bulk_docs", buf.String(),
+		map[string]string{"Content-Encoding": "gzip"})
+	assertStatus(t, response, 201)
+	response = rt.sendRequest("GET", "/db/bulk2", "")
+	assertStatus(t, response, 200)
+
+	response = rt.sendRequestWithHeaders("POST", "/db/_bulk_docs", "not gzip",
+		map[string]string{"Content-Encoding": "gzip"})
+	assertStatus(t, response, 400)
+}
+
 func TestLogin(t *testing.T) {
 	var rt restTester
 	a := auth.NewAuthenticator(rt.bucket(), nil)
@@ -624,6 +820,40 @@ func TestAccessControl(t *testing.T) {
 	assert.Equals(t, len(viewResult.Rows), 2)
 	assert.Equals(t, viewResult.Rows[0].ID, "doc3")
 	assert.Equals(t, viewResult.Rows[1].ID, "doc4")
+
+	// Check _all_docs with limit option (applied after filtering out inaccessible docs):
+	request, _ = http.NewRequest("GET", "/db/_all_docs?limit=1", nil)
+	request.SetBasicAuth("alice", "letmein")
+	response = rt.send(request)
+	assertStatus(t, response, 200)
+	viewResult.Rows = nil
+	err = json.Unmarshal(response.Body.Bytes(), &viewResult)
+	assert.Equals(t, err, nil)
+	assert.Equals(t, len(viewResult.Rows), 1)
+	assert.Equals(t, viewResult.Rows[0].ID, "doc3")
+
+	// Check _all_docs with startkey option:
+	request, _ = http.NewRequest("GET", `/db/_all_docs?startkey="doc4"`, nil)
+	request.SetBasicAuth("alice", "letmein")
+	response = rt.send(request)
+	assertStatus(t, response, 200)
+	viewResult.Rows = nil
+	err = json.Unmarshal(response.Body.Bytes(), &viewResult)
+	assert.Equals(t, err, nil)
+	assert.Equals(t, len(viewResult.Rows), 1)
+	assert.Equals(t, viewResult.Rows[0].ID, "doc4")
+	assert.Equals(t, viewResult.TotalRows, 4)
+
+	// Check _all_docs with keys option:
+	request, _ = http.NewRequest("GET", `/db/_all_docs?keys=["doc4","doc2"]`, nil)
+	request.SetBasicAuth("alice", "letmein")
+	response = rt.send(request)
+	assertStatus(t, response, 200)
+	viewResult.Rows = nil
+	err = json.Unmarshal(response.Body.Bytes(), &viewResult)
+	assert.Equals(t, err, nil)
+	assert.Equals(t, len(viewResult.Rows), 1)
+	assert.Equals(t, viewResult.Rows[0].ID, "doc4")
 }
 
 func TestChannelAccessChanges(t *testing.T) {
@@ -743,8 +973,7 @@ func TestChannelAccessChanges(t *testing.T) {
 }
 
 func TestRoleAccessChanges(t *testing.T) {
-	base.LogKeys["Access"] = true
-	base.LogKeys["CRUD"] = true
+	base.SetLogKeys(map[string]bool{"Access": true, "CRUD": true})
 
 	rt := restTester{syncFn: `function(doc) {role(doc.user, doc.role);channel(doc.channel)}`}
 	a := rt.ServerContext().Database("db").Authenticator()
@@ -901,3 +1130,496 @@ func TestDocDeletionFromChannel(t *testing.T) {
 	response = rt.send(requestByUser("GET", "/db/alpha?rev="+rev1, "", "alice"))
 	assert.Equals(t, response.Code, 200)
 }
+
+func TestChangesEventSource(t *testing.T) {
+	var rt restTester
+	assertStatus(t, rt.sendRequest("PUT", "/db/doc1", `{"channels":["all"]}`), 201)
+	assertStatus(t, rt.sendRequest("PUT", "/db/doc2", `{"channels":["all"]}`), 201)
+
+	response := rt.sendRequest("GET", "/db/_changes?feed=eventsource&limit=1&retry=1000", "")
+	assertStatus(t, response, 200)
+	assert.Equals(t, response.Header().Get("Content-Type"), "text/event-stream")
+	var seq, data string
+	n, _ := fmt.Sscanf(response.Body.String(), "retry: 1000\n\nid: %s\ndata: %s\n\n", &seq, &data)
+	assert.Equals(t, n, 2)
+	var change db.ChangeEntry
+	assert.Equals(t, json.Unmarshal([]byte(data), &change), nil)
+	assert.Equals(t, change.ID, "doc1")
+	assert.Equals(t, change.Seq, seq)
+
+	// A reconnecting EventSource resumes after the last event it got:
+	response = rt.sendRequestWithHeaders("GET", "/db/_changes?feed=eventsource&limit=1", "",
+		map[string]string{"Last-Event-ID": seq})
+	assertStatus(t, response, 200)
+	n, _ = fmt.Sscanf(response.Body.String(), "retry: 5000\n\nid: %s\ndata: %s\n\n", &seq, &data)
+	assert.Equals(t, n, 2)
+	assert.Equals(t, json.Unmarshal([]byte(data), &change), nil)
+	assert.Equals(t, change.ID, "doc2")
+
+	// Events are scrubbed like any other public response:
+	rt.ServerContext().scrubber = newResponseScrubber([]string{"secret"})
+	assertStatus(t, rt.sendRequest("PUT", "/db/doc3", `{"channels":["all"], "secret":"xyzzy"}`), 201)
+	response = rt.sendRequest("GET", "/db/_changes?feed=eventsource&include_docs=true&limit=1&since="+seq, "")
+	assertStatus(t, response, 200)
+	assert.True(t, strings.Contains(response.Body.String(), `"doc3"`))
+	assert.False(t, strings.Contains(response.Body.String(), "xyzzy"))
+}
+
+func TestDocExists(t *testing.T) {
+	var rt restTester
+	rev1 := rt.createDoc(t, "doc1")
+	rev2 := rt.createDoc(t, "doc2")
+	assertStatus(t, rt.sendRequest("DELETE", "/db/doc2?rev="+rev2, ""), 200)
+
+	response := rt.sendRequest("POST", "/db/_exists", `["doc1", "doc2", "nope"]`)
+	assertStatus(t, response, 200)
+	var result map[string]db.DocExistence
+	json.Unmarshal(response.Body.Bytes(), &result)
+	assert.DeepEquals(t, result["doc1"], db.DocExistence{Rev: rev1})
+	assert.True(t, result["doc2"].Deleted)
+	assert.True(t, result["nope"].Missing)
+
+	response = rt.sendRequest("POST", "/db/_exists", `{"doc1": ["`+rev1+`", "2-abc"], "nope": ["1-abc"]}`)
+	assertStatus(t, response, 200)
+	result = nil
+	json.Unmarshal(response.Body.Bytes(), &result)
+	assert.DeepEquals(t, result["doc1"], db.DocExistence{Rev: rev1, MissingRevs: []string{"2-abc"}})
+	assert.DeepEquals(t, result["nope"], db.DocExistence{Missing: true, MissingRevs: []string{"1-abc"}})
+
+	// Internal docs aren't reported, even with sync metadata:
+	raw, err := rt.bucket().GetRaw("doc1")
+	assert.Equals(t, err, nil)
+	assert.Equals(t, rt.bucket().SetRaw("_sync:copy", 0, raw), nil)
+	response = rt.sendRequest("POST", "/db/_exists", `["_sync:copy"]`)
+	assertStatus(t, response, 200)
+	result = nil
+	json.Unmarshal(response.Body.Bytes(), &result)
+	assert.True(t, result["_sync:copy"].Missing)
+
+	assertStatus(t, rt.sendRequest("POST", "/db/_exists", `"doc1"`), 400)
+
+	docids := []byte(`["x0"`)
+	for i := 1; i <= kMaxExistsDocIDs; i++ {
+		docids = append(docids, fmt.Sprintf(`, "x%d"`, i)...)
+	}
+	docids = append(docids, ']')
+	assertStatus(t, rt.sendRequest("POST", "/db/_exists", string(docids)), 413)
+}
+
+func TestDocExistsAccess(t *testing.T) {
+	rt := restTester{noAdminParty: true}
+	assertStatus(t, rt.sendAdminRequest("PUT", "/db/_user/naomi", `{"password":"letmein", "admin_channels":["a"]}`), 201)
+	assertStatus(t, rt.sendAdminRequest("PUT", "/db/pub", `{"channels":["a"]}`), 201)
+	assertStatus(t, rt.sendAdminRequest("PUT", "/db/priv", `{"channels":["b"]}`), 201)
+	response := rt.sendAdminRequest("PUT", "/db/moved", `{"channels":["b"]}`)
+	assertStatus(t, response, 201)
+	var body db.Body
+	json.Unmarshal(response.Body.Bytes(), &body)
+	assertStatus(t, rt.sendAdminRequest("PUT", "/db/moved", `{"_rev":"`+body["rev"].(string)+`", "channels":["a"]}`), 201)
+
+	// The user can only see docs whose current revision is in a channel they have:
+	response = rt.send(requestByUser("POST", "/db/_exists", `["pub", "priv", "moved"]`, "naomi"))
+	assertStatus(t, response, 200)
+	var result map[string]db.DocExistence
+	json.Unmarshal(response.Body.Bytes(), &result)
+	assert.False(t, result["pub"].Missing)
+	assert.True(t, result["priv"].Missing)
+	assert.Equals(t, result["priv"].Rev, "")
+	assert.False(t, result["moved"].Missing)
+	assert.True(t, strings.HasPrefix(result["moved"].Rev, "2-"))
+}
+
+func TestGetDocLock(t *testing.T) {
+	rt := restTester{noAdminParty: true}
+	assertStatus(t, rt.sendAdminRequest("PUT", "/db/_user/naomi", `{"password":"letmein", "admin_channels":["a"]}`), 201)
+	assertStatus(t, rt.sendAdminRequest("PUT", "/db/form", `{"channels":["a"]}`), 201)
+	assertStatus(t, rt.send(requestByUser("POST", "/db/form/_lock?ttl=60", "", "naomi")), 200)
+
+	// The lock is only added to the doc with ?lock=true:
+	var body db.Body
+	response := rt.sendAdminRequest("GET", "/db/form", "")
+	assertStatus(t, response, 200)
+	json.Unmarshal(response.Body.Bytes(), &body)
+	assert.Equals(t, body["_lock"], nil)
+	body = nil
+	response = rt.sendAdminRequest("GET", "/db/form?lock=true", "")
+	assertStatus(t, response, 200)
+	json.Unmarshal(response.Body.Bytes(), &body)
+	lock, _ := body["_lock"].(map[string]interface{})
+	assert.Equals(t, lock["owner"], "naomi")
+}
+
+func TestChangesProfile(t *testing.T) {
+	var rt restTester
+	database := rt.ServerContext().Database("db")
+	err := database.SetChangesProfiles(map[string]*db.ChangesProfile{
+		"inbox": &db.ChangesProfile{Channels: []string{"inbox"}, IncludeDocs: true, Limit: 1},
+	})
+	assert.Equals(t, err, nil)
+	assert.True(t, database.SetChangesProfiles(map[string]*db.ChangesProfile{
+		"bad": &db.ChangesProfile{Style: "sideways"}}) != nil)
+
+	assertStatus(t, rt.sendRequest("PUT", "/db/m1", `{"channels":["inbox"], "n":1}`), 201)
+	assertStatus(t, rt.sendRequest("PUT", "/db/x1", `{"channels":["outbox"]}`), 201)
+	assertStatus(t, rt.sendRequest("PUT", "/db/m2", `{"channels":["inbox"], "n":2}`), 201)
+	database.CheckpointChangeLogs()
+
+	var changes struct {
+		Results []db.ChangeEntry
+	}
+	// The profile's channels replace the client's, and its limit caps the client's:
+	response := rt.sendRequest("GET", "/db/_changes?profile=inbox&filter=sync_gateway/bychannel&channels=outbox&limit=10", "")
+	assertStatus(t, response, 200)
+	json.Unmarshal(response.Body.Bytes(), &changes)
+	assert.Equals(t, len(changes.Results), 1)
+	assert.Equals(t, changes.Results[0].ID, "m1")
+	assert.Equals(t, changes.Results[0].Doc["n"], 1.0)
+
+	since := changes.Results[0].Seq
+	changes.Results = nil
+	response = rt.sendRequest("POST", "/db/_changes", `{"profile":"inbox", "since":"`+since+`"}`)
+	assertStatus(t, response, 200)
+	json.Unmarshal(response.Body.Bytes(), &changes)
+	assert.Equals(t, len(changes.Results), 1)
+	assert.Equals(t, changes.Results[0].ID, "m2")
+
+	// An invalid since is ignored, so the feed starts from the beginning:
+	changes.Results = nil
+	response = rt.sendRequest("GET", "/db/_changes?profile=inbox&since=bogus", "")
+	assertStatus(t, response, 200)
+	json.Unmarshal(response.Body.Bytes(), &changes)
+	assert.Equals(t, len(changes.Results), 1)
+	assert.Equals(t, changes.Results[0].ID, "m1")
+
+	assertStatus(t, rt.sendRequest("GET", "/db/_changes?profile=outbox", ""), 404)
+}
+
+func TestChangesAfterConflictResolution(t *testing.T) {
+	var rt restTester
+	database := rt.ServerContext().Database("db")
+	assert.Equals(t, database.ApplyConflictResolution(db.ConflictPolicyLocalWins, "", ""), nil)
+
+	// Create revs 1-a and 2-b, then push the conflicting 2-c, which loses:
+	for _, doc := range []string{
+		`{"_id": "doc", "_rev": "1-a", "_revisions": {"start": 1, "ids": ["a"]}, "channels": ["all"]}`,
+		`{"_id": "doc", "_rev": "2-b", "_revisions": {"start": 2, "ids": ["b", "a"]}, "channels": ["all"]}`,
+		`{"_id": "doc", "_rev": "2-c", "_revisions": {"start": 2, "ids": ["c", "a"]}, "channels": ["all"]}`,
+	} {
+		assertStatus(t, rt.sendRequest("POST", "/db/_bulk_docs", `{"new_edits": false, "docs": [`+doc+`]}`), 201)
+	}
+	database.CheckpointChangeLogs()
+
+	var changes struct {
+		Results []db.ChangeEntry
+	}
+	lastChange := func(query string) db.ChangeEntry {
+		changes.Results = nil
+		response := rt.sendRequest("GET", "/db/_changes"+query, "")
+		assertStatus(t, response, 200)
+		json.Unmarshal(response.Body.Bytes(), &changes)
+		assert.True(t, len(changes.Results) > 0)
+		return changes.Results[len(changes.Results)-1]
+	}
+
+	// The resolution's change is the winner:
+	change := lastChange("")
+	assert.Equals(t, change.ID, "doc")
+	assert.DeepEquals(t, change.Changes, []db.ChangeRev{{"rev": "2-b"}})
+
+	// ...and with style=all_docs it also lists the loser's tombstone:
+	change = lastChange("?style=all_docs")
+	assert.Equals(t, len(change.Changes), 2)
+	assert.Equals(t, change.Changes[0]["rev"], "2-b")
+	assert.True(t, strings.HasPrefix(change.Changes[1]["rev"], "3-"))
+	assert.False(t, change.Deleted)
+}
+
+func TestCapabilities(t *testing.T) {
+	var rt restTester
+	response := rt.sendRequest("GET", "/db/_capabilities", "")
+	assertStatus(t, response, 200)
+	var body struct {
+		Features map[string]bool `json:"features"`
+	}
+	json.Unmarshal(response.Body.Bytes(), &body)
+	assert.Equals(t, body.Features[db.FeatureDeltas], true)
+	assert.Equals(t, body.Features[db.FeaturePatch], false)
+	assertStatus(t, rt.sendRequest("GET", "/db/doc?deltas=true", ""), 404)
+
+	// Turning a feature off makes requests that use it fail:
+	database := rt.ServerContext().Database("db")
+	assert.Equals(t, database.SetFeatures(map[string]bool{db.FeatureDeltas: false}), nil)
+	response = rt.sendRequest("GET", "/db/_capabilities", "")
+	json.Unmarshal(response.Body.Bytes(), &body)
+	assert.Equals(t, body.Features[db.FeatureDeltas], false)
+	assertStatus(t, rt.sendRequest("GET", "/db/doc?deltas=true", ""), 400)
+
+	// Unimplemented features can't be turned on:
+	assert.True(t, database.SetFeatures(map[string]bool{db.FeaturePatch: true}) != nil)
+}
+
+func TestGetDeltas(t *testing.T) {
+	var rt restTester
+	big := strings.Repeat("lorem ipsum ", 100)
+	var revs []string
+	for n := 1; n <= 3; n++ {
+		body := fmt.Sprintf(`{"text": %q, "n": %d}`, big, n)
+		if len(revs) > 0 {
+			body = fmt.Sprintf(`{"_rev": %q, "text": %q, "n": %d}`, revs[len(revs)-1], big, n)
+		}
+		response := rt.sendRequest("PUT", "/db/doc", body)
+		assertStatus(t, response, 201)
+		var result struct{ Rev string }
+		json.Unmarshal(response.Body.Bytes(), &result)
+		revs = append(revs, result.Rev)
+	}
+
+	// A single GET returns a delta from a revision the client has:
+	response := rt.sendRequest("GET", "/db/doc?deltas=true&atts_since="+url.QueryEscape(`["`+revs[0]+`"]`), "")
+	assertStatus(t, response, 200)
+	var body db.Body
+	json.Unmarshal(response.Body.Bytes(), &body)
+	assert.Equals(t, body["_rev"], revs[2])
+	assert.Equals(t, body["_deltaSrc"], revs[0])
+	assert.Equals(t, body["text"], nil)
+
+	// ...and so does _bulk_get:
+	response = rt.sendRequest("POST", "/db/_bulk_get?deltas=true",
+		`{"docs": [{"id": "doc", "atts_since": ["`+revs[0]+`"]}]}`)
+	assertStatus(t, response, 200)
+	raw := response.Body.Bytes()
+	assert.True(t, bytes.Contains(raw, []byte(`"_deltaSrc":"`+revs[0]+`"`)))
+	assert.False(t, bytes.Contains(raw, []byte(big)))
+
+	// Without a known revision, the whole body is sent:
+	response = rt.sendRequest("GET", "/db/doc?deltas=true", "")
+	assertStatus(t, response, 200)
+	body = nil
+	json.Unmarshal(response.Body.Bytes(), &body)
+	assert.Equals(t, body["_deltaSrc"], nil)
+	assert.Equals(t, body["text"], big)
+}
+
+func TestResponseScrubber(t *testing.T) {
+	scrubber := newResponseScrubber([]string{"secret"})
+	clean := []byte(`{"_id":"doc","_rev":"1-abc","text":"no \"_sync here"}`)
+	scrubbed, removed := scrubber.scrubJSON(clean)
+	assert.Equals(t, string(scrubbed), string(clean))
+	assert.Equals(t, removed, 0)
+
+	scrubbed, removed = scrubber.scrubJSON([]byte(`{"_id":"doc","_sync":{"rev":"1-abc"},"n":12345678901234567890,"secret":1}` + "\n"))
+	assert.Equals(t, string(scrubbed), `{"_id":"doc","n":12345678901234567890}`+"\n")
+	assert.Equals(t, removed, 2)
+
+	scrubbed, removed = scrubber.scrubJSON([]byte(`{"rows":[{"id":"_sync:user:alice"},{"id":"doc"}]}`))
+	assert.Equals(t, string(scrubbed), `{"rows":[{"id":"doc"}]}`)
+	assert.Equals(t, removed, 1)
+
+	scrubbed, removed = scrubber.scrubJSON([]byte(`{"_id":"_sync:user:alice","passwordhash_bcrypt":"xxx"}`))
+	assert.True(t, scrubbed == nil)
+	assert.Equals(t, removed, 1)
+
+	scrubbed, removed = scrubber.scrubJSON([]byte(`"_sync:seq":`))
+	assert.True(t, scrubbed == nil)
+	assert.Equals(t, removed, -1)
+
+	// Properties nested inside a doc's body are user data, left alone:
+	nested := []byte(`{"rows":[{"id":"doc","doc":{"_id":"doc","user":{"id":"_sync:x","passwordhash":"x","_sync":1}}}]}`)
+	scrubbed, removed = scrubber.scrubJSON(nested)
+	assert.Equals(t, string(scrubbed), string(nested))
+	assert.Equals(t, removed, 0)
+
+	// Password hashes are only scrubbed from principal responses:
+	principal := []byte(`{"name":"alice","passwordhash_bcrypt":"xxx"}`)
+	scrubbed, removed = scrubber.scrubJSON(principal)
+	assert.Equals(t, removed, 0)
+	scrubbed, removed = scrubber.scrubPrincipalJSON(principal)
+	assert.Equals(t, string(scrubbed), `{"name":"alice"}`)
+	assert.Equals(t, removed, 1)
+}
+
+func TestScrubbedResponses(t *testing.T) {
+	var rt restTester
+	rt.bucket()
+	h := &handler{server: rt.ServerContext(), privs: regularPrivs, rq: request("GET", "/db/", "")}
+	recorder := httptest.NewRecorder()
+	h.response = &scrubbingResponseWriter{ResponseWriter: recorder, h: h}
+	h.setHeader("Content-Type", "application/json")
+	h.response.Write([]byte(`{"results":[`))
+	h.addJSON(db.Body{"id": "doc", "_sync": db.Body{"sequence": 1}})
+	h.response.Write([]byte(`]}`))
+	assert.Equals(t, recorder.Body.String(), `{"results":[{"id":"doc"}`+"\n"+`]}`)
+
+	// Admins get responses as-is:
+	h.privs = adminPrivs
+	assert.Equals(t, string(h.scrubJSON([]byte(`{"_sync":{}}`))), `{"_sync":{}}`)
+}
+
+func TestScrubbedMultipartResponse(t *testing.T) {
+	var rt restTester
+	rt.ServerContext().scrubber = newResponseScrubber([]string{"secret"})
+	big := strings.Repeat("x", 400)
+	assertStatus(t, rt.sendAdminRequest("PUT", "/db/doc",
+		`{"secret":"xyzzy", "text":"`+big+`", "nested":{"secret":"kept"}}`), 201)
+
+	// The doc's part is big enough to be gzipped, so it has to be scrubbed before it's written:
+	response := rt.sendRequestWithHeaders("POST", "/db/_bulk_get", `{"docs": [{"id": "doc"}]}`,
+		map[string]string{"X-Accept-Part-Encoding": "gzip"})
+	assertStatus(t, response, 200)
+	_, attrs, _ := mime.ParseMediaType(response.Header().Get("Content-Type"))
+	part, err := multipart.NewReader(response.Body, attrs["boundary"]).NextPart()
+	assert.Equals(t, err, nil)
+	assert.Equals(t, part.Header.Get("Content-Encoding"), "gzip")
+	unzip, err := gzip.NewReader(part)
+	assert.Equals(t, err, nil)
+	var body db.Body
+	assert.Equals(t, json.NewDecoder(unzip).Decode(&body), nil)
+	assert.Equals(t, body["secret"], nil)
+	assert.Equals(t, body["text"], big)
+	assert.DeepEquals(t, body["nested"], map[string]interface{}{"secret": "kept"})
+}
+
+func TestSyncFnRejectionDetails(t *testing.T) {
+	rt := restTester{noAdminParty: true, syncFn: `function(doc) {requireUser(doc.owner); channel(doc.channels);}`}
+	assertStatus(t, rt.sendAdminRequest("PUT", "/db/_user/naomi", `{"password":"letmein", "admin_channels":["*"]}`), 201)
+
+	response := rt.send(requestByUser("PUT", "/db/doc", `{"owner":"bob"}`, "naomi"))
+	assertStatus(t, response, 403)
+	var body db.Body
+	json.Unmarshal(response.Body.Bytes(), &body)
+	assert.Equals(t, body["error"], "forbidden")
+	assert.Equals(t, body["reason"], "wrong user")
+	assert.Equals(t, body["rejected_by"], "requireUser")
+	assertStatus(t, rt.send(requestByUser("PUT", "/db/doc", `{"owner":"naomi"}`, "naomi")), 201)
+
+	response = rt.send(requestByUser("POST", "/db/_bulk_docs", `{"docs": [{"_id": "bulk", "owner": "bob"}]}`, "naomi"))
+	assertStatus(t, response, 201)
+	var results []db.Body
+	json.Unmarshal(response.Body.Bytes(), &results)
+	assert.Equals(t, len(results), 1)
+	assert.Equals(t, results[0]["status"], 403.0)
+	assert.Equals(t, results[0]["rejected_by"], "requireUser")
+}
+
+func TestDocValidation(t *testing.T) {
+	var rt restTester
+	context := rt.ServerContext().Database("db")
+	err := context.ApplyValidation([]byte(`{"type": "object", "required": ["title"],
+		"properties": {"title": {"type": "string"}}}`),
+		`function(doc) {if (doc.title == "draft") return {path: "/title", message: "is a draft"};}`)
+	assert.Equals(t, err, nil)
+
+	response := rt.sendRequest("PUT", "/db/doc", `{"title": 5}`)
+	assertStatus(t, response, 403)
+	var body db.Body
+	json.Unmarshal(response.Body.Bytes(), &body)
+	assert.Equals(t, body["rejected_by"], "validation")
+	assert.Equals(t, body["path"], "/title")
+	assert.Equals(t, body["reason"], "Document failed validation: /title must be of type string")
+
+	response = rt.sendRequest("PUT", "/db/doc", `{"title": "draft"}`)
+	assertStatus(t, response, 403)
+	body = nil
+	json.Unmarshal(response.Body.Bytes(), &body)
+	assert.Equals(t, body["path"], "/title")
+	assert.Equals(t, body["reason"], "Document failed validation: /title is a draft")
+
+	response = rt.sendRequest("PUT", "/db/doc", `{"title": "Final"}`)
+	assertStatus(t, response, 201)
+	body = nil
+	json.Unmarshal(response.Body.Bytes(), &body)
+
+	// Deletions aren't validated:
+	assertStatus(t, rt.sendRequest("DELETE", "/db/doc?rev="+body["rev"].(string), ""), 200)
+	assert.True(t, context.ApplyValidation([]byte(`{"type": "nothing"}`), "") != nil)
+}
+
+func TestViewQuery(t *testing.T) {
+	rt := restTester{noAdminParty: true, syncFn: `function(doc) {channel(doc.channel);}`}
+	assertStatus(t, rt.sendAdminRequest("PUT", "/db/_user/alice", `{"password":"letmein", "admin_channels":["a"]}`), 201)
+	assertStatus(t, rt.sendAdminRequest("PUT", "/db/doc1", `{"type":"post", "title":"one", "channel":"a"}`), 201)
+	assertStatus(t, rt.sendAdminRequest("PUT", "/db/doc2", `{"type":"post", "title":"two", "channel":"b"}`), 201)
+	// Saving the design doc installs its views in the bucket:
+	assertStatus(t, rt.sendAdminRequest("PUT", "/db/_design/posts", `{"views": {
+		"by_title": {"map": "function(doc) {if (doc.type == \"post\") emit(doc.title, null);}"},
+		"count": {"map": "function(doc) {emit(doc.type, 1);}", "reduce": "_count"}}}`), 201)
+
+	var result struct {
+		TotalRows int `json:"total_rows"`
+		Rows      []struct {
+			ID  string
+			Key interface{}
+			Doc db.Body
+		}
+	}
+	response := rt.sendAdminRequest("GET", "/db/_design/posts/_view/by_title?stale=false", "")
+	assertStatus(t, response, 200)
+	json.Unmarshal(response.Body.Bytes(), &result)
+	assert.Equals(t, len(result.Rows), 2)
+
+	// A user only gets the rows of docs in their channels:
+	response = rt.send(requestByUser("GET", "/db/_design/posts/_view/by_title?include_docs=true", "", "alice"))
+	assertStatus(t, response, 200)
+	result.Rows = nil
+	json.Unmarshal(response.Body.Bytes(), &result)
+	assert.Equals(t, len(result.Rows), 1)
+	assert.Equals(t, result.TotalRows, 1)
+	assert.Equals(t, result.Rows[0].ID, "doc1")
+	assert.Equals(t, result.Rows[0].Key, "one")
+	assert.Equals(t, result.Rows[0].Doc["title"], "one")
+	assert.Equals(t, result.Rows[0].Doc["_sync"], nil)
+
+	// ...and always from the up-to-date index, since stale rows may come from older revisions:
+	assertStatus(t, rt.sendAdminRequest("PUT", "/db/doc3", `{"type":"post", "title":"three", "channel":"a"}`), 201)
+	response = rt.send(requestByUser("GET", "/db/_design/posts/_view/by_title?stale=ok", "", "alice"))
+	assertStatus(t, response, 200)
+	result.Rows = nil
+	json.Unmarshal(response.Body.Bytes(), &result)
+	assert.Equals(t, len(result.Rows), 2)
+
+	assertStatus(t, rt.send(requestByUser("GET", "/db/_design/posts/_view/count?reduce=true", "", "alice")), 403)
+	assertStatus(t, rt.send(requestByUser("GET", "/db/_design/sync_gateway/_view/access", "", "alice")), 403)
+	assertStatus(t, rt.send(requestByUser("GET", "/db/_design/sync_housekeeping/_view/all_docs", "", "alice")), 403)
+	assertStatus(t, rt.send(requestByUser("GET", "/db/_design/posts/_view/by_title?startkey=bad", "", "alice")), 400)
+
+	// Deleting the design doc removes its views:
+	var ddoc db.Body
+	json.Unmarshal(rt.sendAdminRequest("GET", "/db/_design/posts", "").Body.Bytes(), &ddoc)
+	assertStatus(t, rt.sendAdminRequest("DELETE", "/db/_design/posts?rev="+ddoc["_rev"].(string), ""), 200)
+	response = rt.sendAdminRequest("GET", "/db/_design/posts/_view/by_title", "")
+	assert.False(t, response.Code == 200)
+}
+
+func TestShutdown(t *testing.T) {
+	var rt restTester
+	assertStatus(t, rt.sendRequest("PUT", "/db/doc1", `{"channels":["all"]}`), 201)
+
+	// Open a continuous feed, and wait till it's registered:
+	feedDone := make(chan *testResponse)
+	go func() {
+		feedDone <- rt.sendRequest("GET", "/db/_changes?feed=continuous", "")
+	}()
+	dbContext := rt.ServerContext().Database("db")
+	for i := 0; i < 100 && len(dbContext.ChangesConnections()) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equals(t, len(dbContext.ChangesConnections()), 1)
+
+	assertStatus(t, rt.sendAdminRequest("POST", "/_shutdown", ""), 202)
+	response := <-feedDone
+	assertStatus(t, response, 200)
+	lines := strings.Split(strings.TrimSpace(response.Body.String()), "\n")
+	var change db.ChangeEntry
+	assert.Equals(t, json.Unmarshal([]byte(lines[0]), &change), nil)
+	assert.Equals(t, change.ID, "doc1")
+	var end struct {
+		LastSeq string `json:"last_seq"`
+	}
+	assert.Equals(t, json.Unmarshal([]byte(lines[len(lines)-1]), &end), nil)
+	assert.Equals(t, end.LastSeq, change.Seq)
+
+	<-rt.ServerContext().ShutdownComplete()
+	response = rt.sendRequest("GET", "/db/", "")
+	assertStatus(t, response, 503)
+	assert.Equals(t, response.Header().Get("Connection"), "close")
+}
@@ -12,10 +12,12 @@ package rest
 import (
 	"encoding/json"
 	"fmt"
+	"hash/fnv"
 	"html"
 	"mime/multipart"
 	"net/http"
 	"strings"
+	"sync"
 
 	"github.com/couchbaselabs/sync_gateway/base"
 	"github.com/couchbaselabs/sync_gateway/db"
@@ -29,35 +31,62 @@ func (h *handler) handleAllDocs() error {
 	includeAccess := h.getBoolQuery("access") && h.user == nil
 	includeRevs := h.getBoolQuery("revs")
 	includeSeqs := h.getBoolQuery("update_seq")
+	limit := int(h.getIntQuery("limit", 0))
+	atSeq := h.getIntQuery("at_seq", 0)
 	var ids []db.IDAndRev
 	var err error
 	var docCount int
+	if atSeq > 0 {
+		if err = h.db.RequireFeature(db.FeatureSnapshot); err != nil {
+			return err
+		}
+	}
 
 	// Get the doc IDs:
-	if h.rq.Method == "GET" || h.rq.Method == "HEAD" {
-		ids, err = h.db.AllDocIDs()
-		docCount = len(ids)
-	} else {
-		input, err := h.readJSON()
-		if err == nil {
-			keys, ok := input["keys"].([]interface{})
-			ids = make([]db.IDAndRev, len(keys))
-			for i := 0; i < len(keys); i++ {
-				ids[i].DocID, ok = keys[i].(string)
-				if !ok {
-					break
-				}
-			}
-			if !ok {
+	var keys []interface{}
+	if h.rq.Method == "POST" {
+		var input db.Body
+		if input, err = h.readJSON(); err == nil {
+			if keys, _ = input["keys"].([]interface{}); keys == nil {
 				err = base.HTTPErrorf(http.StatusBadRequest, "Bad/missing keys")
 			}
 		}
-		docCount = h.db.DocCount()
+	} else if keysJSON := h.getQuery("keys"); keysJSON != "" {
+		if json.Unmarshal([]byte(keysJSON), &keys) != nil {
+			err = base.HTTPErrorf(http.StatusBadRequest, "Bad keys")
+		}
 	}
 	if err != nil {
 		return err
 	}
 
+	if keys != nil {
+		ids = make([]db.IDAndRev, len(keys))
+		for i, key := range keys {
+			var ok bool
+			if ids[i].DocID, ok = key.(string); !ok {
+				return base.HTTPErrorf(http.StatusBadRequest, "Bad/missing keys")
+			}
+		}
+		docCount = h.db.DocCount()
+	} else {
+		// The view can only apply the limit itself if every row will be returned, i.e. for admins:
+		viewLimit := 0
+		if h.user == nil {
+			viewLimit = limit
+		}
+		startKey := h.getJSONStringQuery("startkey")
+		endKey := h.getJSONStringQuery("endkey")
+		if ids, err = h.db.AllDocIDsInRange(startKey, endKey, viewLimit); err != nil {
+			return err
+		}
+		if startKey == "" && endKey == "" && viewLimit == 0 {
+			docCount = len(ids)
+		} else {
+			docCount = h.db.DocCount()
+		}
+	}
+
 	type viewRowValue struct {
 		Rev      string              `json:"rev"`
 		Channels base.Set            `json:"channels,omitempty"` // for admins only
@@ -76,11 +105,29 @@ func (h *handler) handleAllDocs() error {
 	// Assemble the result (and read docs if includeDocs is set)
 	totalRows := 0
 	for _, id := range ids {
+		if limit > 0 && totalRows >= limit {
+			break
+		}
 		row := viewRow{ID: id.DocID, Key: id.DocID}
-		if includeDocs || id.RevID == "" || includeChannels || includeAccess {
+		if atSeq > 0 {
+			// List the revision that was current as of the given sequence instead:
+			var err error
+			if id.RevID, err = h.db.RevIDAtSequence(id.DocID, atSeq); err != nil {
+				if status, reason := base.ErrorAsHTTPStatus(err); status == http.StatusConflict {
+					// Don't silently leave out a doc that may have existed at that sequence:
+					if totalRows > 0 {
+						h.response.Write([]byte(",\n"))
+					}
+					totalRows++
+					h.addJSON(db.Body{"key": id.DocID, "error": base.CouchHTTPErrorName(status), "reason": reason})
+				}
+				continue
+			}
+		}
+		if includeDocs || id.RevID == "" || includeChannels || includeAccess || atSeq > 0 {
 			// Fetch the document body and other metadata that lives with it:
 			body, channels, access, roleAccess, err := h.db.GetRevAndChannels(id.DocID, id.RevID, includeRevs)
-			if err != nil || body["_removed"] != nil {
+			if err != nil || body["_removed"] != nil || body["_deleted"] != nil {
 				continue
 			}
 			id.RevID = body["_rev"].(string)
@@ -254,6 +301,8 @@ func (h *handler) handleDumpChannel() error {
 // Request looks like POST /db/_bulk_get?revs=___&attachments=___
 // where the boolean ?revs parameter adds a revision history to each doc
 // and the boolean ?attachments parameter includes attachment bodies.
+// The ?at_seq parameter gets the revisions that were current as of that sequence, for docs
+// without an explicit "rev", so the results are mutually consistent.
 // The body of the request is JSON and looks like:
 // {
 //   "docs": [
@@ -263,16 +312,32 @@ func (h *handler) handleDumpChannel() error {
 func (h *handler) handleBulkGet() error {
 	includeRevs := h.getBoolQuery("revs")
 	includeAttachments := h.getBoolQuery("attachments")
+	atSeq := h.getIntQuery("at_seq", 0)
+	useDeltas := h.getBoolQuery("deltas")
 	canCompress := strings.Contains(h.rq.Header.Get("X-Accept-Part-Encoding"), "gzip")
+	if atSeq > 0 {
+		if err := h.db.RequireFeature(db.FeatureSnapshot); err != nil {
+			return err
+		}
+	}
+	if useDeltas {
+		if err := h.db.RequireFeature(db.FeatureDeltas); err != nil {
+			return err
+		}
+	}
 	body, err := h.readJSON()
 	if err != nil {
 		return err
 	}
 
 	err = h.writeMultipart(func(writer *multipart.Writer) error {
+		// If the entire response is gzipped, there's no point compressing the individual parts:
+		if h.enableResponseCompression() {
+			canCompress = false
+		}
 		for _, item := range body["docs"].([]interface{}) {
 			var body db.Body
-			var attsSince []string
+			var attsSince, knownRevs []string
 			var err error
 
 			doc := item.(map[string]interface{})
@@ -285,30 +350,42 @@ func (h *handler) handleBulkGet() error {
 			if docid == "" || !revok {
 				err = base.HTTPErrorf(http.StatusBadRequest, "Invalid doc/rev ID in _bulk_get")
 			} else {
-				if includeAttachments {
-					if doc["atts_since"] != nil {
-						raw, ok := doc["atts_since"].([]interface{})
-						if ok {
-							attsSince = make([]string, len(raw))
-							for i := 0; i < len(raw); i++ {
-								attsSince[i], ok = raw[i].(string)
-								if !ok {
-									break
-								}
+				// With deltas=true, atts_since also names the revisions the client has, which
+				// can serve as the source of a delta:
+				if doc["atts_since"] != nil && (includeAttachments || useDeltas) {
+					raw, ok := doc["atts_since"].([]interface{})
+					if ok {
+						knownRevs = make([]string, len(raw))
+						for i := 0; i < len(raw); i++ {
+							knownRevs[i], ok = raw[i].(string)
+							if !ok {
+								break
 							}
 						}
-						if !ok {
-							err = base.HTTPErrorf(http.StatusBadRequest, "Invalid atts_since")
-						}
-					} else {
+					}
+					if !ok {
+						err = base.HTTPErrorf(http.StatusBadRequest, "Invalid atts_since")
+					}
+				}
+				if includeAttachments {
+					attsSince = knownRevs
+					if attsSince == nil {
 						attsSince = []string{}
 					}
 				}
 			}
 
-			if err == nil {
+			if err == nil && revid == "" && atSeq > 0 {
+				revid, err = h.db.RevIDAtSequence(docid, atSeq)
+			}
+			if err == nil && useDeltas {
+				body, err = h.db.GetRevAsDelta(docid, revid, includeRevs, attsSince, knownRevs)
+			} else if err == nil {
 				body, err = h.db.GetRev(docid, revid, includeRevs, attsSince)
 			}
+			if err == nil {
+				body, err = h.scrubBody(body)
+			}
 
 			if err != nil {
 				// Report error in the response for this doc:
@@ -321,6 +398,7 @@ func (h *handler) handleBulkGet() error {
 			}
 
 			h.db.WriteRevisionAsPart(body, err != nil, canCompress, writer)
+			h.flush() // stream each part to the client as it's ready
 		}
 		return nil
 	})
@@ -340,47 +418,122 @@ func (h *handler) handleBulkDocs() error {
 	}
 
 	docs := body["docs"].([]interface{})
+	if h.getBoolQuery("atomic") {
+		return h.handleAtomicBulkDocs(docs, newEdits)
+	}
+	for _, item := range docs {
+		if _, ok := item.(map[string]interface{}); !ok {
+			return base.HTTPErrorf(http.StatusBadRequest, "Invalid doc in _bulk_docs")
+		}
+	}
 	h.db.ReserveSequences(uint64(len(docs)))
 
-	result := make([]db.Body, 0, len(docs))
-	for _, item := range docs {
-		doc := item.(map[string]interface{})
-		docid, _ := doc["_id"].(string)
-		var err error
-		var revid string
-		if newEdits {
-			if docid != "" {
-				revid, err = h.db.Put(docid, doc)
-			} else {
-				docid, revid, err = h.db.Post(doc)
-			}
-		} else {
-			revisions := db.ParseRevisions(doc)
-			if revisions == nil {
-				err = base.HTTPErrorf(http.StatusBadRequest, "Bad _revisions")
-			} else {
-				revid = revisions[0]
-				err = h.db.PutExistingRev(docid, doc, revisions)
+	// Docs are saved by several goroutines at once, to overlap their bucket round trips. Every
+	// doc with a given ID goes to the same goroutine, so edits to it are made in order.
+	result := make([]db.Body, len(docs))
+	workers := kBulkDocsConcurrency
+	if len(docs) < workers {
+		workers = len(docs)
+	}
+	var wg sync.WaitGroup
+	for worker := 0; worker < workers; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for i, item := range docs {
+				doc := item.(map[string]interface{})
+				docid, _ := doc["_id"].(string)
+				if bulkDocsWorkerFor(docid, i, workers) == worker {
+					result[i] = h.bulkDocsSave(docid, doc, newEdits)
+				}
 			}
-		}
+		}(worker)
+	}
+	wg.Wait()
+
+	h.writeJSONStatus(http.StatusCreated, result)
+	return nil
+}
+
+// Number of goroutines saving the docs of a _bulk_docs request
+const kBulkDocsConcurrency = 8
+
+// Picks which goroutine saves a _bulk_docs item: by its doc ID, or by index if it has none.
+func bulkDocsWorkerFor(docid string, index int, workers int) int {
+	if docid == "" {
+		return index % workers
+	}
+	hash := fnv.New32a()
+	hash.Write([]byte(docid))
+	return int(hash.Sum32() % uint32(workers))
+}
 
-		status := db.Body{}
+// Saves one doc of a _bulk_docs request, returning its entry in the response.
+func (h *handler) bulkDocsSave(docid string, doc db.Body, newEdits bool) db.Body {
+	var err error
+	var revid string
+	if newEdits {
 		if docid != "" {
-			status["id"] = docid
+			revid, err = h.db.Put(docid, doc)
+		} else {
+			docid, revid, err = h.db.Post(doc)
 		}
-		if err != nil {
-			code, msg := base.ErrorAsHTTPStatus(err)
-			status["status"] = code
-			status["error"] = base.CouchHTTPErrorName(code)
-			status["reason"] = msg
-			base.Log("\tBulkDocs: Doc %q --> %d %s (%v)", docid, code, msg, err)
-			err = nil // wrote it to output already; not going to return it
+	} else {
+		revisions := db.ParseRevisions(doc)
+		if revisions == nil {
+			err = base.HTTPErrorf(http.StatusBadRequest, "Bad _revisions")
 		} else {
-			status["rev"] = revid
+			revid = revisions[0]
+			err = h.db.PutExistingRev(docid, doc, revisions)
 		}
-		result = append(result, status)
 	}
 
+	status := db.Body{}
+	if docid != "" {
+		status["id"] = docid
+	}
+	if err != nil {
+		code, msg := base.ErrorAsHTTPStatus(err)
+		status["status"] = code
+		status["error"] = base.CouchHTTPErrorName(code)
+		status["reason"] = msg
+		if detailed, ok := err.(base.DetailedError); ok {
+			for key, value := range detailed.Details() {
+				status[key] = value
+			}
+		}
+		base.Log("\tBulkDocs: Doc %q --> %d %s (%v)", docid, code, msg, err)
+	} else {
+		status["rev"] = revid
+	}
+	return status
+}
+
+// Handles _bulk_docs?atomic=true: either all the docs are saved, or none are and the error that
+// stopped the update is returned. Only allowed on the admin port unless the db config enables it.
+func (h *handler) handleAtomicBulkDocs(items []interface{}, newEdits bool) error {
+	if h.privs != adminPrivs && !h.db.AtomicBulkDocs {
+		return base.HTTPErrorf(http.StatusForbidden, "Atomic _bulk_docs is not enabled")
+	} else if !newEdits {
+		return base.HTTPErrorf(http.StatusBadRequest, "Atomic _bulk_docs doesn't support new_edits=false")
+	}
+	docs := make([]db.Body, len(items))
+	for i, item := range items {
+		doc, ok := item.(map[string]interface{})
+		if !ok {
+			return base.HTTPErrorf(http.StatusBadRequest, "Invalid doc in _bulk_docs")
+		}
+		docs[i] = doc
+	}
+	h.db.ReserveSequences(uint64(len(docs)))
+	revids, err := h.db.AtomicUpdate(docs)
+	if err != nil {
+		return err
+	}
+	result := make([]db.Body, len(docs))
+	for i, doc := range docs {
+		result[i] = db.Body{"id": doc["_id"], "rev": revids[i]}
+	}
 	h.writeJSONStatus(http.StatusCreated, result)
 	return nil
 }
@@ -32,6 +32,12 @@ const kDefaultTimeoutMS = 5 * 60 * 1000
 // Maximum value of _changes?timeout property
 const kMaxTimeoutMS = 15 * 60 * 1000
 
+// Default value of _changes?retry property: how long an EventSource waits to reconnect
+const kDefaultEventSourceRetryMS = 5 * 1000
+
+// Maximum number of doc IDs in an _exists request
+const kMaxExistsDocIDs = 1000
+
 func (h *handler) handleRevsDiff() error {
 	var input map[string][]string
 	err := h.readJSONInto(&input)
@@ -60,6 +66,41 @@ func (h *handler) handleRevsDiff() error {
 	return nil
 }
 
+// Reports which documents exist, and their current revisions, without reading their bodies.
+// The input is either an array of doc IDs, or (like _revs_diff) an object mapping doc IDs to
+// arrays of revision IDs, in which case the revisions each doc lacks are also reported.
+func (h *handler) handleExists() error {
+	body, err := h.readBody()
+	if err != nil {
+		return err
+	}
+	var input map[string][]string
+	var docids []string
+	if err = json.Unmarshal(body, &docids); err != nil {
+		if err = json.Unmarshal(body, &input); err != nil {
+			return base.HTTPErrorf(http.StatusBadRequest, "Expected an array of doc IDs or an object")
+		}
+	}
+	if docids != nil {
+		input = make(map[string][]string, len(docids))
+		for _, docid := range docids {
+			input[docid] = nil
+		}
+	}
+
+	if len(input) > kMaxExistsDocIDs {
+		return base.HTTPErrorf(http.StatusRequestEntityTooLarge,
+			"Too many doc IDs in _exists (max %d)", kMaxExistsDocIDs)
+	}
+
+	output := make(map[string]db.DocExistence, len(input))
+	for docid, revs := range input {
+		output[docid] = h.db.DocExists(docid, revs)
+	}
+	h.writeJSON(output)
+	return nil
+}
+
 // Top-level handler for _changes feed requests. Accepts GET or POST requests.
 func (h *handler) handleChanges() error {
 	// http://wiki.apache.org/couchdb/HTTP_database_API#Changes
@@ -75,22 +116,30 @@ func (h *handler) handleChanges() error {
 	if h.rq.Method == "GET" {
 		// GET request has parameters in URL:
 		feed = h.getQuery("feed")
-		options.Since = channels.TimedSetFromString(h.getQuery("since"))
+		since := h.getQuery("since")
+		if since == "" && feed == "eventsource" {
+			since = h.rq.Header.Get("Last-Event-ID") // set by a reconnecting EventSource
+		}
+		options.Since = parseSince(since)
 		options.Limit = int(h.getIntQuery("limit", 0))
 		options.Conflicts = (h.getQuery("style") == "all_docs")
 		options.IncludeDocs = (h.getBoolQuery("include_docs"))
+		options.Collapse = (h.getBoolQuery("collapse"))
 		filter = h.getQuery("filter")
 		channelsParam := h.getQuery("channels")
 		if channelsParam != "" {
 			channelsArray = strings.Split(channelsParam, ",")
 		}
+		if err := h.applyChangesProfile(h.getQuery("profile"), &options, &filter, &channelsArray); err != nil {
+			return err
+		}
 	} else {
 		// POST request has parameters in JSON body:
 		body, err := h.readBody()
 		if err != nil {
 			return err
 		}
-		feed, options, filter, channelsArray, err = readChangesOptionsFromJSON(body)
+		feed, options, filter, channelsArray, err = h.readChangesOptionsFromJSON(body)
 		if err != nil {
 			return err
 		}
@@ -116,11 +165,30 @@ func (h *handler) handleChanges() error {
 		}
 	}
 
+	if options.Collapse && feed != "normal" && feed != "" && feed != "longpoll" {
+		return base.HTTPErrorf(http.StatusBadRequest, "collapse is only supported by one-shot feeds")
+	}
+
 	h.db.ChangesClientStats.Increment()
 	defer h.db.ChangesClientStats.Decrement()
 
-	options.Terminator = make(chan bool)
-	defer close(options.Terminator)
+	// Register the feed so it can be listed (and terminated) through the admin API:
+	conn := &db.ChangesConnection{
+		Feed:     feed,
+		Channels: userChannels.ToArray(),
+		Since:    options.Since.String(),
+	}
+	if conn.Feed == "" {
+		conn.Feed = "normal"
+	}
+	if h.user != nil {
+		conn.User = h.user.Name()
+	}
+	if err := h.db.OpenChangesConnection(conn, feed != "normal" && feed != ""); err != nil {
+		return err
+	}
+	defer h.db.CloseChangesConnection(conn)
+	options.Terminator = conn.Terminator
 
 	switch feed {
 	case "normal", "":
@@ -130,7 +198,12 @@ func (h *handler) handleChanges() error {
 		return h.sendSimpleChanges(userChannels, options)
 	case "continuous":
 		return h.sendContinuousChangesByHTTP(userChannels, options)
+	case "eventsource":
+		return h.sendContinuousChangesByEventSource(userChannels, options)
 	case "websocket":
+		if err := h.db.RequireFeature(db.FeatureWebSockets); err != nil {
+			return err
+		}
 		return h.sendContinuousChangesByWebSocket(userChannels, options)
 	default:
 		return base.HTTPErrorf(http.StatusBadRequest, "Unknown feed type")
@@ -190,6 +263,9 @@ func (h *handler) sendSimpleChanges(channels base.Set, options db.ChangesOptions
 			case <-timeout:
 				message = "OK (timeout)"
 				break loop
+			case <-options.Terminator:
+				message = "OK (terminated)"
+				break loop
 			}
 			if err != nil {
 				h.logStatus(599, fmt.Sprintf("Write error: %v", err))
@@ -237,7 +313,9 @@ loop:
 		if feed == nil {
 			// Refresh the feed of all current changes:
 			if lastSeqID != "" { // start after end of last feed
-				options.Since = channels.TimedSetFromString(lastSeqID)
+				if options.Since, err = db.ParseSequenceID(lastSeqID); err != nil {
+					return err
+				}
 			}
 			feed, err = h.db.MultiChangesFeed(inChannels, options)
 			if err != nil || feed == nil {
@@ -302,6 +380,10 @@ loop:
 			err = send(nil)
 		case <-timeout:
 			break loop
+		case <-options.Terminator:
+			send(nil) // A last heartbeat, so the client knows the feed ended cleanly
+			h.logStatus(http.StatusOK, "OK (continuous feed terminated)")
+			return nil
 		}
 
 		if err != nil {
@@ -318,7 +400,9 @@ func (h *handler) sendContinuousChangesByHTTP(inChannels base.Set, options db.Ch
 	// a real content-type from the response text, which can delay or prevent the client app from
 	// receiving the response.
 	h.setHeader("Content-Type", "application/octet-stream")
-	return h.generateContinuousChanges(inChannels, options, func(changes []*db.ChangeEntry) error {
+	h.enableResponseCompression()
+	lastSeq := options.Since.String()
+	err := h.generateContinuousChanges(inChannels, options, func(changes []*db.ChangeEntry) error {
 		var err error
 		if changes != nil {
 			for _, change := range changes {
@@ -329,6 +413,7 @@ func (h *handler) sendContinuousChangesByHTTP(inChannels base.Set, options db.Ch
 				if _, err = h.response.Write([]byte("\n")); err != nil {
 					break
 				}
+				lastSeq = change.Seq
 			}
 		} else {
 			_, err = h.response.Write([]byte("\n"))
@@ -336,6 +421,48 @@ func (h *handler) sendContinuousChangesByHTTP(inChannels base.Set, options db.Ch
 		h.flush()
 		return err
 	})
+
+	// If the feed was terminated (e.g. by a shutdown), end it CouchDB-style with the last
+	// sequence sent, so the client can resume from there:
+	select {
+	case <-options.Terminator:
+		fmt.Fprintf(h.response, "{\"last_seq\":%q}\n", lastSeq)
+		h.flush()
+	default:
+	}
+	return err
+}
+
+// Sends a continuous feed in the Server-Sent Events format, for a browser's EventSource API.
+// Each change is an event whose ID is its sequence, so a reconnecting EventSource's
+// Last-Event-ID header resumes the feed where it left off.
+func (h *handler) sendContinuousChangesByEventSource(inChannels base.Set, options db.ChangesOptions) error {
+	h.setHeader("Content-Type", "text/event-stream")
+	h.setHeader("Cache-Control", "no-cache")
+	h.setHeader("X-Accel-Buffering", "no") // Keeps nginx from buffering the stream
+	retry := h.getRestrictedIntQuery("retry", kDefaultEventSourceRetryMS, 0, kMaxTimeoutMS)
+	if _, err := fmt.Fprintf(h.response, "retry: %d\n\n", retry); err != nil {
+		return nil
+	}
+	h.flush()
+	return h.generateContinuousChanges(inChannels, options, func(changes []*db.ChangeEntry) error {
+		var err error
+		if changes != nil {
+			for _, change := range changes {
+				data, _ := json.Marshal(change)
+				if data = h.scrubJSON(data); data == nil {
+					continue
+				}
+				if _, err = fmt.Fprintf(h.response, "id: %s\ndata: %s\n\n", change.Seq, data); err != nil {
+					break
+				}
+			}
+		} else {
+			_, err = h.response.Write([]byte(":\n\n")) // a comment, as a heartbeat
+		}
+		h.flush()
+		return err
+	})
 }
 
 func (h *handler) sendContinuousChangesByWebSocket(inChannels base.Set, options db.ChangesOptions) error {
@@ -348,7 +475,9 @@ func (h *handler) sendContinuousChangesByWebSocket(inChannels base.Set, options
 			return
 		} else {
 			var channelNames []string
-			_, options, _, channelNames, err = readChangesOptionsFromJSON(msg)
+			terminator := options.Terminator
+			_, options, _, channelNames, err = h.readChangesOptionsFromJSON(msg)
+			options.Terminator = terminator
 			if err != nil {
 				conn.Close()
 				return
@@ -369,7 +498,7 @@ func (h *handler) sendContinuousChangesByWebSocket(inChannels base.Set, options
 			} else {
 				data = []byte{}
 			}
-			_, err := conn.Write(data)
+			_, err := conn.Write(h.scrubJSON(data))
 			return err
 		})
 		conn.Close()
@@ -382,29 +511,65 @@ func (h *handler) sendContinuousChangesByWebSocket(inChannels base.Set, options
 	return nil
 }
 
-func readChangesOptionsFromJSON(jsonData []byte) (feed string, options db.ChangesOptions, filter string, channelsArray []string, err error) {
+// Parses changes-feed options from a POST body or WebSocket message. A "profile" property (or
+// else a ?profile= query parameter) names a changes profile to apply to them.
+func (h *handler) readChangesOptionsFromJSON(jsonData []byte) (feed string, options db.ChangesOptions, filter string, channelsArray []string, err error) {
 	var input struct {
 		Feed        string   `json:"feed"`
 		Since       string   `json:"since"`
 		Limit       int      `json:"limit"`
 		Style       string   `json:"style"`
 		IncludeDocs bool     `json:"include_docs"`
+		Collapse    bool     `json:"collapse"`
 		Filter      string   `json:"filter"`
 		Channels    []string `json:"channels"`
+		Profile     string   `json:"profile"`
 	}
 	if err = json.Unmarshal(jsonData, &input); err != nil {
 		return
 	}
 	feed = input.Feed
-	options.Since = channels.TimedSetFromString(input.Since)
+	options.Since = parseSince(input.Since)
 	options.Limit = input.Limit
 	options.Conflicts = (input.Style == "all_docs")
 	options.IncludeDocs = input.IncludeDocs
+	options.Collapse = input.Collapse
 	filter = input.Filter
 	channelsArray = input.Channels
+	if input.Profile == "" {
+		input.Profile = h.getQuery("profile")
+	}
+	err = h.applyChangesProfile(input.Profile, &options, &filter, &channelsArray)
 	return
 }
 
+// Parses a client's "since" value. As in versions before compound sequence IDs, one that can't
+// be parsed is ignored, and the feed starts from the beginning.
+func parseSince(since string) db.SequenceID {
+	seqID, err := db.ParseSequenceID(since)
+	if err != nil {
+		base.Warn("Ignoring invalid changes 'since' value %q", since)
+	}
+	return seqID
+}
+
+// Applies the named changes profile, if any, to the options the client sent. A profile that
+// lists channels replaces the client's filter with a by-channel filter on those channels.
+func (h *handler) applyChangesProfile(name string, options *db.ChangesOptions, filter *string, channelsArray *[]string) error {
+	if name == "" {
+		return nil
+	}
+	profile, err := h.db.GetChangesProfile(name)
+	if err != nil {
+		return err
+	}
+	base.LogTo("Changes+", "Applying changes profile %q", name)
+	if *channelsArray = profile.Apply(options, *channelsArray); profile.Channels != nil {
+		*filter = "sync_gateway/bychannel"
+	}
+	return nil
+}
+
 // Helper function to read a complete message from a WebSocket (because the API makes it hard)
 func readWebSocketMessage(conn *websocket.Conn) ([]byte, error) {
 	var message []byte
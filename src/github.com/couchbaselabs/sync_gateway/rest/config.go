@@ -17,9 +17,14 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"runtime"
+	"syscall"
+	"time"
 
+	"github.com/couchbaselabs/sync_gateway/auth"
 	"github.com/couchbaselabs/sync_gateway/base"
+	"github.com/couchbaselabs/sync_gateway/db"
 )
 
 // Register profiling handlers (see Go docs)
@@ -36,42 +41,70 @@ const DefaultMaxCouchbaseOverflowConnections = 0
 // Default value of ServerConfig.MaxIncomingConnections
 const DefaultMaxIncomingConnections = 1000
 
+// Default value of ServerConfig.ClientWriteTimeout, in seconds
+const DefaultClientWriteTimeout = 60
+
 // JSON object that defines the server configuration.
 type ServerConfig struct {
-	Interface               *string         // Interface to bind REST API to, default ":4984"
-	SSLCert                 *string         // Path to SSL cert file, or nil
-	SSLKey                  *string         // Path to SSL private key file, or nil
-	AdminInterface          *string         // Interface to bind admin API to, default ":4985"
-	AdminUI                 *string         // Path to Admin HTML page, if omitted uses bundled HTML
-	ProfileInterface        *string         // Interface to bind Go profile API to (no default)
-	ConfigServer            *string         // URL of config server (for dynamic db discovery)
-	Persona                 *PersonaConfig  // Configuration for Mozilla Persona validation
-	Facebook                *FacebookConfig // Configuration for Facebook validation
-	Log                     []string        // Log keywords to enable
-	Pretty                  bool            // Pretty-print JSON responses?
-	DeploymentID            *string         // Optional customer/deployment ID for stats reporting
-	StatsReportInterval     *float64        // Optional stats report interval (0 to disable)
-	MaxCouchbaseConnections *int            // Max # of sockets to open to a Couchbase Server node
-	MaxCouchbaseOverflow    *int            // Max # of overflow sockets to open
-	MaxIncomingConnections  *int            // Max # of incoming HTTP connections to accept
-	CompressResponses       *bool           // If false, disables compression of HTTP responses
-	Databases               DbConfigMap     // Pre-configured databases, mapped by name
+	Interface               *string                        // Interface to bind REST API to, default ":4984"
+	SSLCert                 *string                        // Path to SSL cert file, or nil
+	SSLKey                  *string                        // Path to SSL private key file, or nil
+	AdminInterface          *string                        // Interface to bind admin API to, default ":4985"
+	AdminUI                 *string                        // Path to Admin HTML page, if omitted uses bundled HTML
+	ProfileInterface        *string                        // Interface to bind Go profile API to (no default)
+	ConfigServer            *string                        // URL of config server (for dynamic db discovery)
+	Persona                 *PersonaConfig                 // Configuration for Mozilla Persona validation
+	Facebook                *FacebookConfig                // Configuration for Facebook validation
+	Log                     []string                       // Log keywords to enable
+	Logging                 map[string]*base.LogSinkConfig // Log outputs by name (default: "console")
+	LogDir                  *string                        // Directory file log outputs added through /_logging write into (nil = none can be)
+	Pretty                  bool                           // Pretty-print JSON responses?
+	DeploymentID            *string                        // Optional customer/deployment ID for stats reporting
+	StatsReportInterval     *float64                       // Optional stats report interval (0 to disable)
+	MaxCouchbaseConnections *int                           // Max # of sockets to open to a Couchbase Server node
+	MaxCouchbaseOverflow    *int                           // Max # of overflow sockets to open
+	MaxIncomingConnections  *int                           // Max # of incoming HTTP connections to accept
+	ClientWriteTimeout      *int                           // Secs a write to a client can block before it's disconnected (0 = forever)
+	CompressResponses       *bool                          // If false, disables compression of HTTP responses
+	ScrubResponses          *bool                          // If false, public responses aren't checked for internal data
+	ScrubFields             []string                       // Extra properties to remove from public responses
+	RateLimit               *RateLimitConfig               // Per-client limits on public requests (nil = none)
+	HeapDumpDir             *string                        // Directory /_debug/heapdump writes into (nil = disabled)
+	Databases               DbConfigMap                    // Pre-configured databases, mapped by name
+	Replications            []*ReplicationConfig           // Replications to run at startup
+	ShutdownTimeout         *int                           // Secs to wait for requests to finish when shutting down
 }
 
 // JSON object that defines a database configuration within the ServerConfig.
 type DbConfig struct {
-	name       string                      `json:"name"`                  // Database name in REST API (stored as key in JSON)
-	Server     *string                     `json:"server"`                // Couchbase (or Walrus) server URL, default "http://localhost:8091"
-	Username   string                      `json:"username,omitempty"`    // Username for authenticating to server
-	Password   string                      `json:"password,omitempty"`    // Password for authenticating to server
-	Bucket     *string                     `json:"bucket"`                // Bucket name on server; defaults to same as 'name'
-	Pool       *string                     `json:"pool"`                  // Couchbase pool name, default "default"
-	Sync       *string                     `json:"sync"`                  // Sync function defines which users can see which data
-	Users      map[string]*PrincipalConfig `json:"users,omitempty"`       // Initial user accounts
-	Roles      map[string]*PrincipalConfig `json:"roles,omitempty"`       // Initial roles
-	RevsLimit  *uint32                     `json:"revs_limit,omitempty"`  // Max depth a document's revision tree can grow to
-	ImportDocs interface{}                 `json:"import_docs,omitempty"` // false, true, or "continuous"
-	Shadow     *ShadowConfig               `json:"shadow,omitempty"`      // External bucket to shadow
+	name                 string                        `json:"name"`                             // Database name in REST API (stored as key in JSON)
+	Server               *string                       `json:"server"`                           // Couchbase (or Walrus) server URL, default "http://localhost:8091"
+	Username             string                        `json:"username,omitempty"`               // Username for authenticating to server
+	Password             string                        `json:"password,omitempty"`               // Password for authenticating to server
+	Bucket               *string                       `json:"bucket"`                           // Bucket name on server; defaults to same as 'name'
+	Pool                 *string                       `json:"pool"`                             // Couchbase pool name, default "default"
+	Sync                 *string                       `json:"sync"`                             // Sync function defines which users can see which data
+	Users                map[string]*PrincipalConfig   `json:"users,omitempty"`                  // Initial user accounts
+	Roles                map[string]*PrincipalConfig   `json:"roles,omitempty"`                  // Initial roles
+	RevsLimit            *uint32                       `json:"revs_limit,omitempty"`             // Max depth a document's revision tree can grow to
+	ImportDocs           interface{}                   `json:"import_docs,omitempty"`            // false, true, or "continuous"
+	ImportFilter         *string                       `json:"import_filter,omitempty"`          // JS fn deciding which docs to import
+	Shadow               *ShadowConfig                 `json:"shadow,omitempty"`                 // External bucket to shadow
+	DocIDTemplate        *string                       `json:"doc_id_template,omitempty"`        // Template for IDs of POSTed docs
+	AtomicBulkDocs       bool                          `json:"atomic_bulk_docs,omitempty"`       // Allow _bulk_docs?atomic=true on the public port
+	Features             map[string]bool               `json:"features,omitempty"`               // Enables/disables optional features (see _capabilities)
+	ChangesProfiles      map[string]*db.ChangesProfile `json:"changes_profiles,omitempty"`       // Named _changes options, used as ?profile=name
+	MaxContinuousChanges int                           `json:"max_continuous_changes,omitempty"` // Max concurrent longpoll/continuous/websocket _changes feeds
+	ExternalRevBodies    bool                          `json:"external_rev_bodies,omitempty"`    // Store non-current revision bodies as separate docs
+	PriorityChannels     []string                      `json:"priority_channels,omitempty"`      // Channels to send first when a client first syncs
+	FailoverGraceWindow  *int                          `json:"failover_grace_window,omitempty"`  // Secs writes & queries wait out a bucket outage (0 = fail at once)
+	FailoverMaxQueued    *int                          `json:"failover_max_queued,omitempty"`    // Max requests waiting out an outage at once
+	CORS                 *CORSConfig                   `json:"cors,omitempty"`                   // Cross-origin access by web apps
+	LocalDocRetention    *int                          `json:"local_doc_retention,omitempty"`    // Days after its last update that a _local doc is deleted (0 = never)
+	MeteringInterval     *int                          `json:"metering_interval,omitempty"`      // Mins per usage metering record (0 = no metering)
+	Validation           *ValidationConfig             `json:"validation,omitempty"`             // Checks the shape of new revisions before the sync fn
+	StaticGrants         *auth.StaticGrants            `json:"static_grants,omitempty"`          // Channels/roles granted to users & roles by name, in addition to the admin API & sync fn
+	ConflictResolution   *ConflictResolutionConfig     `json:"conflict_resolution,omitempty"`    // Resolves conflicts automatically as writes create them
 }
 
 type DbConfigMap map[string]*DbConfig
@@ -80,12 +113,17 @@ type DbConfigMap map[string]*DbConfig
 type PrincipalConfig struct {
 	Name              *string  `json:"name,omitempty"`
 	ExplicitChannels  base.Set `json:"admin_channels,omitempty"`
+	ExcludedChannels  base.Set `json:"admin_excluded_channels,omitempty"`
 	Channels          base.Set `json:"all_channels"`
 	Email             string   `json:"email,omitempty"`
 	Disabled          bool     `json:"disabled,omitempty"`
 	Password          *string  `json:"password,omitempty"`
 	ExplicitRoleNames []string `json:"admin_roles,omitempty"`
 	RoleNames         []string `json:"roles,omitempty"`
+	// (read-only) Maps each of a user's channels to where its access came from: "admin" (the
+	// admin_channels), "config" (the static_grants in the database config), "sync" (an access()
+	// call in the sync function), or "role:<name>".
+	ChannelSources map[string][]string `json:"channel_sources,omitempty"`
 }
 
 type PersonaConfig struct {
@@ -106,6 +144,19 @@ type ShadowConfig struct {
 	Doc_id_regex *string `json:"doc_id_regex,omitempty"` // Optional regex that doc IDs must match
 }
 
+// Document validation, applied to every new (non-deletion) revision before the sync function.
+type ValidationConfig struct {
+	Schema   json.RawMessage `json:"schema,omitempty"`   // JSON Schema (draft 4) the body must match
+	Function *string         `json:"function,omitempty"` // JS fn(doc) returning true, or the error
+}
+
+// Automatic conflict resolution. The policy is "lww", "remoteWins", "localWins" or "custom".
+type ConflictResolutionConfig struct {
+	Policy            db.ConflictPolicy `json:"policy,omitempty"`
+	TimestampProperty string            `json:"timestamp_property,omitempty"` // Property lww compares (number or RFC 3339 date)
+	Function          *string           `json:"function,omitempty"`           // JS fn(conflicts) returning the winning rev, for "custom"
+}
+
 func (dbConfig *DbConfig) setup(name string) error {
 	dbConfig.name = name
 	if dbConfig.Bucket == nil {
@@ -133,6 +184,9 @@ func (dbConfig *DbConfig) setup(name string) error {
 		urlStr := url.String()
 		dbConfig.Server = &urlStr
 	}
+	if err == nil && dbConfig.CORS != nil {
+		err = dbConfig.CORS.validate()
+	}
 	return err
 }
 
@@ -166,7 +220,9 @@ func ReadServerConfig(path string) (*ServerConfig, error) {
 
 	// Validation:
 	for name, dbConfig := range config.Databases {
-		dbConfig.setup(name)
+		if err := dbConfig.setup(name); err != nil {
+			return nil, err
+		}
 	}
 	return config, nil
 }
@@ -196,6 +252,15 @@ func (self *ServerConfig) MergeWith(other *ServerConfig) error {
 	for _, flag := range other.Log {
 		self.Log = append(self.Log, flag)
 	}
+	if self.Logging == nil {
+		self.Logging = other.Logging
+	}
+	if self.LogDir == nil {
+		self.LogDir = other.LogDir
+	}
+	if self.HeapDumpDir == nil {
+		self.HeapDumpDir = other.HeapDumpDir
+	}
 	if other.Pretty {
 		self.Pretty = true
 	}
@@ -205,6 +270,7 @@ func (self *ServerConfig) MergeWith(other *ServerConfig) error {
 		}
 		self.Databases[name] = db
 	}
+	self.Replications = append(self.Replications, other.Replications...)
 	return nil
 }
 
@@ -263,6 +329,11 @@ func ParseCommandLine() *ServerConfig {
 		if *pretty {
 			config.Pretty = *pretty
 		}
+		if config.Logging != nil {
+			if err := base.SetLogSinks(config.Logging); err != nil {
+				base.LogFatal("Invalid logging config: %v", err)
+			}
+		}
 		if config.Log != nil {
 			base.ParseLogFlags(config.Log)
 		}
@@ -298,22 +369,33 @@ func ParseCommandLine() *ServerConfig {
 		config.Persona = &PersonaConfig{Origin: *siteURL}
 	}
 
-	base.LogKeys["HTTP"] = true
-	base.LogKeys["HTTP+"] = *verbose
+	base.SetLogKeys(map[string]bool{"HTTP": true, "HTTP+": *verbose})
 	base.ParseLogFlag(*logKeys)
 
 	return config
 }
 
-func (config *ServerConfig) serve(addr string, handler http.Handler) {
+func (config *ServerConfig) serve(sc *ServerContext, addr string, handler http.Handler) {
 	maxConns := DefaultMaxIncomingConnections
 	if config.MaxIncomingConnections != nil {
 		maxConns = *config.MaxIncomingConnections
 	}
-	err := base.ListenAndServeHTTP(addr, maxConns, config.SSLCert, config.SSLKey, handler)
+	writeTimeout := DefaultClientWriteTimeout
+	if config.ClientWriteTimeout != nil {
+		writeTimeout = *config.ClientWriteTimeout
+	}
+	listener, err := base.ListenHTTP(addr, maxConns, time.Duration(writeTimeout)*time.Second,
+		config.SSLCert, config.SSLKey)
 	if err != nil {
 		base.LogFatal("Failed to start HTTP server on %s: %v", addr, err)
 	}
+	if !sc.addListener(listener) {
+		return
+	}
+	server := &http.Server{Addr: addr, Handler: handler}
+	if err := server.Serve(listener); err != nil && !sc.isShuttingDown() {
+		base.LogFatal("HTTP server on %s failed: %v", addr, err)
+	}
 }
 
 // Starts and runs the server given its configuration. (This function never returns.)
@@ -337,6 +419,15 @@ func RunServer(config *ServerConfig) {
 		}
 	}
 
+	for _, replConfig := range config.Replications {
+		go func(replConfig ReplicationConfig) {
+			if _, err := sc.StartReplication(replConfig); err != nil {
+				base.Warn("Error running replication %s -> %s: %v",
+					redactURL(replConfig.Source), redactURL(replConfig.Target), err)
+			}
+		}(*replConfig)
+	}
+
 	if config.ProfileInterface != nil {
 		//runtime.MemProfileRate = 10 * 1024
 		base.Log("Starting profile server on %s", *config.ProfileInterface)
@@ -346,9 +437,34 @@ func RunServer(config *ServerConfig) {
 	}
 
 	base.Log("Starting admin server on %s", *config.AdminInterface)
-	go config.serve(*config.AdminInterface, CreateAdminHandler(sc))
+	go config.serve(sc, *config.AdminInterface, CreateAdminHandler(sc))
 	base.Log("Starting server on %s ...", *config.Interface)
-	config.serve(*config.Interface, CreatePublicHandler(sc))
+	go config.serve(sc, *config.Interface, CreatePublicHandler(sc))
+
+	// SIGINT or SIGTERM shuts down gracefully; a second one exits at once.
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		base.Log("Received signal %v; shutting down", <-signals)
+		go sc.Shutdown()
+		base.Log("Received signal %v again; exiting", <-signals)
+		os.Exit(1)
+	}()
+
+	// SIGHUP reopens the log files, after an external tool has rotated them.
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	go func() {
+		for sig := range hangups {
+			base.Log("Received signal %v; reopening log files", sig)
+			if err := base.ReopenLogFiles(); err != nil {
+				base.Warn("Couldn't reopen log files: %v", err)
+			}
+		}
+	}()
+
+	<-sc.ShutdownComplete()
+	os.Exit(0)
 }
 
 // Main entry point for a simple server; you can have your main() function just call this.
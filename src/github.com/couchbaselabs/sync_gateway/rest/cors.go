@@ -0,0 +1,106 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package rest
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/couchbaselabs/sync_gateway/base"
+)
+
+// JSON object that configures Cross-Origin Resource Sharing for a database, so that web apps
+// loaded from other origins (like PouchDB in a browser) can use its public REST API.
+type CORSConfig struct {
+	Origin      []string `json:"origin"`                // Allowed origins; "*" allows any
+	Headers     []string `json:"headers,omitempty"`     // Request headers allowed besides the simple ones
+	MaxAge      int      `json:"max_age,omitempty"`     // Secs a client may cache a preflight response
+	Credentials bool     `json:"credentials,omitempty"` // Allow cookies & HTTP auth (needed for _session)
+}
+
+// Headers allowed in cross-origin requests if the config doesn't list any
+var kDefaultCORSHeaders = []string{"Content-Type", "Authorization", "Accept", "If-Match"}
+
+// Checks the config for combinations that would be unsafe.
+func (config *CORSConfig) validate() error {
+	if config.Credentials {
+		for _, allowed := range config.Origin {
+			if allowed == "*" {
+				return base.HTTPErrorf(http.StatusBadRequest,
+					"CORS credentials can't be allowed for origin \"*\"; list the origins instead")
+			}
+		}
+	}
+	return nil
+}
+
+// Returns the value of the Access-Control-Allow-Origin response header for a request's
+// Origin header, or "" if the origin isn't allowed.
+func (config *CORSConfig) allowOrigin(origin string) string {
+	if config == nil || origin == "" {
+		return ""
+	}
+	for _, allowed := range config.Origin {
+		if allowed == "*" {
+			return "*"
+		} else if allowed == origin {
+			return origin
+		}
+	}
+	return ""
+}
+
+// Adds the CORS headers common to preflight and actual requests. Returns false if the
+// request doesn't come from an allowed origin.
+func (config *CORSConfig) addHeaders(header http.Header, rq *http.Request) bool {
+	allow := config.allowOrigin(rq.Header.Get("Origin"))
+	if allow == "" {
+		return false
+	}
+	header.Set("Access-Control-Allow-Origin", allow)
+	if allow != "*" {
+		header.Add("Vary", "Origin")
+	}
+	if config.Credentials && allow != "*" { // Any site's scripts could act as the user otherwise
+		header.Set("Access-Control-Allow-Credentials", "true")
+	}
+	return true
+}
+
+// Adds the headers of a response to a CORS preflight (OPTIONS) request, given the methods
+// the URL supports.
+func (config *CORSConfig) addPreflightHeaders(header http.Header, rq *http.Request, methods []string) {
+	if rq.Header.Get("Access-Control-Request-Method") == "" || !config.addHeaders(header, rq) {
+		return
+	}
+	header.Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+	headers := config.Headers
+	if len(headers) == 0 {
+		headers = kDefaultCORSHeaders
+	}
+	header.Set("Access-Control-Allow-Headers", strings.Join(headers, ", "))
+	if config.MaxAge > 0 {
+		header.Set("Access-Control-Max-Age", strconv.Itoa(config.MaxAge))
+	}
+}
+
+// Returns the CORS config of the database a request's URL path refers to, or nil.
+// (This parses the path itself since it's also used for requests no route matched.)
+func (sc *ServerContext) corsConfigForPath(path string) *CORSConfig {
+	components := strings.SplitN(strings.TrimPrefix(path, "/"), "/", 2)
+	if components[0] == "" || components[0][0] == '_' {
+		return nil
+	}
+	if config := sc.GetDatabaseConfig(components[0]); config != nil {
+		return config.CORS
+	}
+	return nil
+}
@@ -2,7 +2,11 @@ package rest
 
 import (
 	"expvar"
+	"fmt"
 	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
 	"strings"
 	"sync"
 	"time"
@@ -16,6 +20,9 @@ import (
 
 const kDebugURLPathPrefix = "/_expvar"
 
+// Admin URL prefix under which the net/http/pprof handlers are served
+const kPprofURLPathPrefix = "/_debug/pprof/"
+
 var (
 	poolhistos = map[string]metrics.Histogram{}
 	opshistos  = map[string]metrics.Histogram{}
@@ -23,6 +30,9 @@ var (
 
 	expPoolHistos *expvar.Map
 	expOpsHistos  *expvar.Map
+
+	blockProfileRate int // Last rate passed to runtime.SetBlockProfileRate (there's no getter)
+	blockProfileMu   sync.Mutex
 )
 
 func init() {
@@ -89,3 +99,125 @@ func (h *handler) handleExpvar() error {
 	http.DefaultServeMux.ServeHTTP(h.response, h.rq)
 	return nil
 }
+
+// Serves the net/http/pprof handlers (index, cmdline, profile, symbol and the named profiles)
+// under /_debug/pprof/, so e.g. `go tool pprof http://host:4985/_debug/pprof/heap` works
+// against the admin port without needing a separate ProfileInterface.
+func (h *handler) handlePprof() error {
+	base.LogTo("HTTP", "pprof: %s", h.rq.URL.Path)
+	h.rq.URL.Path = strings.Replace(h.rq.URL.Path, kPprofURLPathPrefix, "/debug/pprof/", 1)
+	http.DefaultServeMux.ServeHTTP(h.response, h.rq)
+	return nil
+}
+
+type runtimeSettings struct {
+	GOMAXPROCS           *int `json:"gomaxprocs,omitempty"`             // Max OS threads running Go code
+	NumCPU               int  `json:"num_cpu,omitempty"`                // Read-only
+	NumGoroutine         int  `json:"num_goroutine,omitempty"`          // Read-only
+	BlockProfileRate     *int `json:"block_profile_rate,omitempty"`     // See runtime.SetBlockProfileRate; 0 is off
+	MutexProfileFraction *int `json:"mutex_profile_fraction,omitempty"` // See runtime.SetMutexProfileFraction; 0 is off
+}
+
+func currentRuntimeSettings() runtimeSettings {
+	blockProfileMu.Lock()
+	blockRate := blockProfileRate
+	blockProfileMu.Unlock()
+	maxProcs := runtime.GOMAXPROCS(0)
+	mutexFraction := mutexProfileFraction()
+	return runtimeSettings{
+		GOMAXPROCS:           &maxProcs,
+		NumCPU:               runtime.NumCPU(),
+		NumGoroutine:         runtime.NumGoroutine(),
+		BlockProfileRate:     &blockRate,
+		MutexProfileFraction: &mutexFraction,
+	}
+}
+
+// Returns GOMAXPROCS and the block/mutex profiling rates
+func (h *handler) handleGetRuntime() error {
+	h.writeJSON(currentRuntimeSettings())
+	return nil
+}
+
+// Changes GOMAXPROCS and/or the block/mutex profiling rates; properties left out are unchanged.
+// The block and mutex profiles are then readable at /_debug/pprof/block and /_debug/pprof/mutex.
+func (h *handler) handleSetRuntime() error {
+	var settings runtimeSettings
+	if err := h.readJSONInto(&settings); err != nil {
+		return err
+	}
+	if (settings.GOMAXPROCS != nil && *settings.GOMAXPROCS < 1) ||
+		(settings.BlockProfileRate != nil && *settings.BlockProfileRate < 0) ||
+		(settings.MutexProfileFraction != nil && *settings.MutexProfileFraction < 0) {
+		return base.HTTPErrorf(http.StatusBadRequest, "Invalid runtime setting")
+	} else if settings.MutexProfileFraction != nil && *settings.MutexProfileFraction > 0 &&
+		!kMutexProfilingSupported {
+		return base.HTTPErrorf(http.StatusNotImplemented, "Mutex profiling needs a server built with Go 1.8 or later")
+	}
+	if settings.GOMAXPROCS != nil {
+		old := runtime.GOMAXPROCS(*settings.GOMAXPROCS)
+		base.Log("Changed GOMAXPROCS from %d to %d", old, *settings.GOMAXPROCS)
+	}
+	if settings.BlockProfileRate != nil {
+		blockProfileMu.Lock()
+		blockProfileRate = *settings.BlockProfileRate
+		runtime.SetBlockProfileRate(blockProfileRate)
+		blockProfileMu.Unlock()
+		base.Log("Set block profile rate to %d", *settings.BlockProfileRate)
+	}
+	if settings.MutexProfileFraction != nil {
+		setMutexProfileFraction(*settings.MutexProfileFraction)
+		base.Log("Set mutex profile fraction to %d", *settings.MutexProfileFraction)
+	}
+	h.writeJSON(currentRuntimeSettings())
+	return nil
+}
+
+// Writes a full heap dump (see runtime/debug.WriteHeapDump) to a new file in the configured
+// HeapDumpDir, and returns its path. This stops the world until it's done, which can take a
+// while with a large heap.
+func (h *handler) handleHeapDump() error {
+	if h.server.config.HeapDumpDir == nil {
+		return base.HTTPErrorf(http.StatusForbidden, "Heap dumps aren't enabled; set HeapDumpDir in the config")
+	} else if !kHeapDumpsSupported {
+		return base.HTTPErrorf(http.StatusNotImplemented, "Heap dumps need a server built with Go 1.3 or later")
+	}
+	path := filepath.Join(*h.server.config.HeapDumpDir,
+		fmt.Sprintf("heapdump-%s-%d", time.Now().Format("20060102-150405"), os.Getpid()))
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600) // never overwrites
+	if os.IsExist(err) {
+		return base.HTTPErrorf(http.StatusConflict, "A heap dump was just written; try again later")
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	base.Log("Dumping heap to %s ...", path)
+	writeHeapDump(f)
+	base.Log("...heap dump complete")
+	h.writeJSON(map[string]interface{}{"ok": true, "file": path})
+	return nil
+}
+
+// Returns the fault-injection settings (only available in builds with the "chaos" tag)
+func (h *handler) handleGetChaos() error {
+	h.assertAdminOnly()
+	if !base.ChaosEnabled {
+		return base.HTTPErrorf(http.StatusNotFound, "Server wasn't built with chaos hooks")
+	}
+	h.writeJSON(base.GetChaos())
+	return nil
+}
+
+// Changes the fault-injection settings
+func (h *handler) handleSetChaos() error {
+	h.assertAdminOnly()
+	var config base.ChaosConfig
+	if err := h.readJSONInto(&config); err != nil {
+		return err
+	}
+	if err := base.SetChaos(config); err != nil {
+		return err
+	}
+	h.writeJSON(base.GetChaos())
+	return nil
+}
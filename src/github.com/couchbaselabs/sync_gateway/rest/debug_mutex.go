@@ -0,0 +1,25 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+//go:build go1.8
+// +build go1.8
+
+package rest
+
+import "runtime"
+
+const kMutexProfilingSupported = true
+
+func mutexProfileFraction() int {
+	return runtime.SetMutexProfileFraction(-1)
+}
+
+func setMutexProfileFraction(rate int) {
+	runtime.SetMutexProfileFraction(rate)
+}
@@ -14,6 +14,7 @@ import (
 	"mime/multipart"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/couchbaselabs/sync_gateway/base"
 	"github.com/couchbaselabs/sync_gateway/db"
@@ -27,33 +28,69 @@ func (h *handler) handleGetDoc() error {
 	openRevs := h.getQuery("open_revs")
 
 	// What attachment bodies should be included?
-	var attachmentsSince []string = nil
+	// (With deltas=true, atts_since also lists the revisions the client has, any of which can
+	// be the source of a delta.)
+	var attachmentsSince, knownRevs []string
+	useDeltas := h.getBoolQuery("deltas")
+	if useDeltas {
+		if err := h.db.RequireFeature(db.FeatureDeltas); err != nil {
+			return err
+		}
+	}
+	if atts := h.getQuery("atts_since"); atts != "" && (useDeltas || h.getBoolQuery("attachments")) {
+		if err := json.Unmarshal([]byte(atts), &knownRevs); err != nil {
+			return base.HTTPErrorf(http.StatusBadRequest, "bad atts_since")
+		}
+	}
 	if h.getBoolQuery("attachments") {
-		atts := h.getQuery("atts_since")
-		if atts != "" {
-			err := json.Unmarshal([]byte(atts), &attachmentsSince)
-			if err != nil {
-				return base.HTTPErrorf(http.StatusBadRequest, "bad atts_since")
-			}
-		} else {
+		attachmentsSince = knownRevs
+		if attachmentsSince == nil {
 			attachmentsSince = []string{}
 		}
 	}
 
 	if openRevs == "" {
+		// If the client already has the current revision, don't send it again:
+		if etag := h.getETagHeader("If-None-Match"); etag != "" && revid == "" {
+			if currentRev, err := h.db.GetCurrentRevID(docid); err == nil && currentRev == etag {
+				h.setHeader("Etag", currentRev)
+				h.response.WriteHeader(http.StatusNotModified)
+				h.logStatus(http.StatusNotModified, "Not Modified")
+				return nil
+			}
+		}
+
 		// Single-revision GET:
-		value, err := h.db.GetRev(docid, revid, includeRevs, attachmentsSince)
+		var value db.Body
+		var err error
+		if useDeltas {
+			value, err = h.db.GetRevAsDelta(docid, revid, includeRevs, attachmentsSince, knownRevs)
+		} else {
+			value, err = h.db.GetRev(docid, revid, includeRevs, attachmentsSince)
+		}
 		if err != nil {
 			return err
 		}
 		if value == nil {
 			return kNotFoundError
 		}
+		if revid == "" && !useDeltas && h.getBoolQuery("lock") {
+			// ?lock=true adds the current revision's lock, if any:
+			lock, err := h.db.GetDocLock(docid)
+			if err != nil {
+				return err
+			} else if lock != nil {
+				value["_lock"] = lock
+			}
+		}
 		h.setHeader("Etag", value["_rev"].(string))
 
 		hasBodies := (attachmentsSince != nil && value["_attachments"] != nil)
 		if h.requestAccepts("multipart/") && (hasBodies || !h.requestAccepts("application/json")) {
 			canCompress := strings.Contains(h.rq.Header.Get("X-Accept-Part-Encoding"), "gzip")
+			if value, err = h.scrubBody(value); err != nil {
+				return err
+			}
 			return h.writeMultipart(func(writer *multipart.Writer) error {
 				h.db.WriteMultipartDocument(value, writer, canCompress)
 				return nil
@@ -78,6 +115,9 @@ func (h *handler) handleGetDoc() error {
 		err = h.writeMultipart(func(writer *multipart.Writer) error {
 			for _, revid := range revids {
 				revBody, err := h.db.GetRev(docid, revid, includeRevs, attachmentsSince)
+				if err == nil {
+					revBody, err = h.scrubBody(revBody)
+				}
 				if err != nil {
 					revBody = db.Body{"missing": revid} //TODO: More specific error
 				}
@@ -90,6 +130,61 @@ func (h *handler) handleGetDoc() error {
 	return nil
 }
 
+// HTTP handler for a GET of a document's _watch URL. This is a long-poll that returns when the
+// doc's current revision is no longer the "rev" query parameter (or the If-None-Match ETag).
+func (h *handler) handleWatchDoc() error {
+	docid := h.PathVar("docid")
+	sinceRev := h.getQuery("rev")
+	if sinceRev == "" {
+		sinceRev = h.getETagHeader("If-None-Match")
+	}
+	ms := h.getRestrictedIntQuery("timeout", kDefaultTimeoutMS, 0, kMaxTimeoutMS)
+	revid, err := h.db.WaitForDocChange(docid, sinceRev, time.Duration(ms)*time.Millisecond)
+	if err != nil {
+		return err
+	}
+	if revid != "" {
+		h.setHeader("Etag", revid)
+	}
+	h.writeJSON(db.Body{"id": docid, "rev": revid, "changed": revid != sinceRev})
+	return nil
+}
+
+// HTTP handler for a GET of a doc's lock; the response has a null "lock" if it isn't locked.
+func (h *handler) handleGetDocLock() error {
+	docid := h.PathVar("docid")
+	lock, err := h.db.GetDocLock(docid)
+	if err != nil {
+		return err
+	}
+	h.writeJSON(db.Body{"id": docid, "lock": lock})
+	return nil
+}
+
+// HTTP handler for a POST to a doc's _lock, which locks it for the user (or renews the user's
+// lock) for ?ttl= seconds.
+func (h *handler) handleLockDoc() error {
+	docid := h.PathVar("docid")
+	ttl := h.getRestrictedIntQuery("ttl", uint64(db.DefaultDocLockTTL/time.Second), 1,
+		uint64(db.MaxDocLockTTL/time.Second))
+	lock, err := h.db.LockDoc(docid, time.Duration(ttl)*time.Second)
+	if err != nil {
+		return err
+	}
+	h.writeJSON(db.Body{"ok": true, "id": docid, "lock": lock})
+	return nil
+}
+
+// HTTP handler for a DELETE of a doc's _lock
+func (h *handler) handleUnlockDoc() error {
+	docid := h.PathVar("docid")
+	if err := h.db.UnlockDoc(docid); err != nil {
+		return err
+	}
+	h.writeJSON(db.Body{"ok": true, "id": docid})
+	return nil
+}
+
 // HTTP handler for a GET of a specific doc attachment
 func (h *handler) handleGetAttachment() error {
 	docid := h.PathVar("docid")
@@ -133,7 +228,7 @@ func (h *handler) handlePutAttachment() error {
 	}
 	revid := h.getQuery("rev")
 	if revid == "" {
-		revid = h.rq.Header.Get("If-Match")
+		revid = h.getETagHeader("If-Match")
 	}
 	attachmentData, err := h.readBody()
 	if err != nil {
@@ -190,7 +285,7 @@ func (h *handler) handlePutDoc() error {
 		// Regular PUT:
 		if oldRev := h.getQuery("rev"); oldRev != "" {
 			body["_rev"] = oldRev
-		} else if ifMatch := h.rq.Header.Get("If-Match"); ifMatch != "" {
+		} else if ifMatch := h.getETagHeader("If-Match"); ifMatch != "" {
 			body["_rev"] = ifMatch
 		}
 		newRev, err = h.db.Put(docid, body)
@@ -235,10 +330,11 @@ func (h *handler) handleDeleteDoc() error {
 	docid := h.PathVar("docid")
 	revid := h.getQuery("rev")
 	if revid == "" {
-		revid = h.rq.Header.Get("If-Match")
+		revid = h.getETagHeader("If-Match")
 	}
 	newRev, err := h.db.DeleteDoc(docid, revid)
 	if err == nil {
+		h.setHeader("Etag", newRev)
 		h.writeJSON(db.Body{"ok": true, "id": docid, "rev": newRev})
 	}
 	return err
@@ -249,7 +345,7 @@ func (h *handler) handleDeleteDoc() error {
 // HTTP handler for a GET of a _local document
 func (h *handler) handleGetLocalDoc() error {
 	docid := h.PathVar("docid")
-	value, err := h.db.GetSpecial("local", docid)
+	value, err := h.db.GetLocal(docid)
 	if err != nil {
 		return err
 	}
@@ -269,7 +365,7 @@ func (h *handler) handlePutLocalDoc() error {
 	if err == nil {
 		body.FixJSONNumbers()
 		var revid string
-		revid, err = h.db.PutSpecial("local", docid, body)
+		revid, err = h.db.PutLocal(docid, body)
 		if err == nil {
 			h.writeJSONStatus(http.StatusCreated, db.Body{"ok": true, "id": "_local/" + docid, "rev": revid})
 		}
@@ -280,5 +376,13 @@ func (h *handler) handlePutLocalDoc() error {
 // HTTP handler for a DELETE of a _local document
 func (h *handler) handleDelLocalDoc() error {
 	docid := h.PathVar("docid")
-	return h.db.DeleteSpecial("local", docid, h.getQuery("rev"))
+	revid := h.getQuery("rev")
+	if revid == "" {
+		revid = h.getETagHeader("If-Match")
+	}
+	err := h.db.DeleteLocal(docid, revid)
+	if err == nil {
+		h.writeJSON(db.Body{"ok": true, "id": "_local/" + docid})
+	}
+	return err
 }
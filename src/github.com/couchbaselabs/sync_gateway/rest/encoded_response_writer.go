@@ -20,9 +20,10 @@ func init() {
 // GZip compression when appropriate.
 type EncodedResponseWriter struct {
 	http.ResponseWriter
-	gz        *gzip.Writer
-	status    int
-	sniffDone bool
+	gz            *gzip.Writer
+	status        int
+	sniffDone     bool
+	forceCompress bool
 }
 
 // Creates a new EncodedResponseWriter, or returns nil if the request doesn't allow encoded responses.
@@ -56,6 +57,17 @@ func (w *EncodedResponseWriter) disableCompression() {
 	w.sniffDone = true
 }
 
+// Allows the response to be compressed even if its Content-Type isn't JSON or text, and
+// returns true if it will be compressed. Must be called before any output is written.
+func (w *EncodedResponseWriter) enableCompression() bool {
+	if w.sniffDone {
+		base.Warn("EncodedResponseWriter: Too late to enableCompression!")
+	}
+	w.forceCompress = true
+	w.sniff(nil)
+	return w.gz != nil
+}
+
 func (w *EncodedResponseWriter) sniff(bytes []byte) {
 	if w.sniffDone {
 		return
@@ -70,7 +82,7 @@ func (w *EncodedResponseWriter) sniff(bytes []byte) {
 
 	// Can/should we compress the response?
 	if w.status >= 300 || w.Header().Get("Content-Encoding") != "" ||
-		(!strings.HasPrefix(respType, "application/json") && !strings.HasPrefix(respType, "text/")) {
+		(!w.forceCompress && !strings.HasPrefix(respType, "application/json") && !strings.HasPrefix(respType, "text/")) {
 		return
 	}
 
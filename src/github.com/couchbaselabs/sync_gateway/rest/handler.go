@@ -93,7 +93,7 @@ func newHandler(server *ServerContext, privs handlerPrivs, r http.ResponseWriter
 		response:     r,
 		serialNumber: atomic.AddUint64(&lastSerialNum, 1),
 	}
-	if base.LogKeys["HTTP+"] {
+	if base.LogEnabled("HTTP+") {
 		h.startTime = time.Now()
 	}
 	return h
@@ -105,20 +105,31 @@ func (h *handler) invoke(method handlerMethod) error {
 	restExpvars.Add("requests_active", 1)
 	defer restExpvars.Add("requests_active", -1)
 
+	if err := h.startRequest(); err != nil {
+		return err
+	}
+	defer h.finishRequest()
+
 	var err error
+	counted := &countingResponseWriter{ResponseWriter: h.response}
+	h.response = counted
 	if h.server.config.CompressResponses == nil || *h.server.config.CompressResponses {
 		if encoded := NewEncodedResponseWriter(h.response, h.rq); encoded != nil {
 			h.response = encoded
 			defer encoded.Close()
 		}
 	}
+	if h.scrubber() != nil {
+		h.response = &scrubbingResponseWriter{ResponseWriter: h.response, h: h}
+	}
 
+	body := &countingReader{ReadCloser: h.rq.Body}
 	switch h.rq.Header.Get("Content-Encoding") {
 	case "":
-		h.requestBody = h.rq.Body
+		h.requestBody = body
 	case "gzip":
-		if h.requestBody, err = gzip.NewReader(h.rq.Body); err != nil {
-			return err
+		if h.requestBody, err = gzip.NewReader(body); err != nil {
+			return base.HTTPErrorf(http.StatusBadRequest, "Invalid gzip-encoded request body")
 		}
 		h.rq.Header.Del("Content-Encoding") // to prevent double decoding later on
 	default:
@@ -126,6 +137,9 @@ func (h *handler) invoke(method handlerMethod) error {
 	}
 
 	h.setHeader("Server", VersionString)
+	if h.privs != adminPrivs {
+		h.server.corsConfigForPath(h.rq.URL.Path).addHeaders(h.response.Header(), h.rq)
+	}
 
 	// If there is a "db" path variable, look up the database context:
 	var dbContext *db.DatabaseContext
@@ -136,8 +150,22 @@ func (h *handler) invoke(method handlerMethod) error {
 		}
 	}
 
+	// While a database is offline, only admins can read from it:
+	if dbContext != nil && !dbContext.IsOnline() {
+		if h.privs != adminPrivs || (h.rq.Method != "GET" && h.rq.Method != "HEAD") {
+			h.logRequestLine()
+			return base.HTTPErrorf(http.StatusServiceUnavailable, "Database is offline for resync")
+		}
+	}
+
 	// Authenticate, if not on admin port:
+	var finished func()
 	if h.privs != adminPrivs {
+		if finished, err = h.checkRateLimit(h.rateLimitIP()); err != nil {
+			h.logRequestLine()
+			return err
+		}
+		defer finished()
 		if err = h.checkAuth(dbContext); err != nil {
 			h.logRequestLine()
 			return err
@@ -146,19 +174,25 @@ func (h *handler) invoke(method handlerMethod) error {
 
 	h.logRequestLine()
 
+	if finished, err = h.checkRateLimit(h.rateLimitUser()); err != nil {
+		return err
+	}
+	defer finished()
+
 	// Now set the request's Database (i.e. context + user)
 	if dbContext != nil {
 		h.db, err = db.GetDatabase(dbContext, h.user)
 		if err != nil {
 			return err
 		}
+		defer h.recordUsage(body, counted)
 	}
 
 	return method(h) // Call the actual handler code
 }
 
 func (h *handler) logRequestLine() {
-	if !base.LogKeys["HTTP"] {
+	if !base.LogEnabled("HTTP") {
 		return
 	}
 	as := ""
@@ -234,6 +268,24 @@ func (h *handler) getQuery(query string) string {
 	return h.rq.URL.Query().Get(query)
 }
 
+// Returns the ETag in an If-Match or If-None-Match header, minus any surrounding quotes.
+func (h *handler) getETagHeader(name string) string {
+	return strings.Trim(h.rq.Header.Get(name), `"`)
+}
+
+// Returns the value of a URL query that's a JSON-encoded string, like CouchDB's "startkey".
+// For convenience an unquoted string is accepted too.
+func (h *handler) getJSONStringQuery(query string) string {
+	value := h.getQuery(query)
+	if strings.HasPrefix(value, `"`) {
+		var str string
+		if json.Unmarshal([]byte(value), &str) == nil {
+			return str
+		}
+	}
+	return value
+}
+
 func (h *handler) getBoolQuery(query string) bool {
 	return h.getQuery(query) == "true"
 }
@@ -353,20 +405,38 @@ func (h *handler) setHeader(name string, value string) {
 }
 
 func (h *handler) logStatus(status int, message string) {
-	if base.LogKeys["HTTP+"] {
+	if base.LogEnabled("HTTP+") {
 		duration := float64(time.Since(h.startTime)) / float64(time.Millisecond)
 		base.LogTo("HTTP+", "#%03d:     --> %d %s  (%.1f ms)",
 			h.serialNumber, status, message, duration)
 	}
 }
 
+// Returns the response's underlying writer, without any scrubbingResponseWriter.
+func (h *handler) unscrubbedResponse() http.ResponseWriter {
+	if scrubbing, ok := h.response.(*scrubbingResponseWriter); ok {
+		return scrubbing.ResponseWriter
+	}
+	return h.response
+}
+
 func (h *handler) disableResponseCompression() {
-	switch r := h.response.(type) {
+	switch r := h.unscrubbedResponse().(type) {
 	case *EncodedResponseWriter:
 		r.disableCompression()
 	}
 }
 
+// Allows compression of a streamed response whose Content-Type wouldn't normally be compressed.
+// Returns true if the response will be compressed.
+func (h *handler) enableResponseCompression() bool {
+	switch r := h.unscrubbedResponse().(type) {
+	case *EncodedResponseWriter:
+		return r.enableCompression()
+	}
+	return false
+}
+
 // Writes an object to the response in JSON format.
 // If status is nonzero, the header will be written with that status.
 func (h *handler) writeJSONStatus(status int, value interface{}) {
@@ -382,6 +452,10 @@ func (h *handler) writeJSONStatus(status int, value interface{}) {
 		h.writeStatus(http.StatusInternalServerError, "JSON serialization failed")
 		return
 	}
+	if jsonOut = h.scrubJSON(jsonOut); jsonOut == nil {
+		h.writeStatus(http.StatusNotFound, "missing")
+		return
+	}
 	if PrettyPrint {
 		var buffer bytes.Buffer
 		json.Indent(&buffer, jsonOut, "", "  ")
@@ -458,12 +532,21 @@ func (h *handler) flush() {
 func (h *handler) writeError(err error) {
 	if err != nil {
 		status, message := base.ErrorAsHTTPStatus(err)
-		h.writeStatus(status, message)
+		var details db.Body
+		if detailed, ok := err.(base.DetailedError); ok {
+			details = detailed.Details()
+		}
+		h.writeStatusWithDetails(status, message, details)
 	}
 }
 
 // Writes the response status code, and if it's an error writes a JSON description to the body.
 func (h *handler) writeStatus(status int, message string) {
+	h.writeStatusWithDetails(status, message, nil)
+}
+
+// Like writeStatus, but adds the given extra properties to the JSON error description.
+func (h *handler) writeStatusWithDetails(status int, message string, details db.Body) {
 	if status < 300 {
 		h.response.WriteHeader(status)
 		h.logStatus(status, message)
@@ -487,6 +570,10 @@ func (h *handler) writeStatus(status int, message string) {
 	h.setHeader("Content-Type", "application/json")
 	h.response.WriteHeader(status)
 	base.LogTo("HTTP", " #%03d:     --> %d %s", h.serialNumber, status, message)
-	jsonOut, _ := json.Marshal(db.Body{"error": errorStr, "reason": message})
+	response := db.Body{"error": errorStr, "reason": message}
+	for key, value := range details {
+		response[key] = value
+	}
+	jsonOut, _ := json.Marshal(response)
 	h.response.Write(jsonOut)
 }
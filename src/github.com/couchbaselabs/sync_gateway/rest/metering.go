@@ -0,0 +1,88 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package rest
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/couchbaselabs/sync_gateway/base"
+)
+
+// An http.ResponseWriter that counts the bytes written to the client, for usage metering.
+// It sits below any compression, so it counts what actually goes over the wire.
+type countingResponseWriter struct {
+	http.ResponseWriter
+	count int64
+}
+
+func (w *countingResponseWriter) Write(data []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(data)
+	atomic.AddInt64(&w.count, int64(n))
+	return n, err
+}
+
+func (w *countingResponseWriter) Flush() {
+	switch r := w.ResponseWriter.(type) {
+	case http.Flusher:
+		r.Flush()
+	}
+}
+
+func (w *countingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if hijacker, ok := w.ResponseWriter.(http.Hijacker); ok {
+		return hijacker.Hijack()
+	}
+	return nil, nil, base.HTTPErrorf(http.StatusInternalServerError, "Response can't be hijacked")
+}
+
+// Counts the bytes read from a request body.
+type countingReader struct {
+	io.ReadCloser
+	count int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.count += int64(n)
+	return n, err
+}
+
+// Adds the request to its database's usage in the current metering period.
+func (h *handler) recordUsage(body *countingReader, response *countingResponseWriter) {
+	if h.db != nil {
+		h.db.RecordRequest(h.user, body.count, atomic.LoadInt64(&response.count))
+	}
+}
+
+// Returns a database's metering records, optionally limited to periods starting at or after
+// ?since and before ?until (RFC 3339 timestamps.)
+func (h *handler) handleGetMetering() error {
+	var since, until time.Time
+	for param, value := range map[string]*time.Time{"since": &since, "until": &until} {
+		if str := h.getQuery(param); str != "" {
+			t, err := time.Parse(time.RFC3339, str)
+			if err != nil {
+				return base.HTTPErrorf(http.StatusBadRequest, "Invalid %s timestamp", param)
+			}
+			*value = t
+		}
+	}
+	records, err := h.db.MeteringRecords(since, until)
+	if err != nil {
+		return err
+	}
+	h.writeJSON(records)
+	return nil
+}
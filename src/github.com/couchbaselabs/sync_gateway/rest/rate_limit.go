@@ -0,0 +1,152 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package rest
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/couchbaselabs/sync_gateway/base"
+)
+
+// Limits on how hard any one client can use the public API. Each request counts against the IP
+// address it came from (before it's authenticated, so password guessing is throttled too), and
+// then against its authenticated user of a database, if any.
+//
+// Behind a reverse proxy every request comes from the proxy's address, so all of them would share
+// one IP quota; set TrustProxy to take the client's address from X-Forwarded-For instead. Only do
+// that if the proxy is the sole way to reach the public port, since clients can forge the header.
+type RateLimitConfig struct {
+	RequestsPerSec float64 // Sustained requests/sec allowed per client (0 = no limit)
+	Burst          int     // Requests a client can make at once beyond that rate (default 1 sec's worth)
+	MaxConcurrent  int     // Max requests per client being handled at once (0 = no limit)
+	TrustProxy     bool    // Use the last address in X-Forwarded-For as the client's IP
+}
+
+// Once this many clients are tracked, idle ones are forgotten
+const kMaxRateLimitClients = 10000
+
+// What's known about one client's recent requests
+type clientQuota struct {
+	tokens   float64   // Requests the client can make right now (token bucket)
+	lastTime time.Time // When tokens was last updated
+	active   int       // Number of requests being handled
+}
+
+type rateLimiter struct {
+	config  RateLimitConfig
+	burst   float64
+	lock    sync.Mutex
+	clients map[string]*clientQuota
+}
+
+func newRateLimiter(config RateLimitConfig) *rateLimiter {
+	burst := float64(config.Burst)
+	if burst <= 0 {
+		burst = math.Max(config.RequestsPerSec, 1)
+	}
+	return &rateLimiter{config: config, burst: burst, clients: map[string]*clientQuota{}}
+}
+
+// Starts a request by a client. If that's allowed, returns true; the caller must then call
+// finish when the request's done. Otherwise returns false and how long to wait.
+func (rl *rateLimiter) start(client string) (bool, time.Duration) {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	now := time.Now()
+	quota := rl.clients[client]
+	if quota == nil {
+		if len(rl.clients) >= kMaxRateLimitClients {
+			rl.forgetIdleClients(now)
+		}
+		quota = &clientQuota{tokens: rl.burst, lastTime: now}
+		rl.clients[client] = quota
+	}
+
+	if rl.config.MaxConcurrent > 0 && quota.active >= rl.config.MaxConcurrent {
+		return false, time.Second
+	}
+	if rl.config.RequestsPerSec > 0 {
+		quota.tokens = math.Min(rl.burst,
+			quota.tokens+now.Sub(quota.lastTime).Seconds()*rl.config.RequestsPerSec)
+		quota.lastTime = now
+		if quota.tokens < 1 {
+			wait := (1 - quota.tokens) / rl.config.RequestsPerSec
+			return false, time.Duration(wait * float64(time.Second))
+		}
+		quota.tokens--
+	}
+	quota.active++
+	return true, 0
+}
+
+func (rl *rateLimiter) finish(client string) {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	if quota := rl.clients[client]; quota != nil {
+		quota.active--
+	}
+}
+
+// Removes clients with no active requests whose quota has refilled.
+func (rl *rateLimiter) forgetIdleClients(now time.Time) {
+	for client, quota := range rl.clients {
+		refilled := rl.config.RequestsPerSec <= 0 ||
+			quota.tokens+now.Sub(quota.lastTime).Seconds()*rl.config.RequestsPerSec >= rl.burst
+		if quota.active == 0 && refilled {
+			delete(rl.clients, client)
+		}
+	}
+}
+
+// Identifies the IP address the request came from, for rate limiting.
+func (h *handler) rateLimitIP() string {
+	if limiter := h.server.rateLimiter; limiter != nil && limiter.config.TrustProxy {
+		if forwarded := h.rq.Header.Get("X-Forwarded-For"); forwarded != "" {
+			// The proxy appends the address it got the request from, so the last one is it:
+			hops := strings.Split(forwarded, ",")
+			return "ip:" + strings.TrimSpace(hops[len(hops)-1])
+		}
+	}
+	host, _, err := net.SplitHostPort(h.rq.RemoteAddr)
+	if err != nil {
+		host = h.rq.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// Identifies the authenticated user making the request, for rate limiting, or "" if it's a guest.
+func (h *handler) rateLimitUser() string {
+	if h.user == nil || h.user.Name() == "" {
+		return ""
+	}
+	return fmt.Sprintf("user:%s/%s", h.PathVar("db"), h.user.Name())
+}
+
+// Applies the server's rate limits for a client to the request. If it can go ahead, returns a
+// function to call when it's done; otherwise returns a 429 error, with a Retry-After header.
+func (h *handler) checkRateLimit(client string) (func(), error) {
+	limiter := h.server.rateLimiter
+	if limiter == nil || h.privs == adminPrivs || client == "" {
+		return func() {}, nil
+	}
+	if ok, wait := limiter.start(client); !ok {
+		restExpvars.Add("requests_throttled", 1)
+		base.LogTo("HTTP", "#%03d: Throttling %s", h.serialNumber, client)
+		h.setHeader("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		return nil, base.HTTPErrorf(429, "Too many requests")
+	}
+	return func() { limiter.finish(client) }, nil
+}
@@ -0,0 +1,396 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package rest
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/couchbaselabs/sync_gateway/base"
+	"github.com/couchbaselabs/sync_gateway/db"
+)
+
+// Max number of changes the replicator requests from the source at once
+const kReplicatorBatchSize = 100
+
+// How long a continuous replication waits before retrying after an error
+var ReplicatorRetryInterval = 10 * time.Second
+
+// Timeout of the longpoll _changes requests made by a continuous replication
+const kReplicatorLongpollTimeoutMS = 30 * 1000
+
+// JSON object that defines a replication, in the ServerConfig or in a _replicate request.
+type ReplicationConfig struct {
+	Source        string   `json:"source"`                   // URL of the source database
+	Target        string   `json:"target"`                   // URL of the target database
+	Continuous    bool     `json:"continuous,omitempty"`     // Keep running, pushing new changes?
+	Channels      []string `json:"channels,omitempty"`       // Only replicate docs in these channels
+	ReplicationID string   `json:"replication_id,omitempty"` // Defaults to a digest of the source, target & channels
+	Cancel        bool     `json:"cancel,omitempty"`         // (_replicate only) Stops a running replication
+}
+
+// Validates the config and fills in a default ReplicationID.
+func (config *ReplicationConfig) setup() error {
+	for _, str := range []*string{&config.Source, &config.Target} {
+		*str = strings.TrimRight(*str, "/")
+		u, err := url.Parse(*str)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return base.HTTPErrorf(http.StatusBadRequest, "Invalid replication URL %q", redactURL(*str))
+		}
+	}
+	if config.Source == config.Target {
+		return base.HTTPErrorf(http.StatusBadRequest, "Replication source and target are the same")
+	}
+	if config.ReplicationID == "" {
+		digest := sha1.New()
+		fmt.Fprintf(digest, "%s\n%s\n%s", config.Source, config.Target, strings.Join(config.Channels, ","))
+		config.ReplicationID = fmt.Sprintf("%x", digest.Sum(nil))
+	}
+	return nil
+}
+
+// An active replication that pulls changes from one gateway's REST API and pushes them to
+// another's, checkpointing its progress in a _local document on the target.
+type Replicator struct {
+	config           ReplicationConfig
+	client           *http.Client
+	stop             chan bool // Closed when the replication's stopped
+	lock             sync.Mutex
+	stopped          bool
+	request          *http.Request // The request in progress, which Stop cancels
+	checkpointRev    string
+	lastSeq          string
+	docsRead         int
+	docsWritten      int
+	docWriteFailures int
+	lastError        error
+}
+
+// Creates a Replicator. The config must already have been set up.
+func NewReplicator(config ReplicationConfig, client *http.Client) *Replicator {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &Replicator{
+		config: config,
+		client: client,
+		stop:   make(chan bool),
+	}
+}
+
+func (r *Replicator) ID() string {
+	return r.config.ReplicationID
+}
+
+// Runs the replication. A one-shot replication returns once the target has caught up with the
+// source; a continuous one keeps going (retrying after errors) until Stop is called.
+func (r *Replicator) Run() error {
+	base.LogTo("Replicate", "Starting replication %s: %s -> %s", r.ID(),
+		redactURL(r.config.Source), redactURL(r.config.Target))
+	for {
+		if err := r.readCheckpoint(); err != nil && !r.isStopped() {
+			if !r.retryAfter(err) {
+				return err
+			}
+			continue
+		}
+		break
+	}
+	for !r.isStopped() {
+		count, err := r.replicateBatch()
+		if err != nil {
+			if r.isStopped() {
+				break // the error is just the request being aborted
+			} else if !r.retryAfter(err) {
+				return err
+			}
+		} else if count == 0 && !r.config.Continuous {
+			break
+		}
+	}
+	base.LogTo("Replicate", "Replication %s finished at %q", r.ID(), r.lastSeq)
+	return nil
+}
+
+// Stops a running replication, aborting any request it's waiting on.
+func (r *Replicator) Stop() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if !r.stopped {
+		r.stopped = true
+		close(r.stop)
+		if r.request != nil {
+			r.cancelRequest(r.request)
+		}
+	}
+}
+
+func (r *Replicator) isStopped() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.stopped
+}
+
+// Records an error; in continuous mode waits and returns true so the caller can try again.
+func (r *Replicator) retryAfter(err error) bool {
+	r.lock.Lock()
+	r.lastError = err
+	r.lock.Unlock()
+	if !r.config.Continuous || r.isStopped() {
+		base.Warn("Replication %s failed: %v", r.ID(), err)
+		return false
+	}
+	base.Warn("Replication %s got error (will retry): %v", r.ID(), err)
+	select {
+	case <-r.stop:
+	case <-time.After(ReplicatorRetryInterval):
+	}
+	return true
+}
+
+// Returns a JSON-compatible description of the replication's state.
+func (r *Replicator) Status() db.Body {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	status := db.Body{
+		"type":               "replication",
+		"replication_id":     r.ID(),
+		"source":             redactURL(r.config.Source),
+		"target":             redactURL(r.config.Target),
+		"continuous":         r.config.Continuous,
+		"last_seq":           r.lastSeq,
+		"docs_read":          r.docsRead,
+		"docs_written":       r.docsWritten,
+		"doc_write_failures": r.docWriteFailures,
+	}
+	if r.config.Channels != nil {
+		status["channels"] = r.config.Channels
+	}
+	if r.lastError != nil {
+		status["error"] = r.lastError.Error()
+	}
+	return status
+}
+
+// Replicates one batch of changes. Returns the number of changes read from the source.
+func (r *Replicator) replicateBatch() (int, error) {
+	var changes struct {
+		Results []struct {
+			ID      string         `json:"id"`
+			Changes []db.ChangeRev `json:"changes"`
+		} `json:"results"`
+		LastSeq json.RawMessage `json:"last_seq"`
+	}
+	if err := r.sendJSON("GET", r.changesURL(), nil, &changes); err != nil {
+		return 0, err
+	}
+	// Sync Gateway sequence IDs are strings, but CouchDB's are numbers:
+	var lastSeq string
+	if json.Unmarshal(changes.LastSeq, &lastSeq) != nil {
+		lastSeq = string(changes.LastSeq)
+	}
+	if len(changes.Results) == 0 {
+		return 0, nil
+	}
+
+	// Ask the target which of the revisions it's missing:
+	revs := map[string][]string{}
+	for _, change := range changes.Results {
+		for _, rev := range change.Changes {
+			revs[change.ID] = append(revs[change.ID], rev["rev"])
+		}
+	}
+	var diffs map[string]struct {
+		Missing []string `json:"missing"`
+	}
+	if err := r.sendJSON("POST", r.config.Target+"/_revs_diff", revs, &diffs); err != nil {
+		return 0, err
+	}
+
+	// Get the missing revisions, with their histories and attachments, from the source:
+	var docs []db.Body
+	for docid, diff := range diffs {
+		for _, revid := range diff.Missing {
+			var doc db.Body
+			docURL := fmt.Sprintf("%s/%s?rev=%s&revs=true&attachments=true",
+				r.config.Source, escapePathComponent(docid), url.QueryEscape(revid))
+			if err := r.sendJSON("GET", docURL, nil, &doc); err != nil {
+				return 0, err
+			}
+			docs = append(docs, doc)
+		}
+	}
+
+	// And push them to the target:
+	written, failures := 0, 0
+	if len(docs) > 0 {
+		var results []db.Body
+		input := db.Body{"new_edits": false, "docs": docs}
+		if err := r.sendJSON("POST", r.config.Target+"/_bulk_docs", input, &results); err != nil {
+			return 0, err
+		}
+		for _, result := range results {
+			if result["error"] != nil {
+				base.Warn("Replication %s couldn't write %v: %v", r.ID(), result["id"], result["reason"])
+				failures++
+			} else {
+				written++
+			}
+		}
+	}
+
+	r.lock.Lock()
+	r.docsRead += len(docs)
+	r.docsWritten += written
+	r.docWriteFailures += failures
+	r.lock.Unlock()
+
+	base.LogTo("Replicate", "Replication %s: pushed %d revisions through seq %q", r.ID(), written, lastSeq)
+	return len(changes.Results), r.saveCheckpoint(lastSeq)
+}
+
+func (r *Replicator) changesURL() string {
+	query := url.Values{}
+	query.Set("limit", fmt.Sprintf("%d", kReplicatorBatchSize))
+	query.Set("style", "all_docs")
+	if r.lastSeq != "" {
+		query.Set("since", r.lastSeq)
+	}
+	if r.config.Continuous {
+		query.Set("feed", "longpoll")
+		query.Set("timeout", fmt.Sprintf("%d", kReplicatorLongpollTimeoutMS))
+	}
+	if len(r.config.Channels) > 0 {
+		query.Set("filter", "sync_gateway/bychannel")
+		query.Set("channels", strings.Join(r.config.Channels, ","))
+	}
+	return r.config.Source + "/_changes?" + query.Encode()
+}
+
+//////// CHECKPOINTS:
+
+func (r *Replicator) checkpointURL() string {
+	return r.config.Target + "/_local/" + escapePathComponent(r.ID())
+}
+
+func (r *Replicator) readCheckpoint() error {
+	var checkpoint struct {
+		Rev     string `json:"_rev"`
+		LastSeq string `json:"lastSequence"`
+	}
+	err := r.sendJSON("GET", r.checkpointURL(), nil, &checkpoint)
+	if status, _ := base.ErrorAsHTTPStatus(err); status == http.StatusNotFound {
+		err = nil
+	}
+	if err == nil {
+		r.checkpointRev = checkpoint.Rev
+		r.lock.Lock()
+		r.lastSeq = checkpoint.LastSeq
+		r.lock.Unlock()
+	}
+	return err
+}
+
+func (r *Replicator) saveCheckpoint(lastSeq string) error {
+	body := db.Body{"lastSequence": lastSeq}
+	if r.checkpointRev != "" {
+		body["_rev"] = r.checkpointRev
+	}
+	var response struct {
+		Rev string `json:"rev"`
+	}
+	if err := r.sendJSON("PUT", r.checkpointURL(), body, &response); err != nil {
+		return err
+	}
+	r.checkpointRev = response.Rev
+	r.lock.Lock()
+	r.lastSeq = lastSeq
+	r.lock.Unlock()
+	return nil
+}
+
+//////// HTTP:
+
+// Sends a request with an optional JSON body, and parses the JSON response into 'result'.
+func (r *Replicator) sendJSON(method string, urlStr string, body interface{}, result interface{}) error {
+	var input io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		input = bytes.NewReader(data)
+	}
+	rq, err := http.NewRequest(method, urlStr, input)
+	if err != nil {
+		return err
+	}
+	rq.Header.Set("Accept", "application/json")
+	if body != nil {
+		rq.Header.Set("Content-Type", "application/json")
+	}
+	r.lock.Lock()
+	if r.stopped {
+		r.lock.Unlock()
+		return base.HTTPErrorf(http.StatusServiceUnavailable, "Replication stopped")
+	}
+	r.request = rq
+	r.lock.Unlock()
+	defer func() {
+		r.lock.Lock()
+		r.request = nil
+		r.lock.Unlock()
+	}()
+	response, err := r.client.Do(rq)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode >= 300 {
+		return base.HTTPErrorf(response.StatusCode, "%s %s returned %s",
+			method, redactURL(urlStr), response.Status)
+	}
+	return json.NewDecoder(response.Body).Decode(result)
+}
+
+// Aborts a request the client is sending or waiting on, if its transport supports that.
+func (r *Replicator) cancelRequest(rq *http.Request) {
+	transport := r.client.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	if canceler, ok := transport.(interface {
+		CancelRequest(*http.Request)
+	}); ok {
+		canceler.CancelRequest(rq)
+	}
+}
+
+// Escapes a string, such as a doc ID, to be a single component of a URL path ("/" included.)
+func escapePathComponent(s string) string {
+	return strings.Replace(url.QueryEscape(s), "+", "%20", -1)
+}
+
+// Removes any password from a URL so it can be logged or displayed.
+func redactURL(urlStr string) string {
+	if u, err := url.Parse(urlStr); err == nil && u.User != nil {
+		u.User = url.User(u.User.Username())
+		return u.String()
+	}
+	return urlStr
+}
@@ -0,0 +1,113 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package rest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/go.assert"
+
+	"github.com/couchbaselabs/sync_gateway/db"
+)
+
+func TestReplicationConfigSetup(t *testing.T) {
+	config := ReplicationConfig{Source: "http://a:4985/db/", Target: "http://b:4985/db"}
+	assert.Equals(t, config.setup(), nil)
+	assert.Equals(t, config.Source, "http://a:4985/db")
+	assert.True(t, config.ReplicationID != "")
+
+	config = ReplicationConfig{Source: "db", Target: "http://b:4985/db"}
+	assert.True(t, config.setup() != nil)
+	config = ReplicationConfig{Source: "http://b:4985/db", Target: "http://b:4985/db/"}
+	assert.True(t, config.setup() != nil)
+
+	assert.Equals(t, redactURL("http://bob:secret@a:4985/db"), "http://bob@a:4985/db")
+	assert.Equals(t, escapePathComponent("AC/DC rocks?"), "AC%2FDC%20rocks%3F")
+}
+
+func TestOneShotReplication(t *testing.T) {
+	var source, target, filtered restTester
+	sourceServer := httptest.NewServer(CreateAdminHandler(source.ServerContext()))
+	defer sourceServer.Close()
+	targetServer := httptest.NewServer(CreateAdminHandler(target.ServerContext()))
+	defer targetServer.Close()
+	filteredServer := httptest.NewServer(CreateAdminHandler(filtered.ServerContext()))
+	defer filteredServer.Close()
+
+	assertStatus(t, source.sendRequest("PUT", "/db/doc1", `{"n": 1, "channels": ["a"]}`), 201)
+	assertStatus(t, source.sendRequest("PUT", "/db/doc2", `{"n": 2, "channels": ["b"]}`), 201)
+
+	config := ReplicationConfig{Source: sourceServer.URL + "/db", Target: targetServer.URL + "/db"}
+	status, err := source.ServerContext().StartReplication(config)
+	assert.Equals(t, err, nil)
+	assert.Equals(t, status["docs_written"], 2)
+	assertStatus(t, target.sendRequest("GET", "/db/doc1", ""), 200)
+	assertStatus(t, target.sendRequest("GET", "/db/doc2", ""), 200)
+	assert.DeepEquals(t, source.ServerContext().ActiveReplications(), []db.Body{})
+
+	// Running it again only pushes the new changes, thanks to the checkpoint:
+	assertStatus(t, source.sendRequest("PUT", "/db/doc3", `{"n": 3, "channels": ["b"]}`), 201)
+	status, err = source.ServerContext().StartReplication(config)
+	assert.Equals(t, err, nil)
+	assert.Equals(t, status["docs_written"], 1)
+	assertStatus(t, target.sendRequest("GET", "/db/doc3", ""), 200)
+
+	// A channel-filtered replication:
+	config = ReplicationConfig{Source: sourceServer.URL + "/db", Target: filteredServer.URL + "/db",
+		Channels: []string{"b"}}
+	status, err = source.ServerContext().StartReplication(config)
+	assert.Equals(t, err, nil)
+	assert.Equals(t, status["docs_written"], 2)
+	assertStatus(t, filtered.sendRequest("GET", "/db/doc1", ""), 404)
+	assertStatus(t, filtered.sendRequest("GET", "/db/doc2", ""), 200)
+	assertStatus(t, filtered.sendRequest("GET", "/db/doc3", ""), 200)
+
+	// Doc and replication IDs are escaped as path segments, not query values:
+	assertStatus(t, source.sendRequest("PUT", "/db/doc%204+x", `{"n": 4}`), 201)
+	config = ReplicationConfig{Source: sourceServer.URL + "/db", Target: targetServer.URL + "/db",
+		ReplicationID: "my replication"}
+	status, err = source.ServerContext().StartReplication(config)
+	assert.Equals(t, err, nil)
+	assert.Equals(t, status["docs_written"], 1)
+	assertStatus(t, target.sendRequest("GET", "/db/doc%204+x", ""), 200)
+	assertStatus(t, target.sendAdminRequest("GET", "/db/_local/my%20replication", ""), 200)
+}
+
+// Stopping a continuous replication aborts the longpoll _changes request it's waiting on.
+func TestStopContinuousReplication(t *testing.T) {
+	waiting := make(chan bool, 1)
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, rq *http.Request) {
+		if strings.HasSuffix(rq.URL.Path, "/_changes") {
+			waiting <- true
+			<-rq.Context().Done()
+			return
+		}
+		http.NotFound(w, rq)
+	}))
+	defer source.Close()
+
+	config := ReplicationConfig{Source: source.URL + "/db", Target: source.URL + "/db2", Continuous: true}
+	assert.Equals(t, config.setup(), nil)
+	repl := NewReplicator(config, nil)
+	done := make(chan error)
+	go func() { done <- repl.Run() }()
+	<-waiting
+	repl.Stop()
+	select {
+	case err := <-done:
+		assert.Equals(t, err, nil)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Replication didn't stop")
+	}
+}
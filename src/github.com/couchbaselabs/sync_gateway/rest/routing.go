@@ -42,10 +42,13 @@ func createHandler(sc *ServerContext, privs handlerPrivs) (*mux.Router, *mux.Rou
 	dbr.Handle("/_all_docs", makeHandler(sc, privs, (*handler).handleAllDocs)).Methods("GET", "HEAD", "POST")
 	dbr.Handle("/_bulk_docs", makeHandler(sc, privs, (*handler).handleBulkDocs)).Methods("POST")
 	dbr.Handle("/_bulk_get", makeHandler(sc, privs, (*handler).handleBulkGet)).Methods("POST")
+	dbr.Handle("/_capabilities", makeHandler(sc, privs, (*handler).handleGetCapabilities)).Methods("GET", "HEAD")
 	dbr.Handle("/_changes", makeHandler(sc, privs, (*handler).handleChanges)).Methods("GET", "HEAD", "POST")
 	dbr.Handle("/_design/{docid}", makeHandler(sc, privs, (*handler).handleDesign)).Methods("GET", "HEAD")
 	dbr.Handle("/_design/{docid}", makeHandler(sc, privs, (*handler).handlePutDesign)).Methods("PUT", "DELETE")
+	dbr.Handle("/_design/{ddoc}/_view/{view}", makeHandler(sc, privs, (*handler).handleViewQuery)).Methods("GET", "HEAD")
 	dbr.Handle("/_ensure_full_commit", makeHandler(sc, privs, (*handler).handleEFC)).Methods("POST")
+	dbr.Handle("/_exists", makeHandler(sc, privs, (*handler).handleExists)).Methods("POST")
 	dbr.Handle("/_revs_diff", makeHandler(sc, privs, (*handler).handleRevsDiff)).Methods("POST")
 
 	// Document URLs:
@@ -57,6 +60,10 @@ func createHandler(sc *ServerContext, privs handlerPrivs) (*mux.Router, *mux.Rou
 	dbr.Handle("/{docid:"+docRegex+"}", makeHandler(sc, privs, (*handler).handlePutDoc)).Methods("PUT")
 	dbr.Handle("/{docid:"+docRegex+"}", makeHandler(sc, privs, (*handler).handleDeleteDoc)).Methods("DELETE")
 
+	dbr.Handle("/{docid:"+docRegex+"}/_watch", makeHandler(sc, privs, (*handler).handleWatchDoc)).Methods("GET")
+	dbr.Handle("/{docid:"+docRegex+"}/_lock", makeHandler(sc, privs, (*handler).handleGetDocLock)).Methods("GET", "HEAD")
+	dbr.Handle("/{docid:"+docRegex+"}/_lock", makeHandler(sc, privs, (*handler).handleLockDoc)).Methods("POST")
+	dbr.Handle("/{docid:"+docRegex+"}/_lock", makeHandler(sc, privs, (*handler).handleUnlockDoc)).Methods("DELETE")
 	dbr.Handle("/{docid:"+docRegex+"}/{attach}", makeHandler(sc, privs, (*handler).handleGetAttachment)).Methods("GET", "HEAD")
 	dbr.Handle("/{docid:"+docRegex+"}/{attach}", makeHandler(sc, privs, (*handler).handlePutAttachment)).Methods("PUT")
 
@@ -104,6 +111,8 @@ func CreateAdminHandler(sc *ServerContext) http.Handler {
 
 	dbr.Handle("/_raw/{docid:"+docRegex+"}",
 		makeHandler(sc, adminPrivs, (*handler).handleGetRawDoc)).Methods("GET", "HEAD")
+	dbr.Handle("/_revtree/{docid:"+docRegex+"}",
+		makeHandler(sc, adminPrivs, (*handler).handleGetRevTree)).Methods("GET", "HEAD")
 
 	dbr.Handle("/_user/",
 		makeHandler(sc, adminPrivs, (*handler).getUsers)).Methods("GET", "HEAD")
@@ -137,6 +146,18 @@ func CreateAdminHandler(sc *ServerContext) http.Handler {
 		makeHandler(sc, adminPrivs, (*handler).handleStats)).Methods("GET")
 	r.Handle(kDebugURLPathPrefix,
 		makeHandler(sc, adminPrivs, (*handler).handleExpvar)).Methods("GET")
+	r.PathPrefix(kPprofURLPathPrefix).Handler(
+		makeHandler(sc, adminPrivs, (*handler).handlePprof)).Methods("GET", "POST")
+	r.Handle("/_debug/runtime",
+		makeHandler(sc, adminPrivs, (*handler).handleGetRuntime)).Methods("GET", "HEAD")
+	r.Handle("/_debug/runtime",
+		makeHandler(sc, adminPrivs, (*handler).handleSetRuntime)).Methods("PUT")
+	r.Handle("/_debug/heapdump",
+		makeHandler(sc, adminPrivs, (*handler).handleHeapDump)).Methods("POST")
+	r.Handle("/_chaos",
+		makeHandler(sc, adminPrivs, (*handler).handleGetChaos)).Methods("GET", "HEAD")
+	r.Handle("/_chaos",
+		makeHandler(sc, adminPrivs, (*handler).handleSetChaos)).Methods("PUT")
 
 	dbr.Handle("/_config",
 		makeHandler(sc, adminPrivs, (*handler).handleGetDbConfig)).Methods("GET")
@@ -158,8 +179,42 @@ func CreateAdminHandler(sc *ServerContext) http.Handler {
 
 	r.Handle("/_all_dbs",
 		makeHandler(sc, adminPrivs, (*handler).handleAllDbs)).Methods("GET", "HEAD")
+	r.Handle("/_replicate",
+		makeHandler(sc, adminPrivs, (*handler).handleReplicate)).Methods("POST")
+	r.Handle("/_active_tasks",
+		makeHandler(sc, adminPrivs, (*handler).handleActiveTasks)).Methods("GET", "HEAD")
+	r.Handle("/_shutdown",
+		makeHandler(sc, adminPrivs, (*handler).handleShutdown)).Methods("POST")
+	r.Handle("/_logging",
+		makeHandler(sc, adminPrivs, (*handler).handleGetLogging)).Methods("GET", "HEAD")
+	r.Handle("/_logging",
+		makeHandler(sc, adminPrivs, (*handler).handleSetLogging)).Methods("PUT")
 	dbr.Handle("/_compact",
 		makeHandler(sc, adminPrivs, (*handler).handleCompact)).Methods("POST")
+	dbr.Handle("/_bulk_update",
+		makeHandler(sc, adminPrivs, (*handler).handleBulkUpdate)).Methods("POST")
+	dbr.Handle("/_repair",
+		makeHandler(sc, adminPrivs, (*handler).handleRepair)).Methods("POST")
+	dbr.Handle("/_migrate_rev_bodies",
+		makeHandler(sc, adminPrivs, (*handler).handleMigrateRevBodies)).Methods("POST")
+	dbr.Handle("/_pause/{subsystem}",
+		makeHandler(sc, adminPrivs, (*handler).handlePauseSubsystem)).Methods("POST")
+	dbr.Handle("/_resume/{subsystem}",
+		makeHandler(sc, adminPrivs, (*handler).handleResumeSubsystem)).Methods("POST")
+	dbr.Handle("/_resync",
+		makeHandler(sc, adminPrivs, (*handler).handleResync)).Methods("POST")
+	dbr.Handle("/_resync",
+		makeHandler(sc, adminPrivs, (*handler).handleGetResync)).Methods("GET", "HEAD")
+	dbr.Handle("/_channels",
+		makeHandler(sc, adminPrivs, (*handler).handleGetAllChannelStats)).Methods("GET", "HEAD")
+	dbr.Handle("/_channels/{channel}",
+		makeHandler(sc, adminPrivs, (*handler).handleGetChannelStats)).Methods("GET", "HEAD")
+	dbr.Handle("/_metering",
+		makeHandler(sc, adminPrivs, (*handler).handleGetMetering)).Methods("GET", "HEAD")
+	dbr.Handle("/_changes_connections",
+		makeHandler(sc, adminPrivs, (*handler).handleGetChangesConnections)).Methods("GET", "HEAD")
+	dbr.Handle("/_changes_connections/{id}",
+		makeHandler(sc, adminPrivs, (*handler).handleTerminateChangesConnection)).Methods("DELETE")
 
 	return wrapRouter(sc, adminPrivs, r)
 }
@@ -191,6 +246,8 @@ func wrapRouter(sc *ServerContext, privs handlerPrivs, router *mux.Router) http.
 				response.Header().Add("Allow", strings.Join(options, ", "))
 				if rq.Method != "OPTIONS" {
 					h.writeStatus(http.StatusMethodNotAllowed, "")
+				} else if privs != adminPrivs {
+					sc.corsConfigForPath(rq.URL.Path).addPreflightHeaders(response.Header(), rq, options)
 				}
 			}
 		}
@@ -0,0 +1,301 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package rest
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/couchbaselabs/sync_gateway/base"
+	"github.com/couchbaselabs/sync_gateway/db"
+)
+
+// Properties of user docs that only the admin API may return. (These are the password
+// hashes.) They're only scrubbed from principal responses, i.e. session and login.
+var kAdminOnlyFields = []string{"passwordhash_bcrypt", "passwordhash"}
+
+// Prefix of internal docs' IDs, and of "_sync" itself
+const kSyncPrefix = "_sync"
+
+// Properties of a response object whose array values hold docs or rows.
+var kRowListFields = []string{"rows", "results", "docs"}
+
+// Properties of a row whose object values are doc bodies.
+var kRowDocFields = []string{"doc", "ok"}
+
+// Removes internal data from JSON that's about to be sent to a non-admin client: "_sync"
+// metadata properties, rows/entries describing internal "_sync:" docs, and configured fields.
+// Only the places where gateway metadata can appear are looked at -- the top level of a doc,
+// row or change entry -- so properties nested inside a doc's own body are never touched.
+// This is a safety net: handlers shouldn't be producing such data in the first place, so
+// everything removed is counted as a violation and logged.
+type responseScrubber struct {
+	fields          map[string]bool // Property names to remove
+	principalFields map[string]bool // Property names to remove from principal responses
+	markers         [][]byte        // JSON fragments whose presence means the data needs scrubbing
+}
+
+func newResponseScrubber(extraFields []string) *responseScrubber {
+	s := &responseScrubber{
+		fields:          map[string]bool{},
+		principalFields: map[string]bool{},
+		markers:         [][]byte{[]byte(`"` + kSyncPrefix)},
+	}
+	for _, field := range extraFields {
+		s.fields[field] = true
+		s.principalFields[field] = true
+		s.markers = append(s.markers, []byte(`"`+field+`"`))
+	}
+	for _, field := range kAdminOnlyFields {
+		s.principalFields[field] = true
+		s.markers = append(s.markers, []byte(`"`+field+`"`))
+	}
+	return s
+}
+
+func (s *responseScrubber) mightNeedScrubbing(data []byte) bool {
+	for _, marker := range s.markers {
+		if bytes.Contains(data, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// Scrubs a JSON value. Returns the (possibly changed) JSON and the number of things removed.
+// If the data needs scrubbing but isn't a complete JSON value, returns nil and -1.
+// If the value itself describes an internal doc, returns nil and the count.
+func (s *responseScrubber) scrubJSON(data []byte) ([]byte, int) {
+	return s.scrubJSONFields(data, s.fields)
+}
+
+// Scrubs a JSON value from a principal (session or login) response, which additionally
+// mustn't contain password hashes.
+func (s *responseScrubber) scrubPrincipalJSON(data []byte) ([]byte, int) {
+	return s.scrubJSONFields(data, s.principalFields)
+}
+
+func (s *responseScrubber) scrubJSONFields(data []byte, fields map[string]bool) ([]byte, int) {
+	if !s.mightNeedScrubbing(data) {
+		return data, 0
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber() // preserves numbers exactly
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, -1
+	}
+	if decoder.Decode(&struct{}{}) != io.EOF {
+		return nil, -1 // More than one value
+	}
+	value, removed := scrubResponse(value, fields)
+	if removed == 0 {
+		return data, 0
+	} else if value == nil {
+		return nil, removed
+	}
+	scrubbed, err := json.Marshal(value)
+	if err != nil {
+		return nil, -1
+	}
+	// Keep any trailing newline the original had:
+	scrubbed = append(scrubbed, data[len(bytes.TrimRight(data, " \t\r\n")):]...)
+	return scrubbed, removed
+}
+
+// Removes internal data from a decoded response: the value itself if it's an object, and the
+// items of a top-level array or of its "rows"/"results"/"docs" arrays. Returns nil for the
+// value itself if it's an object describing an internal doc.
+func scrubResponse(value interface{}, fields map[string]bool) (interface{}, int) {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		removed := scrubRow(value, fields)
+		if removed < 0 {
+			return nil, 1
+		}
+		for _, key := range kRowListFields {
+			if rows, ok := value[key].([]interface{}); ok {
+				var n int
+				value[key], n = scrubRows(rows, fields)
+				removed += n
+			}
+		}
+		return value, removed
+	case []interface{}:
+		return scrubRows(value, fields)
+	}
+	return value, 0
+}
+
+func scrubRows(rows []interface{}, fields map[string]bool) ([]interface{}, int) {
+	removed := 0
+	kept := rows[:0]
+	for _, row := range rows {
+		if object, ok := row.(map[string]interface{}); ok {
+			n := scrubRow(object, fields)
+			if n < 0 {
+				removed++
+				continue
+			}
+			removed += n
+		}
+		kept = append(kept, row)
+	}
+	return kept, removed
+}
+
+// Scrubs a doc, row or change entry, and the doc bodies it contains. Returns -1 if it
+// describes an internal doc and should be dropped entirely.
+func scrubRow(row map[string]interface{}, fields map[string]bool) int {
+	if isInternalDocObject(row) {
+		return -1
+	}
+	removed := scrubMetadata(row, fields)
+	for _, key := range kRowDocFields {
+		if doc, ok := row[key].(map[string]interface{}); ok {
+			if isInternalDocObject(doc) {
+				return -1
+			}
+			removed += scrubMetadata(doc, fields)
+		}
+	}
+	return removed
+}
+
+// Removes "_sync" properties and the given fields from the top level of an object.
+func scrubMetadata(object map[string]interface{}, fields map[string]bool) int {
+	removed := 0
+	for key := range object {
+		if key == kSyncPrefix || strings.HasPrefix(key, kSyncPrefix+":") || fields[key] {
+			delete(object, key)
+			removed++
+		}
+	}
+	return removed
+}
+
+// Is this object a doc, _all_docs row or _changes entry for an internal "_sync:" doc?
+func isInternalDocObject(object map[string]interface{}) bool {
+	for _, key := range []string{"_id", "id"} {
+		if id, ok := object[key].(string); ok && strings.HasPrefix(id, kSyncPrefix+":") {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *responseScrubber) reportViolation(h *handler, removed int) {
+	restExpvars.Add("scrubViolations_total", 1)
+	base.Warn("#%03d: Response to %s %s contained internal data; scrubbed %d item(s)",
+		h.serialNumber, h.rq.Method, h.rq.URL, removed)
+}
+
+// Scrubs JSON that's about to be sent to the client, if it's not an admin.
+func (h *handler) scrubJSON(data []byte) []byte {
+	scrubber := h.scrubber()
+	if scrubber == nil {
+		return data
+	}
+	scrubbed, removed := h.scrubJSONWith(scrubber, data)
+	if removed != 0 {
+		scrubber.reportViolation(h, removed)
+	}
+	return scrubbed
+}
+
+func (h *handler) scrubJSONWith(scrubber *responseScrubber, data []byte) ([]byte, int) {
+	if h.isPrincipalRequest() {
+		return scrubber.scrubPrincipalJSON(data)
+	}
+	return scrubber.scrubJSON(data)
+}
+
+// Scrubs a revision body that's about to be written as a MIME part. (The scrubbing writer
+// can't parse parts that are compressed or nested multipart bodies, so they're scrubbed
+// beforehand.) Returns a 404 error if the body is an internal doc.
+func (h *handler) scrubBody(body db.Body) (db.Body, error) {
+	scrubber := h.scrubber()
+	if scrubber == nil {
+		return body, nil
+	}
+	removed := scrubRow(body, scrubber.fields)
+	if removed < 0 {
+		scrubber.reportViolation(h, 1)
+		return nil, base.HTTPErrorf(http.StatusNotFound, "missing")
+	} else if removed > 0 {
+		scrubber.reportViolation(h, removed)
+	}
+	return body, nil
+}
+
+func (h *handler) scrubber() *responseScrubber {
+	if h.privs == adminPrivs {
+		return nil
+	}
+	return h.server.scrubber
+}
+
+// Is this a session or login request, whose response describes a user?
+func (h *handler) isPrincipalRequest() bool {
+	path := strings.TrimRight(h.rq.URL.Path, "/")
+	switch path[strings.LastIndex(path, "/")+1:] {
+	case "_session", "_persona", "_facebook":
+		return true
+	}
+	return false
+}
+
+// An http.ResponseWriter that scrubs data written through it. This catches responses that
+// don't go through writeJSON, as long as each JSON value is written in a single call (as
+// addJSON and json.Encoder do.) Data that needs scrubbing but can't be parsed is dropped if
+// the response is JSON; otherwise (as in multipart responses, whose JSON parts are scrubbed
+// by scrubBody before being written) it's passed through.
+type scrubbingResponseWriter struct {
+	http.ResponseWriter
+	h *handler
+}
+
+func (w *scrubbingResponseWriter) Write(data []byte) (int, error) {
+	scrubber := w.h.scrubber()
+	scrubbed, removed := w.h.scrubJSONWith(scrubber, data)
+	if removed < 0 {
+		if !strings.HasPrefix(w.Header().Get("Content-Type"), "application/json") {
+			return w.ResponseWriter.Write(data)
+		}
+		scrubber.reportViolation(w.h, 1)
+		return len(data), nil
+	} else if removed > 0 {
+		scrubber.reportViolation(w.h, removed)
+	}
+	if _, err := w.ResponseWriter.Write(scrubbed); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+func (w *scrubbingResponseWriter) Flush() {
+	switch r := w.ResponseWriter.(type) {
+	case http.Flusher:
+		r.Flush()
+	}
+}
+
+// Passes through hijacking, which WebSocket connections need.
+func (w *scrubbingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if hijacker, ok := w.ResponseWriter.(http.Hijacker); ok {
+		return hijacker.Hijack()
+	}
+	return nil, nil, base.HTTPErrorf(http.StatusInternalServerError, "Response can't be hijacked")
+}
@@ -22,7 +22,9 @@ import (
 
 	"github.com/couchbaselabs/go-couchbase"
 
+	"github.com/couchbaselabs/sync_gateway/auth"
 	"github.com/couchbaselabs/sync_gateway/base"
+	"github.com/couchbaselabs/sync_gateway/channels"
 	"github.com/couchbaselabs/sync_gateway/db"
 )
 
@@ -35,22 +37,34 @@ const kStatsReportInterval = time.Hour
 // This struct is accessed from HTTP handlers running on multiple goroutines, so it needs to
 // be thread-safe.
 type ServerContext struct {
-	config      *ServerConfig
-	databases_  map[string]*db.DatabaseContext
-	lock        sync.RWMutex
-	statsTicker *time.Ticker
-	HTTPClient  *http.Client
+	config       *ServerConfig
+	databases_   map[string]*db.DatabaseContext
+	replications map[string]*Replicator
+	lock         sync.RWMutex
+	statsTicker  *time.Ticker
+	HTTPClient   *http.Client
+	scrubber     *responseScrubber // Scrubs public responses; nil if disabled
+	rateLimiter  *rateLimiter      // Throttles public requests; nil if no limits
+	shutdown     shutdownState     // Listeners & active requests, for graceful shutdown
 }
 
 func NewServerContext(config *ServerConfig) *ServerContext {
 	sc := &ServerContext{
-		config:     config,
-		databases_: map[string]*db.DatabaseContext{},
-		HTTPClient: http.DefaultClient,
+		config:       config,
+		databases_:   map[string]*db.DatabaseContext{},
+		replications: map[string]*Replicator{},
+		HTTPClient:   http.DefaultClient,
 	}
+	sc.shutdown.init()
 	if config.Databases == nil {
 		config.Databases = DbConfigMap{}
 	}
+	if config.ScrubResponses == nil || *config.ScrubResponses {
+		sc.scrubber = newResponseScrubber(config.ScrubFields)
+	}
+	if config.RateLimit != nil {
+		sc.rateLimiter = newRateLimiter(*config.RateLimit)
+	}
 
 	// Initialize the go-couchbase library's global configuration variables:
 	couchbase.PoolSize = DefaultMaxCouchbaseConnections
@@ -73,6 +87,9 @@ func (sc *ServerContext) Close() {
 	defer sc.lock.Unlock()
 
 	sc.stopStatsReporter()
+	for _, repl := range sc.replications {
+		repl.Stop()
+	}
 	for _, ctx := range sc.databases_ {
 		ctx.Close()
 	}
@@ -188,36 +205,39 @@ func (sc *ServerContext) AddDatabaseFromConfig(config *DbConfig) (*db.DatabaseCo
 	if config.Username != "" {
 		spec.Auth = config
 	}
+	if config.FailoverGraceWindow != nil {
+		spec.FailoverGraceWindow = time.Duration(*config.FailoverGraceWindow) * time.Second
+	}
+	if config.FailoverMaxQueued != nil {
+		spec.FailoverMaxQueued = *config.FailoverMaxQueued
+	}
 	bucket, err := db.ConnectToBucket(spec)
 	if err != nil {
 		return nil, err
 	}
 	dbcontext, err := db.NewDatabaseContext(dbName, bucket, autoImport)
 	if err != nil {
+		bucket.Close()
 		return nil, err
 	}
-
-	syncFn := ""
-	if config.Sync != nil {
-		syncFn = *config.Sync
-	}
-	if err := dbcontext.ApplySyncFun(syncFn, importDocs); err != nil {
+	if err := sc.configureDatabase(dbcontext, config, importDocs); err != nil {
+		dbcontext.Close()
 		return nil, err
 	}
 
-	if config.RevsLimit != nil && *config.RevsLimit > 0 {
-		dbcontext.RevsLimit = *config.RevsLimit
+	// Only once the whole config has been applied, start making changes & background tasks:
+	dbcontext.RecoverAtomicWrites()
+	localDocRetention := db.DefaultLocalDocRetention
+	if config.LocalDocRetention != nil {
+		localDocRetention = time.Duration(*config.LocalDocRetention) * 24 * time.Hour
 	}
-
-	if dbcontext.ChannelMapper == nil {
-		base.Log("Using default sync function 'channel(doc.channels)' for database %q", dbName)
+	dbcontext.StartSweeper(localDocRetention)
+	meteringInterval := db.DefaultMeteringInterval
+	if config.MeteringInterval != nil {
+		meteringInterval = time.Duration(*config.MeteringInterval) * time.Minute
 	}
-
-	// Create default users & roles:
-	if err := sc.installPrincipals(dbcontext, config.Roles, "role"); err != nil {
-		return nil, err
-	} else if err := sc.installPrincipals(dbcontext, config.Users, "user"); err != nil {
-		return nil, err
+	if meteringInterval > 0 {
+		dbcontext.StartMetering(meteringInterval)
 	}
 
 	// Install bucket-shadower if any:
@@ -237,6 +257,91 @@ func (sc *ServerContext) AddDatabaseFromConfig(config *DbConfig) (*db.DatabaseCo
 	return dbcontext, nil
 }
 
+// Applies a DbConfig's settings to a new DatabaseContext, and creates its configured users
+// and roles. Returns an error if any of them are invalid.
+func (sc *ServerContext) configureDatabase(dbcontext *db.DatabaseContext, config *DbConfig, importDocs bool) error {
+	var err error
+	if config.ImportFilter != nil {
+		if err := dbcontext.ApplyImportFilter(*config.ImportFilter); err != nil {
+			return err
+		}
+	}
+
+	if config.Validation != nil {
+		fnSource := ""
+		if config.Validation.Function != nil {
+			fnSource = *config.Validation.Function
+		}
+		if err := dbcontext.ApplyValidation(config.Validation.Schema, fnSource); err != nil {
+			return err
+		}
+	}
+
+	if resolution := config.ConflictResolution; resolution != nil {
+		fnSource := ""
+		if resolution.Function != nil {
+			fnSource = *resolution.Function
+		}
+		if err := dbcontext.ApplyConflictResolution(resolution.Policy, resolution.TimestampProperty, fnSource); err != nil {
+			return err
+		}
+	}
+
+	syncFn := ""
+	if config.Sync != nil {
+		syncFn = *config.Sync
+	}
+	if err := dbcontext.ApplySyncFun(syncFn, importDocs); err != nil {
+		return err
+	}
+
+	if config.RevsLimit != nil && *config.RevsLimit > 0 {
+		dbcontext.RevsLimit = *config.RevsLimit
+	}
+
+	if config.DocIDTemplate != nil {
+		if dbcontext.DocIDTemplate, err = db.NewDocIDTemplate(*config.DocIDTemplate); err != nil {
+			return err
+		}
+	}
+	dbcontext.AtomicBulkDocs = config.AtomicBulkDocs
+	if err := dbcontext.SetFeatures(config.Features); err != nil {
+		return err
+	}
+	if err := dbcontext.SetChangesProfiles(config.ChangesProfiles); err != nil {
+		return err
+	}
+	dbcontext.MaxContinuousChanges = config.MaxContinuousChanges
+	dbcontext.ExternalRevBodies = config.ExternalRevBodies
+	if config.PriorityChannels != nil {
+		if dbcontext.PriorityChannels, err = channels.SetFromArray(config.PriorityChannels, channels.RemoveStar); err != nil {
+			return err
+		}
+	}
+
+	if dbcontext.ChannelMapper == nil {
+		base.Log("Using default sync function 'channel(doc.channels)' for database %q", dbcontext.Name)
+	}
+
+	if config.StaticGrants != nil {
+		grants := &auth.StaticGrants{Users: map[string]*auth.StaticGrant{},
+			Roles: config.StaticGrants.Roles}
+		for name, grant := range config.StaticGrants.Users {
+			grants.Users[internalUserName(name)] = grant
+		}
+		if err := grants.Validate(); err != nil {
+			return err
+		}
+		dbcontext.StaticGrants = grants
+	}
+
+	// Create default users & roles:
+	if err := sc.installPrincipals(dbcontext, config.Roles, "role"); err != nil {
+		return err
+	}
+	return sc.installPrincipals(dbcontext, config.Users, "user")
+}
+
 func (sc *ServerContext) startShadowing(dbcontext *db.DatabaseContext, shadow *ShadowConfig) error {
 	var pattern *regexp.Regexp
 	if shadow.Doc_id_regex != nil {
@@ -338,6 +443,62 @@ func (sc *ServerContext) getDbConfigFromServer(dbName string) (*DbConfig, error)
 	return &config, nil
 }
 
+//////// REPLICATIONS:
+
+// Registers and starts a replication. A one-shot replication runs synchronously and its final
+// status is returned; a continuous one runs in the background until stopped.
+func (sc *ServerContext) StartReplication(config ReplicationConfig) (db.Body, error) {
+	if err := config.setup(); err != nil {
+		return nil, err
+	}
+	repl := NewReplicator(config, sc.HTTPClient)
+	sc.lock.Lock()
+	if sc.replications[repl.ID()] != nil {
+		sc.lock.Unlock()
+		return nil, base.HTTPErrorf(http.StatusConflict, "Replication %s is already running", repl.ID())
+	}
+	sc.replications[repl.ID()] = repl
+	sc.lock.Unlock()
+
+	run := func() error {
+		defer func() {
+			sc.lock.Lock()
+			delete(sc.replications, repl.ID())
+			sc.lock.Unlock()
+		}()
+		return repl.Run()
+	}
+	if config.Continuous {
+		go run()
+		return repl.Status(), nil
+	}
+	err := run()
+	return repl.Status(), err
+}
+
+// Stops a running replication; returns false if there's no such replication.
+func (sc *ServerContext) StopReplication(id string) bool {
+	sc.lock.RLock()
+	repl := sc.replications[id]
+	sc.lock.RUnlock()
+	if repl == nil {
+		return false
+	}
+	repl.Stop()
+	return true
+}
+
+// Returns the status of every running replication.
+func (sc *ServerContext) ActiveReplications() []db.Body {
+	sc.lock.RLock()
+	defer sc.lock.RUnlock()
+	tasks := make([]db.Body, 0, len(sc.replications))
+	for _, repl := range sc.replications {
+		tasks = append(tasks, repl.Status())
+	}
+	return tasks
+}
+
 //////// STATISTICS REPORT:
 
 func (sc *ServerContext) startStatsReporter() {
@@ -47,6 +47,24 @@ func TestConfigServer(t *testing.T) {
 	assert.Equals(t, dbc.Bucket.GetName(), "fivez")
 }
 
+// An invalid database config is rejected before the database starts doing anything.
+func TestAddDatabaseBadConfig(t *testing.T) {
+	var rt restTester
+	sc := rt.ServerContext()
+	server, syncFn := "walrus:", "function(doc) {syntax error"
+	config := &DbConfig{Server: &server, Sync: &syncFn}
+	assert.Equals(t, config.setup("baddb"), nil)
+	_, err := sc.AddDatabaseFromConfig(config)
+	assert.True(t, err != nil)
+	_, err = sc.GetDatabase("baddb")
+	assert.True(t, err != nil)
+
+	config.Sync = nil
+	dbc, err := sc.AddDatabaseFromConfig(config)
+	assert.Equals(t, err, nil)
+	assert.Equals(t, dbc.Name, "baddb")
+}
+
 //////// MOCK HTTP CLIENT: (TODO: Move this into a separate package)
 
 // Creates a filled-in http.Response from minimal details
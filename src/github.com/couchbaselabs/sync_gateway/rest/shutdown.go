@@ -0,0 +1,164 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package rest
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/couchbaselabs/sync_gateway/base"
+)
+
+// Default value of ServerConfig.ShutdownTimeout, in seconds
+const DefaultShutdownTimeout = 30
+
+// Tracks the server's listeners and in-flight requests, so it can shut down gracefully.
+type shutdownState struct {
+	lock      sync.Mutex
+	idle      *sync.Cond     // Signaled when the last active request finishes
+	started   bool           // Has Shutdown been called?
+	active    int            // Number of requests being handled
+	listeners []net.Listener // Listeners to close on shutdown
+	done      chan struct{}  // Closed when Shutdown has finished
+}
+
+func (s *shutdownState) init() {
+	s.idle = sync.NewCond(&s.lock)
+	s.done = make(chan struct{})
+}
+
+// Registers a listener to be closed when the server shuts down. Returns false (closing the
+// listener) if it's already shutting down.
+func (sc *ServerContext) addListener(listener net.Listener) bool {
+	s := &sc.shutdown
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.started {
+		listener.Close()
+		return false
+	}
+	s.listeners = append(s.listeners, listener)
+	return true
+}
+
+func (sc *ServerContext) isShuttingDown() bool {
+	s := &sc.shutdown
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.started
+}
+
+// Called when a request starts being handled. After shutdown begins, new requests (which can
+// still arrive over keep-alive connections) are turned away with a 503.
+func (h *handler) startRequest() error {
+	s := &h.server.shutdown
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.started {
+		h.setHeader("Connection", "close")
+		return base.HTTPErrorf(http.StatusServiceUnavailable, "Server is shutting down")
+	}
+	s.active++
+	return nil
+}
+
+func (h *handler) finishRequest() {
+	s := &h.server.shutdown
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.active--; s.active == 0 {
+		s.idle.Broadcast()
+	}
+}
+
+// Shuts down the server gracefully: stops accepting connections and requests, ends open
+// _changes feeds (which send their clients a final heartbeat or last_seq), waits up to
+// ServerConfig.ShutdownTimeout for in-flight requests to finish, then closes the databases,
+// which saves pending channel-log writes and usage metering. Returns when that's done.
+// Sequences that were reserved but not used are simply skipped.
+func (sc *ServerContext) Shutdown() {
+	s := &sc.shutdown
+	s.lock.Lock()
+	if s.started {
+		s.lock.Unlock()
+		<-s.done
+		return
+	}
+	s.started = true
+	base.Log("Shutting down: no longer accepting connections")
+	for _, listener := range s.listeners {
+		listener.Close()
+	}
+	s.listeners = nil
+	s.lock.Unlock()
+
+	sc.lock.RLock()
+	for _, dbContext := range sc.databases_ {
+		if n := dbContext.TerminateAllChangesConnections(); n > 0 {
+			base.Log("Shutting down: ended %d _changes feeds of database %q", n, dbContext.Name)
+		}
+	}
+	sc.lock.RUnlock()
+
+	timeout := DefaultShutdownTimeout
+	if sc.config.ShutdownTimeout != nil {
+		timeout = *sc.config.ShutdownTimeout
+	}
+	if !sc.waitForRequests(time.Duration(timeout) * time.Second) {
+		base.Warn("Shutting down: gave up waiting for %d requests after %d sec",
+			sc.activeRequests(), timeout)
+	}
+
+	sc.Close()
+	base.Log("Shutdown complete")
+	close(s.done)
+}
+
+// Waits until no requests are active, or the timeout expires; returns false on timeout.
+func (sc *ServerContext) waitForRequests(timeout time.Duration) bool {
+	s := &sc.shutdown
+	idle := make(chan struct{})
+	go func() {
+		s.lock.Lock()
+		for s.active > 0 {
+			s.idle.Wait()
+		}
+		s.lock.Unlock()
+		close(idle)
+	}()
+	select {
+	case <-idle:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func (sc *ServerContext) activeRequests() int {
+	s := &sc.shutdown
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.active
+}
+
+// Returns a channel that's closed when the server has finished shutting down.
+func (sc *ServerContext) ShutdownComplete() <-chan struct{} {
+	return sc.shutdown.done
+}
+
+// Handles POST /_shutdown: starts a graceful shutdown, after which the process exits.
+func (h *handler) handleShutdown() error {
+	base.Log("Shutdown requested through the admin API")
+	go h.server.Shutdown()
+	h.writeJSONStatus(http.StatusAccepted, map[string]interface{}{"ok": true})
+	return nil
+}